@@ -0,0 +1,194 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"keydrive/internal/model"
+	"keydrive/internal/service"
+	"net/http"
+)
+
+// batchInlineLimit is the largest batch that is carried out before the response is sent. Larger batches run as a job.
+const batchInlineLimit = 50
+
+type BatchOperationDTO struct {
+	Op   service.BatchOperationType `json:"op" binding:"required,oneof=delete move copy mkdir" enums:"delete,move,copy,mkdir"`
+	Path string                     `json:"path" binding:"required"`
+	// Target is the path that entries are moved or copied to.
+	Target string `json:"target,omitempty" binding:"required_if=Op move,required_if=Op copy"`
+	// TargetLibraryID is the library that entries are moved or copied to. It defaults to the library of the batch.
+	TargetLibraryID int                    `json:"targetLibraryId,omitempty"`
+	Conflict        service.ConflictPolicy `json:"conflict,omitempty" binding:"omitempty,oneof=fail overwrite rename skip" enums:"fail,overwrite,rename,skip"`
+}
+
+type BatchDTO struct {
+	Operations  []BatchOperationDTO `json:"operations" binding:"required,min=1,max=10000,dive"`
+	StopOnError bool                `json:"stopOnError"`
+}
+
+type BatchResultDTO struct {
+	Index   int    `json:"index"`
+	Status  int    `json:"status"`
+	Path    string `json:"path,omitempty"`
+	Skipped bool   `json:"skipped,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+type BatchStatusDTO struct {
+	Total    int              `json:"total"`
+	Done     int              `json:"done"`
+	Finished bool             `json:"finished"`
+	Stopped  bool             `json:"stopped"`
+	Results  []BatchResultDTO `json:"results"`
+}
+
+func toBatchResultDTO(result service.BatchResult) BatchResultDTO {
+	item := BatchResultDTO{Index: result.Index, Status: http.StatusOK, Path: result.Path, Skipped: result.Skipped}
+	if result.Err != nil {
+		apiError := toApiError(result.Err)
+		item.Status = apiError.Status
+		item.Error = apiError.Description
+		if item.Error == "" {
+			item.Error = http.StatusText(apiError.Status)
+		}
+		if apiError.Status == http.StatusInternalServerError {
+			log.Error("Uncaught error in batch operation %d: %s", result.Index, result.Err.Error())
+		}
+	}
+	return item
+}
+
+// toBatch turns a request into a batch for a library. Target libraries are looked up with getTarget.
+func toBatch(request BatchDTO, library model.Library, getTarget func(id int) (model.Library, error)) (service.Batch, error) {
+	batch := service.Batch{
+		Library:     library,
+		Operations:  make([]service.BatchOperation, len(request.Operations)),
+		StopOnError: request.StopOnError,
+	}
+	targets := map[int]model.Library{library.ID: library}
+	for i, operation := range request.Operations {
+		targetId := operation.TargetLibraryID
+		if targetId == 0 {
+			targetId = library.ID
+		}
+		target, ok := targets[targetId]
+		if !ok {
+			var err error
+			if target, err = getTarget(targetId); err != nil {
+				return batch, err
+			}
+			targets[targetId] = target
+		}
+		conflict := operation.Conflict
+		if conflict == "" {
+			conflict = service.ConflictFail
+		}
+		batch.Operations[i] = service.BatchOperation{
+			Type:          operation.Op,
+			Path:          operation.Path,
+			Target:        operation.Target,
+			TargetLibrary: target,
+			Conflict:      conflict,
+		}
+	}
+	return batch, nil
+}
+
+// batchJob carries out batches that are too large to wait for. The results are saved as the job goes, so it continues
+// after the last saved operation if it is interrupted.
+func batchJob(db *gorm.DB, batches *service.Batches) service.JobFunc {
+	return func(ctx context.Context, job *service.RunningJob) (interface{}, error) {
+		var request BatchDTO
+		if err := job.DecodeParams(&request); err != nil {
+			return nil, err
+		}
+		if job.Library == nil || job.Owner == nil {
+			return nil, errors.New("the library or the owner of the batch no longer exists")
+		}
+		batch, err := toBatch(request, *job.Library, func(id int) (model.Library, error) {
+			var library model.Library
+			return library, db.Take(&library, id).Error
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		status := BatchStatusDTO{Total: len(batch.Operations), Results: []BatchResultDTO{}}
+		if _, err := job.DecodeResult(&status); err != nil {
+			return nil, err
+		}
+		completed, err := batches.Run(ctx, batch, *job.Owner, len(status.Results), func(result service.BatchResult) {
+			status.Results = append(status.Results, toBatchResultDTO(result))
+			status.Done = len(status.Results)
+			if err := job.SaveResult(int64(status.Done), int64(status.Total), status); err != nil {
+				log.Error("failed to save the results of job %d: %s", job.ID, err)
+			}
+		})
+		if err != nil {
+			return nil, err
+		}
+		status.Finished = true
+		status.Stopped = !completed
+		return status, nil
+	}
+}
+
+// RunBatch
+// @Tags Files
+// @Router /api/libraries/{libraryId}/entries/batch [post]
+// @Summary Delete, move, copy and create many entries at once
+// @Description Operations are carried out in order, and each one gets its own status code. Unless stopOnError is set, a failed operation does not stop the ones after it.
+// @Description Batches of more than 50 operations run as a job. They are answered with 202 and the job, whose result has the same form as the response for small batches.
+// @Security OAuth2
+// @Accept json
+// @Produce json
+// @Param libraryId path int true "The library id"
+// @Param body body BatchDTO true "The operations"
+// @Success 200 {object} BatchStatusDTO
+// @Success 202 {object} model.Job
+func RunBatch(db *gorm.DB, libs *service.Library, batches *service.Batches, jobs *service.Jobs) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var request BatchDTO
+		if err := c.ShouldBindJSON(&request); err != nil {
+			writeError(c, err)
+			return
+		}
+		library, err := getAccessToLib(c, libs, true, db)
+		if err != nil {
+			writeError(c, err)
+			return
+		}
+		batch, err := toBatch(request, library, func(id int) (model.Library, error) {
+			return getAccessToLibById(c, libs, id, true, db)
+		})
+		if err != nil {
+			writeError(c, err)
+			return
+		}
+
+		user, _ := GetAuthenticatedUser(c)
+		if len(batch.Operations) > batchInlineLimit {
+			job, err := jobs.Enqueue(JobBatch, &user, &library, request)
+			if err != nil {
+				writeError(c, err)
+				return
+			}
+			acceptJob(c, job)
+			return
+		}
+		status := BatchStatusDTO{Total: len(batch.Operations), Results: []BatchResultDTO{}}
+		completed, err := batches.Run(c.Request.Context(), batch, user, 0, func(result service.BatchResult) {
+			status.Results = append(status.Results, toBatchResultDTO(result))
+		})
+		if err != nil {
+			writeError(c, err)
+			return
+		}
+		status.Done = len(status.Results)
+		status.Finished = true
+		status.Stopped = !completed
+		c.JSON(http.StatusOK, status)
+	}
+}
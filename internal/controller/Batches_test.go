@@ -0,0 +1,82 @@
+package controller
+
+import (
+	"encoding/json"
+	"fmt"
+	"keydrive/internal/model"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestBatches(t *testing.T) {
+	tempDir := t.TempDir()
+	lib := model.Library{
+		Type:       model.TypeGeneric,
+		Name:       "Batch Library",
+		RootFolder: tempDir,
+	}
+	testApp.DB.Create(&lib)
+	for i := 0; i < batchInlineLimit+10; i++ {
+		_ = os.WriteFile(filepath.Join(tempDir, fmt.Sprintf("photo%d.jpg", i)), []byte("Photo\n"), 0777)
+	}
+
+	t.Run("it reports the status of every operation", func(t *testing.T) {
+		req := adminRequest("POST", fmt.Sprintf("/api/libraries/%d/entries/batch", lib.ID), strings.NewReader(`{"operations": [
+			{"op": "mkdir", "path": "/album"},
+			{"op": "move", "path": "/photo0.jpg", "target": "/album/photo0.jpg"},
+			{"op": "copy", "path": "/missing.jpg", "target": "/album/missing.jpg"},
+			{"op": "delete", "path": "/photo1.jpg"}
+		]}`))
+		recorder := httptest.NewRecorder()
+		testApp.Router.ServeHTTP(recorder, req)
+		assertStatus(t, recorder, 200)
+		var status BatchStatusDTO
+		assertJsonUnmarshal(t, recorder, &status)
+		if !status.Finished || len(status.Results) != 4 {
+			t.Fatalf("Unexpected status: %+v", status)
+		}
+		for i, expected := range []int{200, 200, 404, 200} {
+			if status.Results[i].Status != expected {
+				t.Errorf("Expected status %d for operation %d but got: %+v", expected, i, status.Results[i])
+			}
+		}
+		if _, err := os.Stat(filepath.Join(tempDir, "photo1.jpg")); !os.IsNotExist(err) {
+			t.Errorf("Expected the photo to be deleted: %v", err)
+		}
+	})
+
+	t.Run("it validates operations", func(t *testing.T) {
+		req := adminRequest("POST", fmt.Sprintf("/api/libraries/%d/entries/batch", lib.ID), strings.NewReader(`{"operations": [{"op": "copy", "path": "/photo2.jpg"}]}`))
+		recorder := httptest.NewRecorder()
+		testApp.Router.ServeHTTP(recorder, req)
+		assertStatus(t, recorder, 400)
+	})
+
+	t.Run("it runs large batches in the background", func(t *testing.T) {
+		operations := make([]string, 0)
+		for i := 2; i < batchInlineLimit+10; i++ {
+			operations = append(operations, fmt.Sprintf(`{"op": "delete", "path": "/photo%d.jpg"}`, i))
+		}
+		req := adminRequest("POST", fmt.Sprintf("/api/libraries/%d/entries/batch", lib.ID), strings.NewReader(`{"operations": [`+strings.Join(operations, ",")+`]}`))
+		recorder := httptest.NewRecorder()
+		testApp.Router.ServeHTTP(recorder, req)
+		assertStatus(t, recorder, 202)
+		location := recorder.Header().Get("Location")
+
+		job := waitForJob(t, location)
+		var status BatchStatusDTO
+		if err := json.Unmarshal(job.Result, &status); err != nil {
+			t.Fatal(err)
+		}
+		if job.Status != model.JobSucceeded || !status.Finished || status.Done != len(operations) {
+			t.Errorf("Unexpected job: %+v with status %+v", job, status)
+		}
+
+		recorder = httptest.NewRecorder()
+		testApp.Router.ServeHTTP(recorder, regularUserRequest("GET", location, nil))
+		assertStatus(t, recorder, 404)
+	})
+}
@@ -0,0 +1,91 @@
+package controller
+
+import (
+	"errors"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"keydrive/internal/model"
+	"keydrive/internal/service"
+	"net/http"
+	"strconv"
+)
+
+const maxChangesPerPage = 1000
+
+type ChangesPage struct {
+	// Cursor is passed to the next request to continue after the last change in this page.
+	Cursor int64 `json:"cursor"`
+	// HasMore is true if more changes can be fetched right away using the new cursor.
+	HasMore bool           `json:"hasMore"`
+	Changes []model.Change `json:"changes"`
+}
+
+type ResyncDetails struct {
+	// Cursor is the latest cursor of the library. Changes can be followed from here once the library was listed again.
+	Cursor int64 `json:"cursor"`
+}
+
+// ListChanges
+// @Tags Files
+// @Router /api/libraries/{libraryId}/changes [get]
+// @Summary List everything that changed in a library since a cursor
+// @Description Covers changes made through the API as well as changes made to the library folder directly.
+// @Description Without a cursor, only the latest cursor is returned. A client lists the library after fetching it, and then follows the changes from there.
+// @Description If changes after the cursor were already removed from the journal, the response is 410 Gone and the client has to list the library again.
+// @Security OAuth2
+// @Produce json
+// @Param libraryId path int true "The library id"
+// @Param cursor query int false "The cursor returned by the previous request"
+// @Param limit query int false "The maximum number of changes to return" default(500)
+// @Success 200 {object} ChangesPage
+// @Failure 410 {object} ApiError{details=ResyncDetails} "The cursor is too old, do a full resync"
+func ListChanges(db *gorm.DB, libs *service.Library, changes *service.Changes) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		library, err := getAccessToLib(c, libs, false, db)
+		if err != nil {
+			writeError(c, err)
+			return
+		}
+		latest, err := changes.LatestCursor(library, db)
+		if err != nil {
+			writeError(c, err)
+			return
+		}
+		cursorQuery, hasCursor := c.GetQuery("cursor")
+		if !hasCursor {
+			c.JSON(http.StatusOK, ChangesPage{Cursor: latest, Changes: []model.Change{}})
+			return
+		}
+		cursor, err := strconv.ParseInt(cursorQuery, 10, 64)
+		if err != nil {
+			writeJsonError(c, ApiError{Status: http.StatusBadRequest, Description: "invalid cursor"})
+			return
+		}
+		limit := 500
+		if limitValue, err := strconv.Atoi(c.Query("limit")); err == nil && limitValue > 0 {
+			limit = limitValue
+		}
+		if limit > maxChangesPerPage {
+			limit = maxChangesPerPage
+		}
+
+		page := ChangesPage{Cursor: cursor}
+		page.Changes, page.HasMore, err = changes.GetChangesSince(library, cursor, limit, db)
+		if errors.Is(err, service.ErrCursorExpired) {
+			writeJsonError(c, ApiError{
+				Status:      http.StatusGone,
+				Description: err.Error(),
+				Details:     ResyncDetails{Cursor: latest},
+			})
+			return
+		}
+		if err != nil {
+			writeError(c, err)
+			return
+		}
+		if len(page.Changes) > 0 {
+			page.Cursor = page.Changes[len(page.Changes)-1].Sequence
+		}
+		c.JSON(http.StatusOK, page)
+	}
+}
@@ -0,0 +1,83 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"keydrive/internal/model"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestListChanges(t *testing.T) {
+	tempDir := t.TempDir()
+	_ = os.WriteFile(filepath.Join(tempDir, "existing.txt"), []byte("Existing\n"), 0777)
+	lib := model.Library{
+		Type:       model.TypeGeneric,
+		Name:       "Synced Library",
+		RootFolder: tempDir,
+	}
+	testApp.DB.Create(&lib)
+	if _, err := testApp.Index.ScanLibrary(context.Background(), lib); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	listChanges := func(t *testing.T, query string, status int) ChangesPage {
+		req := adminRequest("GET", fmt.Sprintf("/api/libraries/%d/changes%s", lib.ID, query), nil)
+		recorder := httptest.NewRecorder()
+		testApp.Router.ServeHTTP(recorder, req)
+		assertStatus(t, recorder, status)
+		var page ChangesPage
+		assertJsonUnmarshal(t, recorder, &page)
+		return page
+	}
+
+	start := listChanges(t, "", 200)
+	_ = os.WriteFile(filepath.Join(tempDir, "first.txt"), []byte("First\n"), 0777)
+	_ = os.WriteFile(filepath.Join(tempDir, "second.txt"), []byte("Second\n"), 0777)
+	_ = os.Remove(filepath.Join(tempDir, "existing.txt"))
+	if _, err := testApp.Index.ScanLibrary(context.Background(), lib); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	t.Run("it lists changes since the cursor", func(t *testing.T) {
+		page := listChanges(t, fmt.Sprintf("?cursor=%d", start.Cursor), 200)
+		if len(page.Changes) != 3 || page.HasMore {
+			t.Fatalf("Expected 3 changes but got: %+v", page)
+		}
+		if page.Cursor != start.Cursor+3 {
+			t.Errorf("Expected cursor %d but got: %d", start.Cursor+3, page.Cursor)
+		}
+
+		page = listChanges(t, fmt.Sprintf("?cursor=%d", page.Cursor), 200)
+		if len(page.Changes) != 0 || page.Cursor != start.Cursor+3 {
+			t.Errorf("Expected no new changes but got: %+v", page)
+		}
+	})
+
+	t.Run("it pages through changes", func(t *testing.T) {
+		cursor := start.Cursor
+		var types []model.ChangeType
+		for i := 0; i < 3; i++ {
+			page := listChanges(t, fmt.Sprintf("?cursor=%d&limit=1", cursor), 200)
+			if len(page.Changes) != 1 || page.HasMore != (i < 2) {
+				t.Fatalf("Expected a single change but got: %+v", page)
+			}
+			cursor = page.Cursor
+			types = append(types, page.Changes[0].Type)
+		}
+		if types[2] != model.ChangeDeleted {
+			t.Errorf("Expected the delete to come last but got: %v", types)
+		}
+	})
+
+	t.Run("it asks for a full resync if the cursor is too old", func(t *testing.T) {
+		testApp.DB.Where("library_id = ? AND sequence = ?", lib.ID, start.Cursor+1).Delete(&model.Change{})
+		listChanges(t, fmt.Sprintf("?cursor=%d", start.Cursor), 410)
+	})
+
+	t.Run("it asks for a full resync if the cursor is unknown", func(t *testing.T) {
+		listChanges(t, "?cursor=1000000", 410)
+	})
+}
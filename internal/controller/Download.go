@@ -3,9 +3,11 @@ package controller
 import (
 	"fmt"
 	"github.com/gin-gonic/gin"
-	"io"
 	"keydrive/internal/model"
 	"keydrive/internal/service"
+	"net/http"
+	"path"
+	"strconv"
 	"strings"
 )
 
@@ -13,29 +15,165 @@ import (
 // @Tags Files
 // @Router /api/download [get]
 // @Summary Download a file
+// @Description Supports range requests and conditional requests using ETag and Last-Modified.
+// @Description Folders and multiple selections are streamed as a zip or tar.gz archive.
 // @Success 200
+// @Success 206
+// @Success 304
 // @Param token query string true "The download token"
-func Download(fs *service.FileSystem) gin.HandlerFunc {
+// @Param inline query bool false "Show the file in the browser instead of downloading it"
+func Download(fs *service.FileSystem, versions *service.Versions) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		token := c.Value(ContextKeyDownloadToken).(*model.DownloadToken)
-
-		entry, err := fs.GetEntryMetadata(token.Library, token.Path)
-		if err != nil {
-			writeError(c, err)
+		if token.ArchiveFormat != "" {
+			downloadArchive(c, fs, token.Library, token.GetArchivePaths(), token.ArchiveFormat)
+			return
+		}
+		inline, _ := strconv.ParseBool(c.Query("inline"))
+		if token.VersionID != 0 {
+			serveVersion(c, versions, token.Library, token.VersionID, inline)
 			return
 		}
+		serveEntry(c, fs, token.Library, token.Path, inline)
+	}
+}
+
+// serveEntry sends a file to the client, or a zip archive if the entry is a folder.
+func serveEntry(c *gin.Context, fs *service.FileSystem, library model.Library, entryPath string, inline bool) {
+	entry, err := fs.GetEntryMetadata(library, entryPath)
+	if err != nil {
+		writeError(c, err)
+		return
+	}
+	if entry.Category == model.CategoryFolder {
+		downloadArchive(c, fs, library, []string{entryPath}, service.ArchiveZip)
+		return
+	}
+
+	file, err := fs.OpenFile(library, entryPath)
+	if err != nil {
+		writeError(c, err)
+		return
+	}
+	defer file.Close()
 
-		stream, err := fs.OpenFile(token.Library, token.Path)
-		if err != nil {
+	setFileHeaders(c, entry.Name, entry.MimeType, inline)
+	c.Header("ETag", entryETag(entry))
+	http.ServeContent(c.Writer, c.Request, entry.Name, entry.Modified, file)
+}
+
+// serveVersion sends a previous version of a file to the client.
+func serveVersion(c *gin.Context, versions *service.Versions, library model.Library, versionId int, inline bool) {
+	version, err := versions.GetVersion(library, versionId, versions.DB)
+	if err != nil {
+		writeError(c, err)
+		return
+	}
+	file, err := versions.OpenVersion(version)
+	if err != nil {
+		writeError(c, err)
+		return
+	}
+	defer file.Close()
+
+	name := path.Base(version.Path)
+	_, mimeType := service.GetFileCategory(name, "", false)
+	entry := service.FileInfo{Size: version.Size, Modified: version.Modified}
+	setFileHeaders(c, name, mimeType, inline)
+	c.Header("ETag", entryETag(entry))
+	http.ServeContent(c.Writer, c.Request, name, version.Modified, file)
+}
+
+func downloadArchive(c *gin.Context, fs *service.FileSystem, library model.Library, paths []string, format string) {
+	// Check all entries up front, because errors can not be reported once the archive is being sent.
+	for _, entryPath := range paths {
+		isLibraryRoot := path.Clean("/"+entryPath) == "/"
+		if _, err := fs.GetEntryMetadata(library, entryPath); err != nil && !isLibraryRoot {
 			writeError(c, err)
 			return
 		}
+	}
 
-		defer func(stream io.ReadCloser) {
-			_ = stream.Close()
-		}(stream)
-		c.Header("Content-Type", entry.MimeType)
-		c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", strings.ReplaceAll(entry.Name, "\"", "\\\"")))
-		_, _ = io.Copy(c.Writer, stream)
+	name := library.Name
+	if len(paths) == 1 && path.Clean("/"+paths[0]) != "/" {
+		name = path.Base(path.Clean("/" + paths[0]))
+	}
+	name += "." + format
+	if format == service.ArchiveZip {
+		c.Header("Content-Type", "application/zip")
+	} else {
+		c.Header("Content-Type", "application/gzip")
+	}
+	c.Header("Content-Disposition", contentDisposition("attachment", name))
+	c.Status(http.StatusOK)
+	if err := fs.WriteArchive(c.Writer, library, paths, format); err != nil {
+		log.Error("failed to write archive for library %d: %s", library.ID, err)
+		_ = c.Error(err)
+	}
+}
+
+// setFileHeaders sets the type and disposition of a file that is sent to the client. Files are uploaded by users, so
+// browsers must not guess their type and must not run their scripts on this origin. Formats that can contain scripts
+// are always downloaded, even if they were asked for inline. PDFs shown inline are not sandboxed, since browsers refuse
+// to render them in a sandbox; their viewers do not run scripts on this origin.
+func setFileHeaders(c *gin.Context, name string, mimeType string, inline bool) {
+	if mimeType == "" {
+		mimeType = "application/octet-stream"
+	}
+	dispositionType := "attachment"
+	if inline && !service.IsActiveMimeType(mimeType) {
+		dispositionType = "inline"
+	}
+	c.Header("Content-Type", mimeType)
+	c.Header("Content-Disposition", contentDisposition(dispositionType, name))
+	c.Header("X-Content-Type-Options", "nosniff")
+	if dispositionType == "attachment" || mimeType != "application/pdf" {
+		c.Header("Content-Security-Policy", "sandbox")
+	}
+}
+
+// entryETag builds a strong validator from the size and modification time of an entry. Strong validators are required
+// for If-Range to work.
+func entryETag(entry service.FileInfo) string {
+	return fmt.Sprintf("\"%x-%x\"", entry.Size, entry.Modified.UnixNano())
+}
+
+// contentDisposition formats a Content-Disposition header. Names that are not plain ascii are added using the RFC 5987
+// encoding, with an ascii approximation for older clients.
+func contentDisposition(dispositionType string, name string) string {
+	quoted := strings.ReplaceAll(name, "\"", "\\\"")
+	if isPlainAscii(name) {
+		return fmt.Sprintf("%s; filename=\"%s\"", dispositionType, quoted)
+	}
+
+	fallback := strings.Map(func(r rune) rune {
+		if r < 0x20 || r > 0x7e {
+			return '_'
+		}
+		return r
+	}, quoted)
+	return fmt.Sprintf("%s; filename=\"%s\"; filename*=UTF-8''%s", dispositionType, fallback, encodeExtValue(name))
+}
+
+func isPlainAscii(value string) bool {
+	for i := 0; i < len(value); i++ {
+		if value[i] < 0x20 || value[i] > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+// encodeExtValue percent encodes all bytes that are not an attr-char as defined in RFC 5987.
+func encodeExtValue(value string) string {
+	var builder strings.Builder
+	for i := 0; i < len(value); i++ {
+		b := value[i]
+		if 'a' <= b && b <= 'z' || 'A' <= b && b <= 'Z' || '0' <= b && b <= '9' || strings.IndexByte("!#$&+-.^_`|~", b) != -1 {
+			builder.WriteByte(b)
+		} else {
+			builder.WriteString(fmt.Sprintf("%%%02X", b))
+		}
 	}
+	return builder.String()
 }
@@ -17,7 +17,12 @@ func RequireDownloadToken(tokens *service.DownloadTokens) gin.HandlerFunc {
 			return
 		}
 
-		token, found := tokens.GetDownloadToken(tokenString)
+		token, found, err := tokens.GetDownloadToken(tokenString)
+		if err != nil {
+			writeError(c, err)
+			c.Abort()
+			return
+		}
 		if !found {
 			c.AbortWithStatusJSON(
 				http.StatusUnauthorized,
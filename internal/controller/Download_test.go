@@ -1,15 +1,28 @@
 package controller
 
 import (
+	"archive/zip"
+	"bytes"
 	"fmt"
 	"keydrive/internal/model"
+	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 )
 
+func generateDownloadToken(t *testing.T, lib model.Library, path string) string {
+	t.Helper()
+	token, err := testApp.DownloadTokens.GenerateDownloadToken(lib, path)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	return token.Token
+}
+
 func TestDownload(t *testing.T) {
 	tempDir := t.TempDir()
 	_ = os.WriteFile(filepath.Join(tempDir, "gimme.txt"), []byte("Hello World!\n"), 0777)
@@ -22,7 +35,7 @@ func TestDownload(t *testing.T) {
 	testApp.DB.Create(&lib)
 
 	t.Run("it downloads a file", func(t *testing.T) {
-		token := testApp.DownloadTokens.GenerateDownloadToken(lib, "/gimme.txt").Token
+		token := generateDownloadToken(t, lib, "/gimme.txt")
 		req, _ := http.NewRequest("GET", fmt.Sprintf("/api/download?token=%s", token), nil)
 		recorder := httptest.NewRecorder()
 		testApp.Router.ServeHTTP(
@@ -45,7 +58,7 @@ func TestDownload(t *testing.T) {
 	})
 
 	t.Run("it returns 404 if file is not found", func(t *testing.T) {
-		token := testApp.DownloadTokens.GenerateDownloadToken(lib, "/not/here.txt").Token
+		token := generateDownloadToken(t, lib, "/not/here.txt")
 		req, _ := http.NewRequest("GET", fmt.Sprintf("/api/download?token=%s", token), nil)
 		recorder := httptest.NewRecorder()
 		testApp.Router.ServeHTTP(
@@ -75,3 +88,227 @@ func TestDownload(t *testing.T) {
 		assertStatus(t, recorder, 401)
 	})
 }
+
+func TestDownloadPartialContent(t *testing.T) {
+	tempDir := t.TempDir()
+	_ = os.WriteFile(filepath.Join(tempDir, "video.mp4"), []byte("0123456789"), 0777)
+	_ = os.WriteFile(filepath.Join(tempDir, "ŝpeciål.txt"), []byte("Hello World!\n"), 0777)
+
+	lib := model.Library{
+		Type:       model.TypeGeneric,
+		Name:       "Test Library",
+		RootFolder: tempDir,
+	}
+	testApp.DB.Create(&lib)
+
+	download := func(path string, query string, headers map[string]string) *httptest.ResponseRecorder {
+		token := generateDownloadToken(t, lib, path)
+		req, _ := http.NewRequest("GET", fmt.Sprintf("/api/download?token=%s%s", token, query), nil)
+		for name, value := range headers {
+			req.Header.Set(name, value)
+		}
+		recorder := httptest.NewRecorder()
+		testApp.Router.ServeHTTP(recorder, req)
+		return recorder
+	}
+
+	t.Run("it returns the requested range", func(t *testing.T) {
+		recorder := download("/video.mp4", "", map[string]string{"Range": "bytes=2-5"})
+
+		assertStatus(t, recorder, 206)
+		if body := recorder.Body.String(); body != "2345" {
+			t.Errorf("Expected [2345] but got: %s", body)
+		}
+		if contentRange := recorder.Header().Get("Content-Range"); contentRange != "bytes 2-5/10" {
+			t.Errorf("Expected [bytes 2-5/10] but got: %s", contentRange)
+		}
+	})
+
+	t.Run("it returns 304 if the etag matches", func(t *testing.T) {
+		etag := download("/video.mp4", "", nil).Header().Get("ETag")
+		if etag == "" {
+			t.Fatalf("Expected an ETag header")
+		}
+
+		recorder := download("/video.mp4", "", map[string]string{"If-None-Match": etag})
+		assertStatus(t, recorder, 304)
+	})
+
+	t.Run("it ignores the range if the file changed", func(t *testing.T) {
+		recorder := download("/video.mp4", "", map[string]string{"Range": "bytes=2-5", "If-Range": "\"outdated\""})
+
+		assertStatus(t, recorder, 200)
+		if body := recorder.Body.String(); body != "0123456789" {
+			t.Errorf("Expected the full file but got: %s", body)
+		}
+	})
+
+	t.Run("it streams inline", func(t *testing.T) {
+		recorder := download("/video.mp4", "&inline=true", nil)
+
+		disposition := recorder.Header().Get("Content-Disposition")
+		if disposition != "inline; filename=\"video.mp4\"" {
+			t.Errorf("Expected [inline; filename=\"video.mp4\"] but got: %s", disposition)
+		}
+		if length := recorder.Header().Get("Content-Length"); length != "10" {
+			t.Errorf("Expected a content length of 10 but got: %s", length)
+		}
+	})
+
+	t.Run("it encodes non-ascii filenames", func(t *testing.T) {
+		recorder := download("/ŝpeciål.txt", "", nil)
+
+		disposition := recorder.Header().Get("Content-Disposition")
+		expected := "attachment; filename=\"_peci_l.txt\"; filename*=UTF-8''%C5%9Dpeci%C3%A5l.txt"
+		if disposition != expected {
+			t.Errorf("Expected [%s] but got: %s", expected, disposition)
+		}
+	})
+}
+
+func TestDownloadArchive(t *testing.T) {
+	tempDir := t.TempDir()
+	_ = os.Mkdir(filepath.Join(tempDir, "folder"), 0777)
+	_ = os.WriteFile(filepath.Join(tempDir, "folder", "nested.txt"), []byte("Nested\n"), 0777)
+	_ = os.WriteFile(filepath.Join(tempDir, "root.txt"), []byte("Root\n"), 0777)
+
+	lib := model.Library{
+		Type:       model.TypeGeneric,
+		Name:       "Test Library",
+		RootFolder: tempDir,
+	}
+	testApp.DB.Create(&lib)
+
+	createToken := func(t *testing.T, body string) string {
+		req := adminRequest("POST", fmt.Sprintf("/api/libraries/%d/entries/download", lib.ID), strings.NewReader(body))
+		recorder := httptest.NewRecorder()
+		testApp.Router.ServeHTTP(recorder, req)
+		assertStatus(t, recorder, 201)
+		var token DownloadTokenDTO
+		assertJsonUnmarshal(t, recorder, &token)
+		return token.Token
+	}
+
+	download := func(token string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", fmt.Sprintf("/api/download?token=%s", token), nil)
+		recorder := httptest.NewRecorder()
+		testApp.Router.ServeHTTP(recorder, req)
+		return recorder
+	}
+
+	t.Run("it downloads a folder as a zip archive", func(t *testing.T) {
+		recorder := download(createToken(t, `{"path": "/folder"}`))
+
+		assertStatus(t, recorder, 200)
+		if disposition := recorder.Header().Get("Content-Disposition"); disposition != "attachment; filename=\"folder.zip\"" {
+			t.Errorf("Unexpected disposition: %s", disposition)
+		}
+		reader, err := zip.NewReader(bytes.NewReader(recorder.Body.Bytes()), int64(recorder.Body.Len()))
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if len(reader.File) != 2 || reader.File[1].Name != "folder/nested.txt" {
+			t.Errorf("Unexpected archive contents: %v", reader.File)
+		}
+	})
+
+	t.Run("it downloads a selection as a tar.gz archive", func(t *testing.T) {
+		recorder := download(createToken(t, `{"paths": ["/folder", "/root.txt"], "format": "tar.gz"}`))
+
+		assertStatus(t, recorder, 200)
+		if contentType := recorder.Header().Get("Content-Type"); contentType != "application/gzip" {
+			t.Errorf("Expected application/gzip but got: %s", contentType)
+		}
+		if disposition := recorder.Header().Get("Content-Disposition"); disposition != "attachment; filename=\"Test Library.tar.gz\"" {
+			t.Errorf("Unexpected disposition: %s", disposition)
+		}
+	})
+
+	t.Run("it returns 404 if an entry does not exist", func(t *testing.T) {
+		recorder := download(createToken(t, `{"paths": ["/root.txt", "/missing.txt"]}`))
+		assertStatus(t, recorder, 404)
+	})
+
+	t.Run("it rejects unknown formats", func(t *testing.T) {
+		req := adminRequest("POST", fmt.Sprintf("/api/libraries/%d/entries/download", lib.ID), strings.NewReader(`{"path": "/folder", "format": "rar"}`))
+		recorder := httptest.NewRecorder()
+		testApp.Router.ServeHTTP(recorder, req)
+		assertStatus(t, recorder, 400)
+	})
+}
+
+func TestDownloadActiveContent(t *testing.T) {
+	lib := model.Library{
+		Type:       model.TypeGeneric,
+		Name:       "Active Content Library",
+		RootFolder: t.TempDir(),
+	}
+	testApp.DB.Create(&lib)
+
+	files := map[string]string{
+		"page.html": "<html><body><script>alert(document.cookie)</script></body></html>",
+		"image.svg": `<svg xmlns="http://www.w3.org/2000/svg"><script>alert(document.cookie)</script></svg>`,
+		"notes.txt": "Just some notes",
+		"paper.pdf": "%PDF-1.4\n%%EOF\n",
+	}
+	for name, content := range files {
+		body := &bytes.Buffer{}
+		writer := multipart.NewWriter(body)
+		part, _ := writer.CreateFormFile("data", name)
+		_, _ = part.Write([]byte(content))
+		_ = writer.Close()
+		req := adminRequest("POST", fmt.Sprintf("/api/libraries/%d/entries", lib.ID), body)
+		req.Header.Set("Content-Type", writer.FormDataContentType())
+		recorder := httptest.NewRecorder()
+		testApp.Router.ServeHTTP(recorder, req)
+		assertStatus(t, recorder, 201)
+	}
+
+	download := func(path string) *httptest.ResponseRecorder {
+		token := generateDownloadToken(t, lib, path)
+		req, _ := http.NewRequest("GET", fmt.Sprintf("/api/download?token=%s&inline=true", token), nil)
+		recorder := httptest.NewRecorder()
+		testApp.Router.ServeHTTP(recorder, req)
+		assertStatus(t, recorder, 200)
+		if nosniff := recorder.Header().Get("X-Content-Type-Options"); nosniff != "nosniff" {
+			t.Errorf("Expected nosniff for %s but got: %s", path, nosniff)
+		}
+		return recorder
+	}
+	expectSandbox := func(t *testing.T, recorder *httptest.ResponseRecorder) {
+		if csp := recorder.Header().Get("Content-Security-Policy"); csp != "sandbox" {
+			t.Errorf("Expected a sandbox but got: %s", csp)
+		}
+	}
+
+	for _, path := range []string{"/page.html", "/image.svg"} {
+		t.Run("it downloads "+path+" instead of showing it", func(t *testing.T) {
+			recorder := download(path)
+			expectSandbox(t, recorder)
+			if disposition := recorder.Header().Get("Content-Disposition"); !strings.HasPrefix(disposition, "attachment;") {
+				t.Errorf("Expected an attachment but got: %s", disposition)
+			}
+		})
+	}
+
+	t.Run("it still shows passive files inline", func(t *testing.T) {
+		recorder := download("/notes.txt")
+		expectSandbox(t, recorder)
+		if disposition := recorder.Header().Get("Content-Disposition"); !strings.HasPrefix(disposition, "inline;") {
+			t.Errorf("Expected inline but got: %s", disposition)
+		}
+	})
+
+	t.Run("it shows pdfs inline without a sandbox", func(t *testing.T) {
+		recorder := download("/paper.pdf")
+		if contentType := recorder.Header().Get("Content-Type"); contentType != "application/pdf" {
+			t.Errorf("Expected application/pdf but got: %s", contentType)
+		}
+		if disposition := recorder.Header().Get("Content-Disposition"); !strings.HasPrefix(disposition, "inline;") {
+			t.Errorf("Expected inline but got: %s", disposition)
+		}
+		if csp := recorder.Header().Get("Content-Security-Policy"); csp != "" {
+			t.Errorf("Expected no sandbox but got: %s", csp)
+		}
+	})
+}
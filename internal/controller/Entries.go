@@ -1,6 +1,7 @@
 package controller
 
 import (
+	"context"
 	"github.com/gin-gonic/gin"
 	"gorm.io/gorm"
 	"keydrive/internal/model"
@@ -8,6 +9,7 @@ import (
 	"mime/multipart"
 	"net/http"
 	"os"
+	"path"
 )
 
 type LibraryAccess struct {
@@ -17,10 +19,15 @@ type LibraryAccess struct {
 
 func getAccessToLib(c *gin.Context, libs *service.Library, writeAccess bool, tx *gorm.DB) (model.Library, error) {
 	libraryId, ok := intParam(c, "libraryId")
-	var library LibraryAccess
 	if !ok {
-		return library.Library, ApiError{Status: http.StatusNotFound}
+		return model.Library{}, ApiError{Status: http.StatusNotFound}
 	}
+	return getAccessToLibById(c, libs, libraryId, writeAccess, tx)
+}
+
+// getAccessToLibById checks the access of the authenticated user to a library that is not given in the path.
+func getAccessToLibById(c *gin.Context, libs *service.Library, libraryId int, writeAccess bool, tx *gorm.DB) (model.Library, error) {
+	var library LibraryAccess
 	user, _ := GetAuthenticatedUser(c)
 	if err := libs.GetLibrariesWithAccessForUser(user, tx).Take(&library, libraryId).Error; err != nil {
 		return library.Library, ApiError{Status: http.StatusNotFound}
@@ -54,13 +61,14 @@ func resolvePath(c *gin.Context, libs *service.Library, db *gorm.DB, writeAccess
 // @Tags Files
 // @Router /api/libraries/{libraryId}/entries [get]
 // @Summary Search the collection of files and folders
+// @Description Files include the metadata that was read from their tags or names, once the library was indexed.
 // @Security OAuth2
 // @Produce  json
 // @Success 200 {array} service.FileInfo
 // @Param parent query string false "The parent folder"
 // @Param path query string false "The entry path. If this value is set, all other parameters are ignored and a maximum of 1 value is returned."
 // @Param libraryId path int true "The library id"
-func ListEntries(db *gorm.DB, libs *service.Library, fs *service.FileSystem) gin.HandlerFunc {
+func ListEntries(db *gorm.DB, libs *service.Library, fs *service.FileSystem, index *service.Index) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		library, err := getAccessToLib(c, libs, false, db)
 		if err != nil {
@@ -71,7 +79,12 @@ func ListEntries(db *gorm.DB, libs *service.Library, fs *service.FileSystem) gin
 		if path, ok := c.GetQuery("path"); ok {
 			entry, err := fs.GetEntryMetadata(library, path)
 			if err == nil {
-				c.JSON(http.StatusOK, []service.FileInfo{entry})
+				entries := []service.FileInfo{entry}
+				if err := index.AddMetadata(library, entries); err != nil {
+					writeError(c, err)
+					return
+				}
+				c.JSON(http.StatusOK, entries)
 				return
 			}
 			if os.IsNotExist(err) {
@@ -88,12 +101,20 @@ func ListEntries(db *gorm.DB, libs *service.Library, fs *service.FileSystem) gin
 			writeError(c, err)
 			return
 		}
+		if err := index.AddMetadata(library, entries); err != nil {
+			writeError(c, err)
+			return
+		}
 		c.JSON(http.StatusOK, entries)
 	}
 }
 
 type CreateDownloadTokenDTO struct {
-	Path string `json:"path" binding:"required"`
+	Path     string   `json:"path" binding:"required_without=Paths"`
+	Paths    []string `json:"paths"`
+	Format   string   `json:"format" binding:"omitempty,oneof=zip tar.gz" enums:"zip,tar.gz"`
+	MultiUse bool     `json:"multiUse"`
+	Version  int      `json:"version" binding:"min=0"`
 }
 
 type DownloadTokenDTO struct {
@@ -104,11 +125,14 @@ type DownloadTokenDTO struct {
 // @Tags Files
 // @Router /api/libraries/{libraryId}/entries/download [post]
 // @Summary Create a download token
+// @Description Tokens can be used once, unless multiUse is set. Reusable tokens allow media players to seek until the token expires.
+// @Description When paths or a format are given, the entries are downloaded as a single archive. Folders are always downloaded as an archive.
+// @Description When a version is given, that previous version of the file is downloaded.
 // @Security OAuth2
 // @Produce json
-// @Param body body CreateDownloadTokenDTO true "The file to create a download token for"
+// @Param body body CreateDownloadTokenDTO true "The file or files to create a download token for"
 // @Success 201 {object} DownloadTokenDTO
-func CreateDownloadToken(db *gorm.DB, libs *service.Library, tokens *service.DownloadTokens) gin.HandlerFunc {
+func CreateDownloadToken(db *gorm.DB, libs *service.Library, tokens *service.DownloadTokens, versions *service.Versions) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		var create CreateDownloadTokenDTO
 		if err := c.ShouldBindJSON(&create); err != nil {
@@ -122,7 +146,33 @@ func CreateDownloadToken(db *gorm.DB, libs *service.Library, tokens *service.Dow
 				return err
 			}
 
-			token := tokens.GenerateDownloadToken(library, create.Path)
+			token := &model.DownloadToken{
+				Library:  library,
+				Path:     create.Path,
+				MultiUse: create.MultiUse,
+			}
+			if len(create.Paths) > 0 || create.Format != "" {
+				if create.Format == "" {
+					create.Format = service.ArchiveZip
+				}
+				if len(create.Paths) == 0 {
+					create.Paths = []string{create.Path}
+				}
+				token.Path = ""
+				token.ArchiveFormat = create.Format
+				token.SetArchivePaths(create.Paths)
+			} else if create.Version != 0 {
+				var version model.FileVersion
+				if result := versions.GetVersionsForEntry(library, create.Path, tx).Take(&version, create.Version); result.Error != nil {
+					return result.Error
+				}
+				token.Path = version.Path
+				token.VersionID = version.ID
+			}
+			token, err = tokens.SaveDownloadToken(token)
+			if err != nil {
+				return err
+			}
 			response := DownloadTokenDTO{Token: token.Token}
 			c.JSON(http.StatusCreated, response)
 
@@ -153,8 +203,12 @@ type CreateEntryDTO struct {
 // @Param name formData string false "The name of the new entry. Required when creating a folder."
 // @Param parent formData string false "The path to the parent folder. When missing this creates a file or folder in the root of the library."
 // @Param data formData file false "The file contents. Required when creating a file."
-func CreateEntry(db *gorm.DB, libs *service.Library, fs *service.FileSystem) gin.HandlerFunc {
+func CreateEntry(db *gorm.DB, libs *service.Library, fs *service.FileSystem, versions *service.Versions, quotas *service.Quotas) gin.HandlerFunc {
 	return func(c *gin.Context) {
+		if err := limitUpload(c, db, libs, quotas); err != nil {
+			writeError(c, err)
+			return
+		}
 		var request CreateEntryDTO
 		if err := c.ShouldBind(&request); err != nil {
 			writeError(c, err)
@@ -181,10 +235,31 @@ func CreateEntry(db *gorm.DB, libs *service.Library, fs *service.FileSystem) gin
 					return err
 				}
 				defer fileData.Close()
-				created, err := fs.CreateFileInLibrary(library, request.Name, request.Parent, request.Data)
+				name := request.Name
+				if name == "" {
+					name = request.Data.Filename
+				}
+				user, _ := GetAuthenticatedUser(c)
+				if err := quotas.Check(library, user, request.Data.Size); err != nil {
+					return err
+				}
+				// The new content is staged first, so the current content is only replaced once it is complete.
+				staged, err := fs.StageFile(library, fileData, request.Data.Size)
 				if err != nil {
 					return err
 				}
+				defer os.Remove(staged)
+				target := path.Join("/", request.Parent, name)
+				if err := versions.KeepVersion(library, target); err != nil {
+					return err
+				}
+				created, err := fs.CommitFileInLibrary(library, staged, target)
+				if err != nil {
+					return err
+				}
+				if err := quotas.Claim(library, path.Join(created.Parent, created.Name), user.ID); err != nil {
+					return err
+				}
 				c.JSON(http.StatusCreated, created)
 			}
 
@@ -196,24 +271,55 @@ func CreateEntry(db *gorm.DB, libs *service.Library, fs *service.FileSystem) gin
 	}
 }
 
+// uploadFormOverhead is the space that is allowed for the fields and boundaries of a multipart form, in addition to the
+// uploaded file.
+const uploadFormOverhead = 64 << 10
+
+// limitUpload rejects uploads whose body does not fit in the quotas before it is read, and limits the body to the
+// available space, so a client can not make the server receive and store a large body that is refused afterwards.
+func limitUpload(c *gin.Context, db *gorm.DB, libs *service.Library, quotas *service.Quotas) error {
+	library, err := getAccessToLib(c, libs, true, db)
+	if err != nil {
+		return err
+	}
+	user, _ := GetAuthenticatedUser(c)
+	return limitUploadFor(c, quotas, library, user)
+}
+
+// limitUploadFor is limitUpload for a library and user that are already known, like the owner of a file drop link.
+func limitUploadFor(c *gin.Context, quotas *service.Quotas, library model.Library, user model.User) error {
+	available, err := quotas.Available(library, user)
+	if err != nil || available < 0 {
+		return err
+	}
+	if c.Request.ContentLength > available+uploadFormOverhead {
+		if err := quotas.Check(library, user, c.Request.ContentLength-uploadFormOverhead); err != nil {
+			return err
+		}
+	}
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, available+uploadFormOverhead)
+	return nil
+}
+
 // DeleteEntry
 // @Tags Files
 // @Router /api/libraries/{libraryId}/entries [delete]
-// @Summary Delete a file or folder
+// @Summary Move a file or folder to the trash
 // @Security OAuth2
 // @Produce  json
 // @Success 204
 // @Param path query string true "The url encoded path"
 // @Param libraryId path int true "The library id"
-func DeleteEntry(db *gorm.DB, libs *service.Library, fs *service.FileSystem) gin.HandlerFunc {
+func DeleteEntry(db *gorm.DB, libs *service.Library, trash *service.Trash) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		library, path, err := resolvePath(c, libs, db, true)
 		if err != nil {
 			writeError(c, err)
 			return
 		}
-		err = fs.DeleteEntryInLibrary(library, path)
-		if err != nil {
+		user, _ := GetAuthenticatedUser(c)
+		_, err = trash.MoveToTrash(library, user, path)
+		if err != nil && !os.IsNotExist(err) {
 			writeError(c, err)
 			return
 		}
@@ -224,34 +330,126 @@ func DeleteEntry(db *gorm.DB, libs *service.Library, fs *service.FileSystem) gin
 type MoveEntryDTO struct {
 	Source string `binding:"required" json:"source"`
 	Target string `binding:"required" json:"target"`
+	// TargetLibraryID is the library the entry is moved or copied to. It defaults to the library of the source.
+	TargetLibraryID int                    `json:"targetLibraryId,omitempty"`
+	Conflict        service.ConflictPolicy `json:"conflict,omitempty" binding:"omitempty,oneof=fail overwrite rename skip" enums:"fail,overwrite,rename,skip"`
+	// Background carries out the transfer as a job, so large folders can be copied without waiting for them.
+	Background bool `json:"background,omitempty"`
 }
 
-// MoveEntry
-// @Tags Files
-// @Router /api/libraries/{libraryId}/entries/move [post]
-// @Summary Move a file or folder
-// @Security OAuth2
-// @Produce json
-// @Success 204
-// @Param libraryId path int true "The library id"
-// @Param body body MoveEntryDTO true "The source and target path"
-func MoveEntry(db *gorm.DB, libs *service.Library, fs *service.FileSystem) gin.HandlerFunc {
-	return func(c *gin.Context) {
-		var request MoveEntryDTO
-		if err := c.ShouldBindJSON(&request); err != nil {
+// transferFunc is a copy or a move of the FileSystem.
+type transferFunc func(ctx context.Context, source model.Library, sourcePath string, target model.Library, targetPath string, conflict service.ConflictPolicy, report service.ProgressFunc) (service.TransferResult, error)
+
+// transferEntry copies or moves an entry as described in the request body. Progress is published as events for the
+// user, so large transfers can be followed while the request is running. Transfers in the background are batch jobs
+// with a single operation. Entries that are overwritten are moved to the trash.
+func transferEntry(c *gin.Context, db *gorm.DB, libs *service.Library, events *service.Events, jobs *service.Jobs, quotas *service.Quotas, trash *service.Trash, operation service.BatchOperationType, transfer transferFunc) {
+	var request MoveEntryDTO
+	if err := c.ShouldBindJSON(&request); err != nil {
+		writeError(c, err)
+		return
+	}
+	// Copies only read from the source, so they need write access to the target only.
+	source, err := getAccessToLib(c, libs, operation == service.BatchMove, db)
+	if err != nil {
+		writeError(c, err)
+		return
+	}
+	target := source
+	if request.TargetLibraryID != 0 && request.TargetLibraryID != source.ID {
+		if target, err = getAccessToLibById(c, libs, request.TargetLibraryID, true, db); err != nil {
 			writeError(c, err)
 			return
 		}
-		library, err := getAccessToLib(c, libs, true, db)
+	}
+	if request.Conflict == "" {
+		request.Conflict = service.ConflictFail
+	}
+
+	user, _ := GetAuthenticatedUser(c)
+	if err := quotas.CheckTransfer(source, request.Source, target, user, operation == service.BatchMove); err != nil {
+		writeError(c, err)
+		return
+	}
+	if request.Background {
+		job, err := jobs.Enqueue(JobBatch, &user, &source, BatchDTO{
+			Operations: []BatchOperationDTO{{
+				Op:              operation,
+				Path:            request.Source,
+				Target:          request.Target,
+				TargetLibraryID: target.ID,
+				Conflict:        request.Conflict,
+			}},
+			StopOnError: true,
+		})
 		if err != nil {
 			writeError(c, err)
 			return
 		}
-		err = fs.MoveEntryInLibrary(library, request.Source, request.Target)
-		if err != nil {
+		acceptJob(c, job)
+		return
+	}
+	result, err := transfer(c.Request.Context(), source, request.Source, target, request.Target, request.Conflict, func(progress service.TransferProgress) {
+		events.Publish(service.Event{
+			Type:      service.EventTransferProgress,
+			LibraryID: target.ID,
+			UserID:    user.ID,
+			Path:      request.Target,
+			OldPath:   request.Source,
+			Progress:  &progress,
+		})
+	})
+	if err != nil {
+		writeError(c, err)
+		return
+	}
+	if _, err := trash.KeepReplaced(target, user, result); err != nil {
+		log.Warn("failed to move %s in library %d to the trash after it was replaced: %s", result.Path, target.ID, err)
+	}
+	if !result.Skipped && (operation == service.BatchCopy || source.ID != target.ID) {
+		if err := quotas.Claim(target, result.Path, user.ID); err != nil {
 			writeError(c, err)
 			return
 		}
+	}
+	if operation == service.BatchMove {
 		c.Status(http.StatusNoContent)
+		return
+	}
+	c.JSON(http.StatusOK, result)
+}
+
+// MoveEntry
+// @Tags Files
+// @Router /api/libraries/{libraryId}/entries/move [post]
+// @Summary Move a file or folder
+// @Description Entries can be moved to another library that the user can write to. If the target exists, the move fails unless another conflict policy is given. Overwritten entries are moved to the trash.
+// @Description Progress of moves between filesystems is sent as transfer-progress events.
+// @Security OAuth2
+// @Success 204
+// @Success 202 {object} model.Job
+// @Param libraryId path int true "The library id"
+// @Param body body MoveEntryDTO true "The source and target path"
+func MoveEntry(db *gorm.DB, libs *service.Library, fs *service.FileSystem, events *service.Events, jobs *service.Jobs, quotas *service.Quotas, trash *service.Trash) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		transferEntry(c, db, libs, events, jobs, quotas, trash, service.BatchMove, fs.MoveEntry)
+	}
+}
+
+// CopyEntry
+// @Tags Files
+// @Router /api/libraries/{libraryId}/entries/copy [post]
+// @Summary Copy a file or folder
+// @Description Folders are copied with everything in them, also to another library that the user can write to. If the target exists, the copy fails unless another conflict policy is given. Overwritten entries are moved to the trash.
+// @Description Progress is sent as transfer-progress events.
+// @Security OAuth2
+// @Produce json
+// @Success 200 {object} service.TransferResult
+// @Success 202 {object} model.Job
+// @Param libraryId path int true "The library id"
+// @Param body body MoveEntryDTO true "The source and target path"
+func CopyEntry(db *gorm.DB, libs *service.Library, fs *service.FileSystem, events *service.Events, jobs *service.Jobs, quotas *service.Quotas, trash *service.Trash) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		transferEntry(c, db, libs, events, jobs, quotas, trash, service.BatchCopy, fs.CopyEntry)
 	}
 }
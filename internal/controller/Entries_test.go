@@ -215,7 +215,10 @@ func TestCreateDownloadToken(t *testing.T) {
 		assertStatus(t, recorder, 201)
 		var body DownloadTokenDTO
 		assertJsonUnmarshal(t, recorder, &body)
-		token, found := testApp.DownloadTokens.GetDownloadToken(body.Token)
+		token, found, err := testApp.DownloadTokens.GetDownloadToken(body.Token)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
 		if !found {
 			t.Errorf("Invalid download token returned")
 		}
@@ -308,7 +311,7 @@ func TestMoveEntry(t *testing.T) {
 		req := adminRequest(
 			"POST",
 			fmt.Sprintf("/api/libraries/%d/entries/move", lib.ID),
-			strings.NewReader("{\"source\":\"/source.txt\",\"target\":\"/overwrite.txt\"}"),
+			strings.NewReader("{\"source\":\"/source.txt\",\"target\":\"/overwrite.txt\",\"conflict\":\"overwrite\"}"),
 		)
 		recorder := httptest.NewRecorder()
 		testApp.Router.ServeHTTP(recorder, req)
@@ -324,6 +327,35 @@ func TestMoveEntry(t *testing.T) {
 		}
 	})
 
+	t.Run("it keeps the overwritten file in the trash", func(t *testing.T) {
+		var item model.TrashItem
+		if err := testApp.DB.Where("library_id = ? AND path = ?", lib.ID, "/overwrite.txt").First(&item).Error; err != nil {
+			t.Fatalf("Expected the overwritten file in the trash: %s", err)
+		}
+		if item.Size != int64(len("Target file\n")) {
+			t.Errorf("Expected the old content in the trash: %+v", item)
+		}
+	})
+
+	t.Run("it does not overwrite the target by default", func(t *testing.T) {
+		sourceFile := filepath.Join(tempDir, "source.txt")
+		_ = os.WriteFile(sourceFile, []byte("Source file\n"), 0777)
+
+		req := adminRequest(
+			"POST",
+			fmt.Sprintf("/api/libraries/%d/entries/move", lib.ID),
+			strings.NewReader("{\"source\":\"/source.txt\",\"target\":\"/overwrite.txt\"}"),
+		)
+		recorder := httptest.NewRecorder()
+		testApp.Router.ServeHTTP(recorder, req)
+
+		assertStatus(t, recorder, 409)
+		if _, err := os.Stat(sourceFile); err != nil {
+			t.Errorf("Source file should stay: %s", err)
+		}
+		_ = os.Remove(sourceFile)
+	})
+
 	t.Run("it returns not found when the source does not exist", func(t *testing.T) {
 		req := adminRequest(
 			"POST",
@@ -339,3 +371,114 @@ func TestMoveEntry(t *testing.T) {
 		}
 	})
 }
+
+func TestCopyEntry(t *testing.T) {
+	tempDir := t.TempDir()
+	_ = os.MkdirAll(filepath.Join(tempDir, "folder", "nested"), 0777)
+	_ = os.WriteFile(filepath.Join(tempDir, "folder", "nested", "file.txt"), []byte("Nested file\n"), 0777)
+	lib := model.Library{
+		Type:       model.TypeGeneric,
+		Name:       "Copy Library",
+		RootFolder: tempDir,
+	}
+	testApp.DB.Create(&lib)
+	otherDir := t.TempDir()
+	other := model.Library{
+		Type:       model.TypeGeneric,
+		Name:       "Other Library",
+		RootFolder: otherDir,
+	}
+	testApp.DB.Create(&other)
+	testApp.DB.Create(&model.CanAccessLibrary{UserID: regularUser.ID, LibraryID: lib.ID, CanWrite: true})
+	testApp.DB.Create(&model.CanAccessLibrary{UserID: regularUser.ID, LibraryID: other.ID})
+
+	t.Run("it copies a folder", func(t *testing.T) {
+		req := adminRequest("POST", fmt.Sprintf("/api/libraries/%d/entries/copy", lib.ID), strings.NewReader(`{"source": "/folder", "target": "/copy"}`))
+		recorder := httptest.NewRecorder()
+		testApp.Router.ServeHTTP(recorder, req)
+		assertStatus(t, recorder, 200)
+		var result service.TransferResult
+		assertJsonUnmarshal(t, recorder, &result)
+		if result.Path != "/copy" || result.Files != 1 || result.Bytes != 12 {
+			t.Errorf("Unexpected result: %+v", result)
+		}
+		if bytes, err := os.ReadFile(filepath.Join(tempDir, "copy", "nested", "file.txt")); err != nil || string(bytes) != "Nested file\n" {
+			t.Errorf("Expected the folder to be copied: %v", err)
+		}
+		if _, err := os.Stat(filepath.Join(tempDir, "folder", "nested", "file.txt")); err != nil {
+			t.Errorf("Expected the source to stay: %s", err)
+		}
+	})
+
+	t.Run("it applies the conflict policy", func(t *testing.T) {
+		req := adminRequest("POST", fmt.Sprintf("/api/libraries/%d/entries/copy", lib.ID), strings.NewReader(`{"source": "/folder", "target": "/copy"}`))
+		recorder := httptest.NewRecorder()
+		testApp.Router.ServeHTTP(recorder, req)
+		assertStatus(t, recorder, 409)
+
+		req = adminRequest("POST", fmt.Sprintf("/api/libraries/%d/entries/copy", lib.ID), strings.NewReader(`{"source": "/folder", "target": "/copy", "conflict": "rename"}`))
+		recorder = httptest.NewRecorder()
+		testApp.Router.ServeHTTP(recorder, req)
+		assertStatus(t, recorder, 200)
+		var result service.TransferResult
+		assertJsonUnmarshal(t, recorder, &result)
+		if result.Path != "/copy (1)" {
+			t.Errorf("Unexpected result: %+v", result)
+		}
+
+		req = adminRequest("POST", fmt.Sprintf("/api/libraries/%d/entries/copy", lib.ID), strings.NewReader(`{"source": "/folder", "target": "/copy", "conflict": "skip"}`))
+		recorder = httptest.NewRecorder()
+		testApp.Router.ServeHTTP(recorder, req)
+		assertStatus(t, recorder, 200)
+		assertJsonUnmarshal(t, recorder, &result)
+		if !result.Skipped {
+			t.Errorf("Expected the copy to be skipped: %+v", result)
+		}
+	})
+
+	t.Run("it does not copy a folder into itself", func(t *testing.T) {
+		req := adminRequest("POST", fmt.Sprintf("/api/libraries/%d/entries/copy", lib.ID), strings.NewReader(`{"source": "/folder", "target": "/folder/nested/folder"}`))
+		recorder := httptest.NewRecorder()
+		testApp.Router.ServeHTTP(recorder, req)
+		assertStatus(t, recorder, 400)
+	})
+
+	t.Run("it moves to another library", func(t *testing.T) {
+		req := adminRequest("POST", fmt.Sprintf("/api/libraries/%d/entries/move", lib.ID), strings.NewReader(fmt.Sprintf(`{"source": "/copy (1)", "target": "/moved", "targetLibraryId": %d}`, other.ID)))
+		recorder := httptest.NewRecorder()
+		testApp.Router.ServeHTTP(recorder, req)
+		assertStatus(t, recorder, 204)
+		if _, err := os.Stat(filepath.Join(otherDir, "moved", "nested", "file.txt")); err != nil {
+			t.Errorf("Expected the folder to be moved: %s", err)
+		}
+		if _, err := os.Stat(filepath.Join(tempDir, "copy (1)")); !os.IsNotExist(err) {
+			t.Errorf("Expected the source to be removed: %v", err)
+		}
+	})
+
+	t.Run("it copies from a library that can only be read", func(t *testing.T) {
+		_ = os.WriteFile(filepath.Join(otherDir, "readonly.txt"), []byte("Read only\n"), 0777)
+		req := regularUserRequest("POST", fmt.Sprintf("/api/libraries/%d/entries/copy", other.ID), strings.NewReader(fmt.Sprintf(`{"source": "/readonly.txt", "target": "/readonly.txt", "targetLibraryId": %d}`, lib.ID)))
+		recorder := httptest.NewRecorder()
+		testApp.Router.ServeHTTP(recorder, req)
+		assertStatus(t, recorder, 200)
+		if _, err := os.Stat(filepath.Join(tempDir, "readonly.txt")); err != nil {
+			t.Errorf("Expected the file to be copied: %s", err)
+		}
+
+		req = regularUserRequest("POST", fmt.Sprintf("/api/libraries/%d/entries/move", other.ID), strings.NewReader(fmt.Sprintf(`{"source": "/readonly.txt", "target": "/moved.txt", "targetLibraryId": %d}`, lib.ID)))
+		recorder = httptest.NewRecorder()
+		testApp.Router.ServeHTTP(recorder, req)
+		assertStatus(t, recorder, 403)
+	})
+
+	t.Run("it requires write access to the target library", func(t *testing.T) {
+		req := regularUserRequest("POST", fmt.Sprintf("/api/libraries/%d/entries/copy", lib.ID), strings.NewReader(fmt.Sprintf(`{"source": "/folder", "target": "/folder", "targetLibraryId": %d}`, other.ID)))
+		recorder := httptest.NewRecorder()
+		testApp.Router.ServeHTTP(recorder, req)
+		assertStatus(t, recorder, 403)
+		if _, err := os.Stat(filepath.Join(otherDir, "folder")); !os.IsNotExist(err) {
+			t.Errorf("Expected nothing to be copied: %v", err)
+		}
+	})
+}
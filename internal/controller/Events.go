@@ -0,0 +1,125 @@
+package controller
+
+import (
+	"github.com/gin-contrib/sse"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"keydrive/internal/model"
+	"keydrive/internal/service"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const eventHeartbeat = 30 * time.Second
+
+// StreamEvents
+// @Tags Events
+// @Router /api/events [get]
+// @Summary Receive changes to libraries as they happen
+// @Description Sends Server-Sent Events for changes to entries, shares and share links that the user can see.
+// @Description Reconnecting clients can send the Last-Event-ID header to receive the events they missed. A reset event means that events were lost and everything has to be reloaded.
+// @Description Browsers that can not set the Authorization header can pass the access token in the access_token query parameter.
+// @Security OAuth2
+// @Produce text/event-stream
+// @Param lastEventId query int false "The id of the last event that was received, if the Last-Event-ID header can not be used"
+// @Success 200
+func StreamEvents(db *gorm.DB, libs *service.Library, events *service.Events) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		user, _ := GetAuthenticatedUser(c)
+		lastID := int64(-1)
+		lastEventId := c.GetHeader("Last-Event-ID")
+		if lastEventId == "" {
+			lastEventId = c.Query("lastEventId")
+		}
+		if lastEventId != "" {
+			parsed, err := strconv.ParseInt(lastEventId, 10, 64)
+			if err != nil {
+				writeJsonError(c, ApiError{Status: http.StatusBadRequest, Description: "invalid last event id"})
+				return
+			}
+			lastID = parsed
+		}
+
+		access, err := accessibleLibraries(db, libs, user)
+		if err != nil {
+			writeError(c, err)
+			return
+		}
+		missed, complete, stream, unsubscribe := events.SubscribeSince(lastID, 100)
+		defer unsubscribe()
+
+		c.Header("Content-Type", "text/event-stream")
+		c.Header("Cache-Control", "no-cache")
+		c.Header("X-Accel-Buffering", "no")
+		c.Status(http.StatusOK)
+		if !complete {
+			c.Render(-1, sse.Event{Event: "reset", Data: gin.H{}})
+		}
+		for _, event := range missed {
+			if eventVisible(event, user, access) {
+				writeEvent(c, event)
+			}
+		}
+		c.Writer.Flush()
+
+		heartbeat := time.NewTicker(eventHeartbeat)
+		defer heartbeat.Stop()
+		for {
+			select {
+			case <-c.Request.Context().Done():
+				return
+			case <-heartbeat.C:
+				_, _ = c.Writer.WriteString(": heartbeat\n\n")
+				c.Writer.Flush()
+			case event, ok := <-stream:
+				if !ok {
+					// The client did not keep up, so it has to reconnect and resume.
+					return
+				}
+				if event.UserID == user.ID && (event.Type == service.EventLibraryShared || event.Type == service.EventLibraryUnshared) {
+					if access, err = accessibleLibraries(db, libs, user); err != nil {
+						log.Error("failed to refresh library access for user %d: %s", user.ID, err)
+						return
+					}
+				}
+				if eventVisible(event, user, access) {
+					writeEvent(c, event)
+					c.Writer.Flush()
+				}
+			}
+		}
+	}
+}
+
+func writeEvent(c *gin.Context, event service.Event) {
+	c.Render(-1, sse.Event{
+		Id:    strconv.FormatInt(event.ID, 10),
+		Event: string(event.Type),
+		Data:  event,
+	})
+}
+
+func accessibleLibraries(db *gorm.DB, libs *service.Library, user model.User) (map[int]bool, error) {
+	var ids []int
+	if result := libs.GetLibrariesForUser(user, db).Pluck("libraries.id", &ids); result.Error != nil {
+		return nil, result.Error
+	}
+	access := make(map[int]bool, len(ids))
+	for _, id := range ids {
+		access[id] = true
+	}
+	return access, nil
+}
+
+// eventVisible checks if an event should be sent to a user. Events for a single user are only sent to that user, and
+// other events to everyone who can access the library.
+func eventVisible(event service.Event, user model.User, access map[int]bool) bool {
+	if user.IsAdmin {
+		return true
+	}
+	if event.UserID != 0 {
+		return event.UserID == user.ID
+	}
+	return access[event.LibraryID]
+}
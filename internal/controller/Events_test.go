@@ -0,0 +1,92 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"keydrive/internal/model"
+	"keydrive/internal/service"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStreamEvents(t *testing.T) {
+	lib := model.Library{
+		Type:       model.TypeGeneric,
+		Name:       "Streamed Library",
+		RootFolder: t.TempDir(),
+	}
+	testApp.DB.Create(&lib)
+
+	// stream opens the event stream, publishes the events and returns everything that was sent.
+	stream := func(req *http.Request, events ...service.Event) string {
+		ctx, cancel := context.WithCancel(req.Context())
+		recorder := httptest.NewRecorder()
+		done := make(chan struct{})
+		go func() {
+			testApp.Router.ServeHTTP(recorder, req.WithContext(ctx))
+			close(done)
+		}()
+		// Give the handler time to subscribe.
+		time.Sleep(100 * time.Millisecond)
+		for _, event := range events {
+			testApp.Events.Publish(event)
+		}
+		time.Sleep(100 * time.Millisecond)
+		cancel()
+		<-done
+		return recorder.Body.String()
+	}
+
+	t.Run("it sends events to admins", func(t *testing.T) {
+		body := stream(
+			adminRequest("GET", "/api/events", nil),
+			service.Event{Type: service.EventCreated, LibraryID: lib.ID, Path: "/admin.txt"},
+		)
+		if !strings.Contains(body, "event:created") || !strings.Contains(body, "/admin.txt") {
+			t.Errorf("Expected a created event but got: %s", body)
+		}
+	})
+
+	t.Run("it does not send events for libraries the user can not access", func(t *testing.T) {
+		body := stream(
+			regularUserRequest("GET", "/api/events", nil),
+			service.Event{Type: service.EventCreated, LibraryID: lib.ID, Path: "/hidden.txt"},
+		)
+		if strings.Contains(body, "/hidden.txt") {
+			t.Errorf("Expected no events but got: %s", body)
+		}
+	})
+
+	t.Run("it sends events after a library is shared", func(t *testing.T) {
+		body := stream(
+			regularUserRequest("GET", "/api/events", nil),
+			service.Event{Type: service.EventLibraryShared, LibraryID: lib.ID, UserID: regularUser.ID},
+		)
+		if !strings.Contains(body, "event:library-shared") {
+			t.Errorf("Expected a share event but got: %s", body)
+		}
+	})
+
+	t.Run("it resumes from the last event id", func(t *testing.T) {
+		first := testApp.Events.Publish(service.Event{Type: service.EventCreated, LibraryID: lib.ID, Path: "/first.txt"})
+		testApp.Events.Publish(service.Event{Type: service.EventCreated, LibraryID: lib.ID, Path: "/second.txt"})
+
+		req := adminRequest("GET", "/api/events", nil)
+		req.Header.Set("Last-Event-ID", fmt.Sprint(first.ID))
+		body := stream(req)
+		if strings.Contains(body, "/first.txt") || !strings.Contains(body, "/second.txt") {
+			t.Errorf("Expected only the second event but got: %s", body)
+		}
+	})
+
+	t.Run("it accepts the access token in the query", func(t *testing.T) {
+		req, _ := http.NewRequest("GET", "/api/events?access_token="+regularToken, nil)
+		body := stream(req)
+		if strings.Contains(body, "error") {
+			t.Errorf("Expected the stream to open but got: %s", body)
+		}
+	})
+}
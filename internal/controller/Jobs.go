@@ -0,0 +1,156 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"keydrive/internal/model"
+	"keydrive/internal/service"
+	"net/http"
+)
+
+// Types of the jobs that are carried out in the background.
+const (
+	JobBatch      = "batch"
+	JobThumbnails = "thumbnails"
+	JobIndex      = "index"
+)
+
+var errJobLibraryGone = errors.New("the library of the job no longer exists")
+
+type JobPage struct {
+	TotalElements int64       `json:"totalElements"`
+	Elements      []model.Job `json:"elements"`
+}
+
+// acceptJob answers a request that started a job. The Location header points to the job, so its progress can be
+// followed.
+func acceptJob(c *gin.Context, job model.Job) {
+	c.Header("Location", fmt.Sprintf("/api/jobs/%d", job.ID))
+	c.JSON(http.StatusAccepted, job)
+}
+
+// thumbnailsJob generates the thumbnails of all images in a library. Its progress counts the images.
+func thumbnailsJob(thumbnails *service.Thumbnails) service.JobFunc {
+	return func(ctx context.Context, job *service.RunningJob) (interface{}, error) {
+		var request GenerateThumbnailsDTO
+		if err := job.DecodeParams(&request); err != nil {
+			return nil, err
+		}
+		if job.Library == nil {
+			return nil, errJobLibraryGone
+		}
+		count, err := thumbnails.GenerateAll(ctx, *job.Library, request.Sizes, func(count int) {
+			job.Progress(int64(count), 0)
+		})
+		if err != nil {
+			return nil, err
+		}
+		log.Info("generated thumbnails for %d images in library %d", count, job.Library.ID)
+		return ThumbnailsResultDTO{Images: count}, nil
+	}
+}
+
+// indexJob updates the search index of a library.
+func indexJob(index *service.Index) service.JobFunc {
+	return func(ctx context.Context, job *service.RunningJob) (interface{}, error) {
+		if job.Library == nil {
+			return nil, errJobLibraryGone
+		}
+		changed, err := index.ScanLibrary(ctx, *job.Library)
+		if err != nil {
+			return nil, err
+		}
+		return IndexResultDTO{Changed: changed}, nil
+	}
+}
+
+// getAccessToJob loads a job that the authenticated user started. Admins can access all jobs.
+func getAccessToJob(c *gin.Context, jobs *service.Jobs) (model.Job, error) {
+	id, ok := intParam(c, "jobId")
+	if !ok {
+		return model.Job{}, ApiError{Status: http.StatusNotFound}
+	}
+	job, err := jobs.Get(id)
+	if err != nil {
+		return job, err
+	}
+	user, _ := GetAuthenticatedUser(c)
+	if !user.IsAdmin && (job.OwnerID == nil || *job.OwnerID != user.ID) {
+		return job, ApiError{Status: http.StatusNotFound}
+	}
+	return job, nil
+}
+
+// ListJobs
+// @Tags Jobs
+// @Router /api/jobs [get]
+// @Summary List the jobs that the user started, newest first
+// @Description Admins see the jobs of all users.
+// @Security OAuth2
+// @Produce json
+// @Param status query string false "Only list jobs with this status" Enums(queued, running, succeeded, failed, cancelled)
+// @Param page query int false "The page to list"
+// @Param limit query int false "The maximum number of elements on a page"
+// @Success 200 {object} JobPage
+func ListJobs(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		user, _ := GetAuthenticatedUser(c)
+		query := db.Model(&model.Job{}).Order("id desc")
+		if !user.IsAdmin {
+			query = query.Where("owner_id = ?", user.ID)
+		}
+		if status := c.Query("status"); status != "" {
+			query = query.Where("status = ?", status)
+		}
+		var page JobPage
+		returnPage(c, query, &page, &page.TotalElements, &page.Elements)
+	}
+}
+
+// GetJob
+// @Tags Jobs
+// @Router /api/jobs/{jobId} [get]
+// @Summary Get the status, progress and result of a job
+// @Security OAuth2
+// @Produce json
+// @Param jobId path int true "The job id"
+// @Success 200 {object} model.Job
+func GetJob(jobs *service.Jobs) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		job, err := getAccessToJob(c, jobs)
+		if err != nil {
+			writeError(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, job)
+	}
+}
+
+// CancelJob
+// @Tags Jobs
+// @Router /api/jobs/{jobId} [delete]
+// @Summary Cancel a job
+// @Description Queued jobs are cancelled right away. Running jobs stop as soon as they notice, which can take a few seconds, so the returned job may still be running.
+// @Security OAuth2
+// @Produce json
+// @Param jobId path int true "The job id"
+// @Success 200 {object} model.Job
+// @Failure 409 {object} ApiError "The job has already finished"
+func CancelJob(jobs *service.Jobs) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		job, err := getAccessToJob(c, jobs)
+		if err != nil {
+			writeError(c, err)
+			return
+		}
+		job, err = jobs.Cancel(job.ID)
+		if err != nil {
+			writeError(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, job)
+	}
+}
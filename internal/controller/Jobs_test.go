@@ -0,0 +1,79 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"keydrive/internal/model"
+	"keydrive/internal/service"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// waitForJob polls a job as admin until it has finished.
+func waitForJob(t *testing.T, location string) model.Job {
+	var job model.Job
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		recorder := httptest.NewRecorder()
+		testApp.Router.ServeHTTP(recorder, adminRequest("GET", location, nil))
+		assertStatus(t, recorder, 200)
+		assertJsonUnmarshal(t, recorder, &job)
+		if job.Finished() {
+			return job
+		}
+	}
+	t.Fatalf("The job did not finish: %+v", job)
+	return job
+}
+
+func TestJobs(t *testing.T) {
+	started := make(chan struct{}, 1)
+	testApp.Jobs.Register("test-wait", func(ctx context.Context, job *service.RunningJob) (interface{}, error) {
+		started <- struct{}{}
+		<-ctx.Done()
+		return nil, ctx.Err()
+	})
+	job, err := testApp.Jobs.Enqueue("test-wait", &regularUser, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	location := fmt.Sprintf("/api/jobs/%d", job.ID)
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("The job did not start")
+	}
+
+	t.Run("it lists the jobs of the user", func(t *testing.T) {
+		recorder := httptest.NewRecorder()
+		testApp.Router.ServeHTTP(recorder, regularUserRequest("GET", "/api/jobs?status=running", nil))
+		assertStatus(t, recorder, 200)
+		var page JobPage
+		assertJsonUnmarshal(t, recorder, &page)
+		if len(page.Elements) != 1 || page.Elements[0].ID != job.ID {
+			t.Errorf("Unexpected jobs: %+v", page.Elements)
+		}
+	})
+
+	t.Run("it hides jobs of other users", func(t *testing.T) {
+		recorder := httptest.NewRecorder()
+		testApp.Router.ServeHTTP(recorder, noAccessUserRequest("GET", location, nil))
+		assertStatus(t, recorder, 404)
+		recorder = httptest.NewRecorder()
+		testApp.Router.ServeHTTP(recorder, noAccessUserRequest("DELETE", location, nil))
+		assertStatus(t, recorder, 404)
+	})
+
+	t.Run("it cancels running jobs", func(t *testing.T) {
+		recorder := httptest.NewRecorder()
+		testApp.Router.ServeHTTP(recorder, regularUserRequest("DELETE", location, nil))
+		assertStatus(t, recorder, 200)
+		if job := waitForJob(t, location); job.Status != model.JobCancelled {
+			t.Errorf("Expected the job to be cancelled: %+v", job)
+		}
+
+		recorder = httptest.NewRecorder()
+		testApp.Router.ServeHTTP(recorder, regularUserRequest("DELETE", location, nil))
+		assertStatus(t, recorder, 409)
+	})
+}
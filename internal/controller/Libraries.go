@@ -42,9 +42,12 @@ func ListLibraries(db *gorm.DB, libs *service.Library) gin.HandlerFunc {
 }
 
 type CreateLibraryDTO struct {
-	Type       model.LibraryType `json:"type" binding:"oneof='' generic books movies shows music" enums:"generic,books,movies,shows,music"`
-	Name       string            `json:"name"  binding:"required"`
-	RootFolder string            `json:"rootFolder" binding:"required"`
+	Type          model.LibraryType   `json:"type" binding:"oneof='' generic books movies shows music" enums:"generic,books,movies,shows,music"`
+	Name          string              `json:"name"  binding:"required"`
+	RootFolder    string              `json:"rootFolder" binding:"required"`
+	SymlinkPolicy model.SymlinkPolicy `json:"symlinkPolicy" binding:"oneof='' follow hide reject" enums:"follow,hide,reject"`
+	// Quota is the number of bytes the library may take up. 0 means there is no limit.
+	Quota int64 `json:"quota" binding:"min=0"`
 }
 
 // CreateLibrary
@@ -65,6 +68,9 @@ func CreateLibrary(db *gorm.DB) gin.HandlerFunc {
 		if create.Type == "" {
 			create.Type = model.TypeGeneric
 		}
+		if create.SymlinkPolicy == "" {
+			create.SymlinkPolicy = model.SymlinkFollow
+		}
 		cleanFolder := filepath.Clean(create.RootFolder)
 		err := os.MkdirAll(cleanFolder, 0770)
 		if err != nil {
@@ -79,9 +85,11 @@ func CreateLibrary(db *gorm.DB) gin.HandlerFunc {
 			return
 		}
 		newLibrary := model.Library{
-			Type:       create.Type,
-			Name:       create.Name,
-			RootFolder: cleanFolder,
+			Type:          create.Type,
+			Name:          create.Name,
+			RootFolder:    cleanFolder,
+			SymlinkPolicy: create.SymlinkPolicy,
+			Quota:         create.Quota,
 		}
 		if result := db.Save(&newLibrary); result.Error != nil {
 			writeError(c, result.Error)
@@ -92,7 +100,9 @@ func CreateLibrary(db *gorm.DB) gin.HandlerFunc {
 }
 
 type UpdateLibraryDTO struct {
-	Name string `json:"name" binding:""`
+	Name          string              `json:"name" binding:""`
+	SymlinkPolicy model.SymlinkPolicy `json:"symlinkPolicy" binding:"oneof='' follow hide reject" enums:"follow,hide,reject"`
+	Quota         *int64              `json:"quota" binding:"omitempty,min=0"`
 }
 
 // UpdateLibrary
@@ -126,6 +136,12 @@ func UpdateLibrary(db *gorm.DB, libs *service.Library) gin.HandlerFunc {
 			if update.Name != "" {
 				library.Name = update.Name
 			}
+			if update.SymlinkPolicy != "" {
+				library.SymlinkPolicy = update.SymlinkPolicy
+			}
+			if update.Quota != nil {
+				library.Quota = *update.Quota
+			}
 			if result := tx.Save(&library); result.Error != nil {
 				return result.Error
 			}
@@ -228,7 +244,7 @@ type ShareLibraryDTO struct {
 // @Param body body ShareLibraryDTO true "The rights to grant to a specific user"
 // @Param libraryId path int true "The library id"
 // @Success 204
-func ShareLibrary(db *gorm.DB, libs *service.Library, users *service.User) gin.HandlerFunc {
+func ShareLibrary(db *gorm.DB, libs *service.Library, users *service.User, events *service.Events) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		libraryId, ok := intParam(c, "libraryId")
 		if !ok {
@@ -267,6 +283,7 @@ func ShareLibrary(db *gorm.DB, libs *service.Library, users *service.User) gin.H
 			writeError(c, err)
 			return
 		}
+		events.Publish(service.Event{Type: service.EventLibraryShared, LibraryID: libraryId, UserID: targetUser.ID})
 		c.Status(http.StatusNoContent)
 	}
 }
@@ -280,7 +297,7 @@ func ShareLibrary(db *gorm.DB, libs *service.Library, users *service.User) gin.H
 // @Param libraryId path int true "The library id"
 // @Param userId path int true "The user id"
 // @Success 204
-func UnshareLibrary(db *gorm.DB) gin.HandlerFunc {
+func UnshareLibrary(db *gorm.DB, events *service.Events) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		libraryId, ok := intParam(c, "libraryId")
 		if !ok {
@@ -297,6 +314,9 @@ func UnshareLibrary(db *gorm.DB) gin.HandlerFunc {
 			writeError(c, result.Error)
 			return
 		} else {
+			if result.RowsAffected > 0 {
+				events.Publish(service.Event{Type: service.EventLibraryUnshared, LibraryID: libraryId, UserID: userId})
+			}
 			c.Status(http.StatusNoContent)
 		}
 	}
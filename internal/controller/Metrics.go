@@ -0,0 +1,204 @@
+package controller
+
+import (
+	"context"
+	"crypto/subtle"
+	"database/sql"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"io"
+	"keydrive/internal/model"
+	"keydrive/internal/service"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Metrics are the metrics that are recorded while requests are handled. Metrics that are kept elsewhere, like the
+// number of queued jobs, are read from the database when they are scraped.
+type Metrics struct {
+	Registry        *service.Metrics
+	Requests        *service.Counter
+	RequestDuration *service.Histogram
+	UploadBytes     *service.Counter
+	DownloadBytes   *service.Counter
+	ActiveDownloads *service.Gauge
+	TokensIssued    *service.Counter
+	LoginFailures   *service.Counter
+}
+
+func NewMetrics(db *gorm.DB) *Metrics {
+	registry := service.NewMetrics()
+	metrics := &Metrics{
+		Registry:        registry,
+		Requests:        registry.Counter("keydrive_http_requests_total", "The number of handled http requests", "method", "route", "status"),
+		RequestDuration: registry.Histogram("keydrive_http_request_duration_seconds", "The time it took to handle http requests", service.DefaultLatencyBuckets, "method", "route"),
+		UploadBytes:     registry.Counter("keydrive_upload_bytes_total", "The number of bytes received in uploads", "route"),
+		DownloadBytes:   registry.Counter("keydrive_download_bytes_total", "The number of bytes sent in downloads", "route"),
+		ActiveDownloads: registry.Gauge("keydrive_active_downloads", "The number of downloads that are being sent"),
+		TokensIssued:    registry.Counter("keydrive_tokens_issued_total", "The number of issued access tokens, download tokens and app passwords", "type"),
+		LoginFailures:   registry.Counter("keydrive_login_failures_total", "The number of logins with a wrong username or password", "method"),
+	}
+	metrics.ActiveDownloads.Set(0)
+
+	poolStats := func(value func(stats sql.DBStats) float64) service.MetricCollectFunc {
+		return func(ctx context.Context) ([]service.MetricSample, error) {
+			sqlDb, err := db.DB()
+			if err != nil {
+				return nil, err
+			}
+			return []service.MetricSample{{Value: value(sqlDb.Stats())}}, nil
+		}
+	}
+	registry.Collect("keydrive_db_connections_open", "The number of open database connections", service.MetricGauge, nil, poolStats(func(stats sql.DBStats) float64 {
+		return float64(stats.OpenConnections)
+	}))
+	registry.Collect("keydrive_db_connections_in_use", "The number of database connections that are in use", service.MetricGauge, nil, poolStats(func(stats sql.DBStats) float64 {
+		return float64(stats.InUse)
+	}))
+	registry.Collect("keydrive_db_connections_idle", "The number of idle database connections", service.MetricGauge, nil, poolStats(func(stats sql.DBStats) float64 {
+		return float64(stats.Idle)
+	}))
+	registry.Collect("keydrive_db_connections_max", "The maximum number of open database connections, 0 means unlimited", service.MetricGauge, nil, poolStats(func(stats sql.DBStats) float64 {
+		return float64(stats.MaxOpenConnections)
+	}))
+	registry.Collect("keydrive_db_connection_waits_total", "The number of times a query waited for a free database connection", service.MetricCounter, nil, poolStats(func(stats sql.DBStats) float64 {
+		return float64(stats.WaitCount)
+	}))
+	registry.Collect("keydrive_db_connection_wait_seconds_total", "The time spent waiting for free database connections", service.MetricCounter, nil, poolStats(func(stats sql.DBStats) float64 {
+		return stats.WaitDuration.Seconds()
+	}))
+
+	libraryStats := func(value func(files int64, size int64) float64) service.MetricCollectFunc {
+		return func(ctx context.Context) ([]service.MetricSample, error) {
+			var rows []struct {
+				ID    int
+				Name  string
+				Files int64
+				Size  int64
+			}
+			err := db.WithContext(ctx).Raw(`SELECT l.id, l.name, count(e.id) AS files, coalesce(sum(e.size), 0) AS size
+				FROM libraries l LEFT JOIN indexed_entries e ON e.library_id = l.id AND e.category <> ?
+				GROUP BY l.id, l.name`, model.CategoryFolder).Scan(&rows).Error
+			samples := make([]service.MetricSample, len(rows))
+			for i, row := range rows {
+				samples[i] = service.MetricSample{LabelValues: []string{strconv.Itoa(row.ID), row.Name}, Value: value(row.Files, row.Size)}
+			}
+			return samples, err
+		}
+	}
+	registry.Collect("keydrive_library_files", "The number of files in a library, according to the search index", service.MetricGauge, []string{"library_id", "library"}, libraryStats(func(files int64, size int64) float64 {
+		return float64(files)
+	}))
+	registry.Collect("keydrive_library_size_bytes", "The size of the files in a library, according to the search index", service.MetricGauge, []string{"library_id", "library"}, libraryStats(func(files int64, size int64) float64 {
+		return float64(size)
+	}))
+
+	registry.Collect("keydrive_jobs", "The number of background jobs that are queued or running", service.MetricGauge, []string{"type", "status"}, func(ctx context.Context) ([]service.MetricSample, error) {
+		var rows []struct {
+			Type   string
+			Status string
+			Count  int64
+		}
+		err := db.WithContext(ctx).Model(&model.Job{}).
+			Select("type, status, count(*) AS count").
+			Where("status IN ?", []model.JobStatus{model.JobQueued, model.JobRunning}).
+			Group("type, status").
+			Scan(&rows).Error
+		samples := make([]service.MetricSample, len(rows))
+		for i, row := range rows {
+			samples[i] = service.MetricSample{LabelValues: []string{row.Type, row.Status}, Value: float64(row.Count)}
+		}
+		return samples, err
+	})
+	return metrics
+}
+
+// RecordRequests counts requests and how long they took per route. Requests that do not match a route, like those for
+// the web app, are counted as the route "other".
+func RecordRequests(metrics *Metrics) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+		method, route := c.Request.Method, c.FullPath()
+		if route == "" {
+			method, route = "other", "other"
+		}
+		metrics.Requests.Inc(method, route, strconv.Itoa(c.Writer.Status()))
+		metrics.RequestDuration.Observe(time.Since(start).Seconds(), method, route)
+	}
+}
+
+// TrackUploads counts the bytes that are read from the body of requests that upload files.
+func TrackUploads(metrics *Metrics) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		body := &countingReader{ReadCloser: c.Request.Body}
+		c.Request.Body = body
+		c.Next()
+		metrics.UploadBytes.Add(float64(body.count), c.FullPath())
+	}
+}
+
+// TrackDownloads counts the downloads that are being sent, and the bytes that were sent.
+func TrackDownloads(metrics *Metrics) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		metrics.ActiveDownloads.Inc()
+		defer metrics.ActiveDownloads.Dec()
+		c.Next()
+		if size := c.Writer.Size(); size > 0 {
+			metrics.DownloadBytes.Add(float64(size), c.FullPath())
+		}
+	}
+}
+
+// CountIssuedTokens counts the tokens that were issued by a handler, which are all responses that are not errors.
+func CountIssuedTokens(metrics *Metrics, tokenType string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Next()
+		if c.Writer.Status() < http.StatusBadRequest {
+			metrics.TokensIssued.Inc(tokenType)
+		}
+	}
+}
+
+// MetricsController
+// @Tags System
+// @Router /metrics [get]
+// @Summary Get metrics in the text format of Prometheus
+// @Description If a metrics token is configured, it has to be sent as a bearer token. The metrics can also be served on a separate address, which is not reachable from outside.
+// @Produce plain
+// @Success 200 {string} string
+// @Failure 401 {object} ApiError
+func MetricsController(metrics *Metrics, token string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if token != "" {
+			authHeader := c.GetHeader("authorization")
+			if !strings.HasPrefix(strings.ToLower(authHeader), "bearer ") ||
+				subtle.ConstantTimeCompare([]byte(authHeader[len("bearer "):]), []byte(token)) != 1 {
+				c.Header("WWW-Authenticate", `Bearer realm="metrics"`)
+				c.AbortWithStatusJSON(
+					http.StatusUnauthorized,
+					ApiError{Status: http.StatusUnauthorized},
+				)
+				return
+			}
+		}
+		c.Header("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		c.Status(http.StatusOK)
+		if err := metrics.Registry.WriteText(c.Request.Context(), c.Writer); err != nil {
+			log.Warn("failed to write metrics: %s", err)
+		}
+	}
+}
+
+type countingReader struct {
+	io.ReadCloser
+	count int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.count += int64(n)
+	return n, err
+}
@@ -0,0 +1,94 @@
+package controller
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"keydrive/internal/model"
+	"mime/multipart"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMetrics(t *testing.T) {
+	lib := model.Library{
+		Type:       model.TypeGeneric,
+		Name:       "Metrics Library",
+		RootFolder: t.TempDir(),
+	}
+	testApp.DB.Create(&lib)
+
+	scrape := func(t *testing.T) string {
+		recorder := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/metrics", nil)
+		req.Header.Set("Authorization", "Bearer "+testMetricsToken)
+		testApp.Router.ServeHTTP(recorder, req)
+		assertStatus(t, recorder, 200)
+		return recorder.Body.String()
+	}
+
+	t.Run("it counts requests and uploads", func(t *testing.T) {
+		body := &bytes.Buffer{}
+		writer := multipart.NewWriter(body)
+		part, _ := writer.CreateFormFile("data", "metrics.txt")
+		_, _ = part.Write([]byte("some metrics"))
+		_ = writer.Close()
+		req := adminRequest("POST", fmt.Sprintf("/api/libraries/%d/entries", lib.ID), body)
+		req.Header.Set("Content-Type", writer.FormDataContentType())
+		recorder := httptest.NewRecorder()
+		testApp.Router.ServeHTTP(recorder, req)
+		assertStatus(t, recorder, 201)
+
+		metrics := scrape(t)
+		for _, expected := range []string{
+			`keydrive_http_requests_total{method="POST",route="/api/libraries/:libraryId/entries",status="201"}`,
+			`keydrive_http_request_duration_seconds_bucket{method="POST",route="/api/libraries/:libraryId/entries",le="+Inf"}`,
+			`keydrive_upload_bytes_total{route="/api/libraries/:libraryId/entries"}`,
+			"keydrive_active_downloads 0",
+			"keydrive_db_connections_open",
+		} {
+			if !strings.Contains(metrics, expected) {
+				t.Errorf("Expected %s in:\n%s", expected, metrics)
+			}
+		}
+	})
+
+	t.Run("it reports the files in libraries", func(t *testing.T) {
+		if _, err := testApp.Index.ScanLibrary(context.Background(), lib); err != nil {
+			t.Fatal(err)
+		}
+		expected := fmt.Sprintf(`keydrive_library_files{library_id="%d",library="Metrics Library"} 1`, lib.ID)
+		if metrics := scrape(t); !strings.Contains(metrics, expected) {
+			t.Errorf("Expected %s in:\n%s", expected, metrics)
+		}
+	})
+
+	t.Run("it counts login failures", func(t *testing.T) {
+		recorder := httptest.NewRecorder()
+		req := httptest.NewRequest("POST", "/oauth2/token", strings.NewReader("client_id=web&grant_type=password&username=admin&password=wrong"))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		testApp.Router.ServeHTTP(recorder, req)
+		assertStatus(t, recorder, 400)
+
+		if metrics := scrape(t); !strings.Contains(metrics, `keydrive_login_failures_total{method="password"}`) {
+			t.Errorf("Expected a login failure in:\n%s", metrics)
+		}
+	})
+
+	t.Run("it requires the metrics token if there is one", func(t *testing.T) {
+		router := gin.New()
+		router.GET("/metrics", MetricsController(testApp.Metrics, "secret"))
+
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+		assertStatus(t, recorder, 401)
+
+		recorder = httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/metrics", nil)
+		req.Header.Set("Authorization", "Bearer secret")
+		router.ServeHTTP(recorder, req)
+		assertStatus(t, recorder, 200)
+	})
+}
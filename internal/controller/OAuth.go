@@ -1,6 +1,7 @@
 package controller
 
 import (
+	"fmt"
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
 	"keydrive/internal/model"
@@ -35,6 +36,55 @@ func Authenticate(tokens *service.Token) gin.HandlerFunc {
 	}
 }
 
+// AuthenticateQuery reads the access token from the access_token query parameter, for clients that can not set
+// headers, like EventSource in browsers. Routes that use it have to list the parameter in secretQueryParams, so the
+// token is not written to the request log.
+func AuthenticateQuery(tokens *service.Token) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if _, found := GetAuthenticatedUser(c); !found {
+			if accessToken := c.Query("access_token"); accessToken != "" {
+				if token, foundToken := tokens.GetToken(c, accessToken); foundToken {
+					c.Set(ContextKeyClient, token.GetClient())
+					c.Set(ContextKeyUser, token.User)
+				}
+			}
+		}
+		c.Next()
+	}
+}
+
+// AuthenticateBasic reads the username and password or app password from the Authorization header, for apps that can
+// not use OAuth2.
+func AuthenticateBasic(appPasswords *service.AppPasswords, metrics *Metrics) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if _, found := GetAuthenticatedUser(c); !found {
+			if username, password, ok := c.Request.BasicAuth(); ok {
+				if user, ok := appPasswords.Authenticate(username, password); ok {
+					c.Set(ContextKeyUser, user)
+				} else {
+					metrics.LoginFailures.Inc("basic")
+				}
+			}
+		}
+		c.Next()
+	}
+}
+
+// RequireBasicAuthentication asks apps for a username and password if they are not authenticated.
+func RequireBasicAuthentication(realm string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if _, found := GetAuthenticatedUser(c); !found {
+			c.Header("WWW-Authenticate", fmt.Sprintf("Basic realm=%q, charset=\"UTF-8\"", realm))
+			c.AbortWithStatusJSON(
+				http.StatusUnauthorized,
+				ApiError{Status: http.StatusUnauthorized},
+			)
+			return
+		}
+		c.Next()
+	}
+}
+
 func RequireAuthentication() gin.HandlerFunc {
 	return func(c *gin.Context) {
 		_, found := GetAuthenticatedUser(c)
@@ -63,7 +113,7 @@ func RequireAdmin() gin.HandlerFunc {
 	}
 }
 
-func Token(users *service.User, clients *model.ClientDetailsService, tokens *service.Token, passwordEncoder *service.BcryptEncoder) gin.HandlerFunc {
+func Token(users *service.User, clients *model.ClientDetailsService, tokens *service.Token, passwordEncoder *service.BcryptEncoder, metrics *Metrics) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		clientId := c.PostForm("client_id")
 		grantType := c.PostForm("grant_type")
@@ -139,6 +189,7 @@ func Token(users *service.User, clients *model.ClientDetailsService, tokens *ser
 
 		user, foundUser := users.GetUser(username)
 		if !foundUser {
+			metrics.LoginFailures.Inc("password")
 			c.JSON(
 				http.StatusBadRequest,
 				TokenError{
@@ -149,6 +200,7 @@ func Token(users *service.User, clients *model.ClientDetailsService, tokens *ser
 			return
 		}
 		if !passwordEncoder.Compare(password, user.GetHashedPassword()) {
+			metrics.LoginFailures.Inc("password")
 			c.JSON(
 				http.StatusBadRequest,
 				TokenError{
@@ -0,0 +1,511 @@
+package controller
+
+import (
+	"encoding/xml"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"keydrive/internal/model"
+	"keydrive/internal/service"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// opdsPageSize is the number of entries in a page of a catalog.
+const opdsPageSize = 50
+
+// getAccessToBookLib checks the access to a library like getAccessToLib, and only allows libraries of books.
+func getAccessToBookLib(c *gin.Context, libs *service.Library, tx *gorm.DB) (model.Library, error) {
+	library, err := getAccessToLib(c, libs, false, tx)
+	if err != nil {
+		return library, err
+	}
+	if library.Type != model.TypeBooks {
+		return library, ApiError{Status: http.StatusNotFound}
+	}
+	return library, nil
+}
+
+func (v OpdsVersion) libraryPath(library model.Library, parts ...string) string {
+	return fmt.Sprintf("%s/libraries/%d%s", v.Path, library.ID, strings.Join(parts, ""))
+}
+
+func opdsPage(c *gin.Context) int {
+	page, err := strconv.Atoi(c.DefaultQuery("page", "1"))
+	if err != nil || page < 1 {
+		return 1
+	}
+	return page
+}
+
+// opdsNextPage returns the url of the page after the current one.
+func opdsNextPage(c *gin.Context, page int) string {
+	query := c.Request.URL.Query()
+	query.Set("page", strconv.Itoa(page+1))
+	return c.Request.URL.Path + "?" + query.Encode()
+}
+
+// bookPublication describes a book for a catalog. Books are downloaded and their covers are read through the routes
+// that are shared by all versions.
+func bookPublication(library model.Library, entryPath string, mimeType string, size int64, modified time.Time, metadata *model.Metadata) opdsPublication {
+	query := "?path=" + url.QueryEscape(entryPath)
+	publication := opdsPublication{
+		ID:       fmt.Sprintf("urn:keydrive:library:%d:%s", library.ID, entryPath),
+		Title:    strings.TrimSuffix(path.Base(entryPath), path.Ext(entryPath)),
+		Updated:  modified,
+		MimeType: mimeType,
+		Size:     size,
+		Download: fmt.Sprintf("/opds/libraries/%d/download%s", library.ID, query),
+	}
+	if metadata != nil {
+		if metadata.Title != "" {
+			publication.Title = metadata.Title
+		}
+		publication.Authors = metadata.Authors
+		publication.Language = metadata.Language
+		publication.Publisher = metadata.Publisher
+		publication.Description = metadata.Description
+		publication.Year = metadata.Year
+		publication.Series = metadata.Series
+		publication.SeriesIndex = metadata.SeriesIndex
+		if metadata.HasCover {
+			publication.Cover = fmt.Sprintf("/opds/libraries/%d/cover%s", library.ID, query)
+		}
+	}
+	return publication
+}
+
+// writeBookPage sends a page of books from the index.
+func writeBookPage(c *gin.Context, version OpdsVersion, feed opdsFeed, query *gorm.DB, library model.Library) {
+	page := opdsPage(c)
+	var entries []model.IndexedEntry
+	if result := query.Offset((page - 1) * opdsPageSize).Limit(opdsPageSize + 1).Find(&entries); result.Error != nil {
+		writeError(c, result.Error)
+		return
+	}
+	if len(entries) > opdsPageSize {
+		entries = entries[:opdsPageSize]
+		feed.Next = opdsNextPage(c, page)
+	}
+	for _, entry := range entries {
+		feed.Publications = append(feed.Publications, bookPublication(library, entry.Path, entry.MimeType, entry.Size, entry.Modified, entry.Metadata))
+	}
+	feed.Self = c.Request.URL.RequestURI()
+	feed.Updated = time.Now()
+	feed.Search = version.libraryPath(library, "/search")
+	feed.OpenSearch = version.libraryPath(library, "/opensearch.xml")
+	version.write(c, feed)
+}
+
+// writeBookGroupPage sends a page of authors or series, which link to the books in them.
+func writeBookGroupPage(c *gin.Context, version OpdsVersion, feed opdsFeed, query *gorm.DB, library model.Library, booksPath string) {
+	page := opdsPage(c)
+	var groups []service.BookGroup
+	if result := query.Offset((page - 1) * opdsPageSize).Limit(opdsPageSize + 1).Scan(&groups); result.Error != nil {
+		writeError(c, result.Error)
+		return
+	}
+	if len(groups) > opdsPageSize {
+		groups = groups[:opdsPageSize]
+		feed.Next = opdsNextPage(c, page)
+	}
+	for _, group := range groups {
+		feed.Navigation = append(feed.Navigation, opdsNavigation{
+			ID:          fmt.Sprintf("%s:%s", feed.ID, group.Name),
+			Title:       group.Name,
+			Href:        version.libraryPath(library, booksPath, "?name=", url.QueryEscape(group.Name)),
+			Acquisition: true,
+			Count:       group.Books,
+		})
+	}
+	feed.Self = c.Request.URL.RequestURI()
+	feed.Updated = time.Now()
+	feed.Up = version.libraryPath(library)
+	feed.Search = version.libraryPath(library, "/search")
+	feed.OpenSearch = version.libraryPath(library, "/opensearch.xml")
+	version.write(c, feed)
+}
+
+// OpdsCatalog
+// @Tags OPDS
+// @Router /opds/{version} [get]
+// @Summary List the book libraries of the user in an OPDS catalog
+// @Description E-readers can sign in with the username and the password of the user, or with an app password.
+// @Security BasicAuth
+// @Produce application/atom+xml
+// @Produce application/opds+json
+// @Param version path string true "The version of OPDS" Enums(v1.2, v2)
+// @Success 200
+func OpdsCatalog(db *gorm.DB, libs *service.Library, version OpdsVersion) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		user, _ := GetAuthenticatedUser(c)
+		var libraries []model.Library
+		if result := libs.GetLibrariesForUser(user, db).Where("type = ?", model.TypeBooks).Order("name").Find(&libraries); result.Error != nil {
+			writeError(c, result.Error)
+			return
+		}
+		feed := opdsFeed{
+			ID:      "urn:keydrive:catalog",
+			Title:   "KeyDrive",
+			Updated: time.Now(),
+			Self:    version.Path,
+		}
+		for _, library := range libraries {
+			feed.Navigation = append(feed.Navigation, opdsNavigation{
+				ID:    fmt.Sprintf("urn:keydrive:library:%d", library.ID),
+				Title: library.Name,
+				Href:  version.libraryPath(library),
+			})
+		}
+		version.write(c, feed)
+	}
+}
+
+// OpdsLibrary
+// @Tags OPDS
+// @Router /opds/{version}/libraries/{libraryId} [get]
+// @Summary Browse a library of books by folder, author or series
+// @Security BasicAuth
+// @Produce application/atom+xml
+// @Produce application/opds+json
+// @Param version path string true "The version of OPDS" Enums(v1.2, v2)
+// @Param libraryId path int true "The library id"
+// @Success 200
+func OpdsLibrary(db *gorm.DB, libs *service.Library, version OpdsVersion) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		library, err := getAccessToBookLib(c, libs, db)
+		if err != nil {
+			writeError(c, err)
+			return
+		}
+		id := fmt.Sprintf("urn:keydrive:library:%d", library.ID)
+		feed := opdsFeed{
+			ID:         id,
+			Title:      library.Name,
+			Updated:    time.Now(),
+			Self:       version.libraryPath(library),
+			Up:         version.Path,
+			Search:     version.libraryPath(library, "/search"),
+			OpenSearch: version.libraryPath(library, "/opensearch.xml"),
+			Navigation: []opdsNavigation{
+				{ID: id + ":folders", Title: "Folders", Href: version.libraryPath(library, "/folder?path=%2F"), Acquisition: true},
+				{ID: id + ":authors", Title: "Authors", Href: version.libraryPath(library, "/authors")},
+				{ID: id + ":series", Title: "Series", Href: version.libraryPath(library, "/series")},
+				{ID: id + ":recent", Title: "Recently added", Href: version.libraryPath(library, "/recent"), Acquisition: true},
+			},
+		}
+		version.write(c, feed)
+	}
+}
+
+// OpdsFolder
+// @Tags OPDS
+// @Router /opds/{version}/libraries/{libraryId}/folder [get]
+// @Summary List the books and the folders in a folder
+// @Security BasicAuth
+// @Produce application/atom+xml
+// @Produce application/opds+json
+// @Param version path string true "The version of OPDS" Enums(v1.2, v2)
+// @Param libraryId path int true "The library id"
+// @Param path query string false "The url encoded path of the folder" default(/)
+// @Success 200
+func OpdsFolder(db *gorm.DB, libs *service.Library, fs *service.FileSystem, index *service.Index, version OpdsVersion) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		library, err := getAccessToBookLib(c, libs, db)
+		if err != nil {
+			writeError(c, err)
+			return
+		}
+		folder := path.Clean("/" + c.DefaultQuery("path", "/"))
+		entries, err := fs.GetEntriesForLibrary(library, folder)
+		if err != nil {
+			writeError(c, err)
+			return
+		}
+		if err := index.AddMetadata(library, entries); err != nil {
+			writeError(c, err)
+			return
+		}
+
+		feed := opdsFeed{
+			ID:         fmt.Sprintf("urn:keydrive:library:%d:folder:%s", library.ID, folder),
+			Title:      library.Name,
+			Updated:    time.Now(),
+			Self:       c.Request.URL.RequestURI(),
+			Up:         version.libraryPath(library),
+			Search:     version.libraryPath(library, "/search"),
+			OpenSearch: version.libraryPath(library, "/opensearch.xml"),
+		}
+		if folder != "/" {
+			feed.Title = path.Base(folder)
+			feed.Up = version.libraryPath(library, "/folder?path=", url.QueryEscape(path.Dir(folder)))
+		}
+		for _, entry := range entries {
+			entryPath := path.Join(entry.Parent, entry.Name)
+			if entry.Category == model.CategoryFolder {
+				feed.Navigation = append(feed.Navigation, opdsNavigation{
+					ID:          fmt.Sprintf("urn:keydrive:library:%d:folder:%s", library.ID, entryPath),
+					Title:       entry.Name,
+					Href:        version.libraryPath(library, "/folder?path=", url.QueryEscape(entryPath)),
+					Acquisition: true,
+				})
+				continue
+			}
+			for _, mimeType := range service.BookMimeTypes {
+				if entry.MimeType == mimeType {
+					feed.Publications = append(feed.Publications, bookPublication(library, entryPath, entry.MimeType, entry.Size, entry.Modified, entry.Metadata))
+					break
+				}
+			}
+		}
+		version.write(c, feed)
+	}
+}
+
+// OpdsAuthors
+// @Tags OPDS
+// @Router /opds/{version}/libraries/{libraryId}/authors [get]
+// @Summary List the authors of the books in a library
+// @Security BasicAuth
+// @Produce application/atom+xml
+// @Produce application/opds+json
+// @Param version path string true "The version of OPDS" Enums(v1.2, v2)
+// @Param libraryId path int true "The library id"
+// @Param page query int false "The page number to fetch" default(1)
+// @Success 200
+func OpdsAuthors(db *gorm.DB, libs *service.Library, index *service.Index, version OpdsVersion) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		library, err := getAccessToBookLib(c, libs, db)
+		if err != nil {
+			writeError(c, err)
+			return
+		}
+		feed := opdsFeed{
+			ID:    fmt.Sprintf("urn:keydrive:library:%d:authors", library.ID),
+			Title: "Authors",
+		}
+		writeBookGroupPage(c, version, feed, index.GetBookAuthors(library, db), library, "/authors/books")
+	}
+}
+
+// OpdsAuthorBooks
+// @Tags OPDS
+// @Router /opds/{version}/libraries/{libraryId}/authors/books [get]
+// @Summary List the books of an author
+// @Security BasicAuth
+// @Produce application/atom+xml
+// @Produce application/opds+json
+// @Param version path string true "The version of OPDS" Enums(v1.2, v2)
+// @Param libraryId path int true "The library id"
+// @Param name query string true "The name of the author"
+// @Param page query int false "The page number to fetch" default(1)
+// @Success 200
+func OpdsAuthorBooks(db *gorm.DB, libs *service.Library, index *service.Index, version OpdsVersion) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		library, err := getAccessToBookLib(c, libs, db)
+		if err != nil {
+			writeError(c, err)
+			return
+		}
+		name := c.Query("name")
+		if name == "" {
+			writeError(c, ApiError{Status: http.StatusBadRequest, Description: "no name query parameter given"})
+			return
+		}
+		feed := opdsFeed{
+			ID:    fmt.Sprintf("urn:keydrive:library:%d:authors:%s", library.ID, name),
+			Title: name,
+			Up:    version.libraryPath(library, "/authors"),
+		}
+		writeBookPage(c, version, feed, index.GetBooksByAuthor(library, name, db), library)
+	}
+}
+
+// OpdsSeries
+// @Tags OPDS
+// @Router /opds/{version}/libraries/{libraryId}/series [get]
+// @Summary List the series of the books in a library
+// @Security BasicAuth
+// @Produce application/atom+xml
+// @Produce application/opds+json
+// @Param version path string true "The version of OPDS" Enums(v1.2, v2)
+// @Param libraryId path int true "The library id"
+// @Param page query int false "The page number to fetch" default(1)
+// @Success 200
+func OpdsSeries(db *gorm.DB, libs *service.Library, index *service.Index, version OpdsVersion) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		library, err := getAccessToBookLib(c, libs, db)
+		if err != nil {
+			writeError(c, err)
+			return
+		}
+		feed := opdsFeed{
+			ID:    fmt.Sprintf("urn:keydrive:library:%d:series", library.ID),
+			Title: "Series",
+		}
+		writeBookGroupPage(c, version, feed, index.GetBookSeries(library, db), library, "/series/books")
+	}
+}
+
+// OpdsSeriesBooks
+// @Tags OPDS
+// @Router /opds/{version}/libraries/{libraryId}/series/books [get]
+// @Summary List the books in a series, in the order of the series
+// @Security BasicAuth
+// @Produce application/atom+xml
+// @Produce application/opds+json
+// @Param version path string true "The version of OPDS" Enums(v1.2, v2)
+// @Param libraryId path int true "The library id"
+// @Param name query string true "The name of the series"
+// @Param page query int false "The page number to fetch" default(1)
+// @Success 200
+func OpdsSeriesBooks(db *gorm.DB, libs *service.Library, index *service.Index, version OpdsVersion) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		library, err := getAccessToBookLib(c, libs, db)
+		if err != nil {
+			writeError(c, err)
+			return
+		}
+		name := c.Query("name")
+		if name == "" {
+			writeError(c, ApiError{Status: http.StatusBadRequest, Description: "no name query parameter given"})
+			return
+		}
+		feed := opdsFeed{
+			ID:    fmt.Sprintf("urn:keydrive:library:%d:series:%s", library.ID, name),
+			Title: name,
+			Up:    version.libraryPath(library, "/series"),
+		}
+		writeBookPage(c, version, feed, index.GetBooksInSeries(library, name, db), library)
+	}
+}
+
+// OpdsRecent
+// @Tags OPDS
+// @Router /opds/{version}/libraries/{libraryId}/recent [get]
+// @Summary List the books in a library, the most recently changed first
+// @Security BasicAuth
+// @Produce application/atom+xml
+// @Produce application/opds+json
+// @Param version path string true "The version of OPDS" Enums(v1.2, v2)
+// @Param libraryId path int true "The library id"
+// @Param page query int false "The page number to fetch" default(1)
+// @Success 200
+func OpdsRecent(db *gorm.DB, libs *service.Library, index *service.Index, version OpdsVersion) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		library, err := getAccessToBookLib(c, libs, db)
+		if err != nil {
+			writeError(c, err)
+			return
+		}
+		feed := opdsFeed{
+			ID:    fmt.Sprintf("urn:keydrive:library:%d:recent", library.ID),
+			Title: "Recently added",
+			Up:    version.libraryPath(library),
+		}
+		writeBookPage(c, version, feed, index.GetBooks(library, db).Order("modified desc, path"), library)
+	}
+}
+
+// OpdsSearch
+// @Tags OPDS
+// @Router /opds/{version}/libraries/{libraryId}/search [get]
+// @Summary Search for books by title, author, series or file name
+// @Security BasicAuth
+// @Produce application/atom+xml
+// @Produce application/opds+json
+// @Param version path string true "The version of OPDS" Enums(v1.2, v2)
+// @Param libraryId path int true "The library id"
+// @Param q query string true "The text to search for"
+// @Param page query int false "The page number to fetch" default(1)
+// @Success 200
+func OpdsSearch(db *gorm.DB, libs *service.Library, index *service.Index, version OpdsVersion) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		library, err := getAccessToBookLib(c, libs, db)
+		if err != nil {
+			writeError(c, err)
+			return
+		}
+		query := c.Query("q")
+		feed := opdsFeed{
+			ID:    fmt.Sprintf("urn:keydrive:library:%d:search:%s", library.ID, query),
+			Title: fmt.Sprintf("Search results for %q", query),
+			Up:    version.libraryPath(library),
+		}
+		writeBookPage(c, version, feed, index.SearchBooks(library, query, db), library)
+	}
+}
+
+type openSearchDescription struct {
+	XMLName     xml.Name `xml:"http://a9.com/-/spec/opensearch/1.1/ OpenSearchDescription"`
+	ShortName   string   `xml:"ShortName"`
+	Description string   `xml:"Description"`
+	Url         struct {
+		Type     string `xml:"type,attr"`
+		Template string `xml:"template,attr"`
+	} `xml:"Url"`
+}
+
+// OpdsOpenSearch
+// @Tags OPDS
+// @Router /opds/{version}/libraries/{libraryId}/opensearch.xml [get]
+// @Summary Describe how a library of books is searched
+// @Security BasicAuth
+// @Produce application/opensearchdescription+xml
+// @Param version path string true "The version of OPDS" Enums(v1.2, v2)
+// @Param libraryId path int true "The library id"
+// @Success 200
+func OpdsOpenSearch(db *gorm.DB, libs *service.Library, version OpdsVersion) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		library, err := getAccessToBookLib(c, libs, db)
+		if err != nil {
+			writeError(c, err)
+			return
+		}
+		description := openSearchDescription{
+			ShortName:   library.Name,
+			Description: fmt.Sprintf("Search the books in %s", library.Name),
+		}
+		description.Url.Type = version.acquisitionType
+		description.Url.Template = version.libraryPath(library, "/search?q={searchTerms}")
+		data, err := xml.Marshal(description)
+		if err != nil {
+			writeError(c, err)
+			return
+		}
+		c.Data(http.StatusOK, openSearchType, append([]byte(xml.Header), data...))
+	}
+}
+
+// OpdsDownload
+// @Tags OPDS
+// @Router /opds/libraries/{libraryId}/download [get]
+// @Summary Download a book
+// @Description Redirects to a download with a new download token, so e-readers can download books without sending their password again.
+// @Security BasicAuth
+// @Param libraryId path int true "The library id"
+// @Param path query string true "The url encoded path"
+// @Success 302
+func OpdsDownload(db *gorm.DB, libs *service.Library, tokens *service.DownloadTokens) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if _, err := getAccessToBookLib(c, libs, db); err != nil {
+			writeError(c, err)
+			return
+		}
+		library, entryPath, err := resolvePath(c, libs, db, false)
+		if err != nil {
+			writeError(c, err)
+			return
+		}
+		token, err := tokens.GenerateDownloadToken(library, entryPath)
+		if err != nil {
+			writeError(c, err)
+			return
+		}
+		c.Redirect(http.StatusFound, "/api/download?token="+url.QueryEscape(token.Token))
+	}
+}
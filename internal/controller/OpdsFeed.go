@@ -0,0 +1,309 @@
+package controller
+
+import (
+	"encoding/xml"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const opdsNavigationType = "application/atom+xml;profile=opds-catalog;kind=navigation"
+const opdsAcquisitionType = "application/atom+xml;profile=opds-catalog;kind=acquisition"
+const opds2Type = "application/opds+json"
+const openSearchType = "application/opensearchdescription+xml"
+
+// OpdsVersion is a version of the OPDS catalog. Both versions serve the same catalog, in a different format.
+type OpdsVersion struct {
+	Name string
+	// Path is where the catalog is served.
+	Path string
+	// acquisitionType is the content type of feeds with books.
+	acquisitionType string
+	write           func(c *gin.Context, feed opdsFeed)
+}
+
+// Opds1 serves catalogs as OPDS 1.2 Atom feeds, which almost every e-reader understands.
+var Opds1 = OpdsVersion{Name: "v1.2", Path: "/opds/v1.2", acquisitionType: opdsAcquisitionType, write: writeAtomFeed}
+
+// Opds2 serves catalogs as OPDS 2.0 JSON documents.
+var Opds2 = OpdsVersion{Name: "v2", Path: "/opds/v2", acquisitionType: opds2Type, write: writeOpds2Feed}
+
+// opdsFeed is a catalog page, independent of the format in which it is sent.
+type opdsFeed struct {
+	ID      string
+	Title   string
+	Updated time.Time
+	Self    string
+	Up      string
+	Next    string
+	// Search is the url of the search endpoint of the library, if the feed belongs to one.
+	Search       string
+	OpenSearch   string
+	Navigation   []opdsNavigation
+	Publications []opdsPublication
+}
+
+type opdsNavigation struct {
+	ID    string
+	Title string
+	Href  string
+	// Acquisition is true if the link leads to a feed of books.
+	Acquisition bool
+	// Count is the number of books behind the link, if it is known.
+	Count int
+}
+
+type opdsPublication struct {
+	ID          string
+	Title       string
+	Authors     []string
+	Language    string
+	Publisher   string
+	Description string
+	Year        int
+	Series      string
+	SeriesIndex float64
+	Updated     time.Time
+	MimeType    string
+	Size        int64
+	Download    string
+	Cover       string
+}
+
+func (f opdsFeed) isAcquisition() bool {
+	return len(f.Publications) > 0 || len(f.Navigation) == 0
+}
+
+type atomFeed struct {
+	XMLName   xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	XmlnsDC   string      `xml:"xmlns:dc,attr"`
+	XmlnsOpds string      `xml:"xmlns:opds,attr"`
+	XmlnsThr  string      `xml:"xmlns:thr,attr"`
+	ID        string      `xml:"id"`
+	Title     string      `xml:"title"`
+	Updated   string      `xml:"updated"`
+	Links     []atomLink  `xml:"link"`
+	Entries   []atomEntry `xml:"entry"`
+}
+
+type atomLink struct {
+	Rel   string `xml:"rel,attr,omitempty"`
+	Href  string `xml:"href,attr"`
+	Type  string `xml:"type,attr,omitempty"`
+	Title string `xml:"title,attr,omitempty"`
+	Count int    `xml:"thr:count,attr,omitempty"`
+	Size  int64  `xml:"length,attr,omitempty"`
+}
+
+type atomAuthor struct {
+	Name string `xml:"name"`
+}
+
+type atomText struct {
+	Type  string `xml:"type,attr"`
+	Value string `xml:",chardata"`
+}
+
+type atomEntry struct {
+	ID        string       `xml:"id"`
+	Title     string       `xml:"title"`
+	Updated   string       `xml:"updated"`
+	Authors   []atomAuthor `xml:"author"`
+	Language  string       `xml:"dc:language,omitempty"`
+	Publisher string       `xml:"dc:publisher,omitempty"`
+	Issued    string       `xml:"dc:issued,omitempty"`
+	Summary   *atomText    `xml:"summary"`
+	Content   *atomText    `xml:"content"`
+	Links     []atomLink   `xml:"link"`
+}
+
+func writeAtomFeed(c *gin.Context, feed opdsFeed) {
+	feedType := opdsNavigationType
+	if feed.isAcquisition() {
+		feedType = opdsAcquisitionType
+	}
+	atom := atomFeed{
+		XmlnsDC:   "http://purl.org/dc/terms/",
+		XmlnsOpds: "http://opds-spec.org/2010/catalog",
+		XmlnsThr:  "http://purl.org/syndication/thread/1.0",
+		ID:        feed.ID,
+		Title:     feed.Title,
+		Updated:   feed.Updated.UTC().Format(time.RFC3339),
+		Links: []atomLink{
+			{Rel: "self", Href: feed.Self, Type: feedType},
+			{Rel: "start", Href: "/opds/v1.2", Type: opdsNavigationType},
+		},
+	}
+	if feed.Up != "" {
+		atom.Links = append(atom.Links, atomLink{Rel: "up", Href: feed.Up, Type: opdsNavigationType})
+	}
+	if feed.Next != "" {
+		atom.Links = append(atom.Links, atomLink{Rel: "next", Href: feed.Next, Type: feedType})
+	}
+	if feed.OpenSearch != "" {
+		atom.Links = append(atom.Links, atomLink{Rel: "search", Href: feed.OpenSearch, Type: openSearchType})
+	}
+	for _, navigation := range feed.Navigation {
+		linkType := opdsNavigationType
+		if navigation.Acquisition {
+			linkType = opdsAcquisitionType
+		}
+		entry := atomEntry{
+			ID:      navigation.ID,
+			Title:   navigation.Title,
+			Updated: atom.Updated,
+			Links:   []atomLink{{Rel: "subsection", Href: navigation.Href, Type: linkType, Count: navigation.Count}},
+		}
+		if navigation.Count > 0 {
+			entry.Content = &atomText{Type: "text", Value: fmt.Sprintf("%d books", navigation.Count)}
+		}
+		atom.Entries = append(atom.Entries, entry)
+	}
+	for _, publication := range feed.Publications {
+		entry := atomEntry{
+			ID:        publication.ID,
+			Title:     publication.Title,
+			Updated:   publication.Updated.UTC().Format(time.RFC3339),
+			Language:  publication.Language,
+			Publisher: publication.Publisher,
+			Links: []atomLink{{
+				Rel:  "http://opds-spec.org/acquisition",
+				Href: publication.Download,
+				Type: publication.MimeType,
+				Size: publication.Size,
+			}},
+		}
+		for _, author := range publication.Authors {
+			entry.Authors = append(entry.Authors, atomAuthor{Name: author})
+		}
+		if publication.Year != 0 {
+			entry.Issued = strconv.Itoa(publication.Year)
+		}
+		if publication.Description != "" {
+			entry.Summary = &atomText{Type: "text", Value: publication.Description}
+		}
+		if publication.Cover != "" {
+			entry.Links = append(entry.Links,
+				atomLink{Rel: "http://opds-spec.org/image", Href: publication.Cover},
+				atomLink{Rel: "http://opds-spec.org/image/thumbnail", Href: publication.Cover},
+			)
+		}
+		atom.Entries = append(atom.Entries, entry)
+	}
+
+	data, err := xml.Marshal(atom)
+	if err != nil {
+		writeError(c, err)
+		return
+	}
+	c.Data(http.StatusOK, feedType+";charset=utf-8", append([]byte(xml.Header), data...))
+}
+
+type opds2Feed struct {
+	Metadata     opds2FeedMetadata  `json:"metadata"`
+	Links        []opds2Link        `json:"links"`
+	Navigation   []opds2Link        `json:"navigation,omitempty"`
+	Publications []opds2Publication `json:"publications,omitempty"`
+}
+
+type opds2FeedMetadata struct {
+	Title    string    `json:"title"`
+	Modified time.Time `json:"modified"`
+}
+
+type opds2Link struct {
+	Rel        string           `json:"rel,omitempty"`
+	Href       string           `json:"href"`
+	Type       string           `json:"type,omitempty"`
+	Title      string           `json:"title,omitempty"`
+	Templated  bool             `json:"templated,omitempty"`
+	Properties *opds2Properties `json:"properties,omitempty"`
+}
+
+type opds2Properties struct {
+	NumberOfItems int `json:"numberOfItems,omitempty"`
+}
+
+type opds2Publication struct {
+	Metadata opds2PublicationMetadata `json:"metadata"`
+	Links    []opds2Link              `json:"links"`
+	Images   []opds2Link              `json:"images,omitempty"`
+}
+
+type opds2PublicationMetadata struct {
+	Type        string          `json:"@type"`
+	Identifier  string          `json:"identifier"`
+	Title       string          `json:"title"`
+	Author      []string        `json:"author,omitempty"`
+	Language    string          `json:"language,omitempty"`
+	Publisher   string          `json:"publisher,omitempty"`
+	Published   string          `json:"published,omitempty"`
+	Description string          `json:"description,omitempty"`
+	Modified    time.Time       `json:"modified"`
+	BelongsTo   *opds2BelongsTo `json:"belongsTo,omitempty"`
+}
+
+type opds2BelongsTo struct {
+	Series []opds2Series `json:"series"`
+}
+
+type opds2Series struct {
+	Name     string  `json:"name"`
+	Position float64 `json:"position,omitempty"`
+}
+
+func writeOpds2Feed(c *gin.Context, feed opdsFeed) {
+	opds := opds2Feed{
+		Metadata: opds2FeedMetadata{Title: feed.Title, Modified: feed.Updated},
+		Links: []opds2Link{
+			{Rel: "self", Href: feed.Self, Type: opds2Type},
+			{Rel: "start", Href: "/opds/v2", Type: opds2Type},
+		},
+	}
+	if feed.Up != "" {
+		opds.Links = append(opds.Links, opds2Link{Rel: "up", Href: feed.Up, Type: opds2Type})
+	}
+	if feed.Next != "" {
+		opds.Links = append(opds.Links, opds2Link{Rel: "next", Href: feed.Next, Type: opds2Type})
+	}
+	if feed.Search != "" {
+		opds.Links = append(opds.Links, opds2Link{Rel: "search", Href: feed.Search + "{?q}", Type: opds2Type, Templated: true})
+	}
+	for _, navigation := range feed.Navigation {
+		link := opds2Link{Href: navigation.Href, Type: opds2Type, Title: navigation.Title}
+		if navigation.Count > 0 {
+			link.Properties = &opds2Properties{NumberOfItems: navigation.Count}
+		}
+		opds.Navigation = append(opds.Navigation, link)
+	}
+	for _, publication := range feed.Publications {
+		metadata := opds2PublicationMetadata{
+			Type:        "http://schema.org/Book",
+			Identifier:  publication.ID,
+			Title:       publication.Title,
+			Author:      publication.Authors,
+			Language:    publication.Language,
+			Publisher:   publication.Publisher,
+			Description: publication.Description,
+			Modified:    publication.Updated,
+		}
+		if publication.Year != 0 {
+			metadata.Published = strconv.Itoa(publication.Year)
+		}
+		if publication.Series != "" {
+			metadata.BelongsTo = &opds2BelongsTo{Series: []opds2Series{{Name: publication.Series, Position: publication.SeriesIndex}}}
+		}
+		entry := opds2Publication{
+			Metadata: metadata,
+			Links:    []opds2Link{{Rel: "http://opds-spec.org/acquisition", Href: publication.Download, Type: publication.MimeType}},
+		}
+		if publication.Cover != "" {
+			entry.Images = []opds2Link{{Href: publication.Cover}}
+		}
+		opds.Publications = append(opds.Publications, entry)
+	}
+	c.Header("Content-Type", opds2Type)
+	c.JSON(http.StatusOK, opds)
+}
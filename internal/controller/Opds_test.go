@@ -0,0 +1,200 @@
+package controller
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"keydrive/internal/model"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeTestBook(t *testing.T, file string, title string, author string) {
+	buffer := &bytes.Buffer{}
+	archive := zip.NewWriter(buffer)
+	add := func(name string, content string) {
+		writer, _ := archive.Create(name)
+		_, _ = writer.Write([]byte(content))
+	}
+	add("mimetype", "application/epub+zip")
+	add("META-INF/container.xml", `<?xml version="1.0"?>
+<container version="1.0" xmlns="urn:oasis:names:tc:opendocument:xmlns:container">
+  <rootfiles><rootfile full-path="content.opf" media-type="application/oebps-package+xml"/></rootfiles>
+</container>`)
+	add("content.opf", fmt.Sprintf(`<?xml version="1.0"?>
+<package xmlns="http://www.idpf.org/2007/opf" version="2.0">
+  <metadata xmlns:dc="http://purl.org/dc/elements/1.1/">
+    <dc:title>%s</dc:title>
+    <dc:creator>%s</dc:creator>
+    <meta name="calibre:series" content="The Series"/>
+  </metadata>
+</package>`, title, author))
+	_ = archive.Close()
+	if err := os.WriteFile(file, buffer.Bytes(), 0777); err != nil {
+		t.Fatal(err.Error())
+	}
+}
+
+func TestOpdsCatalog(t *testing.T) {
+	tempDir := t.TempDir()
+	_ = os.Mkdir(filepath.Join(tempDir, "Shelf"), 0777)
+	writeTestBook(t, filepath.Join(tempDir, "Shelf", "first.epub"), "First Book", "Some Author")
+	writeTestBook(t, filepath.Join(tempDir, "second.epub"), "Second Book", "Other Author")
+	lib := model.Library{
+		Type:       model.TypeBooks,
+		Name:       "Books",
+		RootFolder: tempDir,
+	}
+	testApp.DB.Create(&lib)
+	testApp.DB.Create(&model.CanAccessLibrary{UserID: regularUser.ID, LibraryID: lib.ID})
+	genericLib := model.Library{
+		Type:       model.TypeGeneric,
+		Name:       "Not Books",
+		RootFolder: t.TempDir(),
+	}
+	testApp.DB.Create(&genericLib)
+	if _, err := testApp.Index.ScanLibrary(context.Background(), lib); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	req := regularUserRequest("POST", "/api/user/app-passwords", strings.NewReader(`{"name": "E-reader"}`))
+	recorder := httptest.NewRecorder()
+	testApp.Router.ServeHTTP(recorder, req)
+	assertStatus(t, recorder, 201)
+	var appPassword CreatedAppPasswordDTO
+	assertJsonUnmarshal(t, recorder, &appPassword)
+
+	opdsRequest := func(url string, password string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", url, nil)
+		req.SetBasicAuth(regularUser.Username, password)
+		recorder := httptest.NewRecorder()
+		testApp.Router.ServeHTTP(recorder, req)
+		return recorder
+	}
+
+	t.Run("it asks for basic authentication", func(t *testing.T) {
+		recorder := opdsRequest("/opds/v1.2", "wrong")
+		assertStatus(t, recorder, 401)
+		if !strings.HasPrefix(recorder.Header().Get("WWW-Authenticate"), "Basic ") {
+			t.Errorf("Expected a basic authentication challenge but got: %s", recorder.Header().Get("WWW-Authenticate"))
+		}
+	})
+
+	t.Run("it lists book libraries with an app password", func(t *testing.T) {
+		recorder := opdsRequest("/opds/v1.2", appPassword.Password)
+		assertStatus(t, recorder, 200)
+		if !strings.HasPrefix(recorder.Header().Get("Content-Type"), "application/atom+xml;profile=opds-catalog") {
+			t.Errorf("Unexpected content type: %s", recorder.Header().Get("Content-Type"))
+		}
+		body := recorder.Body.String()
+		if !strings.Contains(body, fmt.Sprintf("/opds/v1.2/libraries/%d", lib.ID)) {
+			t.Errorf("Expected the library in the catalog but got: %s", body)
+		}
+	})
+
+	t.Run("it only serves book libraries", func(t *testing.T) {
+		recorder := opdsRequest(fmt.Sprintf("/opds/v1.2/libraries/%d", genericLib.ID), appPassword.Password)
+		assertStatus(t, recorder, 404)
+	})
+
+	t.Run("it lists folders and books", func(t *testing.T) {
+		recorder := opdsRequest(fmt.Sprintf("/opds/v1.2/libraries/%d/folder?path=%%2F", lib.ID), appPassword.Password)
+		assertStatus(t, recorder, 200)
+		body := recorder.Body.String()
+		if !strings.Contains(body, "<title>Shelf</title>") || !strings.Contains(body, "<title>Second Book</title>") {
+			t.Errorf("Expected the folder and the book but got: %s", body)
+		}
+		if !strings.Contains(body, `rel="http://opds-spec.org/acquisition"`) {
+			t.Errorf("Expected an acquisition link but got: %s", body)
+		}
+	})
+
+	t.Run("it lists authors and their books", func(t *testing.T) {
+		recorder := opdsRequest(fmt.Sprintf("/opds/v2/libraries/%d/authors", lib.ID), appPassword.Password)
+		assertStatus(t, recorder, 200)
+		var feed opds2Feed
+		if err := json.Unmarshal(recorder.Body.Bytes(), &feed); err != nil {
+			t.Fatal(err.Error())
+		}
+		if len(feed.Navigation) != 2 || feed.Navigation[0].Title != "Other Author" {
+			t.Fatalf("Unexpected authors: %+v", feed.Navigation)
+		}
+
+		recorder = opdsRequest(feed.Navigation[1].Href, appPassword.Password)
+		assertStatus(t, recorder, 200)
+		feed = opds2Feed{}
+		if err := json.Unmarshal(recorder.Body.Bytes(), &feed); err != nil {
+			t.Fatal(err.Error())
+		}
+		if len(feed.Publications) != 1 || feed.Publications[0].Metadata.Title != "First Book" {
+			t.Errorf("Unexpected books: %+v", feed.Publications)
+		}
+	})
+
+	t.Run("it lists series", func(t *testing.T) {
+		recorder := opdsRequest(fmt.Sprintf("/opds/v2/libraries/%d/series/books?name=The+Series", lib.ID), appPassword.Password)
+		assertStatus(t, recorder, 200)
+		var feed opds2Feed
+		if err := json.Unmarshal(recorder.Body.Bytes(), &feed); err != nil {
+			t.Fatal(err.Error())
+		}
+		if len(feed.Publications) != 2 {
+			t.Errorf("Expected both books but got: %+v", feed.Publications)
+		}
+	})
+
+	t.Run("it searches books", func(t *testing.T) {
+		recorder := opdsRequest(fmt.Sprintf("/opds/v2/libraries/%d/search?q=other", lib.ID), appPassword.Password)
+		assertStatus(t, recorder, 200)
+		var feed opds2Feed
+		if err := json.Unmarshal(recorder.Body.Bytes(), &feed); err != nil {
+			t.Fatal(err.Error())
+		}
+		if len(feed.Publications) != 1 || feed.Publications[0].Metadata.Title != "Second Book" {
+			t.Errorf("Unexpected books: %+v", feed.Publications)
+		}
+	})
+
+	t.Run("it redirects downloads to a download token", func(t *testing.T) {
+		recorder := opdsRequest(fmt.Sprintf("/opds/libraries/%d/download?path=%%2Fsecond.epub", lib.ID), appPassword.Password)
+		assertStatus(t, recorder, 302)
+		location := recorder.Header().Get("Location")
+		if !strings.HasPrefix(location, "/api/download?token=") {
+			t.Fatalf("Unexpected redirect: %s", location)
+		}
+		req, _ := http.NewRequest("GET", location, nil)
+		recorder = httptest.NewRecorder()
+		testApp.Router.ServeHTTP(recorder, req)
+		assertStatus(t, recorder, 200)
+	})
+
+	t.Run("it stops accepting a password once it is changed", func(t *testing.T) {
+		req := regularUserRequest("PATCH", "/api/user/", strings.NewReader(`{"password": "first-password"}`))
+		recorder := httptest.NewRecorder()
+		testApp.Router.ServeHTTP(recorder, req)
+		assertStatus(t, recorder, 200)
+		assertStatus(t, opdsRequest("/opds/v1.2", "first-password"), 200)
+
+		req = adminRequest("PATCH", fmt.Sprintf("/api/users/%d", regularUser.ID), strings.NewReader(`{"password": "second-password"}`))
+		recorder = httptest.NewRecorder()
+		testApp.Router.ServeHTTP(recorder, req)
+		assertStatus(t, recorder, 200)
+		assertStatus(t, opdsRequest("/opds/v1.2", "first-password"), 401)
+		assertStatus(t, opdsRequest("/opds/v1.2", "second-password"), 200)
+	})
+
+	t.Run("it stops accepting a revoked app password", func(t *testing.T) {
+		req := regularUserRequest("DELETE", fmt.Sprintf("/api/user/app-passwords/%d", appPassword.ID), nil)
+		recorder := httptest.NewRecorder()
+		testApp.Router.ServeHTTP(recorder, req)
+		assertStatus(t, recorder, 204)
+
+		assertStatus(t, opdsRequest("/opds/v1.2", appPassword.Password), 401)
+	})
+}
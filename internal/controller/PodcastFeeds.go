@@ -0,0 +1,444 @@
+package controller
+
+import (
+	"encoding/xml"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"keydrive/internal/model"
+	"keydrive/internal/service"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+type PodcastFeedPage struct {
+	TotalElements int64               `json:"totalElements"`
+	Elements      []model.PodcastFeed `json:"elements"`
+}
+
+type CreatePodcastFeedDTO struct {
+	Path        string `json:"path" binding:"required"`
+	Title       string `json:"title"`
+	Description string `json:"description"`
+	Author      string `json:"author"`
+	Artwork     string `json:"artwork"`
+}
+
+type UpdatePodcastFeedDTO struct {
+	Title       *string `json:"title"`
+	Description *string `json:"description"`
+	Author      *string `json:"author"`
+	Artwork     *string `json:"artwork"`
+	// ResetToken gives the feed a new url. Apps that subscribed to the old url can no longer read it.
+	ResetToken bool `json:"resetToken"`
+}
+
+// publicURL returns the url at which the server is reached. Feeds need absolute links, so it is taken from the
+// configuration or from the request.
+func publicURL(c *gin.Context, configured string) string {
+	if configured != "" {
+		return strings.TrimSuffix(configured, "/")
+	}
+	scheme := "http"
+	if c.Request.TLS != nil {
+		scheme = "https"
+	}
+	if proto := c.GetHeader("X-Forwarded-Proto"); proto == "http" || proto == "https" {
+		scheme = proto
+	}
+	return scheme + "://" + c.Request.Host
+}
+
+// checkFeedArtwork makes sure the artwork of a feed is an image in the library.
+func checkFeedArtwork(fs *service.FileSystem, library model.Library, artwork string) (string, error) {
+	if artwork == "" {
+		return "", nil
+	}
+	entry, err := fs.GetEntryMetadata(library, artwork)
+	if err != nil {
+		return "", err
+	}
+	if !service.IsSafeImageType(entry.MimeType) {
+		return "", ApiError{Status: http.StatusBadRequest, Description: "the artwork of a feed must be a jpeg, png, gif, webp or bmp image"}
+	}
+	return path.Join(entry.Parent, entry.Name), nil
+}
+
+// CreatePodcastFeed
+// @Tags Sharing
+// @Router /api/libraries/{libraryId}/feeds [post]
+// @Summary Publish the audio and video files in a folder as a podcast
+// @Description The feed can be read at /feeds/{token} by anyone who knows the token. Every folder can have one feed.
+// @Security OAuth2
+// @Produce json
+// @Param libraryId path int true "The library id"
+// @Param body body CreatePodcastFeedDTO true "The folder and the details of the feed"
+// @Success 201 {object} model.PodcastFeed
+func CreatePodcastFeed(db *gorm.DB, libs *service.Library, fs *service.FileSystem, feeds *service.PodcastFeeds) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var create CreatePodcastFeedDTO
+		if err := c.ShouldBindJSON(&create); err != nil {
+			writeError(c, err)
+			return
+		}
+
+		err := db.Transaction(func(tx *gorm.DB) error {
+			library, err := getAccessToLib(c, libs, true, tx)
+			if err != nil {
+				return err
+			}
+			entry, err := fs.GetEntryMetadata(library, create.Path)
+			if err != nil {
+				return err
+			}
+			if entry.Category != model.CategoryFolder {
+				return ApiError{Status: http.StatusBadRequest, Description: "only folders can have a feed"}
+			}
+			artwork, err := checkFeedArtwork(fs, library, create.Artwork)
+			if err != nil {
+				return err
+			}
+			feed := model.PodcastFeed{
+				Library:     library,
+				Path:        path.Join(entry.Parent, entry.Name),
+				Title:       create.Title,
+				Description: create.Description,
+				Author:      create.Author,
+				Artwork:     artwork,
+			}
+			if err := feeds.CreateFeed(tx, &feed); err != nil {
+				return err
+			}
+			c.JSON(http.StatusCreated, feed)
+			return nil
+		})
+		if err != nil {
+			writeError(c, err)
+		}
+	}
+}
+
+// ListPodcastFeeds
+// @Tags Sharing
+// @Router /api/libraries/{libraryId}/feeds [get]
+// @Summary List the podcast feeds of the folders in a library
+// @Security OAuth2
+// @Produce json
+// @Param libraryId path int true "The library id"
+// @Success 200 {object} PodcastFeedPage
+// @Param page query int false "The page number to fetch" default(1)
+// @Param limit query int false "The maximum number of elements to return" default(20)
+func ListPodcastFeeds(db *gorm.DB, libs *service.Library, feeds *service.PodcastFeeds) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		library, err := getAccessToLib(c, libs, false, db)
+		if err != nil {
+			writeError(c, err)
+			return
+		}
+		var page PodcastFeedPage
+		returnPage(c, feeds.GetFeedsForLibrary(library, db).Order("path"), &page, &page.TotalElements, &page.Elements)
+	}
+}
+
+// UpdatePodcastFeed
+// @Tags Sharing
+// @Router /api/libraries/{libraryId}/feeds/{feedId} [patch]
+// @Summary Change the details of a podcast feed, or give it a new url
+// @Security OAuth2
+// @Produce json
+// @Param libraryId path int true "The library id"
+// @Param feedId path int true "The feed id"
+// @Param body body UpdatePodcastFeedDTO true "The details to change"
+// @Success 200 {object} model.PodcastFeed
+func UpdatePodcastFeed(db *gorm.DB, libs *service.Library, fs *service.FileSystem, feeds *service.PodcastFeeds) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var update UpdatePodcastFeedDTO
+		if err := c.ShouldBindJSON(&update); err != nil {
+			writeError(c, err)
+			return
+		}
+		feedId, ok := intParam(c, "feedId")
+		if !ok {
+			simpleError(c, http.StatusNotFound)
+			return
+		}
+
+		err := db.Transaction(func(tx *gorm.DB) error {
+			library, err := getAccessToLib(c, libs, true, tx)
+			if err != nil {
+				return err
+			}
+			var feed model.PodcastFeed
+			if result := feeds.GetFeedsForLibrary(library, tx).Take(&feed, feedId); result.Error != nil {
+				return result.Error
+			}
+			if update.Title != nil {
+				feed.Title = *update.Title
+			}
+			if update.Description != nil {
+				feed.Description = *update.Description
+			}
+			if update.Author != nil {
+				feed.Author = *update.Author
+			}
+			if update.Artwork != nil {
+				if feed.Artwork, err = checkFeedArtwork(fs, library, *update.Artwork); err != nil {
+					return err
+				}
+			}
+			if result := tx.Model(&feed).Select("title", "description", "author", "artwork").Updates(&feed); result.Error != nil {
+				return result.Error
+			}
+			if update.ResetToken {
+				if err := feeds.ResetToken(tx, &feed); err != nil {
+					return err
+				}
+			}
+			c.JSON(http.StatusOK, feed)
+			return nil
+		})
+		if err != nil {
+			writeError(c, err)
+		}
+	}
+}
+
+// DeletePodcastFeed
+// @Tags Sharing
+// @Router /api/libraries/{libraryId}/feeds/{feedId} [delete]
+// @Summary Remove the podcast feed of a folder
+// @Security OAuth2
+// @Param libraryId path int true "The library id"
+// @Param feedId path int true "The feed id"
+// @Success 204
+func DeletePodcastFeed(db *gorm.DB, libs *service.Library, feeds *service.PodcastFeeds) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		feedId, ok := intParam(c, "feedId")
+		if !ok {
+			simpleError(c, http.StatusNotFound)
+			return
+		}
+		library, err := getAccessToLib(c, libs, true, db)
+		if err != nil {
+			writeError(c, err)
+			return
+		}
+		result := feeds.GetFeedsForLibrary(library, db).Where("id = ?", feedId).Delete(&model.PodcastFeed{})
+		if result.Error != nil {
+			writeError(c, result.Error)
+			return
+		}
+		if result.RowsAffected == 0 {
+			simpleError(c, http.StatusNotFound)
+			return
+		}
+		c.Status(http.StatusNoContent)
+	}
+}
+
+type rssFeed struct {
+	XMLName     xml.Name   `xml:"rss"`
+	Version     string     `xml:"version,attr"`
+	XmlnsItunes string     `xml:"xmlns:itunes,attr"`
+	Channel     rssChannel `xml:"channel"`
+}
+
+type rssChannel struct {
+	Title         string         `xml:"title"`
+	Link          string         `xml:"link"`
+	Description   string         `xml:"description"`
+	LastBuildDate string         `xml:"lastBuildDate"`
+	Generator     string         `xml:"generator"`
+	Image         *rssImage      `xml:"image"`
+	ItunesAuthor  string         `xml:"itunes:author,omitempty"`
+	ItunesSummary string         `xml:"itunes:summary,omitempty"`
+	ItunesImage   *rssItunesLink `xml:"itunes:image"`
+	ItunesType    string         `xml:"itunes:type"`
+	Items         []rssItem      `xml:"item"`
+}
+
+type rssImage struct {
+	URL   string `xml:"url"`
+	Title string `xml:"title"`
+	Link  string `xml:"link"`
+}
+
+type rssItunesLink struct {
+	Href string `xml:"href,attr"`
+}
+
+type rssGuid struct {
+	IsPermaLink bool   `xml:"isPermaLink,attr"`
+	Value       string `xml:",chardata"`
+}
+
+type rssEnclosure struct {
+	URL    string `xml:"url,attr"`
+	Length int64  `xml:"length,attr"`
+	Type   string `xml:"type,attr"`
+}
+
+type rssItem struct {
+	Title        string       `xml:"title"`
+	Guid         rssGuid      `xml:"guid"`
+	PubDate      string       `xml:"pubDate"`
+	Description  string       `xml:"description,omitempty"`
+	Enclosure    rssEnclosure `xml:"enclosure"`
+	ItunesAuthor string       `xml:"itunes:author,omitempty"`
+}
+
+// GetPodcastFeed
+// @Tags Sharing
+// @Router /feeds/{token} [get]
+// @Summary Read a podcast feed
+// @Description Lists the audio and video files in the folder of the feed, the newest first, as RSS 2.0 with iTunes tags. Files in sub folders are not included.
+// @Produce application/rss+xml
+// @Param token path string true "The token of the feed"
+// @Success 200
+func GetPodcastFeed(fs *service.FileSystem, index *service.Index, feeds *service.PodcastFeeds, config Config) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		feed, err := feeds.OpenFeed(c.Param("token"))
+		if err != nil {
+			writeError(c, err)
+			return
+		}
+		entries, err := fs.GetEntriesForLibrary(feed.Library, feed.Path)
+		if err != nil {
+			writeError(c, err)
+			return
+		}
+		if err := index.AddMetadata(feed.Library, entries); err != nil {
+			writeError(c, err)
+			return
+		}
+		sort.SliceStable(entries, func(i, j int) bool {
+			return entries[i].Modified.After(entries[j].Modified)
+		})
+
+		base := publicURL(c, config.PublicURL) + "/feeds/" + url.PathEscape(feed.Token)
+		title := feed.Title
+		if title == "" {
+			title = path.Base(feed.Path)
+			if feed.Path == "/" {
+				title = feed.Library.Name
+			}
+		}
+		rss := rssFeed{
+			Version:     "2.0",
+			XmlnsItunes: "http://www.itunes.com/dtds/podcast-1.0.dtd",
+			Channel: rssChannel{
+				Title:         title,
+				Link:          base,
+				Description:   feed.Description,
+				LastBuildDate: time.Now().UTC().Format(time.RFC1123Z),
+				Generator:     "KeyDrive",
+				ItunesAuthor:  feed.Author,
+				ItunesSummary: feed.Description,
+				ItunesType:    "episodic",
+			},
+		}
+		if feed.Artwork != "" {
+			rss.Channel.Image = &rssImage{URL: base + "/artwork", Title: title, Link: base}
+			rss.Channel.ItunesImage = &rssItunesLink{Href: base + "/artwork"}
+		}
+		for _, entry := range entries {
+			if entry.Category != model.CategoryAudio && entry.Category != model.CategoryVideo {
+				continue
+			}
+			item := rssItem{
+				Title:   strings.TrimSuffix(entry.Name, path.Ext(entry.Name)),
+				Guid:    rssGuid{Value: fmt.Sprintf("keydrive:%d:%s", feed.ID, entry.Name)},
+				PubDate: entry.Modified.UTC().Format(time.RFC1123Z),
+				Enclosure: rssEnclosure{
+					URL:    base + "/media/" + url.PathEscape(entry.Name),
+					Length: entry.Size,
+					Type:   entry.MimeType,
+				},
+			}
+			if metadata := entry.Metadata; metadata != nil {
+				if metadata.Title != "" {
+					item.Title = metadata.Title
+				}
+				item.Description = metadata.Description
+				item.ItunesAuthor = metadata.Artist
+			}
+			rss.Channel.Items = append(rss.Channel.Items, item)
+		}
+
+		data, err := xml.Marshal(rss)
+		if err != nil {
+			writeError(c, err)
+			return
+		}
+		c.Data(http.StatusOK, "application/rss+xml; charset=utf-8", append([]byte(xml.Header), data...))
+	}
+}
+
+// GetPodcastEpisode
+// @Tags Sharing
+// @Router /feeds/{token}/media/{name} [get]
+// @Summary Download an episode of a podcast feed
+// @Description Range requests are supported, so podcast apps can stream episodes and resume downloads.
+// @Param token path string true "The token of the feed"
+// @Param name path string true "The name of the file"
+// @Success 200
+// @Success 206
+func GetPodcastEpisode(fs *service.FileSystem, feeds *service.PodcastFeeds) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		feed, err := feeds.OpenFeed(c.Param("token"))
+		if err != nil {
+			writeError(c, err)
+			return
+		}
+		entryPath, ok := feeds.ResolveEpisodePath(feed, c.Param("name"))
+		if !ok {
+			simpleError(c, http.StatusNotFound)
+			return
+		}
+		entry, err := fs.GetEntryMetadata(feed.Library, entryPath)
+		if err != nil {
+			writeError(c, err)
+			return
+		}
+		if entry.Category != model.CategoryAudio && entry.Category != model.CategoryVideo {
+			simpleError(c, http.StatusNotFound)
+			return
+		}
+		serveEntry(c, fs, feed.Library, entryPath, true)
+	}
+}
+
+// GetPodcastArtwork
+// @Tags Sharing
+// @Router /feeds/{token}/artwork [get]
+// @Summary Get the artwork of a podcast feed
+// @Param token path string true "The token of the feed"
+// @Success 200
+func GetPodcastArtwork(fs *service.FileSystem, feeds *service.PodcastFeeds) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		feed, err := feeds.OpenFeed(c.Param("token"))
+		if err != nil {
+			writeError(c, err)
+			return
+		}
+		if feed.Artwork == "" {
+			simpleError(c, http.StatusNotFound)
+			return
+		}
+		entry, err := fs.GetEntryMetadata(feed.Library, feed.Artwork)
+		if err != nil {
+			writeError(c, err)
+			return
+		}
+		if !service.IsSafeImageType(entry.MimeType) {
+			simpleError(c, http.StatusNotFound)
+			return
+		}
+		c.Header("X-Content-Type-Options", "nosniff")
+		serveEntry(c, fs, feed.Library, feed.Artwork, true)
+	}
+}
@@ -0,0 +1,99 @@
+package controller
+
+import (
+	"fmt"
+	"keydrive/internal/model"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPodcastFeeds(t *testing.T) {
+	tempDir := t.TempDir()
+	_ = os.Mkdir(filepath.Join(tempDir, "Talks"), 0777)
+	writeTestSong(t, filepath.Join(tempDir, "Talks", "first talk.mp3"), map[string]string{})
+	_ = os.WriteFile(filepath.Join(tempDir, "Talks", "notes.txt"), []byte("Notes\n"), 0777)
+	_ = os.WriteFile(filepath.Join(tempDir, "cover.svg"), []byte("<svg/>"), 0777)
+	lib := model.Library{
+		Type:       model.TypeGeneric,
+		Name:       "Talks Library",
+		RootFolder: tempDir,
+	}
+	testApp.DB.Create(&lib)
+
+	req := adminRequest("POST", fmt.Sprintf("/api/libraries/%d/feeds", lib.ID), strings.NewReader(`{"path": "/Talks", "title": "Our Talks", "description": "Recorded talks"}`))
+	recorder := httptest.NewRecorder()
+	testApp.Router.ServeHTTP(recorder, req)
+	assertStatus(t, recorder, 201)
+	var feed model.PodcastFeed
+	assertJsonUnmarshal(t, recorder, &feed)
+
+	t.Run("it lists audio files in the feed", func(t *testing.T) {
+		req, _ := http.NewRequest("GET", "/feeds/"+feed.Token, nil)
+		recorder := httptest.NewRecorder()
+		testApp.Router.ServeHTTP(recorder, req)
+		assertStatus(t, recorder, 200)
+		body := recorder.Body.String()
+		if !strings.Contains(body, "<title>Our Talks</title>") || !strings.Contains(body, "<title>first talk</title>") {
+			t.Errorf("Unexpected feed: %s", body)
+		}
+		if !strings.Contains(body, `/feeds/`+feed.Token+`/media/first%20talk.mp3" length="14" type="audio/mpeg"`) {
+			t.Errorf("Expected an enclosure but got: %s", body)
+		}
+		if strings.Contains(body, "notes") {
+			t.Errorf("Expected only audio and video files but got: %s", body)
+		}
+	})
+
+	t.Run("it serves ranges of episodes", func(t *testing.T) {
+		req, _ := http.NewRequest("GET", "/feeds/"+feed.Token+"/media/first%20talk.mp3", nil)
+		req.Header.Set("Range", "bytes=2-4")
+		recorder := httptest.NewRecorder()
+		testApp.Router.ServeHTTP(recorder, req)
+		assertStatus(t, recorder, 206)
+		if recorder.Body.String() != "3\x03\x00" {
+			t.Errorf("Unexpected range: %s", recorder.Body.String())
+		}
+	})
+
+	t.Run("it only serves episodes", func(t *testing.T) {
+		req, _ := http.NewRequest("GET", "/feeds/"+feed.Token+"/media/notes.txt", nil)
+		recorder := httptest.NewRecorder()
+		testApp.Router.ServeHTTP(recorder, req)
+		assertStatus(t, recorder, 404)
+	})
+
+	t.Run("it rejects unsafe artwork", func(t *testing.T) {
+		req := adminRequest("PATCH", fmt.Sprintf("/api/libraries/%d/feeds/%d", lib.ID, feed.ID), strings.NewReader(`{"artwork": "/cover.svg"}`))
+		recorder := httptest.NewRecorder()
+		testApp.Router.ServeHTTP(recorder, req)
+		assertStatus(t, recorder, 400)
+	})
+
+	t.Run("it resets the token", func(t *testing.T) {
+		req := adminRequest("PATCH", fmt.Sprintf("/api/libraries/%d/feeds/%d", lib.ID, feed.ID), strings.NewReader(`{"resetToken": true}`))
+		recorder := httptest.NewRecorder()
+		testApp.Router.ServeHTTP(recorder, req)
+		assertStatus(t, recorder, 200)
+		var updated model.PodcastFeed
+		assertJsonUnmarshal(t, recorder, &updated)
+		if updated.Token == feed.Token || updated.Title != "Our Talks" {
+			t.Errorf("Unexpected feed: %+v", updated)
+		}
+
+		req, _ = http.NewRequest("GET", "/feeds/"+feed.Token, nil)
+		recorder = httptest.NewRecorder()
+		testApp.Router.ServeHTTP(recorder, req)
+		assertStatus(t, recorder, 404)
+	})
+
+	t.Run("it requires write access", func(t *testing.T) {
+		req := regularUserRequest("POST", fmt.Sprintf("/api/libraries/%d/feeds", lib.ID), strings.NewReader(`{"path": "/"}`))
+		recorder := httptest.NewRecorder()
+		testApp.Router.ServeHTTP(recorder, req)
+		assertStatus(t, recorder, 404)
+	})
+}
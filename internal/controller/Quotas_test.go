@@ -0,0 +1,171 @@
+package controller
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"keydrive/internal/model"
+	"keydrive/internal/service"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestQuotas(t *testing.T) {
+	lib := model.Library{
+		Type:       model.TypeGeneric,
+		Name:       "Quota Library",
+		RootFolder: t.TempDir(),
+		Quota:      20,
+	}
+	testApp.DB.Create(&lib)
+	testApp.DB.Create(&model.CanAccessLibrary{UserID: regularUser.ID, LibraryID: lib.ID, CanWrite: true})
+	t.Cleanup(func() {
+		testApp.DB.Model(&model.User{}).Where("id = ?", regularUser.ID).Update("quota", 0)
+	})
+
+	upload := func(name string, content string) *httptest.ResponseRecorder {
+		body := &bytes.Buffer{}
+		writer := multipart.NewWriter(body)
+		part, _ := writer.CreateFormFile("data", name)
+		_, _ = part.Write([]byte(content))
+		_ = writer.Close()
+		req := regularUserRequest("POST", fmt.Sprintf("/api/libraries/%d/entries", lib.ID), body)
+		req.Header.Set("Content-Type", writer.FormDataContentType())
+		recorder := httptest.NewRecorder()
+		testApp.Router.ServeHTTP(recorder, req)
+		return recorder
+	}
+
+	t.Run("it rejects uploads that exceed the library quota", func(t *testing.T) {
+		assertStatus(t, upload("a.txt", "12345678"), 201)
+		assertStatus(t, upload("b.txt", "12345678"), 201)
+
+		recorder := upload("c.txt", "12345678")
+		assertStatus(t, recorder, 507)
+		var apiError struct {
+			Details service.QuotaError `json:"details"`
+		}
+		assertJsonUnmarshal(t, recorder, &apiError)
+		if apiError.Details.Scope != service.QuotaScopeLibrary || apiError.Details.Used != 16 || apiError.Details.Requested != 8 {
+			t.Errorf("Unexpected error details: %+v", apiError.Details)
+		}
+
+		assertStatus(t, upload("d.txt", strings.Repeat("x", 21)), 413)
+	})
+
+	t.Run("it rejects large uploads before reading them", func(t *testing.T) {
+		body := &bytes.Buffer{}
+		writer := multipart.NewWriter(body)
+		part, _ := writer.CreateFormFile("data", "large.bin")
+		_, _ = part.Write(make([]byte, 1<<20))
+		_ = writer.Close()
+
+		req := regularUserRequest("POST", fmt.Sprintf("/api/libraries/%d/entries", lib.ID), bytes.NewReader(body.Bytes()))
+		req.Header.Set("Content-Type", writer.FormDataContentType())
+		recorder := httptest.NewRecorder()
+		testApp.Router.ServeHTTP(recorder, req)
+		assertStatus(t, recorder, 413)
+
+		// Without a length, the body is cut off once it exceeds the available space.
+		req = regularUserRequest("POST", fmt.Sprintf("/api/libraries/%d/entries", lib.ID), bytes.NewReader(body.Bytes()))
+		req.Header.Set("Content-Type", writer.FormDataContentType())
+		req.ContentLength = -1
+		recorder = httptest.NewRecorder()
+		testApp.Router.ServeHTTP(recorder, req)
+		assertStatus(t, recorder, 413)
+		if _, err := os.Stat(filepath.Join(lib.RootFolder, "large.bin")); !os.IsNotExist(err) {
+			t.Errorf("Expected nothing to be written: %v", err)
+		}
+	})
+
+	t.Run("it rejects large drops before reading them", func(t *testing.T) {
+		recorder := httptest.NewRecorder()
+		testApp.Router.ServeHTTP(recorder, adminRequest("POST", fmt.Sprintf("/api/libraries/%d/links", lib.ID), strings.NewReader(`{"path": "/", "fileDrop": true}`)))
+		assertStatus(t, recorder, 201)
+		var link model.ShareLink
+		assertJsonUnmarshal(t, recorder, &link)
+
+		body := &bytes.Buffer{}
+		writer := multipart.NewWriter(body)
+		part, _ := writer.CreateFormFile("data", "dropped.bin")
+		_, _ = part.Write(make([]byte, 1<<20))
+		_ = writer.Close()
+		req, _ := http.NewRequest("POST", fmt.Sprintf("/s/%s/entries", link.Slug), body)
+		req.Header.Set("Content-Type", writer.FormDataContentType())
+		recorder = httptest.NewRecorder()
+		testApp.Router.ServeHTTP(recorder, req)
+		assertStatus(t, recorder, 413)
+		if _, err := os.Stat(filepath.Join(lib.RootFolder, "dropped.bin")); !os.IsNotExist(err) {
+			t.Errorf("Expected nothing to be written: %v", err)
+		}
+	})
+
+	t.Run("it rejects resumable uploads up front", func(t *testing.T) {
+		req := regularUserRequest("POST", fmt.Sprintf("/api/libraries/%d/uploads", lib.ID), nil)
+		req.Header.Set("Tus-Resumable", "1.0.0")
+		req.Header.Set("Upload-Length", "5")
+		req.Header.Set("Upload-Metadata", "filename "+base64.StdEncoding.EncodeToString([]byte("e.txt")))
+		recorder := httptest.NewRecorder()
+		testApp.Router.ServeHTTP(recorder, req)
+		assertStatus(t, recorder, 507)
+	})
+
+	t.Run("it reports the usage of libraries and users", func(t *testing.T) {
+		recorder := httptest.NewRecorder()
+		testApp.Router.ServeHTTP(recorder, regularUserRequest("GET", fmt.Sprintf("/api/libraries/%d/usage", lib.ID), nil))
+		assertStatus(t, recorder, 200)
+		var libraryUsage LibraryUsageDTO
+		assertJsonUnmarshal(t, recorder, &libraryUsage)
+		if libraryUsage.Quota.Quota != 20 || libraryUsage.Quota.Used != 16 {
+			t.Errorf("Unexpected library usage: %+v", libraryUsage.Quota)
+		}
+
+		recorder = httptest.NewRecorder()
+		testApp.Router.ServeHTTP(recorder, regularUserRequest("GET", "/api/user/usage", nil))
+		assertStatus(t, recorder, 200)
+		var userUsage service.QuotaUsage
+		assertJsonUnmarshal(t, recorder, &userUsage)
+		if userUsage.Used < 16 {
+			t.Errorf("Expected the uploads to be charged to the user: %+v", userUsage)
+		}
+
+		recorder = httptest.NewRecorder()
+		testApp.Router.ServeHTTP(recorder, adminRequest("GET", fmt.Sprintf("/api/users/%d/usage", regularUser.ID), nil))
+		assertStatus(t, recorder, 200)
+
+		recorder = httptest.NewRecorder()
+		testApp.Router.ServeHTTP(recorder, regularUserRequest("GET", fmt.Sprintf("/api/users/%d/usage", regularUser.ID), nil))
+		assertStatus(t, recorder, 403)
+	})
+
+	t.Run("it rejects uploads that exceed the user quota", func(t *testing.T) {
+		testApp.DB.Model(&lib).Update("quota", 0)
+		recorder := httptest.NewRecorder()
+		testApp.Router.ServeHTTP(recorder, adminRequest("PATCH", fmt.Sprintf("/api/users/%d", regularUser.ID), strings.NewReader(`{"quota": 1}`)))
+		assertStatus(t, recorder, 200)
+
+		recorder = upload("f.txt", "12345678")
+		assertStatus(t, recorder, 413)
+		var apiError ApiError
+		assertJsonUnmarshal(t, recorder, &apiError)
+		if !strings.Contains(apiError.Description, "user quota") {
+			t.Errorf("Expected the user quota to be exceeded: %+v", apiError)
+		}
+	})
+
+	t.Run("users can not change their own quota", func(t *testing.T) {
+		recorder := httptest.NewRecorder()
+		testApp.Router.ServeHTTP(recorder, regularUserRequest("PATCH", "/api/user", strings.NewReader(`{"quota": 0}`)))
+		assertStatus(t, recorder, 200)
+		var user model.User
+		testApp.DB.Take(&user, regularUser.ID)
+		if user.Quota != 1 {
+			t.Errorf("Expected the quota to be unchanged: %d", user.Quota)
+		}
+	})
+}
@@ -0,0 +1,81 @@
+package controller
+
+import (
+	"github.com/gin-gonic/gin"
+	"keydrive/internal/service"
+	"net/http"
+)
+
+type UpdateScheduleDTO struct {
+	// Schedule is a cron expression like "30 3 * * *", a shortcut like "@daily" or an interval like "@every 2h". An
+	// empty schedule restores the default one.
+	Schedule *string `json:"schedule"`
+	Enabled  *bool   `json:"enabled"`
+}
+
+// ListSchedules
+// @Tags System
+// @Router /api/system/schedules [get]
+// @Summary List the maintenance tasks that run on a schedule
+// @Description Each task shows its schedule and when it runs next, and how long its last run took and whether it failed.
+// @Security OAuth2
+// @Produce json
+// @Success 200 {array} service.ScheduleStatus
+func ListSchedules(scheduler *service.Scheduler) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		schedules, err := scheduler.List()
+		if err != nil {
+			writeError(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, schedules)
+	}
+}
+
+// UpdateSchedule
+// @Tags System
+// @Router /api/system/schedules/{name} [put]
+// @Summary Change the schedule of a maintenance task or enable and disable it
+// @Description Fields that are left out are not changed. The next run is planned from now on.
+// @Security OAuth2
+// @Accept json
+// @Produce json
+// @Param name path string true "The name of the task"
+// @Param body body UpdateScheduleDTO true "The new settings"
+// @Success 200 {object} service.ScheduleStatus
+// @Failure 400 {object} ApiError "The schedule is invalid"
+func UpdateSchedule(scheduler *service.Scheduler) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var request UpdateScheduleDTO
+		if err := c.ShouldBindJSON(&request); err != nil {
+			writeError(c, err)
+			return
+		}
+		schedule, err := scheduler.Update(c.Param("name"), request.Schedule, request.Enabled)
+		if err != nil {
+			writeError(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, schedule)
+	}
+}
+
+// RunSchedule
+// @Tags System
+// @Router /api/system/schedules/{name}/run [post]
+// @Summary Run a maintenance task now
+// @Description The task runs within a few seconds on one of the instances, even if it is disabled. Afterwards it continues on its schedule.
+// @Security OAuth2
+// @Produce json
+// @Param name path string true "The name of the task"
+// @Success 202 {object} service.ScheduleStatus
+func RunSchedule(scheduler *service.Scheduler) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		schedule, err := scheduler.Trigger(c.Param("name"))
+		if err != nil {
+			writeError(c, err)
+			return
+		}
+		c.JSON(http.StatusAccepted, schedule)
+	}
+}
@@ -0,0 +1,89 @@
+package controller
+
+import (
+	"keydrive/internal/service"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSchedules(t *testing.T) {
+	t.Run("it lists the tasks for admins only", func(t *testing.T) {
+		recorder := httptest.NewRecorder()
+		testApp.Router.ServeHTTP(recorder, adminRequest("GET", "/api/system/schedules", nil))
+		assertStatus(t, recorder, 200)
+		var schedules []service.ScheduleStatus
+		assertJsonUnmarshal(t, recorder, &schedules)
+		found := false
+		for _, schedule := range schedules {
+			if schedule.Name == "purge-trash" {
+				found = schedule.Enabled && schedule.Schedule == "@hourly"
+			}
+		}
+		if !found {
+			t.Errorf("Expected the trash purge in: %+v", schedules)
+		}
+
+		recorder = httptest.NewRecorder()
+		testApp.Router.ServeHTTP(recorder, regularUserRequest("GET", "/api/system/schedules", nil))
+		assertStatus(t, recorder, 403)
+	})
+
+	t.Run("it changes schedules", func(t *testing.T) {
+		recorder := httptest.NewRecorder()
+		testApp.Router.ServeHTTP(recorder, adminRequest("PUT", "/api/system/schedules/purge-versions", strings.NewReader(`{"schedule": "@every 2h"}`)))
+		assertStatus(t, recorder, 200)
+		var schedule service.ScheduleStatus
+		assertJsonUnmarshal(t, recorder, &schedule)
+		if schedule.Schedule != "@every 2h" || schedule.NextRunAt == nil || schedule.NextRunAt.Before(time.Now().Add(time.Hour)) {
+			t.Errorf("Unexpected schedule: %+v", schedule)
+		}
+
+		recorder = httptest.NewRecorder()
+		testApp.Router.ServeHTTP(recorder, adminRequest("PUT", "/api/system/schedules/purge-versions", strings.NewReader(`{"enabled": false}`)))
+		assertStatus(t, recorder, 200)
+		assertJsonUnmarshal(t, recorder, &schedule)
+		if schedule.Enabled || schedule.NextRunAt != nil || schedule.Schedule != "@every 2h" {
+			t.Errorf("Expected the task to be disabled: %+v", schedule)
+		}
+
+		recorder = httptest.NewRecorder()
+		testApp.Router.ServeHTTP(recorder, adminRequest("PUT", "/api/system/schedules/purge-versions", strings.NewReader(`{"schedule": "", "enabled": true}`)))
+		assertStatus(t, recorder, 200)
+		assertJsonUnmarshal(t, recorder, &schedule)
+		if !schedule.Enabled || schedule.Schedule != schedule.DefaultSchedule {
+			t.Errorf("Expected the default schedule: %+v", schedule)
+		}
+	})
+
+	t.Run("it rejects invalid schedules", func(t *testing.T) {
+		recorder := httptest.NewRecorder()
+		testApp.Router.ServeHTTP(recorder, adminRequest("PUT", "/api/system/schedules/purge-versions", strings.NewReader(`{"schedule": "every day"}`)))
+		assertStatus(t, recorder, 400)
+
+		recorder = httptest.NewRecorder()
+		testApp.Router.ServeHTTP(recorder, adminRequest("PUT", "/api/system/schedules/unknown", strings.NewReader(`{"enabled": false}`)))
+		assertStatus(t, recorder, 404)
+	})
+
+	t.Run("it runs tasks on demand", func(t *testing.T) {
+		recorder := httptest.NewRecorder()
+		testApp.Router.ServeHTTP(recorder, adminRequest("POST", "/api/system/schedules/purge-changes/run", nil))
+		assertStatus(t, recorder, 202)
+
+		var schedule service.ScheduleStatus
+		for deadline := time.Now().Add(5 * time.Second); schedule.LastRunAt == nil && time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+			schedule, _ = testApp.Scheduler.Get("purge-changes")
+		}
+		if schedule.LastRunAt == nil || schedule.LastError != "" || schedule.NextRunAt == nil || schedule.NextRunAt.Before(time.Now()) {
+			t.Errorf("Expected the task to have run: %+v", schedule)
+		}
+	})
+
+	t.Run("it leaves sweeping tokens in memory to every instance", func(t *testing.T) {
+		if _, err := testApp.Scheduler.Get("cleanup-tokens"); err == nil {
+			t.Errorf("Expected no scheduled sweep for tokens in memory")
+		}
+	})
+}
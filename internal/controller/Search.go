@@ -0,0 +1,104 @@
+package controller
+
+import (
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"keydrive/internal/model"
+	"keydrive/internal/service"
+	"net/http"
+	"time"
+)
+
+type SearchPage struct {
+	TotalElements int64                `json:"totalElements"`
+	Elements      []model.IndexedEntry `json:"elements"`
+}
+
+type SearchDTO struct {
+	Query          string         `form:"q"`
+	Category       model.Category `form:"category"`
+	MinSize        int64          `form:"minSize" binding:"min=0"`
+	MaxSize        int64          `form:"maxSize" binding:"min=0"`
+	ModifiedAfter  time.Time      `form:"modifiedAfter" time_format:"2006-01-02T15:04:05Z07:00"`
+	ModifiedBefore time.Time      `form:"modifiedBefore" time_format:"2006-01-02T15:04:05Z07:00"`
+}
+
+type IndexResultDTO struct {
+	Changed int `json:"changed"`
+}
+
+// Search
+// @Tags Files
+// @Router /api/search [get]
+// @Summary Search for files and folders in all libraries
+// @Description Names are matched on any part of the name. When content indexing is enabled, the text of documents is searched as well.
+// @Description Results come from the index, which is updated periodically.
+// @Security OAuth2
+// @Produce json
+// @Param q query string false "The text to search for"
+// @Param category query string false "Only return entries of this category"
+// @Param minSize query int false "The minimum size in bytes"
+// @Param maxSize query int false "The maximum size in bytes"
+// @Param modifiedAfter query string false "Only return entries modified at or after this time (RFC 3339)"
+// @Param modifiedBefore query string false "Only return entries modified before this time (RFC 3339)"
+// @Success 200 {object} SearchPage
+// @Param page query int false "The page number to fetch" default(1)
+// @Param limit query int false "The maximum number of elements to return" default(20)
+func Search(db *gorm.DB, index *service.Index) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var search SearchDTO
+		if err := c.ShouldBindQuery(&search); err != nil {
+			writeError(c, err)
+			return
+		}
+		user, _ := GetAuthenticatedUser(c)
+		query := index.Search(user, service.SearchQuery{
+			Query:          search.Query,
+			Category:       search.Category,
+			MinSize:        search.MinSize,
+			MaxSize:        search.MaxSize,
+			ModifiedAfter:  search.ModifiedAfter,
+			ModifiedBefore: search.ModifiedBefore,
+		}, db).Order("name, library_id, path")
+		var page SearchPage
+		returnPage(c, query, &page, &page.TotalElements, &page.Elements)
+	}
+}
+
+// IndexLibrary
+// @Tags Files
+// @Router /api/libraries/{libraryId}/index [post]
+// @Summary Update the search index of a library now
+// @Description Large libraries can be indexed by a job in the background instead. Its result has the same form as the response.
+// @Security OAuth2
+// @Produce json
+// @Param libraryId path int true "The library id"
+// @Param background query bool false "Index the library in a job and answer right away"
+// @Success 200 {object} IndexResultDTO
+// @Success 202 {object} model.Job
+// @Failure 409 {object} ApiError "The library is already being indexed in the background"
+func IndexLibrary(db *gorm.DB, libs *service.Library, index *service.Index, jobs *service.Jobs) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		library, err := getAccessToLib(c, libs, false, db)
+		if err != nil {
+			writeError(c, err)
+			return
+		}
+		if c.Query("background") == "true" {
+			user, _ := GetAuthenticatedUser(c)
+			job, err := jobs.EnqueueUnique(JobIndex, &user, &library, nil)
+			if err != nil {
+				writeError(c, err)
+				return
+			}
+			acceptJob(c, job)
+			return
+		}
+		changed, err := index.ScanLibrary(c.Request.Context(), library)
+		if err != nil {
+			writeError(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, IndexResultDTO{Changed: changed})
+	}
+}
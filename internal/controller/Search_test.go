@@ -0,0 +1,112 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"keydrive/internal/model"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSearch(t *testing.T) {
+	tempDir := t.TempDir()
+	_ = os.MkdirAll(filepath.Join(tempDir, "holiday"), 0777)
+	_ = os.WriteFile(filepath.Join(tempDir, "holiday", "beach.jpg"), []byte("not really a picture"), 0777)
+	_ = os.WriteFile(filepath.Join(tempDir, "holiday", "packing list.txt"), []byte("sunscreen towels"), 0777)
+	_ = os.WriteFile(filepath.Join(tempDir, "budget.csv"), []byte("1,2,3"), 0777)
+
+	lib := model.Library{
+		Type:       model.TypeGeneric,
+		Name:       "Search Library",
+		RootFolder: tempDir,
+	}
+	testApp.DB.Create(&lib)
+
+	index := func(t *testing.T) {
+		req := adminRequest("POST", fmt.Sprintf("/api/libraries/%d/index", lib.ID), nil)
+		recorder := httptest.NewRecorder()
+		testApp.Router.ServeHTTP(recorder, req)
+		assertStatus(t, recorder, 200)
+	}
+
+	search := func(t *testing.T, request func(string, string, io.Reader) *http.Request, query url.Values) SearchPage {
+		req := request("GET", "/api/search?"+query.Encode(), nil)
+		recorder := httptest.NewRecorder()
+		testApp.Router.ServeHTTP(recorder, req)
+		assertStatus(t, recorder, 200)
+		var page SearchPage
+		assertJsonUnmarshal(t, recorder, &page)
+		return page
+	}
+
+	testApp.Index.IndexContent = true
+	defer func() { testApp.Index.IndexContent = false }()
+	index(t)
+
+	t.Run("it finds entries by name", func(t *testing.T) {
+		page := search(t, adminRequest, url.Values{"q": {"BEACH"}})
+		if page.TotalElements != 1 || page.Elements[0].Path != "/holiday/beach.jpg" {
+			t.Errorf("Expected beach.jpg but got: %v", page.Elements)
+		}
+	})
+
+	t.Run("it filters by category", func(t *testing.T) {
+		page := search(t, adminRequest, url.Values{"q": {"holiday"}, "category": {string(model.CategoryFolder)}})
+		if page.TotalElements != 1 || page.Elements[0].Name != "holiday" {
+			t.Errorf("Expected the holiday folder but got: %v", page.Elements)
+		}
+	})
+
+	t.Run("it searches the content of documents", func(t *testing.T) {
+		page := search(t, adminRequest, url.Values{"q": {"sunscreen"}})
+		if page.TotalElements != 1 || page.Elements[0].Name != "packing list.txt" {
+			t.Errorf("Expected the packing list but got: %v", page.Elements)
+		}
+	})
+
+	t.Run("it removes deleted entries", func(t *testing.T) {
+		_ = os.Remove(filepath.Join(tempDir, "budget.csv"))
+		index(t)
+		if page := search(t, adminRequest, url.Values{"q": {"budget"}}); page.TotalElements != 0 {
+			t.Errorf("Expected no results but got: %v", page.Elements)
+		}
+	})
+
+	t.Run("it only searches libraries the user can access", func(t *testing.T) {
+		if page := search(t, noAccessUserRequest, url.Values{"q": {"beach"}}); page.TotalElements != 0 {
+			t.Errorf("Expected no results but got: %v", page.Elements)
+		}
+	})
+
+	t.Run("it indexes changes made through the api in the background", func(t *testing.T) {
+		if _, err := testApp.FileSystem.CreateFolderInLibrary(lib, "museum", "/holiday"); err != nil {
+			t.Fatal(err.Error())
+		}
+		deadline := time.Now().Add(5 * time.Second)
+		for search(t, adminRequest, url.Values{"q": {"museum"}}).TotalElements != 1 {
+			if time.Now().After(deadline) {
+				t.Fatalf("Expected the new folder to be indexed")
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+	})
+
+	t.Run("it stops scanning when cancelled", func(t *testing.T) {
+		_ = os.Remove(filepath.Join(tempDir, "holiday", "beach.jpg"))
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		if _, err := testApp.Index.ScanLibrary(ctx, lib); !errors.Is(err, context.Canceled) {
+			t.Errorf("Expected the scan to be cancelled but got: %v", err)
+		}
+		if page := search(t, adminRequest, url.Values{"q": {"beach"}}); page.TotalElements != 1 {
+			t.Errorf("Expected the index to stay as it was but got: %v", page.Elements)
+		}
+	})
+}
@@ -0,0 +1,364 @@
+package controller
+
+import (
+	"errors"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"keydrive/internal/model"
+	"keydrive/internal/service"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type ShareLinkPage struct {
+	TotalElements int64             `json:"totalElements"`
+	Elements      []model.ShareLink `json:"elements"`
+}
+
+type ShareLinkAccessPage struct {
+	TotalElements int64                   `json:"totalElements"`
+	Elements      []model.ShareLinkAccess `json:"elements"`
+}
+
+type CreateShareLinkDTO struct {
+	Path         string     `json:"path" binding:"required"`
+	Password     string     `json:"password"`
+	ExpiresAt    *time.Time `json:"expiresAt"`
+	MaxDownloads int        `json:"maxDownloads" binding:"min=0"`
+	FileDrop     bool       `json:"fileDrop"`
+}
+
+// CreateShareLink
+// @Tags Sharing
+// @Router /api/libraries/{libraryId}/links [post]
+// @Summary Share a file or folder with a public link
+// @Description The link can be opened at /s/{slug}. File drop links only allow uploads to a folder, and require write access.
+// @Security OAuth2
+// @Produce json
+// @Param libraryId path int true "The library id"
+// @Param body body CreateShareLinkDTO true "The entry to share"
+// @Success 201 {object} model.ShareLink
+func CreateShareLink(db *gorm.DB, libs *service.Library, fs *service.FileSystem, links *service.ShareLinks, events *service.Events) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var create CreateShareLinkDTO
+		if err := c.ShouldBindJSON(&create); err != nil {
+			writeError(c, err)
+			return
+		}
+
+		err := db.Transaction(func(tx *gorm.DB) error {
+			library, err := getAccessToLib(c, libs, create.FileDrop, tx)
+			if err != nil {
+				return err
+			}
+			entry, err := fs.GetEntryMetadata(library, create.Path)
+			if err != nil {
+				return err
+			}
+			if create.FileDrop && entry.Category != model.CategoryFolder {
+				return ApiError{Status: http.StatusBadRequest, Description: "only folders can be shared as a file drop"}
+			}
+
+			owner, _ := GetAuthenticatedUser(c)
+			link := model.ShareLink{
+				Library:      library,
+				Path:         path.Join(entry.Parent, entry.Name),
+				Owner:        owner,
+				ExpiresAt:    create.ExpiresAt,
+				MaxDownloads: create.MaxDownloads,
+				FileDrop:     create.FileDrop,
+			}
+			if err := links.CreateShareLink(tx, &link, create.Password); err != nil {
+				return err
+			}
+			events.Publish(service.Event{Type: service.EventShareLinkCreated, LibraryID: library.ID, UserID: owner.ID, Path: link.Path})
+			c.JSON(http.StatusCreated, link)
+			return nil
+		})
+		if err != nil {
+			writeError(c, err)
+		}
+	}
+}
+
+// ListShareLinks
+// @Tags Sharing
+// @Router /api/links [get]
+// @Summary List the public links created by the current user
+// @Description Admins see the links of all users.
+// @Security OAuth2
+// @Produce json
+// @Success 200 {object} ShareLinkPage
+// @Param page query int false "The page number to fetch" default(1)
+// @Param limit query int false "The maximum number of elements to return" default(20)
+func ListShareLinks(db *gorm.DB, links *service.ShareLinks) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var page ShareLinkPage
+		user, _ := GetAuthenticatedUser(c)
+		returnPage(c, links.GetShareLinksForUser(user, db).Order("id"), &page, &page.TotalElements, &page.Elements)
+	}
+}
+
+// DeleteShareLink
+// @Tags Sharing
+// @Router /api/links/{linkId} [delete]
+// @Summary Revoke a public link
+// @Security OAuth2
+// @Param linkId path int true "The link id"
+// @Success 204
+func DeleteShareLink(db *gorm.DB, links *service.ShareLinks, events *service.Events) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		linkId, ok := intParam(c, "linkId")
+		if !ok {
+			simpleError(c, http.StatusNotFound)
+			return
+		}
+		user, _ := GetAuthenticatedUser(c)
+		var link model.ShareLink
+		err := db.Transaction(func(tx *gorm.DB) error {
+			if result := links.GetShareLinksForUser(user, tx).Take(&link, linkId); result.Error != nil {
+				return result.Error
+			}
+			if result := tx.Where("share_link_id = ?", link.ID).Delete(&model.ShareLinkAccess{}); result.Error != nil {
+				return result.Error
+			}
+			return tx.Delete(&model.ShareLink{}, link.ID).Error
+		})
+		if err != nil {
+			writeError(c, err)
+			return
+		}
+		events.Publish(service.Event{Type: service.EventShareLinkDeleted, LibraryID: link.LibraryID, UserID: link.OwnerID, Path: link.Path})
+		c.Status(http.StatusNoContent)
+	}
+}
+
+// ListShareLinkAccesses
+// @Tags Sharing
+// @Router /api/links/{linkId}/accesses [get]
+// @Summary List every time a public link was used
+// @Security OAuth2
+// @Produce json
+// @Param linkId path int true "The link id"
+// @Success 200 {object} ShareLinkAccessPage
+// @Param page query int false "The page number to fetch" default(1)
+// @Param limit query int false "The maximum number of elements to return" default(20)
+func ListShareLinkAccesses(db *gorm.DB, links *service.ShareLinks) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		linkId, ok := intParam(c, "linkId")
+		if !ok {
+			simpleError(c, http.StatusNotFound)
+			return
+		}
+		user, _ := GetAuthenticatedUser(c)
+		var link model.ShareLink
+		if result := links.GetShareLinksForUser(user, db).Take(&link, linkId); result.Error != nil {
+			writeError(c, result.Error)
+			return
+		}
+		var page ShareLinkAccessPage
+		query := db.Model(&model.ShareLinkAccess{}).Where("share_link_id = ?", link.ID).Order("id desc")
+		returnPage(c, query, &page, &page.TotalElements, &page.Elements)
+	}
+}
+
+// openShareLink checks that the link in the request can be used, and writes an error response if it can not. The
+// password is taken from basic authentication, so browsers will prompt for it.
+func openShareLink(c *gin.Context, db *gorm.DB, libs *service.Library, links *service.ShareLinks, writeAccess bool) (model.ShareLink, bool) {
+	_, password, _ := c.Request.BasicAuth()
+	link, err := links.OpenShareLink(c.Param("slug"), password)
+	if err == nil {
+		// The owner may have lost access to the library since the link was created.
+		var access LibraryAccess
+		result := libs.GetLibrariesWithAccessForUser(link.Owner, db).Take(&access, link.LibraryID)
+		if result.Error != nil || (writeAccess && !access.CanWrite) {
+			err = gorm.ErrRecordNotFound
+		}
+	}
+	if err == nil {
+		return link, true
+	}
+
+	if link.ID != 0 {
+		logShareLinkAccess(c, links, link, service.ShareLinkActionDenied, "")
+	}
+	switch {
+	case errors.Is(err, service.ErrShareLinkPassword):
+		c.Header("WWW-Authenticate", "Basic realm=\"KeyDrive share\", charset=\"UTF-8\"")
+		simpleError(c, http.StatusUnauthorized)
+	case errors.Is(err, service.ErrShareLinkExpired):
+		writeJsonError(c, ApiError{Status: http.StatusGone, Description: "this link has expired"})
+	default:
+		writeError(c, err)
+	}
+	return link, false
+}
+
+func logShareLinkAccess(c *gin.Context, links *service.ShareLinks, link model.ShareLink, action string, entryPath string) {
+	if err := links.LogAccess(link, action, entryPath, c.ClientIP(), c.Request.UserAgent()); err != nil {
+		log.Error("failed to log access to share link %d: %s", link.ID, err)
+	}
+}
+
+// DownloadSharedEntry
+// @Tags Sharing
+// @Router /s/{slug} [get]
+// @Summary Download the entry behind a public link
+// @Description Folders are downloaded as a zip archive, unless a path inside the folder is given. Password protected links use basic authentication, with any username. Every request counts towards the download limit, also requests for a range of a file.
+// @Param slug path string true "The link slug"
+// @Param path query string false "A path inside a shared folder"
+// @Param inline query bool false "Show the file in the browser instead of downloading it"
+// @Success 200
+// @Failure 410 {object} ApiError "The link has expired or reached its download limit"
+func DownloadSharedEntry(db *gorm.DB, libs *service.Library, fs *service.FileSystem, links *service.ShareLinks) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		link, ok := openShareLink(c, db, libs, links, false)
+		if !ok {
+			return
+		}
+		if link.FileDrop {
+			writeJsonError(c, ApiError{Status: http.StatusForbidden, Description: "this link only accepts uploads"})
+			return
+		}
+
+		entryPath := links.ResolveSharedPath(link, c.Query("path"))
+		// Every request counts, also those for a range of the file. Otherwise the limit could be bypassed by
+		// downloading a file in ranges that do not start at the beginning.
+		if err := links.CountDownload(&link); err != nil {
+			if errors.Is(err, service.ErrShareLinkExhausted) {
+				logShareLinkAccess(c, links, link, service.ShareLinkActionDenied, entryPath)
+				writeJsonError(c, ApiError{Status: http.StatusGone, Description: err.Error()})
+			} else {
+				writeError(c, err)
+			}
+			return
+		}
+		logShareLinkAccess(c, links, link, service.ShareLinkActionDownload, entryPath)
+		inline, _ := strconv.ParseBool(c.Query("inline"))
+		serveEntry(c, fs, link.Library, entryPath, inline)
+	}
+}
+
+// ListSharedEntries
+// @Tags Sharing
+// @Router /s/{slug}/entries [get]
+// @Summary List the contents of a folder behind a public link
+// @Param slug path string true "The link slug"
+// @Param parent query string false "A path inside the shared folder"
+// @Produce json
+// @Success 200 {array} service.FileInfo
+func ListSharedEntries(db *gorm.DB, libs *service.Library, fs *service.FileSystem, links *service.ShareLinks) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		link, ok := openShareLink(c, db, libs, links, false)
+		if !ok {
+			return
+		}
+		if link.FileDrop {
+			writeJsonError(c, ApiError{Status: http.StatusForbidden, Description: "this link only accepts uploads"})
+			return
+		}
+
+		shared, err := fs.GetEntryMetadata(link.Library, link.Path)
+		if err != nil {
+			writeError(c, err)
+			return
+		}
+		entries := []service.FileInfo{shared}
+		parentPath := links.ResolveSharedPath(link, c.Query("parent"))
+		if shared.Category == model.CategoryFolder {
+			entries, err = fs.GetEntriesForLibrary(link.Library, parentPath)
+			if err != nil {
+				writeError(c, err)
+				return
+			}
+		}
+		logShareLinkAccess(c, links, link, service.ShareLinkActionView, parentPath)
+
+		// Paths are reported relative to the shared entry, so the location in the library stays private.
+		for i := range entries {
+			if shared.Category == model.CategoryFolder {
+				entries[i].Parent = path.Join("/", strings.TrimPrefix(entries[i].Parent, link.Path))
+			} else {
+				entries[i].Parent = "/"
+			}
+		}
+		c.JSON(http.StatusOK, entries)
+	}
+}
+
+type UploadSharedEntryDTO struct {
+	Name string                `binding:"" form:"name"`
+	Data *multipart.FileHeader `binding:"required" form:"data"`
+}
+
+// UploadSharedEntry
+// @Tags Sharing
+// @Router /s/{slug}/entries [post]
+// @Summary Upload a file to a file drop link
+// @Description Existing files are never replaced.
+// @Param slug path string true "The link slug"
+// @Param name formData string false "The name of the file"
+// @Param data formData file true "The file contents"
+// @Accept multipart/form-data
+// @Success 201
+// @Failure 409 {object} ApiError "A file with this name already exists"
+func UploadSharedEntry(db *gorm.DB, libs *service.Library, fs *service.FileSystem, links *service.ShareLinks, quotas *service.Quotas) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		link, ok := openShareLink(c, db, libs, links, true)
+		if !ok {
+			return
+		}
+		if !link.FileDrop {
+			writeJsonError(c, ApiError{Status: http.StatusForbidden, Description: "this link does not accept uploads"})
+			return
+		}
+		// Files that are dropped count towards the quota of the owner of the link, which is checked before the anonymous
+		// body is read.
+		if err := limitUploadFor(c, quotas, link.Library, link.Owner); err != nil {
+			writeError(c, err)
+			return
+		}
+		var request UploadSharedEntryDTO
+		if err := c.ShouldBind(&request); err != nil {
+			writeError(c, err)
+			return
+		}
+
+		name := request.Name
+		if name == "" {
+			name = request.Data.Filename
+		}
+		name = path.Base("/" + name)
+		if _, err := fs.GetEntryMetadata(link.Library, path.Join(link.Path, name)); err == nil {
+			writeJsonError(c, ApiError{Status: http.StatusConflict, Description: "a file with this name already exists"})
+			return
+		} else if !os.IsNotExist(err) {
+			writeError(c, err)
+			return
+		}
+		if err := quotas.Check(link.Library, link.Owner, request.Data.Size); err != nil {
+			writeError(c, err)
+			return
+		}
+		// A file with the same name can still be dropped while this one is written, so it is never replaced.
+		if _, err := fs.CreateFileInLibrary(link.Library, name, link.Path, request.Data); errors.Is(err, service.ErrEntryExists) {
+			writeJsonError(c, ApiError{Status: http.StatusConflict, Description: "a file with this name already exists"})
+			return
+		} else if err != nil {
+			writeError(c, err)
+			return
+		}
+		if err := quotas.Claim(link.Library, path.Join(link.Path, name), link.OwnerID); err != nil {
+			writeError(c, err)
+			return
+		}
+		logShareLinkAccess(c, links, link, service.ShareLinkActionUpload, path.Join(link.Path, name))
+		// Visitors of a file drop are not allowed to see what is in the folder, so nothing is returned.
+		c.Status(http.StatusCreated)
+	}
+}
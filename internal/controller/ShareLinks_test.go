@@ -0,0 +1,144 @@
+package controller
+
+import (
+	"bytes"
+	"fmt"
+	"keydrive/internal/model"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestShareLinks(t *testing.T) {
+	tempDir := t.TempDir()
+	_ = os.Mkdir(filepath.Join(tempDir, "drop"), 0777)
+	_ = os.WriteFile(filepath.Join(tempDir, "shared.txt"), []byte("Shared\n"), 0777)
+
+	lib := model.Library{
+		Type:       model.TypeGeneric,
+		Name:       "Test Library",
+		RootFolder: tempDir,
+	}
+	testApp.DB.Create(&lib)
+
+	createLink := func(t *testing.T, body string) model.ShareLink {
+		req := adminRequest("POST", fmt.Sprintf("/api/libraries/%d/links", lib.ID), strings.NewReader(body))
+		recorder := httptest.NewRecorder()
+		testApp.Router.ServeHTTP(recorder, req)
+		assertStatus(t, recorder, 201)
+		var link model.ShareLink
+		assertJsonUnmarshal(t, recorder, &link)
+		return link
+	}
+
+	open := func(link model.ShareLink, password string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", fmt.Sprintf("/s/%s", link.Slug), nil)
+		if password != "" {
+			req.SetBasicAuth("guest", password)
+		}
+		recorder := httptest.NewRecorder()
+		testApp.Router.ServeHTTP(recorder, req)
+		return recorder
+	}
+
+	t.Run("it downloads a shared file", func(t *testing.T) {
+		link := createLink(t, `{"path": "/shared.txt"}`)
+		recorder := open(link, "")
+
+		assertStatus(t, recorder, 200)
+		if body := recorder.Body.String(); body != "Shared\n" {
+			t.Errorf("Expected [Shared] but got: %s", body)
+		}
+	})
+
+	t.Run("it requires the password", func(t *testing.T) {
+		link := createLink(t, `{"path": "/shared.txt", "password": "secret"}`)
+		if !link.HasPassword {
+			t.Errorf("Expected the link to have a password")
+		}
+
+		assertStatus(t, open(link, ""), 401)
+		assertStatus(t, open(link, "wrong"), 401)
+		assertStatus(t, open(link, "secret"), 200)
+	})
+
+	t.Run("it limits the number of downloads", func(t *testing.T) {
+		link := createLink(t, `{"path": "/shared.txt", "maxDownloads": 1}`)
+
+		assertStatus(t, open(link, ""), 200)
+		assertStatus(t, open(link, ""), 410)
+	})
+
+	t.Run("it counts downloads of ranges", func(t *testing.T) {
+		link := createLink(t, `{"path": "/shared.txt", "maxDownloads": 1}`)
+		for i, expected := range []int{206, 410} {
+			req, _ := http.NewRequest("GET", fmt.Sprintf("/s/%s", link.Slug), nil)
+			req.Header.Set("Range", fmt.Sprintf("bytes=%d-", i+1))
+			recorder := httptest.NewRecorder()
+			testApp.Router.ServeHTTP(recorder, req)
+			assertStatus(t, recorder, expected)
+		}
+	})
+
+	t.Run("it does not open expired links", func(t *testing.T) {
+		link := createLink(t, `{"path": "/shared.txt", "expiresAt": "2000-01-01T00:00:00Z"}`)
+		assertStatus(t, open(link, ""), 410)
+	})
+
+	t.Run("it accepts uploads to a file drop", func(t *testing.T) {
+		link := createLink(t, `{"path": "/drop", "fileDrop": true}`)
+		assertStatus(t, open(link, ""), 403)
+
+		body := &bytes.Buffer{}
+		writer := multipart.NewWriter(body)
+		part, _ := writer.CreateFormFile("data", "dropped.txt")
+		_, _ = part.Write([]byte("Dropped\n"))
+		_ = writer.Close()
+		req, _ := http.NewRequest("POST", fmt.Sprintf("/s/%s/entries", link.Slug), body)
+		req.Header.Set("Content-Type", writer.FormDataContentType())
+		recorder := httptest.NewRecorder()
+		testApp.Router.ServeHTTP(recorder, req)
+
+		assertStatus(t, recorder, 201)
+		if _, err := os.Stat(filepath.Join(tempDir, "drop", "dropped.txt")); err != nil {
+			t.Errorf("Dropped file does not exist: %s", err)
+		}
+	})
+
+	t.Run("it revokes a link", func(t *testing.T) {
+		link := createLink(t, `{"path": "/shared.txt"}`)
+		req := adminRequest("DELETE", fmt.Sprintf("/api/links/%d", link.ID), nil)
+		recorder := httptest.NewRecorder()
+		testApp.Router.ServeHTTP(recorder, req)
+		assertStatus(t, recorder, 204)
+
+		assertStatus(t, open(link, ""), 404)
+	})
+
+	t.Run("it logs every access", func(t *testing.T) {
+		link := createLink(t, `{"path": "/shared.txt"}`)
+		open(link, "")
+
+		req := adminRequest("GET", fmt.Sprintf("/api/links/%d/accesses", link.ID), nil)
+		recorder := httptest.NewRecorder()
+		testApp.Router.ServeHTTP(recorder, req)
+		assertStatus(t, recorder, 200)
+		var page ShareLinkAccessPage
+		assertJsonUnmarshal(t, recorder, &page)
+		if page.TotalElements != 1 || page.Elements[0].Action != "download" {
+			t.Errorf("Expected a single download but got: %s", recorder.Body.String())
+		}
+	})
+
+	t.Run("it does not allow other users to revoke a link", func(t *testing.T) {
+		link := createLink(t, `{"path": "/shared.txt"}`)
+		req := regularUserRequest("DELETE", fmt.Sprintf("/api/links/%d", link.ID), nil)
+		recorder := httptest.NewRecorder()
+		testApp.Router.ServeHTTP(recorder, req)
+		assertStatus(t, recorder, 404)
+	})
+}
@@ -0,0 +1,569 @@
+package controller
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"keydrive/internal/model"
+	"keydrive/internal/service"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// subsonicIgnoredArticles are left out when artists are sorted into indexes.
+const subsonicIgnoredArticles = "The"
+
+// AuthenticateSubsonic reads the credentials of the Subsonic API. Clients send either a token and a salt, which works
+// with Subsonic app passwords, or the password itself, which works with any app password of the user. The password of
+// the user itself is not accepted, since clients send it in the url.
+func AuthenticateSubsonic(appPasswords *service.AppPasswords, metrics *Metrics) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		username := c.Request.FormValue("u")
+		token, salt, password := c.Request.FormValue("t"), c.Request.FormValue("s"), c.Request.FormValue("p")
+		if username == "" || (password == "" && (token == "" || salt == "")) {
+			writeSubsonicError(c, subsonicErrorMissingParameter, "required parameter is missing")
+			return
+		}
+		var user model.User
+		var ok bool
+		if token != "" {
+			user, ok = appPasswords.AuthenticateToken(username, token, salt)
+		} else {
+			if strings.HasPrefix(password, "enc:") {
+				decoded, err := hex.DecodeString(password[len("enc:"):])
+				if err != nil {
+					metrics.LoginFailures.Inc("subsonic")
+					writeSubsonicError(c, subsonicErrorWrongCredentials, "wrong username or password")
+					return
+				}
+				password = string(decoded)
+			}
+			user, ok = appPasswords.AuthenticateAppPassword(username, password)
+		}
+		if !ok {
+			metrics.LoginFailures.Inc("subsonic")
+			writeSubsonicError(c, subsonicErrorWrongCredentials, "wrong username or password")
+			return
+		}
+		c.Set(ContextKeyUser, user)
+		c.Next()
+	}
+}
+
+// Artists and albums only exist in tags, so their ids are made from their names.
+
+func subsonicArtistId(artist string) string {
+	return "ar-" + base64.RawURLEncoding.EncodeToString([]byte(artist))
+}
+
+func subsonicAlbumId(artist string, album string) string {
+	return "al-" + base64.RawURLEncoding.EncodeToString([]byte(artist+"\x00"+album))
+}
+
+func parseSubsonicArtistId(id string) (string, bool) {
+	if !strings.HasPrefix(id, "ar-") {
+		return "", false
+	}
+	artist, err := base64.RawURLEncoding.DecodeString(id[len("ar-"):])
+	return string(artist), err == nil
+}
+
+func parseSubsonicAlbumId(id string) (string, string, bool) {
+	if !strings.HasPrefix(id, "al-") {
+		return "", "", false
+	}
+	decoded, err := base64.RawURLEncoding.DecodeString(id[len("al-"):])
+	if err != nil {
+		return "", "", false
+	}
+	artist, album, found := strings.Cut(string(decoded), "\x00")
+	return artist, album, found
+}
+
+// subsonicIndexName returns the index in which an artist or a folder is listed.
+func subsonicIndexName(name string) string {
+	for _, article := range strings.Fields(subsonicIgnoredArticles) {
+		if len(name) > len(article)+1 && strings.EqualFold(name[:len(article)+1], article+" ") {
+			name = name[len(article)+1:]
+			break
+		}
+	}
+	if first, _ := utf8.DecodeRuneInString(name); unicode.IsLetter(first) {
+		return string(unicode.ToUpper(first))
+	}
+	return "#"
+}
+
+func writeSubsonicFailure(c *gin.Context, err error) {
+	if errors.Is(err, gorm.ErrRecordNotFound) || errors.Is(err, service.ErrNoCover) {
+		writeSubsonicError(c, subsonicErrorNotFound, "not found")
+		return
+	}
+	writeSubsonicError(c, subsonicErrorGeneric, err.Error())
+}
+
+// inSubsonicMusicFolder limits a query to the music folder the client asked for, if any.
+func inSubsonicMusicFolder(c *gin.Context, query *gorm.DB) *gorm.DB {
+	if folderId, err := strconv.Atoi(c.Request.FormValue("musicFolderId")); err == nil {
+		return query.Where("library_id = ?", folderId)
+	}
+	return query
+}
+
+func subsonicIntParam(c *gin.Context, name string, defaultValue int, max int) int {
+	value, err := strconv.Atoi(c.Request.FormValue(name))
+	if err != nil || value < 0 {
+		return defaultValue
+	}
+	if value > max {
+		return max
+	}
+	return value
+}
+
+func subsonicSong(entry model.IndexedEntry) subsonicChild {
+	song := subsonicChild{
+		ID:          strconv.Itoa(entry.ID),
+		Title:       strings.TrimSuffix(entry.Name, path.Ext(entry.Name)),
+		Size:        entry.Size,
+		ContentType: entry.MimeType,
+		Suffix:      strings.ToLower(strings.TrimPrefix(path.Ext(entry.Name), ".")),
+		Path:        strings.TrimPrefix(entry.Path, "/"),
+		Created:     entry.Modified,
+		Type:        "music",
+	}
+	if metadata := entry.Metadata; metadata != nil {
+		if metadata.Title != "" {
+			song.Title = metadata.Title
+		}
+		song.Album = metadata.Album
+		song.Artist = metadata.Artist
+		song.Track = metadata.Track
+		song.DiscNumber = metadata.Disc
+		song.Year = metadata.Year
+		song.Genre = metadata.Genre
+		if metadata.HasCover {
+			song.CoverArt = song.ID
+		}
+		artist := metadata.AlbumArtist
+		if artist == "" {
+			artist = metadata.Artist
+		}
+		if artist != "" {
+			song.ArtistID = subsonicArtistId(artist)
+			if metadata.Album != "" {
+				song.AlbumID = subsonicAlbumId(artist, metadata.Album)
+			}
+		}
+	}
+	return song
+}
+
+func subsonicChildren(entries []model.IndexedEntry, parent string) []subsonicChild {
+	children := make([]subsonicChild, 0, len(entries))
+	for _, entry := range entries {
+		var child subsonicChild
+		if entry.Category == model.CategoryFolder {
+			child = subsonicChild{ID: strconv.Itoa(entry.ID), IsDir: true, Title: entry.Name, Created: entry.Modified}
+		} else {
+			child = subsonicSong(entry)
+		}
+		child.Parent = parent
+		children = append(children, child)
+	}
+	return children
+}
+
+func subsonicAlbumInfo(album service.MusicAlbum) subsonicAlbumID3 {
+	info := subsonicAlbumID3{
+		ID:        subsonicAlbumId(album.Artist, album.Name),
+		Name:      album.Name,
+		Artist:    album.Artist,
+		ArtistID:  subsonicArtistId(album.Artist),
+		SongCount: album.Songs,
+		Created:   album.Modified,
+		Year:      album.Year,
+		Genre:     album.Genre,
+	}
+	if album.CoverID != 0 {
+		info.CoverArt = strconv.Itoa(album.CoverID)
+	}
+	return info
+}
+
+// getSubsonicEntry finds the entry with the id in the id parameter in the music libraries of the user.
+func getSubsonicEntry(c *gin.Context, db *gorm.DB, index *service.Index) (model.IndexedEntry, model.Library, error) {
+	var entry model.IndexedEntry
+	id, err := strconv.Atoi(c.Request.FormValue("id"))
+	if err != nil {
+		return entry, model.Library{}, gorm.ErrRecordNotFound
+	}
+	user, _ := GetAuthenticatedUser(c)
+	if result := index.GetMusicEntries(user, db).Take(&entry, id); result.Error != nil {
+		return entry, model.Library{}, result.Error
+	}
+	var library model.Library
+	result := db.Take(&library, entry.LibraryID)
+	return entry, library, result.Error
+}
+
+// SubsonicPing
+// @Tags Subsonic
+// @Router /rest/ping [get]
+// @Summary Check the connection and the credentials of a Subsonic client
+// @Description The Subsonic API serves music libraries to Subsonic and OpenSubsonic clients. Clients authenticate with a username and an app password, or with a token and a salt made from a Subsonic app password. The password of the user itself is not accepted.
+// @Produce xml
+// @Produce json
+// @Param u query string true "The username"
+// @Param t query string false "The md5 hash of a Subsonic app password followed by the salt"
+// @Param s query string false "The salt of the token"
+// @Param p query string false "An app password, optionally hex encoded with an enc: prefix"
+// @Param f query string false "The format of the response" Enums(xml, json)
+// @Success 200
+func SubsonicPing() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		writeSubsonic(c, subsonicResponse{})
+	}
+}
+
+// SubsonicGetMusicFolders
+// @Tags Subsonic
+// @Router /rest/getMusicFolders [get]
+// @Summary List the music libraries of the user
+// @Produce xml
+// @Produce json
+// @Success 200
+func SubsonicGetMusicFolders(db *gorm.DB, libs *service.Library) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		user, _ := GetAuthenticatedUser(c)
+		var libraries []model.Library
+		if result := libs.GetLibrariesForUser(user, db).Where("type = ?", model.TypeMusic).Order("name").Find(&libraries); result.Error != nil {
+			writeSubsonicFailure(c, result.Error)
+			return
+		}
+		folders := &subsonicMusicFolders{MusicFolders: []subsonicMusicFolder{}}
+		for _, library := range libraries {
+			folders.MusicFolders = append(folders.MusicFolders, subsonicMusicFolder{ID: library.ID, Name: library.Name})
+		}
+		writeSubsonic(c, subsonicResponse{MusicFolders: folders})
+	}
+}
+
+// SubsonicGetIndexes
+// @Tags Subsonic
+// @Router /rest/getIndexes [get]
+// @Summary List the folders and the songs in the root of the music libraries
+// @Produce xml
+// @Produce json
+// @Param musicFolderId query int false "Only list this music library"
+// @Success 200
+func SubsonicGetIndexes(db *gorm.DB, index *service.Index) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		user, _ := GetAuthenticatedUser(c)
+		var entries []model.IndexedEntry
+		query := index.GetMusicEntries(user, db).
+			Where("parent = ? AND category IN ?", "/", []model.Category{model.CategoryFolder, model.CategoryAudio}).
+			Order("name")
+		if result := inSubsonicMusicFolder(c, query).Find(&entries); result.Error != nil {
+			writeSubsonicFailure(c, result.Error)
+			return
+		}
+		indexes := &subsonicIndexes{IgnoredArticles: subsonicIgnoredArticles, Indexes: []subsonicIndex{}}
+		var lastModified time.Time
+		var songs []model.IndexedEntry
+		for _, entry := range entries {
+			if entry.Modified.After(lastModified) {
+				lastModified = entry.Modified
+			}
+			if entry.Category != model.CategoryFolder {
+				songs = append(songs, entry)
+				continue
+			}
+			name := subsonicIndexName(entry.Name)
+			if len(indexes.Indexes) == 0 || indexes.Indexes[len(indexes.Indexes)-1].Name != name {
+				indexes.Indexes = append(indexes.Indexes, subsonicIndex{Name: name})
+			}
+			last := &indexes.Indexes[len(indexes.Indexes)-1]
+			last.Artists = append(last.Artists, subsonicIndexArtist{ID: strconv.Itoa(entry.ID), Name: entry.Name})
+		}
+		indexes.LastModified = lastModified.UnixMilli()
+		indexes.Children = subsonicChildren(songs, "")
+		writeSubsonic(c, subsonicResponse{Indexes: indexes})
+	}
+}
+
+// SubsonicGetMusicDirectory
+// @Tags Subsonic
+// @Router /rest/getMusicDirectory [get]
+// @Summary List the folders and the songs in a folder
+// @Produce xml
+// @Produce json
+// @Param id query string true "The id of the folder"
+// @Success 200
+func SubsonicGetMusicDirectory(db *gorm.DB, index *service.Index) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		folder, _, err := getSubsonicEntry(c, db, index)
+		if err == nil && folder.Category != model.CategoryFolder {
+			err = gorm.ErrRecordNotFound
+		}
+		if err != nil {
+			writeSubsonicFailure(c, err)
+			return
+		}
+		user, _ := GetAuthenticatedUser(c)
+		var entries []model.IndexedEntry
+		result := index.GetMusicEntries(user, db).
+			Where("library_id = ? AND parent = ? AND category IN ?", folder.LibraryID, folder.Path, []model.Category{model.CategoryFolder, model.CategoryAudio}).
+			Order("name").
+			Find(&entries)
+		if result.Error != nil {
+			writeSubsonicFailure(c, result.Error)
+			return
+		}
+		id := strconv.Itoa(folder.ID)
+		directory := &subsonicDirectory{ID: id, Name: folder.Name, Children: subsonicChildren(entries, id)}
+		if folder.Parent != "/" {
+			var parent model.IndexedEntry
+			if result := db.Where("library_id = ? AND path = ?", folder.LibraryID, folder.Parent).Take(&parent); result.Error == nil {
+				directory.Parent = strconv.Itoa(parent.ID)
+			}
+		}
+		writeSubsonic(c, subsonicResponse{Directory: directory})
+	}
+}
+
+// SubsonicGetArtists
+// @Tags Subsonic
+// @Router /rest/getArtists [get]
+// @Summary List the artists of albums, as read from the tags of the songs
+// @Produce xml
+// @Produce json
+// @Param musicFolderId query int false "Only list this music library"
+// @Success 200
+func SubsonicGetArtists(db *gorm.DB, index *service.Index) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		user, _ := GetAuthenticatedUser(c)
+		var artists []service.MusicArtist
+		if result := inSubsonicMusicFolder(c, index.GetMusicArtists(user, db)).Scan(&artists); result.Error != nil {
+			writeSubsonicFailure(c, result.Error)
+			return
+		}
+		response := &subsonicArtists{IgnoredArticles: subsonicIgnoredArticles, Indexes: []subsonicArtistIndex{}}
+		indexes := make(map[string]int)
+		for _, artist := range artists {
+			name := subsonicIndexName(artist.Name)
+			position, found := indexes[name]
+			if !found {
+				position = len(response.Indexes)
+				indexes[name] = position
+				response.Indexes = append(response.Indexes, subsonicArtistIndex{Name: name})
+			}
+			response.Indexes[position].Artists = append(response.Indexes[position].Artists, subsonicArtistID3{
+				ID:         subsonicArtistId(artist.Name),
+				Name:       artist.Name,
+				AlbumCount: artist.Albums,
+			})
+		}
+		writeSubsonic(c, subsonicResponse{Artists: response})
+	}
+}
+
+// SubsonicGetArtist
+// @Tags Subsonic
+// @Router /rest/getArtist [get]
+// @Summary List the albums of an artist
+// @Produce xml
+// @Produce json
+// @Param id query string true "The id of the artist"
+// @Success 200
+func SubsonicGetArtist(db *gorm.DB, index *service.Index) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		name, ok := parseSubsonicArtistId(c.Request.FormValue("id"))
+		if !ok {
+			writeSubsonicFailure(c, gorm.ErrRecordNotFound)
+			return
+		}
+		user, _ := GetAuthenticatedUser(c)
+		var albums []service.MusicAlbum
+		if result := index.GetArtistAlbums(user, name, db).Scan(&albums); result.Error != nil {
+			writeSubsonicFailure(c, result.Error)
+			return
+		}
+		if len(albums) == 0 {
+			writeSubsonicFailure(c, gorm.ErrRecordNotFound)
+			return
+		}
+		artist := &subsonicArtist{
+			subsonicArtistID3: subsonicArtistID3{ID: subsonicArtistId(name), Name: name, AlbumCount: len(albums)},
+			Albums:            []subsonicAlbumID3{},
+		}
+		for _, album := range albums {
+			artist.Albums = append(artist.Albums, subsonicAlbumInfo(album))
+		}
+		writeSubsonic(c, subsonicResponse{Artist: artist})
+	}
+}
+
+// SubsonicGetAlbum
+// @Tags Subsonic
+// @Router /rest/getAlbum [get]
+// @Summary List the songs of an album
+// @Produce xml
+// @Produce json
+// @Param id query string true "The id of the album"
+// @Success 200
+func SubsonicGetAlbum(db *gorm.DB, index *service.Index) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		artist, name, ok := parseSubsonicAlbumId(c.Request.FormValue("id"))
+		if !ok {
+			writeSubsonicFailure(c, gorm.ErrRecordNotFound)
+			return
+		}
+		user, _ := GetAuthenticatedUser(c)
+		var albums []service.MusicAlbum
+		if result := index.GetArtistAlbums(user, artist, db).Where("metadata->>'album' = ?", name).Scan(&albums); result.Error != nil {
+			writeSubsonicFailure(c, result.Error)
+			return
+		}
+		if len(albums) == 0 {
+			writeSubsonicFailure(c, gorm.ErrRecordNotFound)
+			return
+		}
+		var songs []model.IndexedEntry
+		if result := index.GetAlbumSongs(user, artist, name, db).Find(&songs); result.Error != nil {
+			writeSubsonicFailure(c, result.Error)
+			return
+		}
+		album := &subsonicAlbum{subsonicAlbumID3: subsonicAlbumInfo(albums[0]), Songs: subsonicChildren(songs, "")}
+		writeSubsonic(c, subsonicResponse{Album: album})
+	}
+}
+
+// SubsonicSearch3
+// @Tags Subsonic
+// @Router /rest/search3 [get]
+// @Summary Search for artists, albums and songs
+// @Description An empty query matches everything, so clients can page through the whole collection.
+// @Produce xml
+// @Produce json
+// @Param query query string true "The text to search for"
+// @Param artistCount query int false "The maximum number of artists to return" default(20)
+// @Param artistOffset query int false "The number of artists to skip" default(0)
+// @Param albumCount query int false "The maximum number of albums to return" default(20)
+// @Param albumOffset query int false "The number of albums to skip" default(0)
+// @Param songCount query int false "The maximum number of songs to return" default(20)
+// @Param songOffset query int false "The number of songs to skip" default(0)
+// @Param musicFolderId query int false "Only search this music library"
+// @Success 200
+func SubsonicSearch3(db *gorm.DB, index *service.Index) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		user, _ := GetAuthenticatedUser(c)
+		// Some clients send two quotes to list everything.
+		text := strings.Trim(c.Request.FormValue("query"), "\"")
+		page := func(query *gorm.DB, name string) *gorm.DB {
+			count := subsonicIntParam(c, name+"Count", 20, 500)
+			offset := subsonicIntParam(c, name+"Offset", 0, 1<<30)
+			return inSubsonicMusicFolder(c, query).Offset(offset).Limit(count)
+		}
+
+		var artists []service.MusicArtist
+		if result := page(index.SearchMusicArtists(user, text, db), "artist").Scan(&artists); result.Error != nil {
+			writeSubsonicFailure(c, result.Error)
+			return
+		}
+		var albums []service.MusicAlbum
+		if result := page(index.SearchMusicAlbums(user, text, db), "album").Scan(&albums); result.Error != nil {
+			writeSubsonicFailure(c, result.Error)
+			return
+		}
+		var songs []model.IndexedEntry
+		if result := page(index.SearchSongs(user, text, db), "song").Find(&songs); result.Error != nil {
+			writeSubsonicFailure(c, result.Error)
+			return
+		}
+
+		results := &subsonicSearchResult3{
+			Artists: []subsonicArtistID3{},
+			Albums:  []subsonicAlbumID3{},
+			Songs:   subsonicChildren(songs, ""),
+		}
+		for _, artist := range artists {
+			results.Artists = append(results.Artists, subsonicArtistID3{ID: subsonicArtistId(artist.Name), Name: artist.Name, AlbumCount: artist.Albums})
+		}
+		for _, album := range albums {
+			results.Albums = append(results.Albums, subsonicAlbumInfo(album))
+		}
+		writeSubsonic(c, subsonicResponse{SearchResult3: results})
+	}
+}
+
+// SubsonicStream
+// @Tags Subsonic
+// @Router /rest/stream [get]
+// @Summary Stream a song
+// @Description Songs are sent as they are stored, they are not transcoded. Range requests are supported.
+// @Param id query string true "The id of the song"
+// @Success 200
+func SubsonicStream(db *gorm.DB, fs *service.FileSystem, index *service.Index) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		entry, library, err := getSubsonicEntry(c, db, index)
+		if err == nil && entry.Category != model.CategoryAudio {
+			err = gorm.ErrRecordNotFound
+		}
+		if err != nil {
+			writeSubsonicFailure(c, err)
+			return
+		}
+		serveEntry(c, fs, library, entry.Path, true)
+	}
+}
+
+// SubsonicDownload
+// @Tags Subsonic
+// @Router /rest/download [get]
+// @Summary Download a song or a folder
+// @Param id query string true "The id of the song or the folder"
+// @Success 200
+func SubsonicDownload(db *gorm.DB, fs *service.FileSystem, index *service.Index) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		entry, library, err := getSubsonicEntry(c, db, index)
+		if err != nil {
+			writeSubsonicFailure(c, err)
+			return
+		}
+		serveEntry(c, fs, library, entry.Path, false)
+	}
+}
+
+// SubsonicGetCoverArt
+// @Tags Subsonic
+// @Router /rest/getCoverArt [get]
+// @Summary Get the artwork embedded in a song
+// @Produce image/jpeg
+// @Produce image/png
+// @Param id query string true "The id of the cover art"
+// @Success 200
+func SubsonicGetCoverArt(db *gorm.DB, fs *service.FileSystem, index *service.Index) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		entry, library, err := getSubsonicEntry(c, db, index)
+		if err != nil {
+			writeSubsonicFailure(c, err)
+			return
+		}
+		cover, err := fs.ReadCover(library, entry.Path)
+		if err != nil {
+			writeSubsonicFailure(c, err)
+			return
+		}
+		c.Header("Cache-Control", "private, max-age=86400")
+		c.Header("X-Content-Type-Options", "nosniff")
+		c.Data(http.StatusOK, cover.MimeType, cover.Data)
+	}
+}
@@ -0,0 +1,172 @@
+package controller
+
+import (
+	"encoding/xml"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"time"
+)
+
+// subsonicApiVersion is the version of the Subsonic API that is implemented.
+const subsonicApiVersion = "1.16.1"
+
+// Error codes of the Subsonic API.
+const (
+	subsonicErrorGeneric          = 0
+	subsonicErrorMissingParameter = 10
+	subsonicErrorWrongCredentials = 40
+	subsonicErrorNotFound         = 70
+)
+
+type subsonicResponse struct {
+	XMLName       xml.Name               `xml:"http://subsonic.org/restapi subsonic-response" json:"-"`
+	Status        string                 `xml:"status,attr" json:"status"`
+	Version       string                 `xml:"version,attr" json:"version"`
+	Type          string                 `xml:"type,attr" json:"type"`
+	OpenSubsonic  bool                   `xml:"openSubsonic,attr" json:"openSubsonic"`
+	Error         *subsonicError         `xml:"error,omitempty" json:"error,omitempty"`
+	MusicFolders  *subsonicMusicFolders  `xml:"musicFolders,omitempty" json:"musicFolders,omitempty"`
+	Indexes       *subsonicIndexes       `xml:"indexes,omitempty" json:"indexes,omitempty"`
+	Directory     *subsonicDirectory     `xml:"directory,omitempty" json:"directory,omitempty"`
+	Artists       *subsonicArtists       `xml:"artists,omitempty" json:"artists,omitempty"`
+	Artist        *subsonicArtist        `xml:"artist,omitempty" json:"artist,omitempty"`
+	Album         *subsonicAlbum         `xml:"album,omitempty" json:"album,omitempty"`
+	SearchResult3 *subsonicSearchResult3 `xml:"searchResult3,omitempty" json:"searchResult3,omitempty"`
+}
+
+type subsonicError struct {
+	Code    int    `xml:"code,attr" json:"code"`
+	Message string `xml:"message,attr" json:"message"`
+}
+
+type subsonicMusicFolders struct {
+	MusicFolders []subsonicMusicFolder `xml:"musicFolder" json:"musicFolder"`
+}
+
+type subsonicMusicFolder struct {
+	ID   int    `xml:"id,attr" json:"id"`
+	Name string `xml:"name,attr" json:"name"`
+}
+
+type subsonicIndexes struct {
+	LastModified    int64           `xml:"lastModified,attr" json:"lastModified"`
+	IgnoredArticles string          `xml:"ignoredArticles,attr" json:"ignoredArticles"`
+	Indexes         []subsonicIndex `xml:"index" json:"index"`
+	Children        []subsonicChild `xml:"child" json:"child,omitempty"`
+}
+
+type subsonicIndex struct {
+	Name    string                `xml:"name,attr" json:"name"`
+	Artists []subsonicIndexArtist `xml:"artist" json:"artist"`
+}
+
+type subsonicIndexArtist struct {
+	ID   string `xml:"id,attr" json:"id"`
+	Name string `xml:"name,attr" json:"name"`
+}
+
+type subsonicDirectory struct {
+	ID       string          `xml:"id,attr" json:"id"`
+	Parent   string          `xml:"parent,attr,omitempty" json:"parent,omitempty"`
+	Name     string          `xml:"name,attr" json:"name"`
+	Children []subsonicChild `xml:"child" json:"child"`
+}
+
+// subsonicChild is a song or a folder.
+type subsonicChild struct {
+	ID          string    `xml:"id,attr" json:"id"`
+	Parent      string    `xml:"parent,attr,omitempty" json:"parent,omitempty"`
+	IsDir       bool      `xml:"isDir,attr" json:"isDir"`
+	Title       string    `xml:"title,attr" json:"title"`
+	Album       string    `xml:"album,attr,omitempty" json:"album,omitempty"`
+	Artist      string    `xml:"artist,attr,omitempty" json:"artist,omitempty"`
+	Track       int       `xml:"track,attr,omitempty" json:"track,omitempty"`
+	DiscNumber  int       `xml:"discNumber,attr,omitempty" json:"discNumber,omitempty"`
+	Year        int       `xml:"year,attr,omitempty" json:"year,omitempty"`
+	Genre       string    `xml:"genre,attr,omitempty" json:"genre,omitempty"`
+	CoverArt    string    `xml:"coverArt,attr,omitempty" json:"coverArt,omitempty"`
+	Size        int64     `xml:"size,attr,omitempty" json:"size,omitempty"`
+	ContentType string    `xml:"contentType,attr,omitempty" json:"contentType,omitempty"`
+	Suffix      string    `xml:"suffix,attr,omitempty" json:"suffix,omitempty"`
+	Path        string    `xml:"path,attr,omitempty" json:"path,omitempty"`
+	Created     time.Time `xml:"created,attr" json:"created"`
+	AlbumID     string    `xml:"albumId,attr,omitempty" json:"albumId,omitempty"`
+	ArtistID    string    `xml:"artistId,attr,omitempty" json:"artistId,omitempty"`
+	Type        string    `xml:"type,attr,omitempty" json:"type,omitempty"`
+}
+
+type subsonicArtists struct {
+	IgnoredArticles string                `xml:"ignoredArticles,attr" json:"ignoredArticles"`
+	Indexes         []subsonicArtistIndex `xml:"index" json:"index"`
+}
+
+type subsonicArtistIndex struct {
+	Name    string              `xml:"name,attr" json:"name"`
+	Artists []subsonicArtistID3 `xml:"artist" json:"artist"`
+}
+
+type subsonicArtistID3 struct {
+	ID         string `xml:"id,attr" json:"id"`
+	Name       string `xml:"name,attr" json:"name"`
+	AlbumCount int    `xml:"albumCount,attr" json:"albumCount"`
+}
+
+type subsonicArtist struct {
+	subsonicArtistID3
+	Albums []subsonicAlbumID3 `xml:"album" json:"album"`
+}
+
+type subsonicAlbumID3 struct {
+	ID        string    `xml:"id,attr" json:"id"`
+	Name      string    `xml:"name,attr" json:"name"`
+	Artist    string    `xml:"artist,attr" json:"artist"`
+	ArtistID  string    `xml:"artistId,attr" json:"artistId"`
+	CoverArt  string    `xml:"coverArt,attr,omitempty" json:"coverArt,omitempty"`
+	SongCount int       `xml:"songCount,attr" json:"songCount"`
+	Duration  int       `xml:"duration,attr" json:"duration"`
+	Created   time.Time `xml:"created,attr" json:"created"`
+	Year      int       `xml:"year,attr,omitempty" json:"year,omitempty"`
+	Genre     string    `xml:"genre,attr,omitempty" json:"genre,omitempty"`
+}
+
+type subsonicAlbum struct {
+	subsonicAlbumID3
+	Songs []subsonicChild `xml:"song" json:"song"`
+}
+
+type subsonicSearchResult3 struct {
+	Artists []subsonicArtistID3 `xml:"artist" json:"artist"`
+	Albums  []subsonicAlbumID3  `xml:"album" json:"album"`
+	Songs   []subsonicChild     `xml:"song" json:"song"`
+}
+
+// writeSubsonic sends a successful response in the format the client asked for with the f parameter.
+func writeSubsonic(c *gin.Context, response subsonicResponse) {
+	response.Status = "ok"
+	sendSubsonic(c, response)
+}
+
+// writeSubsonicError sends an error. Subsonic clients expect errors in the body of a successful response.
+func writeSubsonicError(c *gin.Context, code int, message string) {
+	sendSubsonic(c, subsonicResponse{
+		Status: "failed",
+		Error:  &subsonicError{Code: code, Message: message},
+	})
+	c.Abort()
+}
+
+func sendSubsonic(c *gin.Context, response subsonicResponse) {
+	response.Version = subsonicApiVersion
+	response.Type = "keydrive"
+	response.OpenSubsonic = true
+	if c.Request.FormValue("f") == "json" {
+		c.JSON(http.StatusOK, gin.H{"subsonic-response": response})
+		return
+	}
+	data, err := xml.Marshal(response)
+	if err != nil {
+		writeError(c, err)
+		return
+	}
+	c.Data(http.StatusOK, "text/xml; charset=utf-8", append([]byte(xml.Header), data...))
+}
@@ -0,0 +1,189 @@
+package controller
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"keydrive/internal/model"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeTestSong(t *testing.T, file string, tags map[string]string) {
+	var frames []byte
+	for id, value := range tags {
+		frames = append(frames, id...)
+		frames = binary.BigEndian.AppendUint32(frames, uint32(len(value)+1))
+		frames = append(frames, 0, 0, 3)
+		frames = append(frames, value...)
+	}
+	size := len(frames)
+	data := []byte{'I', 'D', '3', 3, 0, 0, byte(size >> 21 & 0x7f), byte(size >> 14 & 0x7f), byte(size >> 7 & 0x7f), byte(size & 0x7f)}
+	data = append(data, frames...)
+	data = append(data, 0xff, 0xfb, 0x90, 0x00)
+	if err := os.WriteFile(file, data, 0777); err != nil {
+		t.Fatal(err.Error())
+	}
+}
+
+type subsonicTestResponse struct {
+	Response subsonicResponse `json:"subsonic-response"`
+}
+
+func TestSubsonic(t *testing.T) {
+	tempDir := t.TempDir()
+	_ = os.Mkdir(filepath.Join(tempDir, "The Band"), 0777)
+	writeTestSong(t, filepath.Join(tempDir, "The Band", "01.mp3"), map[string]string{"TIT2": "Opening", "TPE1": "The Band", "TALB": "Debut", "TRCK": "1"})
+	writeTestSong(t, filepath.Join(tempDir, "The Band", "02.mp3"), map[string]string{"TIT2": "Closing", "TPE1": "The Band", "TALB": "Debut", "TRCK": "2"})
+	lib := model.Library{
+		Type:       model.TypeMusic,
+		Name:       "Music",
+		RootFolder: tempDir,
+	}
+	testApp.DB.Create(&lib)
+	testApp.DB.Create(&model.CanAccessLibrary{UserID: regularUser.ID, LibraryID: lib.ID})
+	if _, err := testApp.Index.ScanLibrary(context.Background(), lib); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	req := regularUserRequest("POST", "/api/user/app-passwords", strings.NewReader(`{"name": "Phone", "subsonic": true}`))
+	recorder := httptest.NewRecorder()
+	testApp.Router.ServeHTTP(recorder, req)
+	assertStatus(t, recorder, 201)
+	var appPassword CreatedAppPasswordDTO
+	assertJsonUnmarshal(t, recorder, &appPassword)
+
+	subsonicRequest := func(t *testing.T, method string, params url.Values) subsonicResponse {
+		salt := randomString(8)
+		token := md5.Sum([]byte(appPassword.Password + salt))
+		params.Set("u", regularUser.Username)
+		params.Set("t", hex.EncodeToString(token[:]))
+		params.Set("s", salt)
+		params.Set("f", "json")
+		req, _ := http.NewRequest("GET", "/rest/"+method+".view?"+params.Encode(), nil)
+		recorder := httptest.NewRecorder()
+		testApp.Router.ServeHTTP(recorder, req)
+		assertStatus(t, recorder, 200)
+		var response subsonicTestResponse
+		if err := json.Unmarshal(recorder.Body.Bytes(), &response); err != nil {
+			t.Fatal(err.Error())
+		}
+		return response.Response
+	}
+
+	t.Run("it authenticates with a token", func(t *testing.T) {
+		response := subsonicRequest(t, "ping", url.Values{})
+		if response.Status != "ok" {
+			t.Errorf("Expected ok but got: %+v", response.Error)
+		}
+	})
+
+	t.Run("it rejects a wrong token", func(t *testing.T) {
+		req, _ := http.NewRequest("GET", "/rest/ping?f=json&u="+regularUser.Username+"&t=0123456789abcdef&s=abcdefgh", nil)
+		recorder := httptest.NewRecorder()
+		testApp.Router.ServeHTTP(recorder, req)
+		var response subsonicTestResponse
+		assertJsonUnmarshal(t, recorder, &response)
+		if response.Response.Error == nil || response.Response.Error.Code != subsonicErrorWrongCredentials {
+			t.Errorf("Expected wrong credentials but got: %+v", response.Response)
+		}
+	})
+
+	t.Run("it does not accept the password of the account", func(t *testing.T) {
+		for _, password := range []string{"admin", "enc:" + hex.EncodeToString([]byte("admin"))} {
+			req, _ := http.NewRequest("GET", "/rest/ping?f=json&u=admin&p="+password, nil)
+			recorder := httptest.NewRecorder()
+			testApp.Router.ServeHTTP(recorder, req)
+			var response subsonicTestResponse
+			assertJsonUnmarshal(t, recorder, &response)
+			if response.Response.Error == nil || response.Response.Error.Code != subsonicErrorWrongCredentials {
+				t.Errorf("Expected wrong credentials but got: %+v", response.Response)
+			}
+		}
+	})
+
+	t.Run("it answers in xml by default", func(t *testing.T) {
+		req, _ := http.NewRequest("GET", fmt.Sprintf("/rest/ping?u=%s&p=%s", regularUser.Username, appPassword.Password), nil)
+		recorder := httptest.NewRecorder()
+		testApp.Router.ServeHTTP(recorder, req)
+		if !strings.Contains(recorder.Body.String(), `status="ok"`) {
+			t.Errorf("Unexpected response: %s", recorder.Body.String())
+		}
+	})
+
+	t.Run("it lists music folders", func(t *testing.T) {
+		response := subsonicRequest(t, "getMusicFolders", url.Values{})
+		if response.MusicFolders == nil || len(response.MusicFolders.MusicFolders) != 1 || response.MusicFolders.MusicFolders[0].ID != lib.ID {
+			t.Errorf("Unexpected music folders: %+v", response.MusicFolders)
+		}
+	})
+
+	t.Run("it browses folders", func(t *testing.T) {
+		response := subsonicRequest(t, "getIndexes", url.Values{})
+		if response.Indexes == nil || len(response.Indexes.Indexes) != 1 || response.Indexes.Indexes[0].Name != "B" {
+			t.Fatalf("Unexpected indexes: %+v", response.Indexes)
+		}
+		folderId := response.Indexes.Indexes[0].Artists[0].ID
+		response = subsonicRequest(t, "getMusicDirectory", url.Values{"id": {folderId}})
+		if response.Directory == nil || len(response.Directory.Children) != 2 || response.Directory.Children[0].Title != "Opening" {
+			t.Errorf("Unexpected directory: %+v", response.Directory)
+		}
+	})
+
+	t.Run("it browses artists and albums", func(t *testing.T) {
+		response := subsonicRequest(t, "getArtists", url.Values{})
+		if response.Artists == nil || len(response.Artists.Indexes) != 1 {
+			t.Fatalf("Unexpected artists: %+v", response.Artists)
+		}
+		artist := response.Artists.Indexes[0].Artists[0]
+		if artist.Name != "The Band" || artist.AlbumCount != 1 {
+			t.Fatalf("Unexpected artist: %+v", artist)
+		}
+		response = subsonicRequest(t, "getArtist", url.Values{"id": {artist.ID}})
+		if response.Artist == nil || len(response.Artist.Albums) != 1 {
+			t.Fatalf("Unexpected artist: %+v", response.Artist)
+		}
+		response = subsonicRequest(t, "getAlbum", url.Values{"id": {response.Artist.Albums[0].ID}})
+		if response.Album == nil || len(response.Album.Songs) != 2 || response.Album.Songs[1].Title != "Closing" {
+			t.Errorf("Unexpected album: %+v", response.Album)
+		}
+	})
+
+	t.Run("it searches songs", func(t *testing.T) {
+		response := subsonicRequest(t, "search3", url.Values{"query": {"clos"}})
+		if response.SearchResult3 == nil || len(response.SearchResult3.Songs) != 1 {
+			t.Fatalf("Unexpected search result: %+v", response.SearchResult3)
+		}
+
+		req, _ := http.NewRequest("GET", fmt.Sprintf("/rest/stream?u=%s&p=%s&id=%s", regularUser.Username, appPassword.Password, response.SearchResult3.Songs[0].ID), nil)
+		recorder := httptest.NewRecorder()
+		testApp.Router.ServeHTTP(recorder, req)
+		assertStatus(t, recorder, 200)
+		if recorder.Header().Get("Content-Type") != "audio/mpeg" {
+			t.Errorf("Unexpected content type: %s", recorder.Header().Get("Content-Type"))
+		}
+	})
+}
+
+func TestRedactQuery(t *testing.T) {
+	tests := map[string]string{
+		"/rest/ping.view?u=admin&p=secret&f=json": "/rest/ping.view?u=admin&p=REDACTED&f=json",
+		"/rest/stream?t=abc&s=def&id=1":           "/rest/stream?t=REDACTED&s=REDACTED&id=1",
+		"/api/search?p=1":                         "/api/search?p=1",
+		"/rest/ping":                              "/rest/ping",
+		"/api/events?access_token=secret":         "/api/events?access_token=REDACTED",
+	}
+	for path, expected := range tests {
+		if redacted := redactQuery(path); redacted != expected {
+			t.Errorf("Expected %s but got: %s", expected, redacted)
+		}
+	}
+}
@@ -1,65 +1,143 @@
 package controller
 
 import (
+	"context"
+	"fmt"
 	"github.com/gin-gonic/gin"
 	"gorm.io/gorm"
 	"io/ioutil"
+	"keydrive/internal/model"
 	"keydrive/internal/service"
 	"net/http"
+	"os"
 	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Statuses of health checks. Warnings are reported, but only critical problems make a service unhealthy.
+const (
+	HealthOK       = "ok"
+	HealthWarning  = "warning"
+	HealthCritical = "critical"
 )
 
 type HealthCheckService struct {
 	Name    string `json:"name"`
 	Healthy bool   `json:"healthy"`
+	Status  string `json:"status" enums:"ok,warning,critical"`
+	Message string `json:"message,omitempty"`
+}
+
+// HealthCheckDisk is the space left on a filesystem that holds the root folders of one or more libraries.
+type HealthCheckDisk struct {
+	Libraries   []int   `json:"libraries"`
+	Total       uint64  `json:"total"`
+	Free        uint64  `json:"free"`
+	FreePercent float64 `json:"freePercent"`
+	Status      string  `json:"status" enums:"ok,warning,critical"`
 }
 
 type HealthCheckResponse struct {
 	Healthy  bool                 `json:"healthy"`
+	Status   string               `json:"status" enums:"ok,warning,critical"`
 	Services []HealthCheckService `json:"services"`
+	Disks    []HealthCheckDisk    `json:"disks"`
+}
+
+// LivenessController
+// @Tags System
+// @Router /api/system/health/live [get]
+// @Summary Check if the server is running
+// @Description This does not check any other systems, so a failing database does not get the server restarted.
+// @Produce  json
+// @Success 200 {object} HealthCheckResponse
+func LivenessController() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.JSON(http.StatusOK, HealthCheckResponse{
+			Healthy:  true,
+			Status:   HealthOK,
+			Services: []HealthCheckService{{Name: "api", Healthy: true, Status: HealthOK}},
+			Disks:    []HealthCheckDisk{},
+		})
+	}
 }
 
 // HealthCheckController
 // @Tags System
 // @Router /api/system/health [get]
-// @Summary Run a simple healthcheck on all required systems
+// @Router /api/system/health/ready [get]
+// @Summary Check if the server can handle requests
+// @Description Checks the database, that the root folder of every library can be read and written to and the free space on the filesystems of the libraries.
+// @Description The server is only not ready if the database can not be reached, since it can still serve the other libraries if one fails. Libraries that can not be read or do not respond in time are reported with the critical status, read-only libraries and filesystems that are running full with the warning or critical status.
 // @Produce  json
 // @Success 200 {object} HealthCheckResponse
 // @Success 503 {object} HealthCheckResponse
-func HealthCheckController(db *gorm.DB) gin.HandlerFunc {
+func HealthCheckController(db *gorm.DB, fs *service.FileSystem, diskWarningPercent int, diskCriticalPercent int) gin.HandlerFunc {
+	checks := &libraryChecks{running: make(map[int]bool)}
 	return func(c *gin.Context) {
+		ctx, cancel := context.WithTimeout(c.Request.Context(), healthCheckTimeout)
+		defer cancel()
 		result := HealthCheckResponse{
 			Services: make([]HealthCheckService, 0),
+			Disks:    make([]HealthCheckDisk, 0),
 		}
 
 		// api is always healthy
 		result.Services = append(result.Services, HealthCheckService{
 			Name:    "api",
 			Healthy: true,
+			Status:  HealthOK,
 		})
 
 		// database
 		dbHealth := HealthCheckService{
 			Name:    "psql",
 			Healthy: false,
+			Status:  HealthCritical,
 		}
 		if sqlDb, err := db.DB(); err == nil {
-			err = sqlDb.Ping()
+			err = sqlDb.PingContext(ctx)
 			if err != nil {
 				log.Error("database error: %s", err)
+			} else {
+				dbHealth.Healthy = true
+				dbHealth.Status = HealthOK
 			}
-			dbHealth.Healthy = err == nil
 		} else {
 			log.Error("database error: %s", err)
 		}
 		result.Services = append(result.Services, dbHealth)
 
-		result.Healthy = true
-		for _, service := range result.Services {
-			if !service.Healthy {
-				result.Healthy = false
-				break
+		// libraries, which can only be found when the database is up
+		var libraries []model.Library
+		if dbHealth.Healthy {
+			if err := db.WithContext(ctx).Order("id").Find(&libraries).Error; err != nil {
+				log.Error("database error: %s", err)
+			}
+		}
+		disks := make(map[string]int)
+		for i, check := range checks.run(ctx, fs, libraries) {
+			result.Services = append(result.Services, check.health)
+			if check.space == nil {
+				continue
+			}
+			if j, ok := disks[check.space.Device]; ok {
+				result.Disks[j].Libraries = append(result.Disks[j].Libraries, libraries[i].ID)
+				continue
 			}
+			disks[check.space.Device] = len(result.Disks)
+			result.Disks = append(result.Disks, checkDiskHealth(*check.space, libraries[i].ID, diskWarningPercent, diskCriticalPercent))
+		}
+
+		// Only the database decides if the server is ready, the other services are reported with their status.
+		result.Healthy = dbHealth.Healthy
+		result.Status = HealthOK
+		for _, service := range result.Services {
+			result.Status = worseHealth(result.Status, service.Status)
+		}
+		for _, disk := range result.Disks {
+			result.Status = worseHealth(result.Status, disk.Status)
 		}
 		if result.Healthy {
 			c.JSON(http.StatusOK, result)
@@ -69,6 +147,123 @@ func HealthCheckController(db *gorm.DB) gin.HandlerFunc {
 	}
 }
 
+// healthCheckTimeout is how long the health check waits for the database and the libraries.
+const healthCheckTimeout = 5 * time.Second
+
+// libraryChecks checks the root folders of libraries with a deadline. Checks of a library that stopped responding, like
+// a hung network mount, can not be cancelled, so no new check of it is started until the last one returned.
+type libraryChecks struct {
+	lock    sync.Mutex
+	running map[int]bool
+}
+
+type libraryCheck struct {
+	health HealthCheckService
+	space  *service.DiskSpace
+}
+
+// run checks all libraries at the same time and returns the results in the same order.
+func (l *libraryChecks) run(ctx context.Context, fs *service.FileSystem, libraries []model.Library) []libraryCheck {
+	pending := make([]chan libraryCheck, len(libraries))
+	for i, library := range libraries {
+		l.lock.Lock()
+		if l.running[library.ID] {
+			l.lock.Unlock()
+			continue
+		}
+		l.running[library.ID] = true
+		l.lock.Unlock()
+
+		pending[i] = make(chan libraryCheck, 1)
+		go func(library model.Library, done chan<- libraryCheck) {
+			defer func() {
+				l.lock.Lock()
+				delete(l.running, library.ID)
+				l.lock.Unlock()
+			}()
+			check := libraryCheck{health: checkLibraryHealth(fs, library)}
+			if check.health.Healthy {
+				if space, err := fs.GetDiskSpace(library.RootFolder); err == nil {
+					check.space = &space
+				} else {
+					log.Warn("could not get the free space of library %d: %s", library.ID, err)
+				}
+			}
+			done <- check
+		}(library, pending[i])
+	}
+
+	results := make([]libraryCheck, len(libraries))
+	for i, library := range libraries {
+		if pending[i] != nil {
+			select {
+			case results[i] = <-pending[i]:
+				continue
+			case <-ctx.Done():
+			}
+		}
+		log.Error("library %d did not respond to the health check in time", library.ID)
+		results[i] = libraryCheck{health: HealthCheckService{
+			Name:    fmt.Sprintf("library:%d", library.ID),
+			Status:  HealthCritical,
+			Message: "the root folder does not respond",
+		}}
+	}
+	return results
+}
+
+func checkLibraryHealth(fs *service.FileSystem, library model.Library) HealthCheckService {
+	health := HealthCheckService{
+		Name:    fmt.Sprintf("library:%d", library.ID),
+		Healthy: true,
+		Status:  HealthOK,
+	}
+	readErr, writeErr := fs.CheckLibraryAccess(library)
+	if readErr != nil {
+		log.Error("library %d is not readable: %s", library.ID, readErr)
+		health.Healthy = false
+		health.Status = HealthCritical
+		if os.IsNotExist(readErr) {
+			health.Message = "the root folder does not exist"
+		} else {
+			health.Message = "the root folder can not be read"
+		}
+	} else if writeErr != nil {
+		log.Warn("library %d is not writable: %s", library.ID, writeErr)
+		health.Status = HealthWarning
+		health.Message = "the root folder can not be written to"
+	}
+	return health
+}
+
+func checkDiskHealth(space service.DiskSpace, libraryID int, warningPercent int, criticalPercent int) HealthCheckDisk {
+	disk := HealthCheckDisk{
+		Libraries: []int{libraryID},
+		Total:     space.Total,
+		Free:      space.Free,
+		Status:    HealthOK,
+	}
+	if space.Total > 0 {
+		disk.FreePercent = float64(space.Free) * 100 / float64(space.Total)
+	}
+	if disk.FreePercent < float64(criticalPercent) {
+		disk.Status = HealthCritical
+	} else if disk.FreePercent < float64(warningPercent) {
+		disk.Status = HealthWarning
+	}
+	return disk
+}
+
+func worseHealth(a string, b string) string {
+	if a == HealthCritical || b == HealthCritical {
+		return HealthCritical
+	}
+	if a == HealthWarning || b == HealthWarning {
+		return HealthWarning
+	}
+	return HealthOK
+}
+
 type BrowseResponseFolder struct {
 	Path string `json:"path"`
 }
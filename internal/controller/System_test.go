@@ -0,0 +1,72 @@
+package controller
+
+import (
+	"fmt"
+	"keydrive/internal/model"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+func TestHealthCheck(t *testing.T) {
+	lib := model.Library{
+		Type:       model.TypeGeneric,
+		Name:       "Health Library",
+		RootFolder: t.TempDir(),
+	}
+	testApp.DB.Create(&lib)
+	missing := model.Library{
+		Type:       model.TypeGeneric,
+		Name:       "Missing Library",
+		RootFolder: filepath.Join(t.TempDir(), "missing"),
+	}
+
+	findService := func(response HealthCheckResponse, name string) *HealthCheckService {
+		for _, service := range response.Services {
+			if service.Name == name {
+				return &service
+			}
+		}
+		return nil
+	}
+
+	t.Run("it is live without checking other systems", func(t *testing.T) {
+		recorder := httptest.NewRecorder()
+		testApp.Router.ServeHTTP(recorder, httptest.NewRequest("GET", "/api/system/health/live", nil))
+		assertStatus(t, recorder, 200)
+	})
+
+	t.Run("it checks libraries and their disks", func(t *testing.T) {
+		recorder := httptest.NewRecorder()
+		testApp.Router.ServeHTTP(recorder, httptest.NewRequest("GET", "/api/system/health/ready", nil))
+		var response HealthCheckResponse
+		assertJsonUnmarshal(t, recorder, &response)
+		if service := findService(response, fmt.Sprintf("library:%d", lib.ID)); service == nil || !service.Healthy {
+			t.Errorf("Expected the library to be healthy: %+v", response)
+		}
+		found := false
+		for _, disk := range response.Disks {
+			for _, id := range disk.Libraries {
+				found = found || (id == lib.ID && disk.Total > 0)
+			}
+		}
+		if !found {
+			t.Errorf("Expected the disk of the library: %+v", response.Disks)
+		}
+	})
+
+	t.Run("it stays ready when a library is missing", func(t *testing.T) {
+		testApp.DB.Create(&missing)
+		defer testApp.DB.Delete(&missing)
+
+		recorder := httptest.NewRecorder()
+		testApp.Router.ServeHTTP(recorder, httptest.NewRequest("GET", "/api/system/health/ready", nil))
+		assertStatus(t, recorder, 200)
+		var response HealthCheckResponse
+		assertJsonUnmarshal(t, recorder, &response)
+		service := findService(response, fmt.Sprintf("library:%d", missing.ID))
+		if !response.Healthy || response.Status != HealthCritical || service == nil || service.Healthy || service.Message != "the root folder does not exist" {
+			t.Errorf("Expected the missing library to be reported: %+v", response)
+		}
+	})
+}
@@ -0,0 +1,148 @@
+package controller
+
+import (
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"keydrive/internal/service"
+	"net/http"
+	"os"
+	"strconv"
+)
+
+// GetThumbnail
+// @Tags Files
+// @Router /api/libraries/{libraryId}/entries/thumbnail [get]
+// @Summary Get a small version of an image
+// @Description JPEG, PNG, GIF and WebP images are supported. The size is rounded up to 128, 256, 512 or 1024 pixels, and images are never scaled up.
+// @Description Thumbnails are cached until the image changes.
+// @Security OAuth2
+// @Produce image/jpeg
+// @Produce image/png
+// @Param libraryId path int true "The library id"
+// @Param path query string true "The url encoded path"
+// @Param size query int false "The maximum width and height" default(256)
+// @Success 200
+// @Success 304
+// @Failure 415 {object} ApiError "The file is not a supported image"
+func GetThumbnail(db *gorm.DB, libs *service.Library, thumbnails *service.Thumbnails) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		library, entryPath, err := resolvePath(c, libs, db, false)
+		if err != nil {
+			writeError(c, err)
+			return
+		}
+		size := 256
+		if sizeQuery, ok := c.GetQuery("size"); ok {
+			if size, err = strconv.Atoi(sizeQuery); err != nil || size <= 0 {
+				writeJsonError(c, ApiError{Status: http.StatusBadRequest, Description: "invalid size"})
+				return
+			}
+		}
+
+		thumbnail, err := thumbnails.GetThumbnail(library, entryPath, size)
+		if err != nil {
+			writeError(c, err)
+			return
+		}
+		file, err := os.Open(thumbnail.File)
+		if err != nil {
+			writeError(c, err)
+			return
+		}
+		defer file.Close()
+		info, err := file.Stat()
+		if err != nil {
+			writeError(c, err)
+			return
+		}
+		c.Header("Content-Type", thumbnail.MimeType)
+		c.Header("Cache-Control", "private, max-age=86400")
+		c.Header("ETag", fmt.Sprintf(`"%x-%x"`, info.ModTime().UnixNano(), info.Size()))
+		http.ServeContent(c.Writer, c.Request, "", info.ModTime(), file)
+	}
+}
+
+// defaultThumbnailSizes are generated when no sizes are requested. They are the sizes that the web app shows.
+var defaultThumbnailSizes = []int{128, 256}
+
+type GenerateThumbnailsDTO struct {
+	Sizes []int `json:"sizes" binding:"dive,min=1"`
+}
+
+type ThumbnailsResultDTO struct {
+	Images int `json:"images"`
+}
+
+// GenerateThumbnails
+// @Tags Files
+// @Router /api/libraries/{libraryId}/thumbnails [post]
+// @Summary Generate the thumbnails of all images in a library in the background
+// @Description Images that already have an up-to-date thumbnail are skipped. The thumbnails are generated by a job, whose progress counts the images.
+// @Security OAuth2
+// @Accept json
+// @Param libraryId path int true "The library id"
+// @Param body body GenerateThumbnailsDTO false "The sizes to generate, 128 and 256 by default"
+// @Success 202 {object} model.Job
+// @Failure 409 {object} ApiError "Thumbnails are already being generated for this library"
+func GenerateThumbnails(db *gorm.DB, libs *service.Library, jobs *service.Jobs) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var request GenerateThumbnailsDTO
+		if c.Request.ContentLength != 0 {
+			if err := c.ShouldBindJSON(&request); err != nil {
+				writeError(c, err)
+				return
+			}
+		}
+		if len(request.Sizes) == 0 {
+			request.Sizes = defaultThumbnailSizes
+		}
+		library, err := getAccessToLib(c, libs, true, db)
+		if err != nil {
+			writeError(c, err)
+			return
+		}
+		user, _ := GetAuthenticatedUser(c)
+		job, err := jobs.EnqueueUnique(JobThumbnails, &user, &library, request)
+		if errors.Is(err, service.ErrJobActive) {
+			writeJsonError(c, ApiError{Status: http.StatusConflict, Description: "thumbnails are already being generated"})
+			return
+		}
+		if err != nil {
+			writeError(c, err)
+			return
+		}
+		acceptJob(c, job)
+	}
+}
+
+// GetCover
+// @Tags Files
+// @Router /api/libraries/{libraryId}/entries/cover [get]
+// @Summary Get the cover image embedded in a book or an audio file
+// @Description Covers are read from EPUB books, and from the artwork in MP3, FLAC, Ogg Vorbis and Opus files.
+// @Security OAuth2
+// @Produce image/jpeg
+// @Produce image/png
+// @Param libraryId path int true "The library id"
+// @Param path query string true "The url encoded path"
+// @Success 200
+// @Failure 404 {object} ApiError "The file has no cover"
+func GetCover(db *gorm.DB, libs *service.Library, fs *service.FileSystem) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		library, entryPath, err := resolvePath(c, libs, db, false)
+		if err != nil {
+			writeError(c, err)
+			return
+		}
+		cover, err := fs.ReadCover(library, entryPath)
+		if err != nil {
+			writeError(c, err)
+			return
+		}
+		c.Header("Cache-Control", "private, max-age=86400")
+		c.Header("X-Content-Type-Options", "nosniff")
+		c.Data(http.StatusOK, cover.MimeType, cover.Data)
+	}
+}
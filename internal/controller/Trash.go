@@ -0,0 +1,126 @@
+package controller
+
+import (
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"keydrive/internal/model"
+	"keydrive/internal/service"
+	"net/http"
+)
+
+type TrashPage struct {
+	TotalElements int64             `json:"totalElements"`
+	Elements      []model.TrashItem `json:"elements"`
+}
+
+// getTrashItem looks up the trash item in the request, after checking access to its library.
+func getTrashItem(c *gin.Context, db *gorm.DB, libs *service.Library, trash *service.Trash) (model.TrashItem, error) {
+	var item model.TrashItem
+	library, err := getAccessToLib(c, libs, true, db)
+	if err != nil {
+		return item, err
+	}
+	itemId, ok := intParam(c, "itemId")
+	if !ok {
+		return item, ApiError{Status: http.StatusNotFound}
+	}
+	if result := trash.GetTrashForLibrary(library, db).Take(&item, itemId); result.Error != nil {
+		return item, result.Error
+	}
+	item.Library = library
+	return item, nil
+}
+
+// ListTrash
+// @Tags Files
+// @Router /api/libraries/{libraryId}/trash [get]
+// @Summary List the deleted files and folders in a library
+// @Description Items are purged automatically once the retention period has passed.
+// @Security OAuth2
+// @Produce json
+// @Param libraryId path int true "The library id"
+// @Success 200 {object} TrashPage
+// @Param page query int false "The page number to fetch" default(1)
+// @Param limit query int false "The maximum number of elements to return" default(20)
+func ListTrash(db *gorm.DB, libs *service.Library, trash *service.Trash) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		library, err := getAccessToLib(c, libs, false, db)
+		if err != nil {
+			writeError(c, err)
+			return
+		}
+		var page TrashPage
+		returnPage(c, trash.GetTrashForLibrary(library, db).Order("deleted_at desc"), &page, &page.TotalElements, &page.Elements)
+	}
+}
+
+// RestoreTrashItem
+// @Tags Files
+// @Router /api/libraries/{libraryId}/trash/{itemId}/restore [post]
+// @Summary Restore a deleted file or folder to its original path
+// @Security OAuth2
+// @Produce json
+// @Param libraryId path int true "The library id"
+// @Param itemId path int true "The trash item id"
+// @Success 200 {object} service.FileInfo
+// @Failure 409 {object} ApiError "An entry with the original name already exists"
+func RestoreTrashItem(db *gorm.DB, libs *service.Library, trash *service.Trash) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		item, err := getTrashItem(c, db, libs, trash)
+		if err != nil {
+			writeError(c, err)
+			return
+		}
+		restored, err := trash.Restore(item)
+		if err != nil {
+			writeError(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, restored)
+	}
+}
+
+// DeleteTrashItem
+// @Tags Files
+// @Router /api/libraries/{libraryId}/trash/{itemId} [delete]
+// @Summary Permanently delete a file or folder from the trash
+// @Security OAuth2
+// @Param libraryId path int true "The library id"
+// @Param itemId path int true "The trash item id"
+// @Success 204
+func DeleteTrashItem(db *gorm.DB, libs *service.Library, trash *service.Trash) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		item, err := getTrashItem(c, db, libs, trash)
+		if err != nil {
+			writeError(c, err)
+			return
+		}
+		if err := trash.Purge(item); err != nil {
+			writeError(c, err)
+			return
+		}
+		c.Status(http.StatusNoContent)
+	}
+}
+
+// EmptyTrash
+// @Tags Files
+// @Router /api/libraries/{libraryId}/trash [delete]
+// @Summary Permanently delete everything in the trash of a library
+// @Security OAuth2
+// @Param libraryId path int true "The library id"
+// @Success 204
+func EmptyTrash(db *gorm.DB, libs *service.Library, trash *service.Trash) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		library, err := getAccessToLib(c, libs, true, db)
+		if err != nil {
+			writeError(c, err)
+			return
+		}
+		if _, err := trash.PurgeAll(library); err != nil {
+			writeError(c, err)
+			return
+		}
+		c.Status(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,123 @@
+package controller
+
+import (
+	"fmt"
+	"keydrive/internal/model"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestTrash(t *testing.T) {
+	tempDir := t.TempDir()
+	lib := model.Library{
+		Type:       model.TypeGeneric,
+		Name:       "Test Library",
+		RootFolder: tempDir,
+	}
+	testApp.DB.Create(&lib)
+	trashUrl := fmt.Sprintf("/api/libraries/%d/trash", lib.ID)
+
+	deleteEntry := func(t *testing.T, path string) model.TrashItem {
+		req := adminRequest("DELETE", fmt.Sprintf("/api/libraries/%d/entries?path=%s", lib.ID, path), nil)
+		recorder := httptest.NewRecorder()
+		testApp.Router.ServeHTTP(recorder, req)
+		assertStatus(t, recorder, 204)
+
+		req = adminRequest("GET", trashUrl, nil)
+		recorder = httptest.NewRecorder()
+		testApp.Router.ServeHTTP(recorder, req)
+		assertStatus(t, recorder, 200)
+		var page TrashPage
+		assertJsonUnmarshal(t, recorder, &page)
+		if len(page.Elements) == 0 || page.Elements[0].Path != path {
+			t.Fatalf("Expected %s in the trash but got: %s", path, recorder.Body.String())
+		}
+		return page.Elements[0]
+	}
+
+	t.Run("it restores a deleted folder", func(t *testing.T) {
+		_ = os.MkdirAll(filepath.Join(tempDir, "folder", "sub"), 0777)
+		_ = os.WriteFile(filepath.Join(tempDir, "folder", "sub", "file.txt"), []byte("Hello\n"), 0777)
+		item := deleteEntry(t, "/folder")
+		if item.Category != model.CategoryFolder {
+			t.Errorf("Expected a folder but got: %s", item.Category)
+		}
+		if _, err := os.Stat(filepath.Join(tempDir, "folder")); !os.IsNotExist(err) {
+			t.Errorf("Folder still exists")
+		}
+
+		req := adminRequest("POST", fmt.Sprintf("%s/%d/restore", trashUrl, item.ID), nil)
+		recorder := httptest.NewRecorder()
+		testApp.Router.ServeHTTP(recorder, req)
+		assertStatus(t, recorder, 200)
+		if _, err := os.Stat(filepath.Join(tempDir, "folder", "sub", "file.txt")); err != nil {
+			t.Errorf("File was not restored: %s", err)
+		}
+	})
+
+	t.Run("it does not overwrite an entry when restoring", func(t *testing.T) {
+		_ = os.WriteFile(filepath.Join(tempDir, "file.txt"), []byte("Old\n"), 0777)
+		item := deleteEntry(t, "/file.txt")
+		_ = os.WriteFile(filepath.Join(tempDir, "file.txt"), []byte("New\n"), 0777)
+
+		req := adminRequest("POST", fmt.Sprintf("%s/%d/restore", trashUrl, item.ID), nil)
+		recorder := httptest.NewRecorder()
+		testApp.Router.ServeHTTP(recorder, req)
+		assertStatus(t, recorder, 409)
+		if data, _ := os.ReadFile(filepath.Join(tempDir, "file.txt")); string(data) != "New\n" {
+			t.Errorf("File was overwritten: %s", data)
+		}
+	})
+
+	t.Run("it does not restore a folder over an empty folder", func(t *testing.T) {
+		_ = os.MkdirAll(filepath.Join(tempDir, "photos"), 0777)
+		_ = os.WriteFile(filepath.Join(tempDir, "photos", "beach.jpg"), []byte("Beach\n"), 0777)
+		item := deleteEntry(t, "/photos")
+		_ = os.Mkdir(filepath.Join(tempDir, "photos"), 0777)
+
+		req := adminRequest("POST", fmt.Sprintf("%s/%d/restore", trashUrl, item.ID), nil)
+		recorder := httptest.NewRecorder()
+		testApp.Router.ServeHTTP(recorder, req)
+		assertStatus(t, recorder, 409)
+		if entries, _ := os.ReadDir(filepath.Join(tempDir, "photos")); len(entries) != 0 {
+			t.Errorf("Empty folder was replaced: %v", entries)
+		}
+	})
+
+	t.Run("it permanently deletes an item", func(t *testing.T) {
+		_ = os.WriteFile(filepath.Join(tempDir, "purge.txt"), []byte("Purge\n"), 0777)
+		item := deleteEntry(t, "/purge.txt")
+
+		req := adminRequest("DELETE", fmt.Sprintf("%s/%d", trashUrl, item.ID), nil)
+		recorder := httptest.NewRecorder()
+		testApp.Router.ServeHTTP(recorder, req)
+		assertStatus(t, recorder, 204)
+		if _, err := os.Stat(filepath.Join(tempDir, ".keydrive", "trash", fmt.Sprint(item.ID))); !os.IsNotExist(err) {
+			t.Errorf("Trashed file still exists")
+		}
+	})
+
+	t.Run("it purges expired items", func(t *testing.T) {
+		_ = os.WriteFile(filepath.Join(tempDir, "expired.txt"), []byte("Expired\n"), 0777)
+		item := deleteEntry(t, "/expired.txt")
+		testApp.DB.Model(&model.TrashItem{}).Where("id = ?", item.ID).Update("deleted_at", item.DeletedAt.AddDate(-1, 0, 0))
+
+		if _, err := testApp.Trash.PurgeExpired(); err != nil {
+			t.Fatal(err.Error())
+		}
+		var count int64
+		testApp.DB.Model(&model.TrashItem{}).Where("id = ?", item.ID).Count(&count)
+		if count != 0 {
+			t.Errorf("Expected the item to be purged")
+		}
+	})
+
+	t.Run("it requires access to the library", func(t *testing.T) {
+		req := noAccessUserRequest("GET", trashUrl, nil)
+		recorder := httptest.NewRecorder()
+		testApp.Router.ServeHTTP(recorder, req)
+		assertStatus(t, recorder, 404)
+	})
+}
@@ -0,0 +1,261 @@
+package controller
+
+import (
+	"encoding/base64"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"keydrive/internal/model"
+	"keydrive/internal/service"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+)
+
+const tusVersion = "1.0.0"
+const tusExtensions = "creation,creation-with-upload,expiration,termination"
+
+// TusResumable checks that requests are made with a supported version of the tus protocol, and adds the version to
+// every response.
+func TusResumable() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Header("Tus-Resumable", tusVersion)
+		if c.Request.Method != http.MethodOptions && c.GetHeader("Tus-Resumable") != tusVersion {
+			c.Header("Tus-Version", tusVersion)
+			c.AbortWithStatusJSON(
+				http.StatusPreconditionFailed,
+				ApiError{Status: http.StatusPreconditionFailed, Description: "unsupported tus version"},
+			)
+			return
+		}
+		c.Next()
+	}
+}
+
+// parseUploadMetadata decodes the Upload-Metadata header, which is a comma separated list of keys with base64
+// encoded values.
+func parseUploadMetadata(header string) (map[string]string, error) {
+	metadata := map[string]string{}
+	for _, pair := range strings.Split(header, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		key, encoded, _ := strings.Cut(pair, " ")
+		value, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, err
+		}
+		metadata[key] = string(value)
+	}
+	return metadata, nil
+}
+
+func writeUploadError(c *gin.Context, err error) {
+	if errors.Is(err, service.ErrUploadExpired) {
+		simpleError(c, http.StatusGone)
+		return
+	}
+	if errors.Is(err, service.ErrOffsetMismatch) {
+		writeJsonError(c, ApiError{Status: http.StatusConflict, Description: "Upload-Offset does not match the upload"})
+		return
+	}
+	writeError(c, err)
+}
+
+func writeUploadHeaders(c *gin.Context, upload model.Upload, offset int64) {
+	c.Header("Upload-Offset", strconv.FormatInt(offset, 10))
+	c.Header("Upload-Length", strconv.FormatInt(upload.Length, 10))
+	c.Header("Upload-Expires", upload.ExpiresAt.UTC().Format(http.TimeFormat))
+	if upload.Metadata != "" {
+		c.Header("Upload-Metadata", upload.Metadata)
+	}
+	c.Header("Cache-Control", "no-store")
+}
+
+// GetUploadOptions
+// @Tags Uploads
+// @Router /api/libraries/{libraryId}/uploads [options]
+// @Summary Discover the tus protocol features supported by the server
+// @Security OAuth2
+// @Param libraryId path int true "The library id"
+// @Success 204
+func GetUploadOptions() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Header("Tus-Version", tusVersion)
+		c.Header("Tus-Extension", tusExtensions)
+		c.Status(http.StatusNoContent)
+	}
+}
+
+// CreateUpload
+// @Tags Uploads
+// @Router /api/libraries/{libraryId}/uploads [post]
+// @Summary Start a resumable upload using the tus protocol
+// @Description The Upload-Metadata header must contain a filename, and may contain a parent folder.
+// @Security OAuth2
+// @Param libraryId path int true "The library id"
+// @Param Tus-Resumable header string true "The tus protocol version" default(1.0.0)
+// @Param Upload-Length header int true "The size of the file in bytes"
+// @Param Upload-Metadata header string true "The base64 encoded filename and parent"
+// @Success 201
+func CreateUpload(db *gorm.DB, libs *service.Library, uploads *service.Uploads) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		length, err := strconv.ParseInt(c.GetHeader("Upload-Length"), 10, 64)
+		if err != nil || length < 0 {
+			writeJsonError(c, ApiError{Status: http.StatusBadRequest, Description: "invalid Upload-Length header"})
+			return
+		}
+		metadata, err := parseUploadMetadata(c.GetHeader("Upload-Metadata"))
+		if err != nil {
+			writeJsonError(c, ApiError{Status: http.StatusBadRequest, Description: "invalid Upload-Metadata header"})
+			return
+		}
+		if metadata["filename"] == "" {
+			writeJsonError(c, ApiError{Status: http.StatusBadRequest, Description: "a filename is required in the Upload-Metadata header"})
+			return
+		}
+
+		library, err := getAccessToLib(c, libs, true, db)
+		if err != nil {
+			writeError(c, err)
+			return
+		}
+		user, _ := GetAuthenticatedUser(c)
+		target := path.Join("/", metadata["parent"], path.Base("/"+metadata["filename"]))
+		upload, err := uploads.CreateUpload(library, user, target, length, c.GetHeader("Upload-Metadata"))
+		if err != nil {
+			writeError(c, err)
+			return
+		}
+
+		offset := int64(0)
+		if length == 0 {
+			if _, err := uploads.CompleteEmptyUpload(upload); err != nil {
+				writeError(c, err)
+				return
+			}
+		} else if c.ContentType() == "application/offset+octet-stream" {
+			// creation-with-upload: the request body contains the first chunk.
+			offset, _, err = uploads.WriteUpload(upload, 0, c.Request.Body)
+			if err != nil {
+				// The client never learns the location of the upload, so it can not be resumed.
+				if err := uploads.TerminateUpload(upload); err != nil {
+					log.Warn("failed to terminate upload %s: %s", upload.ID, err)
+				}
+				writeUploadError(c, err)
+				return
+			}
+		}
+
+		c.Header("Location", path.Join(c.Request.URL.Path, upload.ID))
+		writeUploadHeaders(c, upload, offset)
+		c.Status(http.StatusCreated)
+	}
+}
+
+// GetUploadOffset
+// @Tags Uploads
+// @Router /api/libraries/{libraryId}/uploads/{uploadId} [head]
+// @Summary Get the number of bytes that were received for an upload
+// @Security OAuth2
+// @Param libraryId path int true "The library id"
+// @Param uploadId path string true "The upload id"
+// @Param Tus-Resumable header string true "The tus protocol version" default(1.0.0)
+// @Success 200
+func GetUploadOffset(db *gorm.DB, libs *service.Library, uploads *service.Uploads) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		library, err := getAccessToLib(c, libs, true, db)
+		if err != nil {
+			writeError(c, err)
+			return
+		}
+		user, _ := GetAuthenticatedUser(c)
+		upload, offset, err := uploads.GetUpload(library, user, c.Param("uploadId"))
+		if err != nil {
+			writeUploadError(c, err)
+			return
+		}
+		writeUploadHeaders(c, upload, offset)
+		c.Status(http.StatusOK)
+	}
+}
+
+// PatchUpload
+// @Tags Uploads
+// @Router /api/libraries/{libraryId}/uploads/{uploadId} [patch]
+// @Summary Send a chunk of data for an upload
+// @Description When the last chunk is received, the file is moved into place in the library.
+// @Security OAuth2
+// @Accept application/offset+octet-stream
+// @Param libraryId path int true "The library id"
+// @Param uploadId path string true "The upload id"
+// @Param Tus-Resumable header string true "The tus protocol version" default(1.0.0)
+// @Param Upload-Offset header int true "The offset at which the chunk starts"
+// @Success 204
+// @Failure 409 {object} ApiError "The offset does not match the number of received bytes"
+// @Failure 410 {object} ApiError "The upload has expired"
+func PatchUpload(db *gorm.DB, libs *service.Library, uploads *service.Uploads) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if c.ContentType() != "application/offset+octet-stream" {
+			simpleError(c, http.StatusUnsupportedMediaType)
+			return
+		}
+		offset, err := strconv.ParseInt(c.GetHeader("Upload-Offset"), 10, 64)
+		if err != nil || offset < 0 {
+			writeJsonError(c, ApiError{Status: http.StatusBadRequest, Description: "invalid Upload-Offset header"})
+			return
+		}
+
+		library, err := getAccessToLib(c, libs, true, db)
+		if err != nil {
+			writeError(c, err)
+			return
+		}
+		user, _ := GetAuthenticatedUser(c)
+		upload, _, err := uploads.GetUpload(library, user, c.Param("uploadId"))
+		if err != nil {
+			writeUploadError(c, err)
+			return
+		}
+
+		offset, _, err = uploads.WriteUpload(upload, offset, c.Request.Body)
+		if err != nil {
+			writeUploadError(c, err)
+			return
+		}
+		writeUploadHeaders(c, upload, offset)
+		c.Status(http.StatusNoContent)
+	}
+}
+
+// TerminateUpload
+// @Tags Uploads
+// @Router /api/libraries/{libraryId}/uploads/{uploadId} [delete]
+// @Summary Cancel an upload and discard the received data
+// @Security OAuth2
+// @Param libraryId path int true "The library id"
+// @Param uploadId path string true "The upload id"
+// @Param Tus-Resumable header string true "The tus protocol version" default(1.0.0)
+// @Success 204
+func TerminateUpload(db *gorm.DB, libs *service.Library, uploads *service.Uploads) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		library, err := getAccessToLib(c, libs, true, db)
+		if err != nil {
+			writeError(c, err)
+			return
+		}
+		user, _ := GetAuthenticatedUser(c)
+		upload, _, err := uploads.GetUpload(library, user, c.Param("uploadId"))
+		if err != nil && !errors.Is(err, service.ErrUploadExpired) {
+			writeUploadError(c, err)
+			return
+		}
+		if err := uploads.TerminateUpload(upload); err != nil {
+			writeError(c, err)
+			return
+		}
+		c.Status(http.StatusNoContent)
+	}
+}
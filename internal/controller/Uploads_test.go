@@ -0,0 +1,124 @@
+package controller
+
+import (
+	"encoding/base64"
+	"fmt"
+	"keydrive/internal/model"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestUploads(t *testing.T) {
+	tempDir := t.TempDir()
+	lib := model.Library{
+		Type:       model.TypeGeneric,
+		Name:       "Test Library",
+		RootFolder: tempDir,
+	}
+	testApp.DB.Create(&lib)
+	uploadsUrl := fmt.Sprintf("/api/libraries/%d/uploads", lib.ID)
+	metadata := "filename " + base64.StdEncoding.EncodeToString([]byte("upload.txt"))
+
+	createUpload := func(t *testing.T, length int) string {
+		req := adminRequest("POST", uploadsUrl, nil)
+		req.Header.Set("Tus-Resumable", "1.0.0")
+		req.Header.Set("Upload-Length", fmt.Sprint(length))
+		req.Header.Set("Upload-Metadata", metadata)
+		recorder := httptest.NewRecorder()
+		testApp.Router.ServeHTTP(recorder, req)
+		assertStatus(t, recorder, 201)
+		return recorder.Header().Get("Location")
+	}
+
+	patch := func(location string, offset int, body string) *httptest.ResponseRecorder {
+		req := adminRequest("PATCH", location, strings.NewReader(body))
+		req.Header.Set("Tus-Resumable", "1.0.0")
+		req.Header.Set("Content-Type", "application/offset+octet-stream")
+		req.Header.Set("Upload-Offset", fmt.Sprint(offset))
+		recorder := httptest.NewRecorder()
+		testApp.Router.ServeHTTP(recorder, req)
+		return recorder
+	}
+
+	t.Run("it uploads a file in chunks", func(t *testing.T) {
+		location := createUpload(t, 12)
+		if !strings.HasPrefix(location, uploadsUrl+"/") {
+			t.Fatalf("Unexpected location: %s", location)
+		}
+
+		recorder := patch(location, 0, "Hello ")
+		assertStatus(t, recorder, 204)
+		if offset := recorder.Header().Get("Upload-Offset"); offset != "6" {
+			t.Errorf("Expected offset 6 but got: %s", offset)
+		}
+
+		req := adminRequest("HEAD", location, nil)
+		req.Header.Set("Tus-Resumable", "1.0.0")
+		recorder = httptest.NewRecorder()
+		testApp.Router.ServeHTTP(recorder, req)
+		assertStatus(t, recorder, 200)
+		if offset := recorder.Header().Get("Upload-Offset"); offset != "6" {
+			t.Errorf("Expected offset 6 but got: %s", offset)
+		}
+
+		recorder = patch(location, 6, "World!")
+		assertStatus(t, recorder, 204)
+		data, err := os.ReadFile(filepath.Join(tempDir, "upload.txt"))
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if string(data) != "Hello World!" {
+			t.Errorf("Expected [Hello World!] but got: %s", data)
+		}
+	})
+
+	t.Run("it rejects a chunk at the wrong offset", func(t *testing.T) {
+		location := createUpload(t, 12)
+		recorder := patch(location, 3, "lo World!")
+		assertStatus(t, recorder, 409)
+	})
+
+	t.Run("it terminates an upload", func(t *testing.T) {
+		location := createUpload(t, 12)
+		req := adminRequest("DELETE", location, nil)
+		req.Header.Set("Tus-Resumable", "1.0.0")
+		recorder := httptest.NewRecorder()
+		testApp.Router.ServeHTTP(recorder, req)
+		assertStatus(t, recorder, 204)
+
+		recorder = patch(location, 0, "Hello")
+		assertStatus(t, recorder, 404)
+	})
+
+	t.Run("it requires an existing parent folder", func(t *testing.T) {
+		req := adminRequest("POST", uploadsUrl, nil)
+		req.Header.Set("Tus-Resumable", "1.0.0")
+		req.Header.Set("Upload-Length", "12")
+		req.Header.Set("Upload-Metadata", metadata+",parent "+base64.StdEncoding.EncodeToString([]byte("/missing")))
+		recorder := httptest.NewRecorder()
+		testApp.Router.ServeHTTP(recorder, req)
+		assertStatus(t, recorder, 404)
+	})
+
+	t.Run("it requires the tus version header", func(t *testing.T) {
+		req := adminRequest("POST", uploadsUrl, nil)
+		req.Header.Set("Upload-Length", "12")
+		req.Header.Set("Upload-Metadata", metadata)
+		recorder := httptest.NewRecorder()
+		testApp.Router.ServeHTTP(recorder, req)
+		assertStatus(t, recorder, 412)
+	})
+
+	t.Run("it requires write access", func(t *testing.T) {
+		req := noAccessUserRequest("POST", uploadsUrl, nil)
+		req.Header.Set("Tus-Resumable", "1.0.0")
+		req.Header.Set("Upload-Length", "12")
+		req.Header.Set("Upload-Metadata", metadata)
+		recorder := httptest.NewRecorder()
+		testApp.Router.ServeHTTP(recorder, req)
+		assertStatus(t, recorder, 404)
+	})
+}
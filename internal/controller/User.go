@@ -3,6 +3,7 @@ package controller
 import (
 	"github.com/gin-gonic/gin"
 	"gorm.io/gorm"
+	"keydrive/internal/model"
 	"keydrive/internal/service"
 	"net/http"
 )
@@ -21,6 +22,26 @@ func GetAuthenticatedUserInfo() gin.HandlerFunc {
 	}
 }
 
+// GetAuthenticatedUserUsage
+// @Tags Authentication
+// @Router /api/user/usage [get]
+// @Summary Get the space used by the files of the currently authenticated user
+// @Description Users are charged for the files they upload or copy, in all libraries. Uploads that are still in progress are reserved.
+// @Security OAuth2
+// @Produce json
+// @Success 200 {object} service.QuotaUsage
+func GetAuthenticatedUserUsage(quotas *service.Quotas) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		user, _ := GetAuthenticatedUser(c)
+		usage, err := quotas.GetUserUsage(user)
+		if err != nil {
+			writeError(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, usage)
+	}
+}
+
 // UpdateAuthenticatedUser
 // @Tags Authentication
 // @Router /api/user [patch]
@@ -65,3 +86,86 @@ func UpdateAuthenticatedUser(db *gorm.DB, pwdEnc *service.BcryptEncoder) gin.Han
 		}
 	}
 }
+
+type AppPasswordPage struct {
+	TotalElements int64               `json:"totalElements"`
+	Elements      []model.AppPassword `json:"elements"`
+}
+
+type CreateAppPasswordDTO struct {
+	Name string `json:"name" binding:"required"`
+	// Subsonic allows the password to be used with the token authentication of the Subsonic API.
+	Subsonic bool `json:"subsonic"`
+}
+
+type CreatedAppPasswordDTO struct {
+	model.AppPassword
+	// Password is only returned when the app password is created.
+	Password string `json:"password"`
+}
+
+// ListAppPasswords
+// @Tags Authentication
+// @Router /api/user/app-passwords [get]
+// @Summary List the app passwords of the currently authenticated user
+// @Security OAuth2
+// @Produce  json
+// @Success 200 {object} AppPasswordPage
+// @Param page query int false "The page number to fetch" default(1)
+// @Param limit query int false "The maximum number of elements to return" default(20)
+func ListAppPasswords(db *gorm.DB, appPasswords *service.AppPasswords) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		user, _ := GetAuthenticatedUser(c)
+		var page AppPasswordPage
+		returnPage(c, appPasswords.GetAppPasswordsForUser(user, db).Order("created_at desc"), &page, &page.TotalElements, &page.Elements)
+	}
+}
+
+// CreateAppPassword
+// @Tags Authentication
+// @Router /api/user/app-passwords [post]
+// @Summary Create a password for an app that only supports basic authentication
+// @Description The password is only returned in this response. Apps like e-readers use it with the username of the user.
+// @Security OAuth2
+// @Produce  json
+// @Param body body CreateAppPasswordDTO true "The name of the app"
+// @Success 201 {object} CreatedAppPasswordDTO
+func CreateAppPassword(db *gorm.DB, appPasswords *service.AppPasswords) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var create CreateAppPasswordDTO
+		if err := c.ShouldBindJSON(&create); err != nil {
+			writeError(c, err)
+			return
+		}
+		user, _ := GetAuthenticatedUser(c)
+		appPassword, password, err := appPasswords.CreateAppPassword(db, user, create.Name, create.Subsonic)
+		if err != nil {
+			writeError(c, err)
+			return
+		}
+		c.JSON(http.StatusCreated, CreatedAppPasswordDTO{AppPassword: appPassword, Password: password})
+	}
+}
+
+// DeleteAppPassword
+// @Tags Authentication
+// @Router /api/user/app-passwords/{passwordId} [delete]
+// @Summary Revoke an app password
+// @Security OAuth2
+// @Param passwordId path int true "The app password id"
+// @Success 204
+func DeleteAppPassword(db *gorm.DB, appPasswords *service.AppPasswords) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		user, _ := GetAuthenticatedUser(c)
+		passwordId, ok := intParam(c, "passwordId")
+		if !ok {
+			simpleError(c, http.StatusNotFound)
+			return
+		}
+		if err := appPasswords.DeleteAppPassword(db, user, passwordId); err != nil {
+			writeError(c, err)
+			return
+		}
+		c.Status(http.StatusNoContent)
+	}
+}
@@ -40,6 +40,8 @@ type CreateUserDTO struct {
 	Username string `json:"username" binding:"required"`
 	Name     string `json:"name" binding:"required"`
 	Password string `json:"password" binding:"required"`
+	// Quota is the number of bytes the files of the user may take up. 0 means there is no limit.
+	Quota int64 `json:"quota" binding:"min=0"`
 }
 
 // CreateUser
@@ -62,6 +64,7 @@ func CreateUser(db *gorm.DB, pwdEnc *service.BcryptEncoder) gin.HandlerFunc {
 			Name:           create.Name,
 			Username:       create.Username,
 			HashedPassword: pwdEnc.Encode(create.Password),
+			Quota:          create.Quota,
 		}
 		if result := db.Save(&newUser); result.Error != nil {
 			writeError(c, result.Error)
@@ -101,13 +104,19 @@ type UpdateUserDTO struct {
 	Password string `json:"password" binding:""`
 }
 
+// AdminUpdateUserDTO has the changes that only admins can make.
+type AdminUpdateUserDTO struct {
+	UpdateUserDTO
+	Quota *int64 `json:"quota" binding:"omitempty,min=0"`
+}
+
 // UpdateUser
 // @Tags Authentication
 // @Router /api/users/{userId} [patch]
 // @Summary Update an existing user
 // @Security OAuth2
 // @Produce  json
-// @Param body body UpdateUserDTO true "The changes"
+// @Param body body AdminUpdateUserDTO true "The changes"
 // @Param userId path int true "The user id"
 // @Success 200 {object} model.User
 func UpdateUser(db *gorm.DB, users *service.User, pwdEnc *service.BcryptEncoder) gin.HandlerFunc {
@@ -118,7 +127,7 @@ func UpdateUser(db *gorm.DB, users *service.User, pwdEnc *service.BcryptEncoder)
 			return
 		}
 
-		var update UpdateUserDTO
+		var update AdminUpdateUserDTO
 		if err := c.ShouldBindJSON(&update); err != nil {
 			writeError(c, err)
 			return
@@ -137,6 +146,9 @@ func UpdateUser(db *gorm.DB, users *service.User, pwdEnc *service.BcryptEncoder)
 			if update.Password != "" {
 				user.HashedPassword = pwdEnc.Encode(update.Password)
 			}
+			if update.Quota != nil {
+				user.Quota = *update.Quota
+			}
 			if result := tx.Save(&user); result.Error != nil {
 				return result.Error
 			}
@@ -151,6 +163,35 @@ func UpdateUser(db *gorm.DB, users *service.User, pwdEnc *service.BcryptEncoder)
 	}
 }
 
+// GetUserUsage
+// @Tags Authentication
+// @Router /api/users/{userId}/usage [get]
+// @Summary Get the space used by the files of a user
+// @Security OAuth2
+// @Produce json
+// @Param userId path int true "The user id"
+// @Success 200 {object} service.QuotaUsage
+func GetUserUsage(db *gorm.DB, users *service.User, quotas *service.Quotas) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userId, ok := intParam(c, "userId")
+		if !ok {
+			simpleError(c, http.StatusNotFound)
+			return
+		}
+		var user model.User
+		if result := users.GetUsers(db).Take(&user, userId); result.Error != nil {
+			writeError(c, result.Error)
+			return
+		}
+		usage, err := quotas.GetUserUsage(user)
+		if err != nil {
+			writeError(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, usage)
+	}
+}
+
 // DeleteUser
 // @Tags Authentication
 // @Router /api/users/{userId} [delete]
@@ -0,0 +1,110 @@
+package controller
+
+import (
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"keydrive/internal/model"
+	"keydrive/internal/service"
+	"net/http"
+)
+
+type FileVersionPage struct {
+	TotalElements int64               `json:"totalElements"`
+	Elements      []model.FileVersion `json:"elements"`
+}
+
+// ListVersions
+// @Tags Files
+// @Router /api/libraries/{libraryId}/versions [get]
+// @Summary List the previous versions of a file
+// @Description Versions can be downloaded by creating a download token with the version id.
+// @Security OAuth2
+// @Produce json
+// @Param libraryId path int true "The library id"
+// @Param path query string true "The url encoded path"
+// @Success 200 {object} FileVersionPage
+// @Param page query int false "The page number to fetch" default(1)
+// @Param limit query int false "The maximum number of elements to return" default(20)
+func ListVersions(db *gorm.DB, libs *service.Library, versions *service.Versions) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		library, path, err := resolvePath(c, libs, db, false)
+		if err != nil {
+			writeError(c, err)
+			return
+		}
+		var page FileVersionPage
+		query := versions.GetVersionsForEntry(library, path, db).Order("created_at desc, id desc")
+		returnPage(c, query, &page, &page.TotalElements, &page.Elements)
+	}
+}
+
+// RestoreVersion
+// @Tags Files
+// @Router /api/libraries/{libraryId}/versions/{versionId}/restore [post]
+// @Summary Make a previous version the current content of its file
+// @Description The content that is replaced is kept as a new version.
+// @Security OAuth2
+// @Produce json
+// @Param libraryId path int true "The library id"
+// @Param versionId path int true "The version id"
+// @Success 200 {object} service.FileInfo
+func RestoreVersion(db *gorm.DB, libs *service.Library, versions *service.Versions) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		library, err := getAccessToLib(c, libs, true, db)
+		if err != nil {
+			writeError(c, err)
+			return
+		}
+		versionId, ok := intParam(c, "versionId")
+		if !ok {
+			simpleError(c, http.StatusNotFound)
+			return
+		}
+		version, err := versions.GetVersion(library, versionId, db)
+		if err != nil {
+			writeError(c, err)
+			return
+		}
+		restored, err := versions.Restore(version)
+		if err != nil {
+			writeError(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, restored)
+	}
+}
+
+type LibraryUsageDTO struct {
+	service.LibraryUsage
+	// Quota is the space that counts towards the quota of the library, according to the search index.
+	Quota service.QuotaUsage `json:"quota"`
+}
+
+// GetLibraryUsage
+// @Tags Files
+// @Router /api/libraries/{libraryId}/usage [get]
+// @Summary Get the disk space used by a library
+// @Description Files in the trash and previous versions of files are reported separately.
+// @Security OAuth2
+// @Produce json
+// @Param libraryId path int true "The library id"
+// @Success 200 {object} LibraryUsageDTO
+func GetLibraryUsage(db *gorm.DB, libs *service.Library, usage *service.Usage, quotas *service.Quotas) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		library, err := getAccessToLib(c, libs, false, db)
+		if err != nil {
+			writeError(c, err)
+			return
+		}
+		var result LibraryUsageDTO
+		if result.LibraryUsage, err = usage.GetUsageForLibrary(library); err != nil {
+			writeError(c, err)
+			return
+		}
+		if result.Quota, err = quotas.GetLibraryUsage(library); err != nil {
+			writeError(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, result)
+	}
+}
@@ -0,0 +1,129 @@
+package controller
+
+import (
+	"bytes"
+	"fmt"
+	"keydrive/internal/model"
+	"keydrive/internal/service"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestVersions(t *testing.T) {
+	tempDir := t.TempDir()
+	lib := model.Library{
+		Type:       model.TypeGeneric,
+		Name:       "Test Library",
+		RootFolder: tempDir,
+	}
+	testApp.DB.Create(&lib)
+
+	upload := func(t *testing.T, content string) {
+		body := &bytes.Buffer{}
+		writer := multipart.NewWriter(body)
+		part, _ := writer.CreateFormFile("data", "notes.txt")
+		_, _ = part.Write([]byte(content))
+		_ = writer.Close()
+		req := adminRequest("POST", fmt.Sprintf("/api/libraries/%d/entries", lib.ID), body)
+		req.Header.Set("Content-Type", writer.FormDataContentType())
+		recorder := httptest.NewRecorder()
+		testApp.Router.ServeHTTP(recorder, req)
+		assertStatus(t, recorder, 201)
+	}
+
+	listVersions := func(t *testing.T) FileVersionPage {
+		req := adminRequest("GET", fmt.Sprintf("/api/libraries/%d/versions?path=/notes.txt", lib.ID), nil)
+		recorder := httptest.NewRecorder()
+		testApp.Router.ServeHTTP(recorder, req)
+		assertStatus(t, recorder, 200)
+		var page FileVersionPage
+		assertJsonUnmarshal(t, recorder, &page)
+		return page
+	}
+
+	upload(t, "First\n")
+	upload(t, "Second\n")
+
+	t.Run("it keeps the previous version", func(t *testing.T) {
+		page := listVersions(t)
+		if page.TotalElements != 1 || page.Elements[0].Size != 6 {
+			t.Errorf("Expected a single version but got: %v", page)
+		}
+		if data, _ := os.ReadFile(filepath.Join(tempDir, "notes.txt")); string(data) != "Second\n" {
+			t.Errorf("Expected [Second] but got: %s", data)
+		}
+	})
+
+	t.Run("it downloads a version", func(t *testing.T) {
+		version := listVersions(t).Elements[0]
+		body := fmt.Sprintf(`{"path": "/notes.txt", "version": %d}`, version.ID)
+		req := adminRequest("POST", fmt.Sprintf("/api/libraries/%d/entries/download", lib.ID), strings.NewReader(body))
+		recorder := httptest.NewRecorder()
+		testApp.Router.ServeHTTP(recorder, req)
+		assertStatus(t, recorder, 201)
+		var token DownloadTokenDTO
+		assertJsonUnmarshal(t, recorder, &token)
+
+		req, _ = http.NewRequest("GET", fmt.Sprintf("/api/download?token=%s", token.Token), nil)
+		recorder = httptest.NewRecorder()
+		testApp.Router.ServeHTTP(recorder, req)
+		assertStatus(t, recorder, 200)
+		if body := recorder.Body.String(); body != "First\n" {
+			t.Errorf("Expected [First] but got: %s", body)
+		}
+	})
+
+	t.Run("it restores a version", func(t *testing.T) {
+		version := listVersions(t).Elements[0]
+		req := adminRequest("POST", fmt.Sprintf("/api/libraries/%d/versions/%d/restore", lib.ID, version.ID), nil)
+		recorder := httptest.NewRecorder()
+		testApp.Router.ServeHTTP(recorder, req)
+		assertStatus(t, recorder, 200)
+
+		if data, _ := os.ReadFile(filepath.Join(tempDir, "notes.txt")); string(data) != "First\n" {
+			t.Errorf("Expected [First] but got: %s", data)
+		}
+		page := listVersions(t)
+		if page.TotalElements != 1 || page.Elements[0].Size != 7 {
+			t.Errorf("Expected the replaced content to be kept as a version, but got: %v", page)
+		}
+	})
+
+	t.Run("it leaves the file in place while a version is kept", func(t *testing.T) {
+		if err := testApp.Versions.KeepVersion(lib, "/notes.txt"); err != nil {
+			t.Fatal(err.Error())
+		}
+		if data, _ := os.ReadFile(filepath.Join(tempDir, "notes.txt")); string(data) != "First\n" {
+			t.Errorf("Expected [First] but got: %s", data)
+		}
+		if page := listVersions(t); page.TotalElements != 2 || page.Elements[0].Size != 6 {
+			t.Errorf("Expected the current content to be kept as a version, but got: %v", page)
+		}
+	})
+
+	t.Run("it keeps a limited number of versions", func(t *testing.T) {
+		for i := 0; i < testApp.Config.VersionMaxCount+2; i++ {
+			upload(t, fmt.Sprintf("Version %d\n", i))
+		}
+		if page := listVersions(t); int(page.TotalElements) != testApp.Config.VersionMaxCount {
+			t.Errorf("Expected %d versions but got %d", testApp.Config.VersionMaxCount, page.TotalElements)
+		}
+	})
+
+	t.Run("it reports versions separately in the usage", func(t *testing.T) {
+		req := adminRequest("GET", fmt.Sprintf("/api/libraries/%d/usage", lib.ID), nil)
+		recorder := httptest.NewRecorder()
+		testApp.Router.ServeHTTP(recorder, req)
+		assertStatus(t, recorder, 200)
+		var usage service.LibraryUsage
+		assertJsonUnmarshal(t, recorder, &usage)
+		if usage.Files.Count != 1 || int(usage.Versions.Count) != testApp.Config.VersionMaxCount {
+			t.Errorf("Unexpected usage: %s", recorder.Body.String())
+		}
+	})
+}
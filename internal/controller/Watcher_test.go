@@ -0,0 +1,72 @@
+package controller
+
+import (
+	"context"
+	"keydrive/internal/model"
+	"keydrive/internal/service"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestWatcher(t *testing.T) {
+	tempDir := t.TempDir()
+	_ = os.WriteFile(filepath.Join(tempDir, "existing.txt"), []byte("Existing\n"), 0777)
+	lib := model.Library{
+		Type:       model.TypeGeneric,
+		Name:       "Watched Library",
+		RootFolder: tempDir,
+	}
+	testApp.DB.Create(&lib)
+	if _, err := testApp.Index.ScanLibrary(context.Background(), lib); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	watcher := &service.Watcher{DB: testApp.DB, Index: testApp.Index, Delay: 50 * time.Millisecond}
+	if err := watcher.Watch(lib); err != nil {
+		t.Fatal(err.Error())
+	}
+	defer watcher.Close()
+	events, unsubscribe := testApp.Events.Subscribe(100)
+	defer unsubscribe()
+
+	expectEvent := func(t *testing.T, eventType service.EventType, path string) service.Event {
+		timeout := time.After(5 * time.Second)
+		for {
+			select {
+			case event := <-events:
+				if event.LibraryID == lib.ID && event.Type == eventType && event.Path == path {
+					return event
+				}
+			case <-timeout:
+				t.Fatalf("Expected a %s event for %s", eventType, path)
+			}
+		}
+	}
+
+	t.Run("it finds new files", func(t *testing.T) {
+		_ = os.WriteFile(filepath.Join(tempDir, "new.txt"), []byte("New\n"), 0777)
+		expectEvent(t, service.EventCreated, "/new.txt")
+	})
+
+	t.Run("it finds files in new folders", func(t *testing.T) {
+		_ = os.MkdirAll(filepath.Join(tempDir, "folder", "nested"), 0777)
+		expectEvent(t, service.EventCreated, "/folder/nested")
+		_ = os.WriteFile(filepath.Join(tempDir, "folder", "nested", "deep.txt"), []byte("Deep\n"), 0777)
+		expectEvent(t, service.EventCreated, "/folder/nested/deep.txt")
+	})
+
+	t.Run("it finds moves", func(t *testing.T) {
+		_ = os.Rename(filepath.Join(tempDir, "existing.txt"), filepath.Join(tempDir, "folder", "moved.txt"))
+		event := expectEvent(t, service.EventMoved, "/folder/moved.txt")
+		if event.OldPath != "/existing.txt" {
+			t.Errorf("Expected the old path to be /existing.txt but got: %s", event.OldPath)
+		}
+	})
+
+	t.Run("it finds deletes", func(t *testing.T) {
+		_ = os.RemoveAll(filepath.Join(tempDir, "folder"))
+		expectEvent(t, service.EventDeleted, "/folder")
+	})
+}
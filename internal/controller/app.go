@@ -1,19 +1,115 @@
 package controller
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	"github.com/gin-gonic/gin"
 	"gorm.io/gorm"
 	glog "gorm.io/gorm/logger"
 	"keydrive/internal/model"
 	"keydrive/internal/service"
 	"keydrive/web/dist"
+	"net"
 	"net/http"
 	"os"
 	"time"
 )
 
+type Config struct {
+	// UploadExpiration is the time after which unfinished resumable uploads are discarded.
+	UploadExpiration time.Duration
+	// DownloadTokenTTL is the time after which an unused download token expires.
+	DownloadTokenTTL time.Duration
+	// DownloadTokenStore is either "memory" or "database". Tokens in the database survive restarts and can be used
+	// on every instance sharing the database.
+	DownloadTokenStore string
+	// DownloadTokenMultiUse makes all download tokens reusable until they expire.
+	DownloadTokenMultiUse bool
+	// TrashRetention is the time after which deleted entries are permanently removed from the trash.
+	TrashRetention time.Duration
+	// VersionMaxCount is the number of previous versions that are kept for every file.
+	VersionMaxCount int
+	// VersionMaxAge is the time after which previous versions of a file are removed.
+	VersionMaxAge time.Duration
+	// IndexInterval is the time between scans of all libraries to update the search index.
+	IndexInterval time.Duration
+	// IndexContent extracts the text of documents, so it can be searched.
+	IndexContent bool
+	// WatchFiles watches the library folders, so changes made outside KeyDrive are found right away.
+	WatchFiles bool
+	// RescanInterval is the time between scans of libraries that can not be watched completely, because the system
+	// limit on watches was reached.
+	RescanInterval time.Duration
+	// ChangeRetention is the time after which changes are removed from the change journal. Sync clients that have not
+	// fetched changes for longer have to do a full resync.
+	ChangeRetention time.Duration
+	// MimeTypesFile is a JSON file with extra file extensions, mime types and categories.
+	MimeTypesFile string
+	// PublicURL is the url at which KeyDrive is reached, for absolute links in feeds. By default it is taken from the
+	// request.
+	PublicURL string
+	// JobWorkers is the number of background jobs that run at the same time on this instance.
+	JobWorkers int
+	// JobRetention is the time after which finished jobs are removed.
+	JobRetention time.Duration
+	// DiskWarningPercent and DiskCriticalPercent are the percentages of free space below which the health check
+	// reports the filesystem of a library with the warning or critical status.
+	DiskWarningPercent  int
+	DiskCriticalPercent int
+	// MetricsListen is the address of a separate server for the metrics endpoint, so it is not reachable on the
+	// public address.
+	MetricsListen string
+	// MetricsToken is a bearer token that scrapers have to send to read the metrics. Without a separate address, the
+	// metrics are only served at /metrics next to the api if a token is set, since they contain the names of libraries.
+	MetricsToken string
+}
+
+func (c Config) withDefaults() Config {
+	if c.UploadExpiration <= 0 {
+		c.UploadExpiration = 24 * time.Hour
+	}
+	if c.DownloadTokenTTL <= 0 {
+		c.DownloadTokenTTL = time.Hour
+	}
+	if c.DownloadTokenStore == "" {
+		c.DownloadTokenStore = "memory"
+	}
+	if c.TrashRetention <= 0 {
+		c.TrashRetention = 30 * 24 * time.Hour
+	}
+	if c.VersionMaxCount <= 0 {
+		c.VersionMaxCount = 10
+	}
+	if c.VersionMaxAge <= 0 {
+		c.VersionMaxAge = 30 * 24 * time.Hour
+	}
+	if c.IndexInterval <= 0 {
+		c.IndexInterval = time.Hour
+	}
+	if c.RescanInterval <= 0 {
+		c.RescanInterval = 5 * time.Minute
+	}
+	if c.ChangeRetention <= 0 {
+		c.ChangeRetention = 30 * 24 * time.Hour
+	}
+	if c.JobWorkers <= 0 {
+		c.JobWorkers = 2
+	}
+	if c.JobRetention <= 0 {
+		c.JobRetention = 7 * 24 * time.Hour
+	}
+	if c.DiskWarningPercent <= 0 {
+		c.DiskWarningPercent = 10
+	}
+	if c.DiskCriticalPercent <= 0 {
+		c.DiskCriticalPercent = 5
+	}
+	return c
+}
+
 type App struct {
+	Config          Config
 	Router          *gin.Engine
 	DB              *gorm.DB
 	Users           *service.User
@@ -22,11 +118,41 @@ type App struct {
 	FileSystem      *service.FileSystem
 	PasswordEncoder *service.BcryptEncoder
 	DownloadTokens  *service.DownloadTokens
+	Uploads         *service.Uploads
+	ShareLinks      *service.ShareLinks
+	Trash           *service.Trash
+	Versions        *service.Versions
+	Usage           *service.Usage
+	Thumbnails      *service.Thumbnails
+	Index           *service.Index
+	Events          *service.Events
+	Changes         *service.Changes
+	AppPasswords    *service.AppPasswords
+	PodcastFeeds    *service.PodcastFeeds
+	Batches         *service.Batches
+	Quotas          *service.Quotas
+	Jobs            *service.Jobs
+	Scheduler       *service.Scheduler
+	Integrity       *service.Integrity
+	Metrics         *Metrics
+	Watcher         *service.Watcher
 	Clients         *model.ClientDetailsService
 	Close           func()
 }
 
-func NewApp(dbDiag gorm.Dialector) (app App, err error) {
+func NewApp(dbDiag gorm.Dialector, config Config) (app App, err error) {
+	app.Config = config.withDefaults()
+	if app.Config.DownloadTokenStore != "memory" && app.Config.DownloadTokenStore != "database" {
+		err = fmt.Errorf("unknown download token store: %s", app.Config.DownloadTokenStore)
+		log.Error("invalid configuration: %s", err)
+		return
+	}
+	if app.Config.MimeTypesFile != "" {
+		if err = service.LoadMimeTypes(app.Config.MimeTypesFile); err != nil {
+			log.Error("invalid configuration: %s", err)
+			return
+		}
+	}
 	connectAttempt := 0
 	for app.DB == nil {
 		connectAttempt++
@@ -54,7 +180,7 @@ func NewApp(dbDiag gorm.Dialector) (app App, err error) {
 	log.Info("starting automigration...")
 
 	app.DB.Exec("CREATE EXTENSION IF NOT EXISTS citext WITH SCHEMA public")
-	err = app.DB.AutoMigrate(&model.User{}, &model.OAuth2Token{}, &model.Library{}, &model.CanAccessLibrary{})
+	err = app.DB.AutoMigrate(&model.User{}, &model.OAuth2Token{}, &model.Library{}, &model.CanAccessLibrary{}, &model.Upload{}, &model.DownloadToken{}, &model.ShareLink{}, &model.ShareLinkAccess{}, &model.TrashItem{}, &model.FileVersion{}, &model.IndexedEntry{}, &model.Change{}, &model.ChangeJournal{}, &model.AppPassword{}, &model.PodcastFeed{}, &model.Job{}, &model.ScheduledTask{})
 	if err != nil {
 		log.Error("migration failed: %s", err)
 		os.Exit(1)
@@ -88,13 +214,100 @@ func NewApp(dbDiag gorm.Dialector) (app App, err error) {
 	}
 	app.FileSystem = &service.FileSystem{}
 	app.PasswordEncoder = &service.BcryptEncoder{}
-	app.DownloadTokens = service.NewDownloadTokens()
+	if app.Config.DownloadTokenStore == "database" {
+		app.DownloadTokens = service.NewDatabaseDownloadTokens(app.DB)
+	} else {
+		app.DownloadTokens = service.NewDownloadTokens()
+	}
+	app.DownloadTokens.TTL = app.Config.DownloadTokenTTL
+	app.DownloadTokens.MultiUse = app.Config.DownloadTokenMultiUse
+	app.Versions = &service.Versions{
+		DB:         app.DB,
+		FileSystem: app.FileSystem,
+		MaxCount:   app.Config.VersionMaxCount,
+		MaxAge:     app.Config.VersionMaxAge,
+	}
+	app.Usage = &service.Usage{
+		DB:         app.DB,
+		FileSystem: app.FileSystem,
+	}
+	app.Events = service.NewEvents()
+	app.Thumbnails = &service.Thumbnails{FileSystem: app.FileSystem}
+	app.Changes = &service.Changes{
+		DB:        app.DB,
+		Retention: app.Config.ChangeRetention,
+	}
+	app.Index = &service.Index{
+		DB:           app.DB,
+		FileSystem:   app.FileSystem,
+		Libraries:    app.Libraries,
+		Events:       app.Events,
+		Changes:      app.Changes,
+		IndexContent: app.Config.IndexContent,
+	}
+	app.FileSystem.Listener = app.Index
+	app.Watcher = &service.Watcher{
+		DB:    app.DB,
+		Index: app.Index,
+	}
+	app.Quotas = &service.Quotas{
+		DB:         app.DB,
+		FileSystem: app.FileSystem,
+		Index:      app.Index,
+	}
+	app.Uploads = &service.Uploads{
+		DB:         app.DB,
+		FileSystem: app.FileSystem,
+		Versions:   app.Versions,
+		Quotas:     app.Quotas,
+		Expiration: app.Config.UploadExpiration,
+	}
+	app.ShareLinks = &service.ShareLinks{
+		DB:              app.DB,
+		PasswordEncoder: app.PasswordEncoder,
+	}
+	app.Trash = &service.Trash{
+		DB:         app.DB,
+		FileSystem: app.FileSystem,
+		Retention:  app.Config.TrashRetention,
+	}
+	app.Batches = &service.Batches{
+		FileSystem: app.FileSystem,
+		Trash:      app.Trash,
+		Quotas:     app.Quotas,
+	}
+	app.AppPasswords = &service.AppPasswords{
+		DB:              app.DB,
+		Users:           app.Users,
+		PasswordEncoder: app.PasswordEncoder,
+	}
+	app.PodcastFeeds = &service.PodcastFeeds{
+		DB: app.DB,
+	}
+	app.Jobs = &service.Jobs{
+		DB:      app.DB,
+		Workers: app.Config.JobWorkers,
+	}
+	app.Jobs.Register(JobBatch, batchJob(app.DB, app.Batches))
+	app.Jobs.Register(JobThumbnails, thumbnailsJob(app.Thumbnails))
+	app.Jobs.Register(JobIndex, indexJob(app.Index))
+	app.Scheduler = &service.Scheduler{DB: app.DB}
+	app.Integrity = &service.Integrity{
+		DB:         app.DB,
+		FileSystem: app.FileSystem,
+		Trash:      app.Trash,
+		Versions:   app.Versions,
+	}
 	app.Clients = &model.ClientDetailsService{}
 
-	app.Router = gin.Default()
+	app.Metrics = NewMetrics(app.DB)
+
+	app.Router = gin.New()
+	app.Router.Use(RequestLogger(), gin.Recovery())
+	app.Router.Use(RecordRequests(app.Metrics))
 	oauth2 := app.Router.Group("/oauth2")
 	{
-		oauth2.POST("/token", Token(app.Users, app.Clients, app.Tokens, app.PasswordEncoder))
+		oauth2.POST("/token", CountIssuedTokens(app.Metrics, "access"), Token(app.Users, app.Clients, app.Tokens, app.PasswordEncoder, app.Metrics))
 	}
 
 	api := app.Router.Group("/api", Authenticate(app.Tokens))
@@ -103,6 +316,10 @@ func NewApp(dbDiag gorm.Dialector) (app App, err error) {
 		{
 			user.GET("/", GetAuthenticatedUserInfo())
 			user.PATCH("/", UpdateAuthenticatedUser(app.DB, app.PasswordEncoder))
+			user.GET("/usage", GetAuthenticatedUserUsage(app.Quotas))
+			user.GET("/app-passwords", ListAppPasswords(app.DB, app.AppPasswords))
+			user.POST("/app-passwords", CountIssuedTokens(app.Metrics, "app_password"), CreateAppPassword(app.DB, app.AppPasswords))
+			user.DELETE("/app-passwords/:passwordId", DeleteAppPassword(app.DB, app.AppPasswords))
 		}
 		users := api.Group("/users", RequireAuthentication())
 		{
@@ -111,6 +328,7 @@ func NewApp(dbDiag gorm.Dialector) (app App, err error) {
 			users.GET("/:userId", GetUser(app.DB, app.Users))
 			users.PATCH("/:userId", RequireAdmin(), UpdateUser(app.DB, app.Users, app.PasswordEncoder))
 			users.DELETE("/:userId", RequireAdmin(), DeleteUser(app.DB, app.Users))
+			users.GET("/:userId/usage", RequireAdmin(), GetUserUsage(app.DB, app.Users, app.Quotas))
 		}
 		libraries := api.Group("/libraries", RequireAuthentication())
 		{
@@ -119,32 +337,296 @@ func NewApp(dbDiag gorm.Dialector) (app App, err error) {
 			libraries.GET("/:libraryId", RequireAdmin(), GetLibrary(app.DB, app.Libraries))
 			libraries.PATCH("/:libraryId", RequireAdmin(), UpdateLibrary(app.DB, app.Libraries))
 			libraries.DELETE("/:libraryId", RequireAdmin(), DeleteLibrary(app.DB, app.Libraries))
-			libraries.POST("/:libraryId/shares", RequireAdmin(), ShareLibrary(app.DB, app.Libraries, app.Users))
-			libraries.DELETE("/:libraryId/shares/:userId", RequireAdmin(), UnshareLibrary(app.DB))
+			libraries.POST("/:libraryId/shares", RequireAdmin(), ShareLibrary(app.DB, app.Libraries, app.Users, app.Events))
+			libraries.DELETE("/:libraryId/shares/:userId", RequireAdmin(), UnshareLibrary(app.DB, app.Events))
+			libraries.GET("/:libraryId/usage", GetLibraryUsage(app.DB, app.Libraries, app.Usage, app.Quotas))
+			libraries.GET("/:libraryId/changes", ListChanges(app.DB, app.Libraries, app.Changes))
+			libraries.POST("/:libraryId/index", RequireAdmin(), IndexLibrary(app.DB, app.Libraries, app.Index, app.Jobs))
+			libraries.POST("/:libraryId/thumbnails", RequireAdmin(), GenerateThumbnails(app.DB, app.Libraries, app.Jobs))
+			libraries.POST("/:libraryId/links", CreateShareLink(app.DB, app.Libraries, app.FileSystem, app.ShareLinks, app.Events))
+			libraries.GET("/:libraryId/feeds", ListPodcastFeeds(app.DB, app.Libraries, app.PodcastFeeds))
+			libraries.POST("/:libraryId/feeds", CreatePodcastFeed(app.DB, app.Libraries, app.FileSystem, app.PodcastFeeds))
+			libraries.PATCH("/:libraryId/feeds/:feedId", UpdatePodcastFeed(app.DB, app.Libraries, app.FileSystem, app.PodcastFeeds))
+			libraries.DELETE("/:libraryId/feeds/:feedId", DeletePodcastFeed(app.DB, app.Libraries, app.PodcastFeeds))
 
 			entries := libraries.Group("/:libraryId/entries")
 			{
-				entries.GET("", ListEntries(app.DB, app.Libraries, app.FileSystem))
-				entries.POST("", CreateEntry(app.DB, app.Libraries, app.FileSystem))
-				entries.POST("/download", CreateDownloadToken(app.DB, app.Libraries, app.DownloadTokens))
-				entries.DELETE("", DeleteEntry(app.DB, app.Libraries, app.FileSystem))
-				entries.POST("/move", MoveEntry(app.DB, app.Libraries, app.FileSystem))
+				entries.GET("", ListEntries(app.DB, app.Libraries, app.FileSystem, app.Index))
+				entries.POST("", TrackUploads(app.Metrics), CreateEntry(app.DB, app.Libraries, app.FileSystem, app.Versions, app.Quotas))
+				entries.POST("/download", CountIssuedTokens(app.Metrics, "download"), CreateDownloadToken(app.DB, app.Libraries, app.DownloadTokens, app.Versions))
+				entries.DELETE("", DeleteEntry(app.DB, app.Libraries, app.Trash))
+				entries.POST("/move", MoveEntry(app.DB, app.Libraries, app.FileSystem, app.Events, app.Jobs, app.Quotas, app.Trash))
+				entries.POST("/copy", CopyEntry(app.DB, app.Libraries, app.FileSystem, app.Events, app.Jobs, app.Quotas, app.Trash))
+				entries.POST("/batch", RunBatch(app.DB, app.Libraries, app.Batches, app.Jobs))
+				entries.GET("/thumbnail", GetThumbnail(app.DB, app.Libraries, app.Thumbnails))
+				entries.GET("/cover", GetCover(app.DB, app.Libraries, app.FileSystem))
+			}
+
+			trash := libraries.Group("/:libraryId/trash")
+			{
+				trash.GET("", ListTrash(app.DB, app.Libraries, app.Trash))
+				trash.DELETE("", EmptyTrash(app.DB, app.Libraries, app.Trash))
+				trash.POST("/:itemId/restore", RestoreTrashItem(app.DB, app.Libraries, app.Trash))
+				trash.DELETE("/:itemId", DeleteTrashItem(app.DB, app.Libraries, app.Trash))
+			}
+
+			versions := libraries.Group("/:libraryId/versions")
+			{
+				versions.GET("", ListVersions(app.DB, app.Libraries, app.Versions))
+				versions.POST("/:versionId/restore", RestoreVersion(app.DB, app.Libraries, app.Versions))
+			}
+
+			uploads := libraries.Group("/:libraryId/uploads", TusResumable())
+			{
+				uploads.OPTIONS("", GetUploadOptions())
+				uploads.POST("", TrackUploads(app.Metrics), CreateUpload(app.DB, app.Libraries, app.Uploads))
+				uploads.HEAD("/:uploadId", GetUploadOffset(app.DB, app.Libraries, app.Uploads))
+				uploads.PATCH("/:uploadId", TrackUploads(app.Metrics), PatchUpload(app.DB, app.Libraries, app.Uploads))
+				uploads.DELETE("/:uploadId", TerminateUpload(app.DB, app.Libraries, app.Uploads))
 			}
 		}
+		links := api.Group("/links", RequireAuthentication())
+		{
+			links.GET("", ListShareLinks(app.DB, app.ShareLinks))
+			links.DELETE("/:linkId", DeleteShareLink(app.DB, app.ShareLinks, app.Events))
+			links.GET("/:linkId/accesses", ListShareLinkAccesses(app.DB, app.ShareLinks))
+		}
+		jobs := api.Group("/jobs", RequireAuthentication())
+		{
+			jobs.GET("", ListJobs(app.DB))
+			jobs.GET("/:jobId", GetJob(app.Jobs))
+			jobs.DELETE("/:jobId", CancelJob(app.Jobs))
+		}
+		api.GET("/search", RequireAuthentication(), Search(app.DB, app.Index))
+		api.GET("/events", AuthenticateQuery(app.Tokens), RequireAuthentication(), StreamEvents(app.DB, app.Libraries, app.Events))
 		download := api.Group("/download", RequireDownloadToken(app.DownloadTokens))
 		{
-			download.GET("", Download(app.FileSystem))
+			download.GET("", TrackDownloads(app.Metrics), Download(app.FileSystem, app.Versions))
 		}
 		system := api.Group("/system")
 		{
-			system.GET("/health", HealthCheckController(app.DB))
+			healthCheck := HealthCheckController(app.DB, app.FileSystem, app.Config.DiskWarningPercent, app.Config.DiskCriticalPercent)
+			system.GET("/health", healthCheck)
+			system.GET("/health/ready", healthCheck)
+			system.GET("/health/live", LivenessController())
 			system.POST("/browse", RequireAdmin(), SystemBrowse(app.FileSystem))
+			system.GET("/schedules", RequireAdmin(), ListSchedules(app.Scheduler))
+			system.PUT("/schedules/:name", RequireAdmin(), UpdateSchedule(app.Scheduler))
+			system.POST("/schedules/:name/run", RequireAdmin(), RunSchedule(app.Scheduler))
+		}
+	}
+	shared := app.Router.Group("/s/:slug")
+	{
+		shared.GET("", TrackDownloads(app.Metrics), DownloadSharedEntry(app.DB, app.Libraries, app.FileSystem, app.ShareLinks))
+		shared.GET("/entries", ListSharedEntries(app.DB, app.Libraries, app.FileSystem, app.ShareLinks))
+		shared.POST("/entries", TrackUploads(app.Metrics), UploadSharedEntry(app.DB, app.Libraries, app.FileSystem, app.ShareLinks, app.Quotas))
+	}
+	feeds := app.Router.Group("/feeds/:token")
+	{
+		feeds.GET("", GetPodcastFeed(app.FileSystem, app.Index, app.PodcastFeeds, app.Config))
+		feeds.GET("/media/:name", TrackDownloads(app.Metrics), GetPodcastEpisode(app.FileSystem, app.PodcastFeeds))
+		feeds.GET("/artwork", GetPodcastArtwork(app.FileSystem, app.PodcastFeeds))
+	}
+	opds := app.Router.Group("/opds", Authenticate(app.Tokens), AuthenticateBasic(app.AppPasswords, app.Metrics), RequireBasicAuthentication("KeyDrive"))
+	{
+		for _, version := range []OpdsVersion{Opds1, Opds2} {
+			catalog := opds.Group("/" + version.Name)
+			catalog.GET("", OpdsCatalog(app.DB, app.Libraries, version))
+			catalog.GET("/libraries/:libraryId", OpdsLibrary(app.DB, app.Libraries, version))
+			catalog.GET("/libraries/:libraryId/folder", OpdsFolder(app.DB, app.Libraries, app.FileSystem, app.Index, version))
+			catalog.GET("/libraries/:libraryId/authors", OpdsAuthors(app.DB, app.Libraries, app.Index, version))
+			catalog.GET("/libraries/:libraryId/authors/books", OpdsAuthorBooks(app.DB, app.Libraries, app.Index, version))
+			catalog.GET("/libraries/:libraryId/series", OpdsSeries(app.DB, app.Libraries, app.Index, version))
+			catalog.GET("/libraries/:libraryId/series/books", OpdsSeriesBooks(app.DB, app.Libraries, app.Index, version))
+			catalog.GET("/libraries/:libraryId/recent", OpdsRecent(app.DB, app.Libraries, app.Index, version))
+			catalog.GET("/libraries/:libraryId/search", OpdsSearch(app.DB, app.Libraries, app.Index, version))
+			catalog.GET("/libraries/:libraryId/opensearch.xml", OpdsOpenSearch(app.DB, app.Libraries, version))
+		}
+		opds.GET("/libraries/:libraryId/download", CountIssuedTokens(app.Metrics, "download"), OpdsDownload(app.DB, app.Libraries, app.DownloadTokens))
+		opds.GET("/libraries/:libraryId/cover", GetCover(app.DB, app.Libraries, app.FileSystem))
+	}
+	subsonic := app.Router.Group("/rest", AuthenticateSubsonic(app.AppPasswords, app.Metrics))
+	{
+		// Subsonic clients call the api with and without the .view suffix, with GET and with POST.
+		for name, handler := range map[string]gin.HandlerFunc{
+			"ping":              SubsonicPing(),
+			"getMusicFolders":   SubsonicGetMusicFolders(app.DB, app.Libraries),
+			"getIndexes":        SubsonicGetIndexes(app.DB, app.Index),
+			"getMusicDirectory": SubsonicGetMusicDirectory(app.DB, app.Index),
+			"getArtists":        SubsonicGetArtists(app.DB, app.Index),
+			"getArtist":         SubsonicGetArtist(app.DB, app.Index),
+			"getAlbum":          SubsonicGetAlbum(app.DB, app.Index),
+			"search3":           SubsonicSearch3(app.DB, app.Index),
+			"stream":            SubsonicStream(app.DB, app.FileSystem, app.Index),
+			"download":          SubsonicDownload(app.DB, app.FileSystem, app.Index),
+			"getCoverArt":       SubsonicGetCoverArt(app.DB, app.FileSystem, app.Index),
+		} {
+			handlers := []gin.HandlerFunc{handler}
+			if name == "stream" || name == "download" {
+				handlers = append([]gin.HandlerFunc{TrackDownloads(app.Metrics)}, handlers...)
+			}
+			subsonic.Match([]string{http.MethodGet, http.MethodPost}, "/"+name, handlers...)
+			subsonic.Match([]string{http.MethodGet, http.MethodPost}, "/"+name+".view", handlers...)
+		}
+	}
+	var metricsServer *http.Server
+	if app.Config.MetricsListen != "" {
+		var listener net.Listener
+		if listener, err = net.Listen("tcp", app.Config.MetricsListen); err != nil {
+			log.Error("failed to listen for metrics on %s: %s", app.Config.MetricsListen, err)
+			return
 		}
+		metricsRouter := gin.New()
+		metricsRouter.GET("/metrics", MetricsController(app.Metrics, app.Config.MetricsToken))
+		metricsServer = &http.Server{Handler: metricsRouter}
+		go func() {
+			if err := metricsServer.Serve(listener); err != http.ErrServerClosed {
+				log.Error("metrics server failed: %s", err)
+			}
+		}()
+	} else if app.Config.MetricsToken != "" {
+		app.Router.GET("/metrics", MetricsController(app.Metrics, app.Config.MetricsToken))
 	}
 	app.Router.NoRoute(Static(http.FS(dist.App)))
 
+	app.Jobs.Start()
+	if app.Config.DownloadTokenStore == "database" {
+		app.Scheduler.Register("cleanup-tokens", "Remove expired download tokens", "@every 1m", true, func(ctx context.Context) error {
+			_, err := app.DownloadTokens.SweepExpired()
+			return err
+		})
+	}
+	app.Scheduler.Register("purge-uploads", "Discard unfinished uploads that expired", "@hourly", true, func(ctx context.Context) error {
+		purged, err := app.Uploads.PurgeExpiredUploads()
+		if purged > 0 {
+			log.Info("purged %d expired uploads", purged)
+		}
+		return err
+	})
+	app.Scheduler.Register("purge-trash", "Permanently delete entries that have been in the trash for longer than the retention period", "@hourly", true, func(ctx context.Context) error {
+		purged, err := app.Trash.PurgeExpired()
+		if purged > 0 {
+			log.Info("purged %d items from the trash", purged)
+		}
+		return err
+	})
+	app.Scheduler.Register("purge-versions", "Remove old versions of files", "@hourly", true, func(ctx context.Context) error {
+		purged, err := app.Versions.PurgeExpired()
+		if purged > 0 {
+			log.Info("purged %d old file versions", purged)
+		}
+		return err
+	})
+	app.Scheduler.Register("purge-changes", "Remove old changes from the change journal", "@hourly", true, func(ctx context.Context) error {
+		purged, err := app.Changes.PurgeExpired()
+		if purged > 0 {
+			log.Info("purged %d changes from the change journal", purged)
+		}
+		return err
+	})
+	app.Scheduler.Register("purge-jobs", "Remove finished background jobs", "@daily", true, func(ctx context.Context) error {
+		purged, err := app.Jobs.PurgeFinished(app.Config.JobRetention)
+		if purged > 0 {
+			log.Info("purged %d finished jobs", purged)
+		}
+		return err
+	})
+	indexLibraries := func(ctx context.Context) error {
+		changed, err := app.Index.ScanAllLibraries(ctx)
+		if changed > 0 {
+			log.Info("updated %d entries in the search index", changed)
+		}
+		return err
+	}
+	app.Scheduler.Register("update-index", "Rescan all libraries to update the search index", "@every "+app.Config.IndexInterval.String(), true, func(ctx context.Context) error {
+		return indexLibraries(ctx)
+	})
+	app.Scheduler.Register("warm-thumbnails", "Generate missing thumbnails for all libraries in the background", "0 4 * * *", false, func(ctx context.Context) error {
+		var libraries []model.Library
+		if err := app.DB.Find(&libraries).Error; err != nil {
+			return err
+		}
+		for _, library := range libraries {
+			library := library
+			_, err := app.Jobs.EnqueueUnique(JobThumbnails, nil, &library, GenerateThumbnailsDTO{Sizes: defaultThumbnailSizes})
+			if err != nil && !errors.Is(err, service.ErrJobActive) {
+				return err
+			}
+		}
+		return nil
+	})
+	app.Scheduler.Register("check-integrity", "Remove records of trash items and versions whose files are gone, and clean up interrupted transfers", "30 3 * * *", true, func(ctx context.Context) error {
+		report, err := app.Integrity.Check(ctx)
+		if report != (service.IntegrityReport{}) {
+			log.Info("integrity check: %+v", report)
+		}
+		return err
+	})
+	app.Scheduler.Start()
+
+	stop := make(chan struct{})
+	// ctx stops the scans that are started here when the app is closed.
+	ctx, cancel := context.WithCancel(context.Background())
+	app.Index.Start(ctx)
+	go func() {
+		if app.Config.WatchFiles {
+			// Start watching first, so no changes are missed while the libraries are scanned.
+			if err := app.Watcher.Sync(); err != nil {
+				log.Error("failed to watch libraries: %s", err)
+			}
+		}
+		if err := indexLibraries(ctx); err != nil && ctx.Err() == nil {
+			log.Error("failed to update search index: %s", err)
+		}
+	}()
+	if app.Config.DownloadTokenStore == "memory" {
+		// Tokens in memory belong to this instance, so every instance sweeps its own.
+		runPeriodically(stop, time.Minute, "sweep expired download tokens", func() error {
+			_, err := app.DownloadTokens.SweepExpired()
+			return err
+		})
+	}
+	if app.Config.WatchFiles {
+		// The watches belong to this instance, so every instance rescans what it can not watch.
+		runPeriodically(stop, app.Config.RescanInterval, "rescan libraries", func() error {
+			if err := app.Watcher.Sync(); err != nil {
+				return err
+			}
+			changed, err := app.Watcher.RescanLimited(ctx)
+			if changed > 0 {
+				log.Info("found %d changed entries in libraries that are not watched completely", changed)
+			}
+			return err
+		})
+	}
+
 	app.Close = func() {
-		// Nothing to do by default
+		close(stop)
+		cancel()
+		if metricsServer != nil {
+			_ = metricsServer.Close()
+		}
+		app.Scheduler.Stop()
+		app.Watcher.Close()
+		app.Jobs.Stop()
 	}
 	return
 }
+
+// runPeriodically runs a task in the background at a fixed interval, until the stop channel is closed.
+func runPeriodically(stop <-chan struct{}, interval time.Duration, name string, task func() error) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				if err := task(); err != nil {
+					log.Error("failed to %s: %s", name, err)
+				}
+			}
+		}
+	}()
+}
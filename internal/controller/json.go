@@ -5,6 +5,7 @@ import (
 	"github.com/gin-gonic/gin"
 	"github.com/go-playground/validator/v10"
 	"gorm.io/gorm"
+	"keydrive/internal/service"
 	"keydrive/pkg/logger"
 	"net/http"
 	"os"
@@ -75,33 +76,64 @@ type SQLError interface {
 }
 
 func writeError(c *gin.Context, err error) {
+	apiError := toApiError(err)
+	if apiError.Status == http.StatusInternalServerError {
+		log.Error("Uncaught error in %s %s: %s", c.Request.Method, c.Request.URL.Path, err.Error())
+	}
+	writeJsonError(c, apiError)
+}
+
+// toApiError describes an error the way it is sent to clients. Errors that are not known are internal server errors.
+func toApiError(err error) ApiError {
 	if apiError, ok := err.(ApiError); ok {
-		writeJsonError(c, apiError)
-		return
+		return apiError
 	}
 	if validationErrors, ok := err.(validator.ValidationErrors); ok {
-		writeJsonError(c, ApiError{
+		return ApiError{
 			Status:      http.StatusBadRequest,
 			Description: "validation failure",
 			Details:     mapErrors(validationErrors),
-		})
-		return
+		}
 	}
 	if sqlError, ok := err.(SQLError); ok {
 		if sqlError.SQLState() == "23505" {
 			// unique constraint violation
-			simpleError(c, http.StatusConflict)
-			return
+			return ApiError{Status: http.StatusConflict}
 		}
 	}
 	if errors.Is(err, gorm.ErrRecordNotFound) {
-		simpleError(c, http.StatusNotFound)
-		return
+		return ApiError{Status: http.StatusNotFound}
 	}
 	if os.IsNotExist(err) {
-		simpleError(c, http.StatusNotFound)
-		return
+		return ApiError{Status: http.StatusNotFound}
+	}
+	if errors.Is(err, service.ErrReservedPath) || errors.Is(err, service.ErrTransferIntoItself) || errors.Is(err, service.ErrUnknownBatchOperation) || errors.Is(err, service.ErrInvalidSchedule) {
+		return ApiError{Status: http.StatusBadRequest, Description: err.Error()}
+	}
+	if errors.Is(err, service.ErrEntryExists) || errors.Is(err, service.ErrJobActive) || errors.Is(err, service.ErrJobFinished) {
+		return ApiError{Status: http.StatusConflict, Description: err.Error()}
+	}
+	var quotaError service.QuotaError
+	if errors.As(err, &quotaError) {
+		// A file that is larger than the whole quota will never fit, while others fit once space is freed.
+		status := http.StatusInsufficientStorage
+		if quotaError.Requested > quotaError.Quota {
+			status = http.StatusRequestEntityTooLarge
+		}
+		return ApiError{Status: status, Description: quotaError.Error(), Details: quotaError}
+	}
+	var maxBytesError *http.MaxBytesError
+	if errors.As(err, &maxBytesError) {
+		return ApiError{Status: http.StatusRequestEntityTooLarge, Description: "the upload does not fit in the quota"}
+	}
+	if errors.Is(err, service.ErrNoCover) || errors.Is(err, service.ErrUnknownTask) || errors.Is(err, service.ErrNoParentFolder) {
+		return ApiError{Status: http.StatusNotFound, Description: err.Error()}
+	}
+	if errors.Is(err, service.ErrNoThumbnail) {
+		return ApiError{Status: http.StatusUnsupportedMediaType, Description: err.Error()}
+	}
+	if errors.Is(err, service.ErrOutsideLibrary) || errors.Is(err, service.ErrSymlinkRejected) {
+		return ApiError{Status: http.StatusForbidden, Description: err.Error()}
 	}
-	log.Error("Uncaught error in %s %s: %s", c.Request.Method, c.Request.URL.Path, err.Error())
-	simpleError(c, http.StatusInternalServerError)
+	return ApiError{Status: http.StatusInternalServerError}
 }
@@ -0,0 +1,66 @@
+package controller
+
+import (
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"strings"
+	"time"
+)
+
+// secretQueryParams are the query parameters that carry secrets, by the path prefix of the routes that read them.
+// Their values are left out of the request log.
+var secretQueryParams = map[string][]string{
+	"/rest/":      {"p", "t", "s"},
+	"/api/events": {"access_token"},
+}
+
+// RequestLogger logs requests in the format of the default logger of gin, without the secrets in their query strings.
+func RequestLogger() gin.HandlerFunc {
+	return gin.LoggerWithFormatter(func(param gin.LogFormatterParams) string {
+		var statusColor, methodColor, resetColor string
+		if param.IsOutputColor() {
+			statusColor = param.StatusCodeColor()
+			methodColor = param.MethodColor()
+			resetColor = param.ResetColor()
+		}
+		if param.Latency > time.Minute {
+			param.Latency = param.Latency.Truncate(time.Second)
+		}
+		return fmt.Sprintf("[GIN] %v |%s %3d %s| %13v | %15s |%s %-7s %s %#v\n%s",
+			param.TimeStamp.Format("2006/01/02 - 15:04:05"),
+			statusColor, param.StatusCode, resetColor,
+			param.Latency,
+			param.ClientIP,
+			methodColor, param.Method, resetColor,
+			redactQuery(param.Path),
+			param.ErrorMessage,
+		)
+	})
+}
+
+// redactQuery replaces the values of secret query parameters in a path with a placeholder.
+func redactQuery(path string) string {
+	route, query, found := strings.Cut(path, "?")
+	if !found {
+		return path
+	}
+	var secrets []string
+	for prefix, params := range secretQueryParams {
+		if strings.HasPrefix(route, prefix) {
+			secrets = append(secrets, params...)
+		}
+	}
+	if len(secrets) == 0 {
+		return path
+	}
+	pairs := strings.Split(query, "&")
+	for i, pair := range pairs {
+		name, _, _ := strings.Cut(pair, "=")
+		for _, secret := range secrets {
+			if name == secret {
+				pairs[i] = name + "=REDACTED"
+			}
+		}
+	}
+	return route + "?" + strings.Join(pairs, "&")
+}
@@ -67,7 +67,7 @@ func createTestContext() App {
 		5432,
 	)
 	testDiag := postgres.Open(testPSQL)
-	app, err := NewApp(testDiag)
+	app, err := NewApp(testDiag, Config{MetricsToken: testMetricsToken})
 	if err != nil {
 		panic(err)
 	}
@@ -93,6 +93,8 @@ func createTestContext() App {
 	return app
 }
 
+const testMetricsToken = "metrics-secret"
+
 var testApp App
 var adminToken string
 var lonelyToken string
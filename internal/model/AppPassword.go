@@ -0,0 +1,19 @@
+package model
+
+import "time"
+
+// AppPassword lets a user sign in to apps that only support basic authentication, without giving them their real
+// password. Every app gets its own password, so it can be revoked on its own.
+type AppPassword struct {
+	ID             int    `json:"id"`
+	UserID         int    `json:"-" gorm:"not null;index;constraint:OnDelete:CASCADE"`
+	User           User   `json:"-" gorm:"not null;constraint:OnDelete:CASCADE"`
+	Name           string `json:"name" gorm:"not null"`
+	HashedPassword string `json:"-" gorm:"not null"`
+	// Subsonic passwords can be used with the token authentication of the Subsonic API. That needs the password
+	// itself, so it is kept in SubsonicSecret.
+	Subsonic       bool       `json:"subsonic" gorm:"not null;default:false"`
+	SubsonicSecret string     `json:"-" gorm:"not null;default:''"`
+	CreatedAt      time.Time  `json:"createdAt" gorm:"not null"`
+	LastUsedAt     *time.Time `json:"lastUsedAt"`
+}
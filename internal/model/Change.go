@@ -0,0 +1,35 @@
+package model
+
+import "time"
+
+type ChangeType string
+
+const (
+	ChangeCreated ChangeType = "created"
+	ChangeUpdated ChangeType = "updated"
+	ChangeMoved   ChangeType = "moved"
+	ChangeDeleted ChangeType = "deleted"
+)
+
+// Change is an entry in the change journal of a library. Every library numbers its changes without gaps, so a client
+// that missed changes can tell from the sequence numbers.
+type Change struct {
+	ID        int64      `json:"-"`
+	LibraryID int        `json:"libraryId" gorm:"not null;uniqueIndex:idx_changes_sequence;constraint:OnDelete:CASCADE"`
+	Library   Library    `json:"-" gorm:"not null;constraint:OnDelete:CASCADE"`
+	Sequence  int64      `json:"sequence" gorm:"not null;uniqueIndex:idx_changes_sequence"`
+	Type      ChangeType `json:"type" gorm:"not null" enums:"created,updated,moved,deleted"`
+	Path      string     `json:"path" gorm:"not null"`
+	OldPath   string     `json:"oldPath,omitempty"`
+	Category  Category   `json:"category,omitempty"`
+	Size      int64      `json:"size,omitempty"`
+	Modified  *time.Time `json:"modified,omitempty"`
+	CreatedAt time.Time  `json:"createdAt" gorm:"not null;index"`
+}
+
+// ChangeJournal holds the last sequence number that was used for a library.
+type ChangeJournal struct {
+	LibraryID int     `gorm:"primaryKey"`
+	Library   Library `gorm:"constraint:OnDelete:CASCADE"`
+	Sequence  int64   `gorm:"not null"`
+}
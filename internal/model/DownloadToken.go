@@ -1,7 +1,31 @@
 package model
 
+import (
+	"encoding/json"
+	"time"
+)
+
 type DownloadToken struct {
-	Token   string
-	Library Library
-	Path    string
+	Token     string    `gorm:"primaryKey;type:uuid"`
+	LibraryID int       `gorm:"not null;constraint:OnDelete:CASCADE"`
+	Library   Library   `gorm:"not null;constraint:OnDelete:CASCADE"`
+	Path      string    `gorm:"not null"`
+	MultiUse  bool      `gorm:"not null"`
+	ExpiresAt time.Time `gorm:"not null;index"`
+	// ArchiveFormat is set when the token downloads an archive of the entries in ArchivePaths.
+	ArchiveFormat string `gorm:"not null;default:''"`
+	ArchivePaths  string `gorm:"not null;default:''"`
+	// VersionID is set when the token downloads an old version of the file at Path.
+	VersionID int `gorm:"not null;default:0"`
+}
+
+func (t *DownloadToken) SetArchivePaths(paths []string) {
+	encoded, _ := json.Marshal(paths)
+	t.ArchivePaths = string(encoded)
+}
+
+func (t DownloadToken) GetArchivePaths() []string {
+	var paths []string
+	_ = json.Unmarshal([]byte(t.ArchivePaths), &paths)
+	return paths
 }
@@ -0,0 +1,13 @@
+package model
+
+import "time"
+
+type FileVersion struct {
+	ID        int       `json:"id"`
+	LibraryID int       `json:"libraryId" gorm:"not null;index:idx_file_versions_entry;constraint:OnDelete:CASCADE"`
+	Library   Library   `json:"-" gorm:"not null;constraint:OnDelete:CASCADE"`
+	Path      string    `json:"path" gorm:"not null;index:idx_file_versions_entry"`
+	Size      int64     `json:"size" gorm:"not null"`
+	Modified  time.Time `json:"modified" gorm:"not null"`
+	CreatedAt time.Time `json:"createdAt" gorm:"not null;index"`
+}
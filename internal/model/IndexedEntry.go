@@ -0,0 +1,27 @@
+package model
+
+import "time"
+
+type IndexedEntry struct {
+	ID        int       `json:"-"`
+	LibraryID int       `json:"libraryId" gorm:"not null;uniqueIndex:idx_indexed_entries_path;constraint:OnDelete:CASCADE"`
+	Library   Library   `json:"-" gorm:"not null;constraint:OnDelete:CASCADE"`
+	Path      string    `json:"path" gorm:"not null;uniqueIndex:idx_indexed_entries_path"`
+	Parent    string    `json:"parent" gorm:"not null"`
+	Name      string    `json:"name" gorm:"not null;index"`
+	Category  Category  `json:"category" gorm:"not null;index"`
+	MimeType  string    `json:"mimeType,omitempty" gorm:"not null;default:''"`
+	Size      int64     `json:"size" gorm:"not null"`
+	Modified  time.Time `json:"modified" gorm:"not null"`
+	// OwnerID is the user who wrote the file, who is charged for it. It is kept when the entry is scanned again.
+	OwnerID *int  `json:"-" gorm:"index;constraint:OnDelete:SET NULL"`
+	Owner   *User `json:"-" gorm:"constraint:OnDelete:SET NULL"`
+	// Metadata is read from the tags or the name of the file, depending on the type of the library.
+	Metadata *Metadata `json:"metadata,omitempty" gorm:"type:jsonb"`
+	// MetadataVersion tells which version of the metadata scanners was used, so entries are scanned again when they
+	// improve.
+	MetadataVersion int `json:"-" gorm:"not null;default:0"`
+	// Content is the text extracted from documents, if content indexing is enabled.
+	Content      string `json:"-" gorm:"not null;default:''"`
+	SearchVector string `json:"-" gorm:"->;type:tsvector GENERATED ALWAYS AS (to_tsvector('simple', name || ' ' || content)) STORED;index:,type:gin"`
+}
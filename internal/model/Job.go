@@ -0,0 +1,86 @@
+package model
+
+import (
+	"database/sql/driver"
+	"errors"
+	"time"
+)
+
+type JobStatus string
+
+const (
+	JobQueued    JobStatus = "queued"
+	JobRunning   JobStatus = "running"
+	JobSucceeded JobStatus = "succeeded"
+	JobFailed    JobStatus = "failed"
+	JobCancelled JobStatus = "cancelled"
+)
+
+// Job is work that runs in the background, like generating thumbnails or carrying out a large batch of file
+// operations. Jobs are kept in the database, so they survive a restart and can be picked up by any instance.
+type Job struct {
+	ID        int       `json:"id"`
+	Type      string    `json:"type" gorm:"not null;index"`
+	OwnerID   *int      `json:"ownerId,omitempty" gorm:"index;constraint:OnDelete:CASCADE"`
+	Owner     *User     `json:"-" gorm:"constraint:OnDelete:CASCADE"`
+	LibraryID *int      `json:"libraryId,omitempty" gorm:"index;constraint:OnDelete:CASCADE"`
+	Library   *Library  `json:"-" gorm:"constraint:OnDelete:CASCADE"`
+	Status    JobStatus `json:"status" gorm:"not null;index" enums:"queued,running,succeeded,failed,cancelled"`
+	// Done and Total describe the progress of a running job. What they count depends on the type of the job, and
+	// Total is 0 if it is not known in advance.
+	Done   int64   `json:"done" gorm:"not null;default:0"`
+	Total  int64   `json:"total" gorm:"not null;default:0"`
+	Params JobData `json:"-" gorm:"type:jsonb"`
+	Result JobData `json:"result,omitempty" gorm:"type:jsonb" swaggertype:"object"`
+	Error  string  `json:"error,omitempty" gorm:"not null;default:''"`
+	// CancelRequested tells the instance that runs the job to stop it.
+	CancelRequested bool       `json:"cancelRequested" gorm:"not null;default:false"`
+	CreatedAt       time.Time  `json:"createdAt" gorm:"not null"`
+	UpdatedAt       time.Time  `json:"updatedAt" gorm:"not null"`
+	StartedAt       *time.Time `json:"startedAt,omitempty"`
+	FinishedAt      *time.Time `json:"finishedAt,omitempty"`
+}
+
+// Finished checks if the job will not change anymore.
+func (j Job) Finished() bool {
+	return j.Status == JobSucceeded || j.Status == JobFailed || j.Status == JobCancelled
+}
+
+// JobData is a JSON document that is stored and sent to clients as it is.
+type JobData []byte
+
+// Value stores the document as JSON.
+func (d JobData) Value() (driver.Value, error) {
+	if len(d) == 0 {
+		return nil, nil
+	}
+	return string(d), nil
+}
+
+// Scan reads a document that was stored as JSON.
+func (d *JobData) Scan(value interface{}) error {
+	switch data := value.(type) {
+	case nil:
+		*d = nil
+		return nil
+	case []byte:
+		*d = append(JobData(nil), data...)
+		return nil
+	case string:
+		*d = JobData(data)
+		return nil
+	}
+	return errors.New("invalid job data")
+}
+
+func (d JobData) MarshalJSON() ([]byte, error) {
+	if len(d) == 0 {
+		return []byte("null"), nil
+	}
+	return d, nil
+}
+
+func (d *JobData) UnmarshalJSON(data []byte) error {
+	*d = append(JobData(nil), data...)
+	return nil
+}
@@ -10,11 +10,26 @@ const (
 	TypeMusic   LibraryType = "music"
 )
 
+type SymlinkPolicy string
+
+const (
+	// SymlinkFollow follows symbolic links, as long as they point to something inside the library.
+	SymlinkFollow SymlinkPolicy = "follow"
+	// SymlinkHide leaves symbolic links out of listings and treats them as if they do not exist.
+	SymlinkHide SymlinkPolicy = "hide"
+	// SymlinkReject lists symbolic links, but refuses to follow them.
+	SymlinkReject SymlinkPolicy = "reject"
+)
+
 type Library struct {
-	ID         int         `json:"id"`
-	Type       LibraryType `json:"type" gorm:"not null" enums:"generic,books,movies,shows,music"`
-	Name       string      `json:"name" gorm:"not null"`
-	RootFolder string      `json:"rootFolder" gorm:"not null"`
+	ID            int           `json:"id"`
+	Type          LibraryType   `json:"type" gorm:"not null" enums:"generic,books,movies,shows,music"`
+	Name          string        `json:"name" gorm:"not null"`
+	RootFolder    string        `json:"rootFolder" gorm:"not null"`
+	SymlinkPolicy SymlinkPolicy `json:"symlinkPolicy" gorm:"not null;default:'follow'" enums:"follow,hide,reject"`
+	// Quota is the number of bytes that the files, the trash and the previous versions in the library may take up. 0
+	// means there is no limit.
+	Quota int64 `json:"quota" gorm:"not null;default:0"`
 }
 
 type CanAccessLibrary struct {
@@ -0,0 +1,59 @@
+package model
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+// Metadata describes the content of a file, as read from its tags or its name. Which fields are set depends on the
+// type of the file and the type of its library.
+type Metadata struct {
+	Title       string     `json:"title,omitempty"`
+	Artist      string     `json:"artist,omitempty"`
+	Album       string     `json:"album,omitempty"`
+	AlbumArtist string     `json:"albumArtist,omitempty"`
+	Genre       string     `json:"genre,omitempty"`
+	Track       int        `json:"track,omitempty"`
+	Disc        int        `json:"disc,omitempty"`
+	Year        int        `json:"year,omitempty"`
+	Authors     []string   `json:"authors,omitempty"`
+	Publisher   string     `json:"publisher,omitempty"`
+	Language    string     `json:"language,omitempty"`
+	Description string     `json:"description,omitempty"`
+	Identifier  string     `json:"identifier,omitempty"`
+	Series      string     `json:"series,omitempty"`
+	SeriesIndex float64    `json:"seriesIndex,omitempty"`
+	Show        string     `json:"show,omitempty"`
+	Season      int        `json:"season,omitempty"`
+	Episode     int        `json:"episode,omitempty"`
+	CameraMake  string     `json:"cameraMake,omitempty"`
+	CameraModel string     `json:"cameraModel,omitempty"`
+	TakenAt     *time.Time `json:"takenAt,omitempty"`
+	Latitude    *float64   `json:"latitude,omitempty"`
+	Longitude   *float64   `json:"longitude,omitempty"`
+	Width       int        `json:"width,omitempty"`
+	Height      int        `json:"height,omitempty"`
+	// HasCover is true if the file contains a cover image, like the front cover of a book or the artwork of an album.
+	HasCover bool `json:"hasCover,omitempty"`
+}
+
+// Value stores metadata as JSON.
+func (m Metadata) Value() (driver.Value, error) {
+	return json.Marshal(m)
+}
+
+// Scan reads metadata that was stored as JSON.
+func (m *Metadata) Scan(value interface{}) error {
+	switch data := value.(type) {
+	case nil:
+		*m = Metadata{}
+		return nil
+	case []byte:
+		return json.Unmarshal(data, m)
+	case string:
+		return json.Unmarshal([]byte(data), m)
+	}
+	return errors.New("invalid metadata")
+}
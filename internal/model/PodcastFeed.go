@@ -0,0 +1,19 @@
+package model
+
+import "time"
+
+// PodcastFeed publishes the audio and video files in a folder as a podcast. The feed can be read by anyone who knows
+// its token, so podcast apps can subscribe to it without signing in.
+type PodcastFeed struct {
+	ID          int     `json:"id"`
+	Token       string  `json:"token" gorm:"not null;unique"`
+	LibraryID   int     `json:"libraryId" gorm:"not null;uniqueIndex:idx_podcast_feeds_path;constraint:OnDelete:CASCADE"`
+	Library     Library `json:"-" gorm:"not null;constraint:OnDelete:CASCADE"`
+	Path        string  `json:"path" gorm:"not null;uniqueIndex:idx_podcast_feeds_path"`
+	Title       string  `json:"title" gorm:"not null;default:''"`
+	Description string  `json:"description" gorm:"not null;default:''"`
+	Author      string  `json:"author" gorm:"not null;default:''"`
+	// Artwork is the path of an image in the library that is shown as the cover of the podcast.
+	Artwork   string    `json:"artwork" gorm:"not null;default:''"`
+	CreatedAt time.Time `json:"createdAt"`
+}
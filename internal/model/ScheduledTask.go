@@ -0,0 +1,18 @@
+package model
+
+import "time"
+
+// ScheduledTask keeps the schedule and the last run of a recurring maintenance task. The tasks themselves are defined
+// in code, so a row only holds what an admin changed and what happened when the task ran, on any instance.
+type ScheduledTask struct {
+	Name string `gorm:"primaryKey"`
+	// Schedule overrides the default schedule of the task if it is not empty.
+	Schedule string `gorm:"not null;default:''"`
+	// Enabled overrides whether the task runs by default.
+	Enabled      *bool
+	NextRunAt    *time.Time
+	LastRunAt    *time.Time
+	LastDuration time.Duration `gorm:"not null;default:0"`
+	LastError    string        `gorm:"not null;default:''"`
+	UpdatedAt    time.Time     `gorm:"not null"`
+}
@@ -0,0 +1,31 @@
+package model
+
+import "time"
+
+type ShareLink struct {
+	ID             int        `json:"id"`
+	Slug           string     `json:"slug" gorm:"not null;unique"`
+	LibraryID      int        `json:"libraryId" gorm:"not null;constraint:OnDelete:CASCADE"`
+	Library        Library    `json:"-" gorm:"not null;constraint:OnDelete:CASCADE"`
+	Path           string     `json:"path" gorm:"not null"`
+	OwnerID        int        `json:"ownerId" gorm:"not null;constraint:OnDelete:CASCADE"`
+	Owner          User       `json:"-" gorm:"not null;constraint:OnDelete:CASCADE"`
+	HashedPassword string     `json:"-" gorm:"not null;default:''"`
+	HasPassword    bool       `json:"hasPassword" gorm:"->;type:boolean GENERATED ALWAYS AS (hashed_password <> '') STORED"`
+	ExpiresAt      *time.Time `json:"expiresAt"`
+	MaxDownloads   int        `json:"maxDownloads" gorm:"not null;default:0"`
+	Downloads      int        `json:"downloads" gorm:"not null;default:0"`
+	FileDrop       bool       `json:"fileDrop" gorm:"not null"`
+	CreatedAt      time.Time  `json:"createdAt"`
+}
+
+type ShareLinkAccess struct {
+	ID          int       `json:"id"`
+	ShareLinkID int       `json:"-" gorm:"not null;index;constraint:OnDelete:CASCADE"`
+	ShareLink   ShareLink `json:"-" gorm:"not null;constraint:OnDelete:CASCADE"`
+	Action      string    `json:"action" gorm:"not null"`
+	Path        string    `json:"path" gorm:"not null;default:''"`
+	RemoteAddr  string    `json:"remoteAddr" gorm:"not null;default:''"`
+	UserAgent   string    `json:"userAgent" gorm:"not null;default:''"`
+	Time        time.Time `json:"time" gorm:"not null"`
+}
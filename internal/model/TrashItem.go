@@ -0,0 +1,15 @@
+package model
+
+import "time"
+
+type TrashItem struct {
+	ID          int       `json:"id"`
+	LibraryID   int       `json:"libraryId" gorm:"not null;index;constraint:OnDelete:CASCADE"`
+	Library     Library   `json:"-" gorm:"not null;constraint:OnDelete:CASCADE"`
+	Path        string    `json:"path" gorm:"not null"`
+	Category    Category  `json:"category" gorm:"not null"`
+	Size        int64     `json:"size" gorm:"not null;default:0"`
+	DeletedByID *int      `json:"deletedById" gorm:"constraint:OnDelete:SET NULL"`
+	DeletedBy   *User     `json:"-" gorm:"constraint:OnDelete:SET NULL"`
+	DeletedAt   time.Time `json:"deletedAt" gorm:"not null;index"`
+}
@@ -0,0 +1,15 @@
+package model
+
+import "time"
+
+type Upload struct {
+	ID        string    `gorm:"primaryKey;type:uuid"`
+	LibraryID int       `gorm:"not null;constraint:OnDelete:CASCADE"`
+	Library   Library   `gorm:"not null;constraint:OnDelete:CASCADE"`
+	UserID    int       `gorm:"not null;constraint:OnDelete:CASCADE"`
+	User      User      `gorm:"not null;constraint:OnDelete:CASCADE"`
+	Path      string    `gorm:"not null"`
+	Length    int64     `gorm:"not null"`
+	Metadata  string    `gorm:"not null;default:''"`
+	ExpiresAt time.Time `gorm:"not null"`
+}
@@ -6,6 +6,8 @@ type User struct {
 	Name           string `json:"name" gorm:"not null;default:''"`
 	HashedPassword string `json:"-" gorm:"not null"`
 	IsAdmin        bool   `json:"isAdmin" gorm:"->;type:boolean GENERATED ALWAYS AS (id = 1) STORED"`
+	// Quota is the number of bytes that the files of the user may take up in all libraries. 0 means there is no limit.
+	Quota int64 `json:"quota" gorm:"not null;default:0"`
 }
 
 func (u User) GetUsername() string {
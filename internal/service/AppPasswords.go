@@ -0,0 +1,174 @@
+package service
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"gorm.io/gorm"
+	"keydrive/internal/model"
+	"strings"
+	"sync"
+	"time"
+)
+
+// basicAuthCacheTime is how long a successful basic authentication is remembered. Apps send the password with every
+// request, and checking a bcrypt hash every time would make them slow.
+const basicAuthCacheTime = 5 * time.Minute
+
+// minSubsonicSaltLength is the shortest salt that is accepted for token authentication, as the Subsonic API demands.
+const minSubsonicSaltLength = 6
+
+type cachedLogin struct {
+	userID int
+	// hashedPassword is the stored password of the user when the login was cached, so changing it ends the login.
+	hashedPassword string
+	expires        time.Time
+}
+
+// AppPasswords authenticates users with their password or an app password, for apps that only support basic
+// authentication.
+type AppPasswords struct {
+	DB              *gorm.DB
+	Users           *User
+	PasswordEncoder *BcryptEncoder
+
+	lock  sync.Mutex
+	cache map[[sha256.Size]byte]cachedLogin
+}
+
+func (a *AppPasswords) GetAppPasswordsForUser(user model.User, tx *gorm.DB) *gorm.DB {
+	return tx.Model(&model.AppPassword{}).Where("user_id = ?", user.ID)
+}
+
+// CreateAppPassword generates a new app password for a user. The password is returned only once, only its hash is
+// stored, unless it is a password for Subsonic apps.
+func (a *AppPasswords) CreateAppPassword(tx *gorm.DB, user model.User, name string, subsonic bool) (model.AppPassword, string, error) {
+	first, err := randomSlug()
+	if err != nil {
+		return model.AppPassword{}, "", err
+	}
+	second, err := randomSlug()
+	if err != nil {
+		return model.AppPassword{}, "", err
+	}
+	password := first + "-" + second
+	appPassword := model.AppPassword{
+		UserID:         user.ID,
+		Name:           name,
+		HashedPassword: a.PasswordEncoder.Encode(password),
+		Subsonic:       subsonic,
+		CreatedAt:      time.Now(),
+	}
+	if subsonic {
+		appPassword.SubsonicSecret = password
+	}
+	if result := tx.Omit("User").Create(&appPassword); result.Error != nil {
+		return model.AppPassword{}, "", result.Error
+	}
+	return appPassword, password, nil
+}
+
+// DeleteAppPassword revokes an app password. Logins that are cached are forgotten, so the password stops working
+// right away.
+func (a *AppPasswords) DeleteAppPassword(tx *gorm.DB, user model.User, id int) error {
+	result := a.GetAppPasswordsForUser(user, tx).Where("id = ?", id).Delete(&model.AppPassword{})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	a.lock.Lock()
+	a.cache = nil
+	a.lock.Unlock()
+	return nil
+}
+
+// Authenticate checks a username with either the password of the user or one of their app passwords.
+func (a *AppPasswords) Authenticate(username string, password string) (model.User, bool) {
+	return a.authenticate(username, password, true)
+}
+
+// AuthenticateAppPassword checks a username with one of the app passwords of the user. It is used by apis that send
+// the password in the url, where it could end up in logs, so the password of the user itself is not accepted.
+func (a *AppPasswords) AuthenticateAppPassword(username string, password string) (model.User, bool) {
+	return a.authenticate(username, password, false)
+}
+
+func (a *AppPasswords) authenticate(username string, password string, allowUserPassword bool) (model.User, bool) {
+	// The cache is split by whether the user password is allowed, so a cached login with it is not accepted by apis
+	// that only take app passwords.
+	key := sha256.Sum256([]byte(fmt.Sprintf("%t\x00%s\x00%s", allowUserPassword, username, password)))
+	a.lock.Lock()
+	cached, ok := a.cache[key]
+	a.lock.Unlock()
+	if ok && time.Now().Before(cached.expires) {
+		var user model.User
+		result := a.Users.GetUsers(a.DB).Take(&user, cached.userID)
+		if result.Error == nil && user.GetHashedPassword() == cached.hashedPassword {
+			return user, true
+		}
+	}
+
+	user, found := a.Users.GetUser(username)
+	if !found {
+		return model.User{}, false
+	}
+	authenticated := allowUserPassword && a.PasswordEncoder.Compare(password, user.GetHashedPassword())
+	if !authenticated {
+		var appPasswords []model.AppPassword
+		if result := a.GetAppPasswordsForUser(user, a.DB).Find(&appPasswords); result.Error != nil {
+			return model.User{}, false
+		}
+		for _, appPassword := range appPasswords {
+			if a.PasswordEncoder.Compare(password, appPassword.HashedPassword) {
+				a.DB.Model(&model.AppPassword{ID: appPassword.ID}).Update("last_used_at", time.Now())
+				authenticated = true
+				break
+			}
+		}
+	}
+	if !authenticated {
+		return model.User{}, false
+	}
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if a.cache == nil {
+		a.cache = make(map[[sha256.Size]byte]cachedLogin)
+	}
+	now := time.Now()
+	for cachedKey, login := range a.cache {
+		if now.After(login.expires) {
+			delete(a.cache, cachedKey)
+		}
+	}
+	a.cache[key] = cachedLogin{userID: user.ID, hashedPassword: user.GetHashedPassword(), expires: now.Add(basicAuthCacheTime)}
+	return user, true
+}
+
+// AuthenticateToken checks the token authentication of the Subsonic API, where the token is the md5 hash of the
+// password followed by the salt. Only Subsonic app passwords can be used.
+func (a *AppPasswords) AuthenticateToken(username string, token string, salt string) (model.User, bool) {
+	if len(salt) < minSubsonicSaltLength {
+		return model.User{}, false
+	}
+	user, found := a.Users.GetUser(username)
+	if !found {
+		return model.User{}, false
+	}
+	var appPasswords []model.AppPassword
+	if result := a.GetAppPasswordsForUser(user, a.DB).Where("subsonic").Find(&appPasswords); result.Error != nil {
+		return model.User{}, false
+	}
+	for _, appPassword := range appPasswords {
+		hash := md5.Sum([]byte(appPassword.SubsonicSecret + salt))
+		if subtle.ConstantTimeCompare([]byte(hex.EncodeToString(hash[:])), []byte(strings.ToLower(token))) == 1 {
+			a.DB.Model(&model.AppPassword{ID: appPassword.ID}).Update("last_used_at", time.Now())
+			return user, true
+		}
+	}
+	return model.User{}, false
+}
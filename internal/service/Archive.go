@@ -0,0 +1,177 @@
+package service
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"errors"
+	"io"
+	"keydrive/internal/model"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	ArchiveZip   = "zip"
+	ArchiveTarGz = "tar.gz"
+)
+
+var ErrUnknownArchiveFormat = errors.New("unknown archive format")
+
+// archiveWriter adds files and folders to an archive, using slash separated names.
+type archiveWriter interface {
+	addFolder(name string, info os.FileInfo) error
+	addFile(name string, info os.FileInfo, data io.Reader) error
+	Close() error
+}
+
+// WriteArchive streams the given entries of a library to w as an archive. Folders are added recursively. Nothing is
+// buffered on disk, so the archive can be sent to the client while it is created.
+func (fs *FileSystem) WriteArchive(w io.Writer, library model.Library, paths []string, format string) error {
+	var archive archiveWriter
+	switch format {
+	case ArchiveZip:
+		archive = &zipArchive{writer: zip.NewWriter(w)}
+	case ArchiveTarGz:
+		compressed := gzip.NewWriter(w)
+		archive = &tarArchive{compressed: compressed, writer: tar.NewWriter(compressed)}
+	default:
+		return ErrUnknownArchiveFormat
+	}
+
+	for _, entryPath := range paths {
+		entryPath = fs.cleanRelativePath(entryPath)
+		if fs.isSystemPath(entryPath) {
+			return os.ErrNotExist
+		}
+		root, err := fs.resolve(library, entryPath, true)
+		if err != nil {
+			return err
+		}
+		prefix := path.Base(entryPath)
+		if entryPath == "/" {
+			prefix = ""
+		}
+		if err := fs.addToArchive(archive, root, prefix, entryPath == "/"); err != nil {
+			return err
+		}
+	}
+	return archive.Close()
+}
+
+func (fs *FileSystem) addToArchive(archive archiveWriter, root string, prefix string, isLibraryRoot bool) error {
+	return filepath.Walk(root, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		relative, err := filepath.Rel(root, file)
+		if err != nil {
+			return err
+		}
+		name := path.Join(prefix, filepath.ToSlash(relative))
+		if isLibraryRoot && (name == SystemFolder || strings.HasPrefix(name, SystemFolder+"/")) {
+			return filepath.SkipDir
+		}
+
+		if info.IsDir() {
+			if name == "." || name == "" {
+				return nil
+			}
+			return archive.addFolder(name+"/", info)
+		}
+		if !info.Mode().IsRegular() {
+			// Links and devices are left out.
+			return nil
+		}
+
+		data, err := os.Open(file)
+		if err != nil {
+			return err
+		}
+		defer data.Close()
+		return archive.addFile(name, info, data)
+	})
+}
+
+type zipArchive struct {
+	writer *zip.Writer
+}
+
+func (a *zipArchive) addFolder(name string, info os.FileInfo) error {
+	header, err := zip.FileInfoHeader(info)
+	if err != nil {
+		return err
+	}
+	header.Name = name
+	_, err = a.writer.CreateHeader(header)
+	return err
+}
+
+func (a *zipArchive) addFile(name string, info os.FileInfo, data io.Reader) error {
+	header, err := zip.FileInfoHeader(info)
+	if err != nil {
+		return err
+	}
+	header.Name = name
+	header.Method = zip.Deflate
+	switch category, _ := GetFileCategory(name, "", false); category {
+	case model.CategoryArchive, model.CategoryAudio, model.CategoryImage, model.CategoryVideo:
+		// These are compressed already, so deflating them again would only cost time.
+		header.Method = zip.Store
+	}
+	writer, err := a.writer.CreateHeader(header)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(writer, data)
+	return err
+}
+
+func (a *zipArchive) Close() error {
+	return a.writer.Close()
+}
+
+type tarArchive struct {
+	compressed *gzip.Writer
+	writer     *tar.Writer
+}
+
+func (a *tarArchive) header(name string, info os.FileInfo) (*tar.Header, error) {
+	header, err := tar.FileInfoHeader(info, "")
+	if err != nil {
+		return nil, err
+	}
+	header.Name = name
+	// PAX headers store names as utf-8, so they can contain any character.
+	header.Format = tar.FormatPAX
+	return header, nil
+}
+
+func (a *tarArchive) addFolder(name string, info os.FileInfo) error {
+	header, err := a.header(name, info)
+	if err != nil {
+		return err
+	}
+	return a.writer.WriteHeader(header)
+}
+
+func (a *tarArchive) addFile(name string, info os.FileInfo, data io.Reader) error {
+	header, err := a.header(name, info)
+	if err != nil {
+		return err
+	}
+	if err := a.writer.WriteHeader(header); err != nil {
+		return err
+	}
+	_, err = io.CopyN(a.writer, data, header.Size)
+	return err
+}
+
+func (a *tarArchive) Close() error {
+	if err := a.writer.Close(); err != nil {
+		return err
+	}
+	return a.compressed.Close()
+}
@@ -0,0 +1,97 @@
+package service
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"keydrive/internal/model"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+func createArchiveLibrary(t *testing.T) model.Library {
+	tmpDir := t.TempDir()
+	_ = os.Mkdir(filepath.Join(tmpDir, "Fotos"), 0777)
+	_ = os.WriteFile(filepath.Join(tmpDir, "Fotos", "zoë.jpg"), []byte("not really a jpeg"), 0777)
+	_ = os.WriteFile(filepath.Join(tmpDir, "notes.txt"), []byte("Hello World!\n"), 0777)
+	_ = os.MkdirAll(filepath.Join(tmpDir, SystemFolder, "uploads"), 0777)
+	return model.Library{
+		RootFolder: tmpDir,
+	}
+}
+
+func TestFileSystem_WriteArchive(t *testing.T) {
+	lib := createArchiveLibrary(t)
+	fs := FileSystem{}
+
+	t.Run("it writes a zip archive", func(t *testing.T) {
+		var buffer bytes.Buffer
+		if err := fs.WriteArchive(&buffer, lib, []string{"/Fotos", "/notes.txt"}, ArchiveZip); err != nil {
+			t.Fatal(err.Error())
+		}
+
+		reader, err := zip.NewReader(bytes.NewReader(buffer.Bytes()), int64(buffer.Len()))
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		var names []string
+		for _, file := range reader.File {
+			names = append(names, file.Name)
+			if file.Name == "notes.txt" {
+				stream, _ := file.Open()
+				data, _ := io.ReadAll(stream)
+				if string(data) != "Hello World!\n" {
+					t.Errorf("Unexpected content of notes.txt: %s", data)
+				}
+			}
+		}
+		assertNames(t, names, "Fotos/", "Fotos/zoë.jpg", "notes.txt")
+	})
+
+	t.Run("it writes a tar.gz archive of the whole library", func(t *testing.T) {
+		var buffer bytes.Buffer
+		if err := fs.WriteArchive(&buffer, lib, []string{"/"}, ArchiveTarGz); err != nil {
+			t.Fatal(err.Error())
+		}
+
+		compressed, err := gzip.NewReader(&buffer)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		reader := tar.NewReader(compressed)
+		var names []string
+		for {
+			header, err := reader.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatal(err.Error())
+			}
+			names = append(names, header.Name)
+		}
+		assertNames(t, names, "Fotos/", "Fotos/zoë.jpg", "notes.txt")
+	})
+
+	t.Run("it rejects unknown formats", func(t *testing.T) {
+		if err := fs.WriteArchive(io.Discard, lib, []string{"/notes.txt"}, "rar"); err != ErrUnknownArchiveFormat {
+			t.Errorf("Expected ErrUnknownArchiveFormat but got: %v", err)
+		}
+	})
+}
+
+func assertNames(t *testing.T, names []string, expected ...string) {
+	sort.Strings(names)
+	if len(names) != len(expected) {
+		t.Fatalf("Expected %v but got %v", expected, names)
+	}
+	for i := range names {
+		if names[i] != expected[i] {
+			t.Errorf("Expected %v but got %v", expected, names)
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"keydrive/internal/model"
+	"os"
+	"path"
+)
+
+var ErrUnknownBatchOperation = errors.New("unknown batch operation")
+
+type BatchOperationType string
+
+const (
+	BatchDelete BatchOperationType = "delete"
+	BatchMove   BatchOperationType = "move"
+	BatchCopy   BatchOperationType = "copy"
+	BatchMkdir  BatchOperationType = "mkdir"
+)
+
+// BatchOperation is a single change to an entry of the library of a batch. Target and TargetLibrary are only used by
+// moves and copies.
+type BatchOperation struct {
+	Type          BatchOperationType
+	Path          string
+	Target        string
+	TargetLibrary model.Library
+	Conflict      ConflictPolicy
+}
+
+// BatchResult is the outcome of one operation of a batch. Path is where the entry ended up, if it still exists.
+type BatchResult struct {
+	Index   int
+	Path    string
+	Skipped bool
+	Err     error
+}
+
+// Batch is a list of operations on a library that are carried out one after another.
+type Batch struct {
+	Library     model.Library
+	Operations  []BatchOperation
+	StopOnError bool
+}
+
+// Batches carries out batches of file operations.
+type Batches struct {
+	FileSystem *FileSystem
+	Trash      *Trash
+	Quotas     *Quotas
+}
+
+// Run carries out the operations of a batch in order, beginning with the one at start, and reports the result of each
+// one. It returns false if it stopped at an error. When the context is cancelled, it stops before the next operation
+// and returns the error of the context.
+func (b *Batches) Run(ctx context.Context, batch Batch, user model.User, start int, report func(result BatchResult)) (bool, error) {
+	for i := start; i < len(batch.Operations); i++ {
+		if err := ctx.Err(); err != nil {
+			return false, err
+		}
+		result := b.runOperation(ctx, batch.Library, user, batch.Operations[i])
+		result.Index = i
+		report(result)
+		if result.Err != nil && batch.StopOnError {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+func (b *Batches) runOperation(ctx context.Context, library model.Library, user model.User, operation BatchOperation) BatchResult {
+	switch operation.Type {
+	case BatchDelete:
+		_, err := b.Trash.MoveToTrash(library, user, operation.Path)
+		if os.IsNotExist(err) {
+			// Deleting is idempotent, like a single DeleteEntry.
+			err = nil
+		}
+		return BatchResult{Err: err}
+	case BatchMove, BatchCopy:
+		transfer := b.FileSystem.MoveEntry
+		if operation.Type == BatchCopy {
+			transfer = b.FileSystem.CopyEntry
+		}
+		if b.Quotas != nil {
+			if err := b.Quotas.CheckTransfer(library, operation.Path, operation.TargetLibrary, user, operation.Type == BatchMove); err != nil {
+				return BatchResult{Err: err}
+			}
+		}
+		result, err := transfer(ctx, library, operation.Path, operation.TargetLibrary, operation.Target, operation.Conflict, nil)
+		if err == nil {
+			if _, err := b.Trash.KeepReplaced(operation.TargetLibrary, user, result); err != nil {
+				log.Warn("failed to move %s in library %d to the trash after it was replaced: %s", result.Path, operation.TargetLibrary.ID, err)
+			}
+		}
+		if err == nil && !result.Skipped && b.Quotas != nil && (operation.Type == BatchCopy || library.ID != operation.TargetLibrary.ID) {
+			err = b.Quotas.Claim(operation.TargetLibrary, result.Path, user.ID)
+		}
+		return BatchResult{Path: result.Path, Skipped: result.Skipped, Err: err}
+	case BatchMkdir:
+		cleaned := b.FileSystem.cleanRelativePath(operation.Path)
+		if cleaned == "/" {
+			return BatchResult{Err: ErrReservedPath}
+		}
+		info, err := b.FileSystem.CreateFolderInLibrary(library, path.Base(cleaned), path.Dir(cleaned))
+		if err != nil {
+			return BatchResult{Err: err}
+		}
+		return BatchResult{Path: path.Join(info.Parent, info.Name)}
+	}
+	return BatchResult{Err: ErrUnknownBatchOperation}
+}
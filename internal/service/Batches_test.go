@@ -0,0 +1,59 @@
+package service
+
+import (
+	"context"
+	"keydrive/internal/model"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestBatches(t *testing.T) {
+	lib := model.Library{ID: 1, RootFolder: t.TempDir()}
+	_ = os.WriteFile(filepath.Join(lib.RootFolder, "a.txt"), []byte("A\n"), 0777)
+	_ = os.WriteFile(filepath.Join(lib.RootFolder, "b.txt"), []byte("B\n"), 0777)
+	batches := &Batches{FileSystem: &FileSystem{}}
+	operations := []BatchOperation{
+		{Type: BatchMkdir, Path: "/folder"},
+		{Type: BatchMove, Path: "/a.txt", Target: "/folder/a.txt", TargetLibrary: lib, Conflict: ConflictFail},
+		{Type: BatchCopy, Path: "/missing.txt", Target: "/folder/missing.txt", TargetLibrary: lib, Conflict: ConflictFail},
+		{Type: BatchCopy, Path: "/b.txt", Target: "/folder/b.txt", TargetLibrary: lib, Conflict: ConflictFail},
+	}
+	run := func(batch Batch, start int) ([]BatchResult, bool, error) {
+		var results []BatchResult
+		completed, err := batches.Run(context.Background(), batch, model.User{}, start, func(result BatchResult) {
+			results = append(results, result)
+		})
+		return results, completed, err
+	}
+
+	t.Run("it continues after errors", func(t *testing.T) {
+		results, completed, err := run(Batch{Library: lib, Operations: operations}, 0)
+		if err != nil || !completed || len(results) != 4 {
+			t.Fatalf("Unexpected results: %+v, %v", results, err)
+		}
+		if results[0].Path != "/folder" || results[1].Path != "/folder/a.txt" || results[1].Err != nil {
+			t.Errorf("Unexpected results: %+v", results)
+		}
+		if !os.IsNotExist(results[2].Err) || results[3].Err != nil {
+			t.Errorf("Unexpected results: %+v", results)
+		}
+		if _, err := os.Stat(filepath.Join(lib.RootFolder, "folder", "b.txt")); err != nil {
+			t.Errorf("Expected the file to be copied: %s", err)
+		}
+	})
+
+	t.Run("it stops at the first error", func(t *testing.T) {
+		results, completed, err := run(Batch{Library: lib, Operations: operations, StopOnError: true}, 0)
+		if err != nil || completed || len(results) != 2 || !os.IsNotExist(results[1].Err) {
+			t.Errorf("Unexpected results: %+v", results)
+		}
+	})
+
+	t.Run("it starts at the given operation", func(t *testing.T) {
+		results, completed, err := run(Batch{Library: lib, Operations: operations}, 3)
+		if err != nil || !completed || len(results) != 1 || results[0].Index != 3 || results[0].Err != ErrEntryExists {
+			t.Errorf("Unexpected results: %+v", results)
+		}
+	})
+}
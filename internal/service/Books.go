@@ -0,0 +1,73 @@
+package service
+
+import (
+	"encoding/json"
+	"gorm.io/gorm"
+	"keydrive/internal/model"
+)
+
+// BookMimeTypes are the types of files that are served as books to e-readers.
+var BookMimeTypes = []string{
+	"application/epub+zip",
+	"application/pdf",
+	"application/vnd.amazon.ebook",
+	"application/vnd.amazon.mobi8-ebook",
+	"application/vnd.comicbook+zip",
+	"application/vnd.comicbook-rar",
+	"application/x-fictionbook+xml",
+	"application/x-mobipocket-ebook",
+}
+
+// BookGroup is an author or a series, with the number of books in it.
+type BookGroup struct {
+	Name  string
+	Books int
+}
+
+// GetBooks returns the indexed books in a library.
+func (i *Index) GetBooks(library model.Library, tx *gorm.DB) *gorm.DB {
+	return tx.Model(&model.IndexedEntry{}).Where("library_id = ? AND mime_type IN ?", library.ID, BookMimeTypes)
+}
+
+// GetBookAuthors returns the authors of the books in a library as BookGroup rows, ordered by name.
+func (i *Index) GetBookAuthors(library model.Library, tx *gorm.DB) *gorm.DB {
+	return i.GetBooks(library, tx).
+		Joins("CROSS JOIN jsonb_array_elements_text(indexed_entries.metadata->'authors') AS author").
+		Select("author AS name, COUNT(*) AS books").
+		Group("author").
+		Order("author")
+}
+
+// GetBooksByAuthor returns the books in a library that were written by an author, ordered by title.
+func (i *Index) GetBooksByAuthor(library model.Library, author string, tx *gorm.DB) *gorm.DB {
+	authors, _ := json.Marshal([]string{author})
+	return i.GetBooks(library, tx).
+		Where("metadata->'authors' @> CAST(? AS jsonb)", string(authors)).
+		Order("COALESCE(metadata->>'title', name), path")
+}
+
+// GetBookSeries returns the series of the books in a library as BookGroup rows, ordered by name.
+func (i *Index) GetBookSeries(library model.Library, tx *gorm.DB) *gorm.DB {
+	return i.GetBooks(library, tx).
+		Where("COALESCE(metadata->>'series', '') <> ''").
+		Select("metadata->>'series' AS name, COUNT(*) AS books").
+		Group("metadata->>'series'").
+		Order("metadata->>'series'")
+}
+
+// GetBooksInSeries returns the books in a series, in the order of the series.
+func (i *Index) GetBooksInSeries(library model.Library, series string, tx *gorm.DB) *gorm.DB {
+	return i.GetBooks(library, tx).
+		Where("metadata->>'series' = ?", series).
+		Order("COALESCE(CAST(metadata->>'seriesIndex' AS numeric), 0), path")
+}
+
+// SearchBooks finds books in a library by their title, author, series or file name.
+func (i *Index) SearchBooks(library model.Library, query string, tx *gorm.DB) *gorm.DB {
+	pattern := "%" + escapeLike(query) + "%"
+	return i.GetBooks(library, tx).
+		Where("name ILIKE ? OR metadata->>'title' ILIKE ? OR metadata->>'series' ILIKE ? OR "+
+			"EXISTS (SELECT 1 FROM jsonb_array_elements_text(metadata->'authors') AS author WHERE author ILIKE ?)",
+			pattern, pattern, pattern, pattern).
+		Order("COALESCE(metadata->>'title', name), path")
+}
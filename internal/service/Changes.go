@@ -0,0 +1,109 @@
+package service
+
+import (
+	"errors"
+	"gorm.io/gorm"
+	"keydrive/internal/model"
+	"time"
+)
+
+var ErrCursorExpired = errors.New("cursor too old, do a full resync")
+
+// Changes keeps a journal of the changes to the entries of every library, so sync clients can fetch everything that
+// changed since they last looked. Changes are removed from the journal once the retention period has passed.
+type Changes struct {
+	DB        *gorm.DB
+	Retention time.Duration
+}
+
+// Record adds an entry event to the journal of its library. Other events are ignored.
+func (c *Changes) Record(event Event) error {
+	change := model.Change{
+		LibraryID: event.LibraryID,
+		Path:      event.Path,
+		OldPath:   event.OldPath,
+		CreatedAt: event.Time,
+	}
+	switch event.Type {
+	case EventCreated:
+		change.Type = model.ChangeCreated
+	case EventUpdated:
+		change.Type = model.ChangeUpdated
+	case EventMoved:
+		change.Type = model.ChangeMoved
+	case EventDeleted:
+		change.Type = model.ChangeDeleted
+	default:
+		return nil
+	}
+	if change.CreatedAt.IsZero() {
+		change.CreatedAt = time.Now()
+	}
+	if event.Entry != nil {
+		modified := event.Entry.Modified
+		change.Category = event.Entry.Category
+		change.Size = event.Entry.Size
+		change.Modified = &modified
+	}
+
+	return c.DB.Transaction(func(tx *gorm.DB) error {
+		// The journal row is locked until the transaction ends, so sequence numbers are handed out in order.
+		result := tx.Raw(
+			"INSERT INTO change_journals (library_id, sequence) VALUES (?, 1) "+
+				"ON CONFLICT (library_id) DO UPDATE SET sequence = change_journals.sequence + 1 "+
+				"RETURNING sequence",
+			change.LibraryID,
+		).Scan(&change.Sequence)
+		if result.Error != nil {
+			return result.Error
+		}
+		return tx.Omit("Library").Create(&change).Error
+	})
+}
+
+// LatestCursor returns the sequence number of the last change in a library.
+func (c *Changes) LatestCursor(library model.Library, tx *gorm.DB) (int64, error) {
+	var journal model.ChangeJournal
+	result := tx.Model(&model.ChangeJournal{}).Where("library_id = ?", library.ID).Limit(1).Find(&journal)
+	return journal.Sequence, result.Error
+}
+
+// GetChangesSince returns at most limit changes in a library that came after the cursor, in the order they happened.
+// It returns ErrCursorExpired if some of those changes were already removed from the journal, or if the cursor was
+// never handed out.
+func (c *Changes) GetChangesSince(library model.Library, cursor int64, limit int, tx *gorm.DB) ([]model.Change, bool, error) {
+	latest, err := c.LatestCursor(library, tx)
+	if err != nil {
+		return nil, false, err
+	}
+	if cursor < 0 || cursor > latest {
+		return nil, false, ErrCursorExpired
+	}
+	if cursor == latest {
+		return []model.Change{}, false, nil
+	}
+
+	changes := make([]model.Change, 0, limit+1)
+	result := tx.Model(&model.Change{}).
+		Where("library_id = ? AND sequence > ?", library.ID, cursor).
+		Order("sequence").
+		Limit(limit + 1).
+		Find(&changes)
+	if result.Error != nil {
+		return nil, false, result.Error
+	}
+	// Sequence numbers have no gaps, so if the next one is missing it was purged.
+	if len(changes) == 0 || changes[0].Sequence != cursor+1 {
+		return nil, false, ErrCursorExpired
+	}
+	if len(changes) > limit {
+		return changes[:limit], true, nil
+	}
+	return changes, false, nil
+}
+
+// PurgeExpired removes changes from the journal that are older than the retention period.
+func (c *Changes) PurgeExpired() (int64, error) {
+	result := c.DB.Where("created_at < ?", time.Now().Add(-c.Retention)).Delete(&model.Change{})
+	return result.RowsAffected, result.Error
+}
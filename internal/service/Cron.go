@@ -0,0 +1,178 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var ErrInvalidSchedule = errors.New("invalid schedule")
+
+// CronSchedule tells when a recurring task runs next.
+type CronSchedule interface {
+	// Next returns the first time after t at which the task runs.
+	Next(t time.Time) time.Time
+}
+
+// cronDescriptors are the shortcuts for common schedules.
+var cronDescriptors = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+var monthNames = map[string]int{
+	"jan": 1, "feb": 2, "mar": 3, "apr": 4, "may": 5, "jun": 6,
+	"jul": 7, "aug": 8, "sep": 9, "oct": 10, "nov": 11, "dec": 12,
+}
+
+var weekdayNames = map[string]int{
+	"sun": 0, "mon": 1, "tue": 2, "wed": 3, "thu": 4, "fri": 5, "sat": 6,
+}
+
+// ParseCronSchedule reads a schedule in the usual cron format with five fields for the minute, hour, day of the month,
+// month and day of the week. Fields can be lists, ranges and steps, like "0 */6 * * mon-fri". The shortcuts @hourly,
+// @daily, @weekly, @monthly and @yearly are supported too, and "@every 90m" runs a task at a fixed interval.
+func ParseCronSchedule(spec string) (CronSchedule, error) {
+	spec = strings.TrimSpace(spec)
+	if strings.HasPrefix(spec, "@every ") {
+		interval, err := time.ParseDuration(strings.TrimSpace(strings.TrimPrefix(spec, "@every ")))
+		if err != nil || interval < time.Second {
+			return nil, fmt.Errorf("%w: the interval of @every has to be a duration of at least one second", ErrInvalidSchedule)
+		}
+		return everySchedule(interval), nil
+	}
+	if expanded, ok := cronDescriptors[spec]; ok {
+		spec = expanded
+	}
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("%w: expected 5 fields but got %d", ErrInvalidSchedule, len(fields))
+	}
+	var schedule cronSchedule
+	var err error
+	if schedule.minutes, err = parseCronField(fields[0], 0, 59, nil); err != nil {
+		return nil, err
+	}
+	if schedule.hours, err = parseCronField(fields[1], 0, 23, nil); err != nil {
+		return nil, err
+	}
+	if schedule.days, err = parseCronField(fields[2], 1, 31, nil); err != nil {
+		return nil, err
+	}
+	if schedule.months, err = parseCronField(fields[3], 1, 12, monthNames); err != nil {
+		return nil, err
+	}
+	if schedule.weekdays, err = parseCronField(fields[4], 0, 7, weekdayNames); err != nil {
+		return nil, err
+	}
+	if schedule.weekdays&(1<<7) != 0 {
+		// 7 is Sunday too.
+		schedule.weekdays |= 1
+	}
+	schedule.anyDay = fields[2] == "*" || fields[2] == "?"
+	schedule.anyWeekday = fields[4] == "*" || fields[4] == "?"
+	if schedule.Next(time.Now()).IsZero() {
+		return nil, fmt.Errorf("%w: the schedule never matches", ErrInvalidSchedule)
+	}
+	return schedule, nil
+}
+
+// parseCronField reads a field of a cron expression into a bit set of the values it matches.
+func parseCronField(field string, min int, max int, names map[string]int) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if slash := strings.IndexByte(part, '/'); slash >= 0 {
+			var err error
+			if step, err = strconv.Atoi(part[slash+1:]); err != nil || step <= 0 {
+				return 0, fmt.Errorf("%w: invalid step in %q", ErrInvalidSchedule, part)
+			}
+			part = part[:slash]
+		}
+		start, end := min, max
+		if part != "*" && part != "?" {
+			bounds := strings.SplitN(part, "-", 2)
+			var err error
+			if start, err = parseCronValue(bounds[0], min, max, names); err != nil {
+				return 0, err
+			}
+			end = start
+			if len(bounds) == 2 {
+				if end, err = parseCronValue(bounds[1], min, max, names); err != nil {
+					return 0, err
+				}
+			} else if step > 1 {
+				// "5/15" means every 15 starting at 5.
+				end = max
+			}
+			if end < start {
+				return 0, fmt.Errorf("%w: invalid range %q", ErrInvalidSchedule, part)
+			}
+		}
+		for value := start; value <= end; value += step {
+			bits |= 1 << value
+		}
+	}
+	return bits, nil
+}
+
+func parseCronValue(value string, min int, max int, names map[string]int) (int, error) {
+	if number, ok := names[strings.ToLower(value)]; ok {
+		return number, nil
+	}
+	number, err := strconv.Atoi(value)
+	if err != nil || number < min || number > max {
+		return 0, fmt.Errorf("%w: %q is not between %d and %d", ErrInvalidSchedule, value, min, max)
+	}
+	return number, nil
+}
+
+type everySchedule time.Duration
+
+func (s everySchedule) Next(t time.Time) time.Time {
+	return t.Add(time.Duration(s))
+}
+
+type cronSchedule struct {
+	minutes, hours, days, months, weekdays uint64
+	anyDay, anyWeekday                     bool
+}
+
+// matchesDay checks the day of the month and the day of the week. Like in cron, a day matches either of them if both
+// are restricted.
+func (s cronSchedule) matchesDay(t time.Time) bool {
+	day := s.days&(1<<t.Day()) != 0
+	weekday := s.weekdays&(1<<t.Weekday()) != 0
+	if s.anyDay || s.anyWeekday {
+		return day && weekday
+	}
+	return day || weekday
+}
+
+func (s cronSchedule) Next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	// Every schedule that matches at all does so within a few years, even if it only matches on leap days.
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		switch {
+		case s.months&(1<<t.Month()) == 0:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+		case !s.matchesDay(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+		case s.hours&(1<<t.Hour()) == 0:
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+		case s.minutes&(1<<t.Minute()) == 0:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
@@ -0,0 +1,54 @@
+package service
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestParseCronSchedule(t *testing.T) {
+	// A Wednesday.
+	start := time.Date(2024, 1, 10, 14, 37, 20, 0, time.UTC)
+
+	tests := []struct {
+		spec     string
+		expected time.Time
+	}{
+		{"* * * * *", time.Date(2024, 1, 10, 14, 38, 0, 0, time.UTC)},
+		{"@hourly", time.Date(2024, 1, 10, 15, 0, 0, 0, time.UTC)},
+		{"@daily", time.Date(2024, 1, 11, 0, 0, 0, 0, time.UTC)},
+		{"@weekly", time.Date(2024, 1, 14, 0, 0, 0, 0, time.UTC)},
+		{"@monthly", time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC)},
+		{"@every 90m", time.Date(2024, 1, 10, 16, 7, 20, 0, time.UTC)},
+		{"*/15 * * * *", time.Date(2024, 1, 10, 14, 45, 0, 0, time.UTC)},
+		{"5/20 * * * *", time.Date(2024, 1, 10, 14, 45, 0, 0, time.UTC)},
+		{"30 3 * * *", time.Date(2024, 1, 11, 3, 30, 0, 0, time.UTC)},
+		{"0 9-17/4 * * *", time.Date(2024, 1, 10, 17, 0, 0, 0, time.UTC)},
+		{"0 0 * * sat,sun", time.Date(2024, 1, 13, 0, 0, 0, 0, time.UTC)},
+		{"0 0 * * 7", time.Date(2024, 1, 14, 0, 0, 0, 0, time.UTC)},
+		{"0 0 1 mar *", time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)},
+		// Restricting both days matches either of them.
+		{"0 0 15 * mon", time.Date(2024, 1, 15, 0, 0, 0, 0, time.UTC)},
+		{"0 0 12 * fri", time.Date(2024, 1, 12, 0, 0, 0, 0, time.UTC)},
+		{"0 0 29 2 *", time.Date(2024, 2, 29, 0, 0, 0, 0, time.UTC)},
+	}
+	for _, test := range tests {
+		t.Run(test.spec, func(t *testing.T) {
+			schedule, err := ParseCronSchedule(test.spec)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if next := schedule.Next(start); !next.Equal(test.expected) {
+				t.Errorf("Expected %s but got %s", test.expected, next)
+			}
+		})
+	}
+
+	t.Run("it rejects invalid schedules", func(t *testing.T) {
+		for _, spec := range []string{"", "* * * *", "60 * * * *", "* * 0 * *", "5-1 * * * *", "*/0 * * * *", "0 0 31 2 *", "@every 0s", "@every soon", "@often"} {
+			if _, err := ParseCronSchedule(spec); !errors.Is(err, ErrInvalidSchedule) {
+				t.Errorf("Expected %q to be invalid but got: %v", spec, err)
+			}
+		}
+	})
+}
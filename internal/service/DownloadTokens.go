@@ -1,33 +1,154 @@
 package service
 
 import (
+	"errors"
 	"github.com/google/uuid"
+	"gorm.io/gorm"
 	"keydrive/internal/model"
+	"sync"
+	"time"
 )
 
+// DownloadTokenStore keeps download tokens until they are used or expire.
+type DownloadTokenStore interface {
+	Save(token *model.DownloadToken) error
+	// Take returns a token that has not expired yet. Single use tokens are removed from the store. An error means the
+	// store could not be read, not that the token is unknown.
+	Take(tokenString string, now time.Time) (*model.DownloadToken, bool, error)
+	// Sweep removes all expired tokens and returns how many there were.
+	Sweep(now time.Time) (int, error)
+}
+
 type DownloadTokens struct {
-	tokens map[string]*model.DownloadToken
+	// TTL is the time after which a token can no longer be used.
+	TTL time.Duration
+	// MultiUse makes all tokens reusable until they expire, instead of only the ones that ask for it.
+	MultiUse bool
+	store    DownloadTokenStore
 }
 
 func NewDownloadTokens() *DownloadTokens {
 	return &DownloadTokens{
-		tokens: map[string]*model.DownloadToken{},
+		TTL:   time.Hour,
+		store: &memoryDownloadTokenStore{tokens: map[string]*model.DownloadToken{}},
 	}
 }
 
-func (t *DownloadTokens) GenerateDownloadToken(library model.Library, path string) *model.DownloadToken {
-	token := &model.DownloadToken{
-		Token:   uuid.NewString(),
+// NewDatabaseDownloadTokens creates download tokens that are kept in the database, so they survive restarts and can be
+// used on every instance that shares the database.
+func NewDatabaseDownloadTokens(db *gorm.DB) *DownloadTokens {
+	return &DownloadTokens{
+		TTL:   time.Hour,
+		store: &databaseDownloadTokenStore{db: db},
+	}
+}
+
+func (t *DownloadTokens) GenerateDownloadToken(library model.Library, path string) (*model.DownloadToken, error) {
+	return t.SaveDownloadToken(&model.DownloadToken{
 		Library: library,
 		Path:    path,
+	})
+}
+
+// SaveDownloadToken assigns a new token string and expiry time to the token and stores it.
+func (t *DownloadTokens) SaveDownloadToken(token *model.DownloadToken) (*model.DownloadToken, error) {
+	token.Token = uuid.NewString()
+	token.LibraryID = token.Library.ID
+	token.MultiUse = token.MultiUse || t.MultiUse
+	token.ExpiresAt = time.Now().Add(t.TTL)
+	if err := t.store.Save(token); err != nil {
+		return nil, err
 	}
+	return token, nil
+}
+
+func (t *DownloadTokens) GetDownloadToken(tokenString string) (token *model.DownloadToken, found bool, err error) {
+	return t.store.Take(tokenString, time.Now())
+}
+
+func (t *DownloadTokens) SweepExpired() (int, error) {
+	return t.store.Sweep(time.Now())
+}
 
-	t.tokens[token.Token] = token
-	return token
+type memoryDownloadTokenStore struct {
+	lock   sync.Mutex
+	tokens map[string]*model.DownloadToken
+}
+
+func (s *memoryDownloadTokenStore) Save(token *model.DownloadToken) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.tokens[token.Token] = token
+	return nil
+}
+
+func (s *memoryDownloadTokenStore) Take(tokenString string, now time.Time) (*model.DownloadToken, bool, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	token, found := s.tokens[tokenString]
+	if !found {
+		return nil, false, nil
+	}
+	if !now.Before(token.ExpiresAt) {
+		delete(s.tokens, tokenString)
+		return nil, false, nil
+	}
+	if !token.MultiUse {
+		delete(s.tokens, tokenString)
+	}
+	return token, true, nil
+}
+
+func (s *memoryDownloadTokenStore) Sweep(now time.Time) (int, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	swept := 0
+	for tokenString, token := range s.tokens {
+		if !now.Before(token.ExpiresAt) {
+			delete(s.tokens, tokenString)
+			swept++
+		}
+	}
+	return swept, nil
+}
+
+type databaseDownloadTokenStore struct {
+	db *gorm.DB
+}
+
+func (s *databaseDownloadTokenStore) Save(token *model.DownloadToken) error {
+	return s.db.Omit("Library").Create(token).Error
+}
+
+func (s *databaseDownloadTokenStore) Take(tokenString string, now time.Time) (*model.DownloadToken, bool, error) {
+	if _, err := uuid.Parse(tokenString); err != nil {
+		return nil, false, nil
+	}
+	var token model.DownloadToken
+	result := s.db.Model(&model.DownloadToken{}).
+		Preload("Library").
+		Where("token = ? AND expires_at > ?", tokenString, now).
+		Take(&token)
+	if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+		return nil, false, nil
+	}
+	if result.Error != nil {
+		return nil, false, result.Error
+	}
+	if !token.MultiUse {
+		// Only one request can delete the token, even when several instances share the database.
+		result = s.db.Delete(&model.DownloadToken{}, "token = ?", tokenString)
+		if result.Error != nil {
+			return nil, false, result.Error
+		}
+		if result.RowsAffected != 1 {
+			return nil, false, nil
+		}
+	}
+	return &token, true, nil
 }
 
-func (t *DownloadTokens) GetDownloadToken(tokenString string) (token *model.DownloadToken, found bool) {
-	token, found = t.tokens[tokenString]
-	delete(t.tokens, tokenString)
-	return
+func (s *databaseDownloadTokenStore) Sweep(now time.Time) (int, error) {
+	result := s.db.Delete(&model.DownloadToken{}, "expires_at <= ?", now)
+	return int(result.RowsAffected), result.Error
 }
@@ -1,8 +1,11 @@
 package service
 
 import (
+	"errors"
 	"keydrive/internal/model"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestDownloadTokens(t *testing.T) {
@@ -15,9 +18,9 @@ func TestDownloadTokens(t *testing.T) {
 	}
 
 	t.Run("it returns a token with the correct information", func(t *testing.T) {
-		tokenId := tokens.GenerateDownloadToken(lib, "/download/path").Token
+		tokenId := generateToken(t, tokens, lib)
 
-		tokenValue, found := tokens.GetDownloadToken(tokenId)
+		tokenValue, found, _ := tokens.GetDownloadToken(tokenId)
 		if !found {
 			t.Errorf("Did not find a download token after generating it")
 		}
@@ -30,12 +33,121 @@ func TestDownloadTokens(t *testing.T) {
 	})
 
 	t.Run("it returns a token only once", func(t *testing.T) {
-		tokenId := tokens.GenerateDownloadToken(lib, "/download/path").Token
+		tokenId := generateToken(t, tokens, lib)
 
 		tokens.GetDownloadToken(tokenId)
-		_, found := tokens.GetDownloadToken(tokenId)
+		_, found, _ := tokens.GetDownloadToken(tokenId)
 		if found {
 			t.Errorf("Download token was not deleted after getting it once")
 		}
 	})
 }
+
+func TestDownloadTokens_Expiry(t *testing.T) {
+	tokens := NewDownloadTokens()
+	lib := model.Library{
+		ID:         1,
+		Type:       "generic",
+		Name:       "Test Library",
+		RootFolder: "/tmp/test",
+	}
+
+	t.Run("it does not return expired tokens", func(t *testing.T) {
+		tokens.TTL = -time.Second
+		tokenId := generateToken(t, tokens, lib)
+		tokens.TTL = time.Hour
+
+		if _, found, _ := tokens.GetDownloadToken(tokenId); found {
+			t.Errorf("Expired download token was returned")
+		}
+	})
+
+	t.Run("it sweeps expired tokens", func(t *testing.T) {
+		tokens.TTL = -time.Second
+		generateToken(t, tokens, lib)
+		generateToken(t, tokens, lib)
+		tokens.TTL = time.Hour
+		valid := generateToken(t, tokens, lib)
+
+		swept, err := tokens.SweepExpired()
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if swept != 2 {
+			t.Errorf("Expected 2 swept tokens but got %d", swept)
+		}
+		if _, found, _ := tokens.GetDownloadToken(valid); !found {
+			t.Errorf("Valid download token was swept")
+		}
+	})
+
+	t.Run("it returns multi use tokens until they expire", func(t *testing.T) {
+		token, err := tokens.SaveDownloadToken(&model.DownloadToken{
+			Library:  lib,
+			Path:     "/download/path",
+			MultiUse: true,
+		})
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		tokenId := token.Token
+
+		for i := 0; i < 3; i++ {
+			if _, found, _ := tokens.GetDownloadToken(tokenId); !found {
+				t.Errorf("Multi use download token was not found on attempt %d", i+1)
+			}
+		}
+	})
+
+	t.Run("it can be used concurrently", func(t *testing.T) {
+		var wait sync.WaitGroup
+		for i := 0; i < 10; i++ {
+			wait.Add(1)
+			go func() {
+				defer wait.Done()
+				token, err := tokens.GenerateDownloadToken(lib, "/download/path")
+				if err != nil {
+					t.Error(err.Error())
+					return
+				}
+				if _, found, _ := tokens.GetDownloadToken(token.Token); !found {
+					t.Errorf("Download token was not found")
+				}
+			}()
+		}
+		wait.Wait()
+	})
+
+	t.Run("it returns the error if the store fails", func(t *testing.T) {
+		failing := &DownloadTokens{TTL: time.Hour, store: failingDownloadTokenStore{}}
+		if token, err := failing.GenerateDownloadToken(lib, "/download/path"); err == nil || token != nil {
+			t.Errorf("Expected an error but got token %v", token)
+		}
+		if _, found, err := failing.GetDownloadToken("token"); err == nil || found {
+			t.Errorf("Expected an error when the store can not be read")
+		}
+	})
+}
+
+func generateToken(t *testing.T, tokens *DownloadTokens, lib model.Library) string {
+	t.Helper()
+	token, err := tokens.GenerateDownloadToken(lib, "/download/path")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	return token.Token
+}
+
+type failingDownloadTokenStore struct{}
+
+func (failingDownloadTokenStore) Save(*model.DownloadToken) error {
+	return errors.New("store is not available")
+}
+
+func (failingDownloadTokenStore) Take(string, time.Time) (*model.DownloadToken, bool, error) {
+	return nil, false, errors.New("store is not available")
+}
+
+func (failingDownloadTokenStore) Sweep(time.Time) (int, error) {
+	return 0, nil
+}
@@ -0,0 +1,122 @@
+package service
+
+import (
+	"keydrive/pkg/logger"
+	"sync"
+	"time"
+)
+
+var log = logger.NewConsole(logger.LevelDebug, "SERVICE")
+
+type EventType string
+
+const (
+	EventCreated          EventType = "created"
+	EventUpdated          EventType = "updated"
+	EventMoved            EventType = "moved"
+	EventDeleted          EventType = "deleted"
+	EventLibraryShared    EventType = "library-shared"
+	EventLibraryUnshared  EventType = "library-unshared"
+	EventShareLinkCreated EventType = "share-link-created"
+	EventShareLinkDeleted EventType = "share-link-deleted"
+	// EventTransferProgress reports how far a copy or move has come. It is only sent to the user who started it.
+	EventTransferProgress EventType = "transfer-progress"
+)
+
+// eventHistory is the number of events that is kept, so subscribers can resume after reconnecting.
+const eventHistory = 1000
+
+type Event struct {
+	ID        int64     `json:"id"`
+	Type      EventType `json:"type"`
+	LibraryID int       `json:"libraryId"`
+	// UserID is set for events that only concern a single user. Other events are meant for everyone who can access
+	// the library.
+	UserID  int       `json:"userId,omitempty"`
+	Path    string    `json:"path,omitempty"`
+	OldPath string    `json:"oldPath,omitempty"`
+	Entry   *FileInfo `json:"entry,omitempty"`
+	// Progress is set for transfer progress events, which also carry the source of the transfer in OldPath.
+	Progress *TransferProgress `json:"progress,omitempty"`
+	Time     time.Time         `json:"time"`
+}
+
+// Events passes change events to everyone who is subscribed. Publishing never blocks, so subscribers that do not keep
+// up are unsubscribed. They can resume from the last event they received using SubscribeSince.
+type Events struct {
+	lock        sync.Mutex
+	lastID      int64
+	history     []Event
+	subscribers map[chan Event]struct{}
+}
+
+func NewEvents() *Events {
+	return &Events{
+		// Ids start at the current time, so ids from before a restart are never mistaken for new ones.
+		lastID:      time.Now().UnixMicro(),
+		history:     make([]Event, 0, eventHistory),
+		subscribers: map[chan Event]struct{}{},
+	}
+}
+
+// Publish assigns an id to the event and sends it to all subscribers.
+func (e *Events) Publish(event Event) Event {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.lastID++
+	event.ID = e.lastID
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	if len(e.history) == eventHistory {
+		copy(e.history, e.history[1:])
+		e.history = e.history[:eventHistory-1]
+	}
+	e.history = append(e.history, event)
+	for subscriber := range e.subscribers {
+		select {
+		case subscriber <- event:
+		default:
+			delete(e.subscribers, subscriber)
+			close(subscriber)
+		}
+	}
+	return event
+}
+
+// Subscribe returns a channel that receives all events published from now on, and a function to stop receiving them.
+func (e *Events) Subscribe(buffer int) (<-chan Event, func()) {
+	_, _, subscriber, unsubscribe := e.SubscribeSince(-1, buffer)
+	return subscriber, unsubscribe
+}
+
+// SubscribeSince subscribes to events like Subscribe, and also returns the events that were published after the given
+// id. If some of those events are no longer available, complete is false and the subscriber has to reload everything
+// it knows. An id of -1 skips the events that were published before.
+func (e *Events) SubscribeSince(lastID int64, buffer int) (missed []Event, complete bool, events <-chan Event, unsubscribe func()) {
+	subscriber := make(chan Event, buffer)
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.subscribers[subscriber] = struct{}{}
+
+	complete = true
+	if lastID >= 0 && lastID != e.lastID {
+		if len(e.history) == 0 || e.history[0].ID > lastID+1 || lastID > e.lastID {
+			complete = false
+		}
+		for _, event := range e.history {
+			if event.ID > lastID {
+				missed = append(missed, event)
+			}
+		}
+	}
+
+	return missed, complete, subscriber, func() {
+		e.lock.Lock()
+		defer e.lock.Unlock()
+		if _, ok := e.subscribers[subscriber]; ok {
+			delete(e.subscribers, subscriber)
+			close(subscriber)
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package service
+
+import (
+	"testing"
+)
+
+func TestEvents(t *testing.T) {
+	events := NewEvents()
+
+	t.Run("it sends events to subscribers", func(t *testing.T) {
+		received, unsubscribe := events.Subscribe(10)
+		defer unsubscribe()
+
+		first := events.Publish(Event{Type: EventCreated, LibraryID: 1, Path: "/a.txt"})
+		second := events.Publish(Event{Type: EventDeleted, LibraryID: 1, Path: "/a.txt"})
+		if second.ID <= first.ID {
+			t.Errorf("Expected increasing ids but got %d and %d", first.ID, second.ID)
+		}
+		if event := <-received; event.ID != first.ID || event.Type != EventCreated {
+			t.Errorf("Unexpected event: %v", event)
+		}
+		if event := <-received; event.ID != second.ID || event.Type != EventDeleted {
+			t.Errorf("Unexpected event: %v", event)
+		}
+	})
+
+	t.Run("it unsubscribes slow subscribers", func(t *testing.T) {
+		received, unsubscribe := events.Subscribe(1)
+		defer unsubscribe()
+
+		for i := 0; i < 10; i++ {
+			events.Publish(Event{Type: EventUpdated, LibraryID: 1, Path: "/a.txt"})
+		}
+		count := 0
+		for range received {
+			count++
+		}
+		if count != 1 {
+			t.Errorf("Expected 1 event before the channel was closed but got %d", count)
+		}
+	})
+
+	t.Run("it resumes from an event id", func(t *testing.T) {
+		first := events.Publish(Event{Type: EventCreated, LibraryID: 1, Path: "/b.txt"})
+		second := events.Publish(Event{Type: EventDeleted, LibraryID: 1, Path: "/b.txt"})
+
+		missed, complete, _, unsubscribe := events.SubscribeSince(first.ID, 1)
+		unsubscribe()
+		if !complete || len(missed) != 1 || missed[0].ID != second.ID {
+			t.Errorf("Expected to miss only the second event but got: %v", missed)
+		}
+
+		_, complete, _, unsubscribe = events.SubscribeSince(1, 1)
+		unsubscribe()
+		if complete {
+			t.Errorf("Expected an unknown id to require a reload")
+		}
+	})
+
+	t.Run("it stops sending after unsubscribing", func(t *testing.T) {
+		received, unsubscribe := events.Subscribe(1)
+		unsubscribe()
+		events.Publish(Event{Type: EventUpdated, LibraryID: 1, Path: "/a.txt"})
+		if _, ok := <-received; ok {
+			t.Errorf("Expected the channel to be closed")
+		}
+	})
+}
@@ -6,8 +6,8 @@ import (
 	"strings"
 )
 
-// TODO: Collect WAY more types
-
+// ExtToMime maps file extensions to mime types, for files whose content does not tell their type. More types can be
+// added using LoadMimeTypes.
 var ExtToMime = map[string]string{
 	".123":         "application/vnd.lotus-1-2-3",
 	".3dml":        "text/vnd.in3d.3dml",
@@ -48,6 +48,7 @@ var ExtToMime = map[string]string{
 	".azf":         "application/vnd.airzip.filesecure.azf",
 	".azs":         "application/vnd.airzip.filesecure.azs",
 	".azw":         "application/vnd.amazon.ebook",
+	".azw3":        "application/vnd.amazon.mobi8-ebook",
 	".bcpio":       "application/x-bcpio",
 	".bdf":         "application/x-font-bdf",
 	".bdm":         "application/vnd.syncml.dm+wbxml",
@@ -67,6 +68,8 @@ var ExtToMime = map[string]string{
 	".cab":         "application/vnd.ms-cab-compressed",
 	".car":         "application/vnd.curl.car",
 	".cat":         "application/vnd.ms-pki.seccat",
+	".cbr":         "application/vnd.comicbook-rar",
+	".cbz":         "application/vnd.comicbook+zip",
 	".ccxml":       "application/ccxml+xml,",
 	".cdbcmsg":     "application/vnd.contact.cmsg",
 	".cdkey":       "application/vnd.mediastation.cdkey",
@@ -169,6 +172,7 @@ var ExtToMime = map[string]string{
 	".ez3":         "application/vnd.ezpix-package",
 	".f":           "text/x-fortran",
 	".f4v":         "video/x-f4v",
+	".fb2":         "application/x-fictionbook+xml",
 	".fbs":         "image/vnd.fastbidsheet",
 	".fcs":         "application/vnd.isac.fcs",
 	".fdf":         "application/vnd.fdf",
@@ -323,6 +327,7 @@ var ExtToMime = map[string]string{
 	".mmf":         "application/vnd.smaf",
 	".mmr":         "image/vnd.fujixerox.edmics-mmr",
 	".mny":         "application/x-msmoney",
+	".mobi":        "application/x-mobipocket-ebook",
 	".mods":        "application/mods+xml",
 	".mov":         "video/quicktime",
 	".movie":       "video/x-sgi-movie",
@@ -715,11 +720,17 @@ var MimeToCategory = map[string]model.Category{
 	"application/epub+zip":                          model.CategoryDocument,
 	"application/msword":                            model.CategoryDocument,
 	"application/pdf":                               model.CategoryDocument,
+	"application/vnd.amazon.ebook":                  model.CategoryDocument,
+	"application/vnd.amazon.mobi8-ebook":            model.CategoryDocument,
+	"application/vnd.comicbook+zip":                 model.CategoryDocument,
+	"application/vnd.comicbook-rar":                 model.CategoryDocument,
 	"application/vnd.ms-excel":                      model.CategoryDocument,
 	"application/vnd.ms-word":                       model.CategoryDocument,
 	"application/vnd.oasis.opendocument":            model.CategoryDocument,
 	"application/vnd.openxmlformats-officedocument": model.CategoryDocument,
 	"application/x-7z-compressed":                   model.CategoryArchive,
+	"application/x-fictionbook+xml":                 model.CategoryDocument,
+	"application/x-mobipocket-ebook":                model.CategoryDocument,
 	"application/x-rar-compressed":                  model.CategoryArchive,
 	"application/x-tar":                             model.CategoryArchive,
 	"application/zip":                               model.CategoryArchive,
@@ -16,21 +16,77 @@ import (
 )
 
 type FileInfo struct {
-	Name     string         `json:"name"`
-	Modified time.Time      `json:"modified"`
-	Parent   string         `json:"parent"`
-	Category model.Category `json:"category"`
-	MimeType string         `json:"mimeType,omitempty"`
-	Size     int64          `json:"size"`
+	Name     string          `json:"name"`
+	Modified time.Time       `json:"modified"`
+	Parent   string          `json:"parent"`
+	Category model.Category  `json:"category"`
+	MimeType string          `json:"mimeType,omitempty"`
+	Size     int64           `json:"size"`
+	Metadata *model.Metadata `json:"metadata,omitempty"`
+}
+
+// SystemFolder is the folder in the root of every library in which KeyDrive keeps its own data. It is hidden from
+// listings and can not be accessed through the entries api.
+const SystemFolder = ".keydrive"
+
+var ErrReservedPath = errors.New("this path is reserved")
+var ErrOutsideLibrary = errors.New("this path is outside the library")
+var ErrSymlinkRejected = errors.New("symbolic links are not allowed in this library")
+
+// ChangeListener is told about every change that is made to a library through the FileSystem.
+type ChangeListener interface {
+	EntryChanged(library model.Library, path string)
+	EntryMoved(library model.Library, oldPath string, newPath string)
 }
 
 type FileSystem struct {
+	Listener ChangeListener
+
+	mimeTypes mimeTypeCache
+}
+
+func (fs *FileSystem) changed(library model.Library, path string) {
+	if fs.Listener != nil {
+		fs.Listener.EntryChanged(library, filepath.ToSlash(fs.cleanRelativePath(path)))
+	}
+}
+
+func (fs *FileSystem) moved(library model.Library, oldPath string, newPath string) {
+	if fs.Listener != nil {
+		fs.Listener.EntryMoved(library, filepath.ToSlash(fs.cleanRelativePath(oldPath)), filepath.ToSlash(fs.cleanRelativePath(newPath)))
+	}
 }
 
 func (fs *FileSystem) GetDisks() []string {
 	return listDisks()
 }
 
+// DiskSpace is the size of the filesystem that a folder is on, and the space that is left on it. Folders on the same
+// filesystem have the same Device.
+type DiskSpace struct {
+	Device string
+	Total  uint64
+	Free   uint64
+}
+
+// GetDiskSpace returns the space on the filesystem of a folder.
+func (fs *FileSystem) GetDiskSpace(folder string) (DiskSpace, error) {
+	return diskSpace(folder)
+}
+
+// CheckLibraryAccess checks if the root folder of a library can be read and written to.
+func (fs *FileSystem) CheckLibraryAccess(library model.Library) (readErr error, writeErr error) {
+	folder, err := os.Open(library.RootFolder)
+	if err != nil {
+		return err, err
+	}
+	defer folder.Close()
+	if _, err := folder.Readdirnames(1); err != nil && err != io.EOF {
+		return err, err
+	}
+	return nil, checkWritable(library.RootFolder)
+}
+
 func (fs *FileSystem) cleanRelativePath(relPath string) string {
 	relPath = filepath.Clean("/" + strings.TrimPrefix(relPath, "/"))
 	if relPath == "." {
@@ -39,30 +95,167 @@ func (fs *FileSystem) cleanRelativePath(relPath string) string {
 	return "/" + strings.TrimPrefix(relPath, "/")
 }
 
-func (fs *FileSystem) resolve(library model.Library, path ...string) string {
-	return filepath.Clean(filepath.Join(library.RootFolder, filepath.Join(path...)))
+// libraryRoot returns the real path of the library root folder, with all symbolic links resolved.
+func (fs *FileSystem) libraryRoot(library model.Library) (string, error) {
+	return filepath.EvalSymlinks(library.RootFolder)
+}
+
+// resolve turns a path in a library into a path on disk. Symbolic links in the path are handled according to the
+// policy of the library, and the result is always inside the library root folder. When followLast is false, a link at
+// the end of the path is not followed, so the link itself can be moved or deleted.
+func (fs *FileSystem) resolve(library model.Library, relPath string, followLast bool) (string, error) {
+	root, err := fs.libraryRoot(library)
+	if err != nil {
+		return "", err
+	}
+	relPath = filepath.ToSlash(fs.cleanRelativePath(relPath))
+	if relPath == "/" {
+		return root, nil
+	}
+
+	current := root
+	parts := strings.Split(strings.TrimPrefix(relPath, "/"), "/")
+	for i, part := range parts {
+		next := filepath.Join(current, part)
+		info, err := os.Lstat(next)
+		if os.IsNotExist(err) {
+			// The rest of the path does not exist yet, so it can not contain any links.
+			return filepath.Join(next, filepath.Join(parts[i+1:]...)), nil
+		}
+		if err != nil {
+			return "", err
+		}
+		if info.Mode()&os.ModeSymlink == 0 {
+			current = next
+			continue
+		}
+
+		isLast := i == len(parts)-1
+		switch {
+		case library.SymlinkPolicy == model.SymlinkHide:
+			return "", os.ErrNotExist
+		case isLast && !followLast:
+			current = next
+		case library.SymlinkPolicy == model.SymlinkReject:
+			return "", ErrSymlinkRejected
+		default:
+			target, err := filepath.EvalSymlinks(next)
+			if err != nil {
+				return "", err
+			}
+			if !isInside(root, target) {
+				return "", ErrOutsideLibrary
+			}
+			current = target
+		}
+	}
+	return current, nil
+}
+
+func isInside(root string, target string) bool {
+	rel, err := filepath.Rel(root, target)
+	if err != nil {
+		return false
+	}
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) && !filepath.IsAbs(rel)
+}
+
+// relativeBeneath returns the path of target relative to root, or ErrOutsideLibrary if it is not inside root.
+func relativeBeneath(root string, target string) (string, error) {
+	if !isInside(root, target) {
+		return "", ErrOutsideLibrary
+	}
+	return filepath.Rel(root, target)
+}
+
+// mkdirAll creates a folder at a resolved path in the library together with any missing parents.
+func (fs *FileSystem) mkdirAll(library model.Library, target string) error {
+	root, err := fs.libraryRoot(library)
+	if err != nil {
+		return err
+	}
+	return mkdirAllBeneath(root, target)
+}
+
+// rename moves an entry between resolved paths in two libraries, which may be the same. Like OpenFile, the kernel
+// checks on Linux that no link was swapped in after the paths were resolved.
+func (fs *FileSystem) rename(sourceLibrary model.Library, source string, targetLibrary model.Library, target string) error {
+	sourceRoot, err := fs.libraryRoot(sourceLibrary)
+	if err != nil {
+		return err
+	}
+	targetRoot, err := fs.libraryRoot(targetLibrary)
+	if err != nil {
+		return err
+	}
+	return renameBeneath(sourceRoot, source, targetRoot, target)
+}
+
+// renameNoReplace is like rename, but fails with ErrEntryExists if there already is an entry at the target.
+func (fs *FileSystem) renameNoReplace(sourceLibrary model.Library, source string, targetLibrary model.Library, target string) error {
+	sourceRoot, err := fs.libraryRoot(sourceLibrary)
+	if err != nil {
+		return err
+	}
+	targetRoot, err := fs.libraryRoot(targetLibrary)
+	if err != nil {
+		return err
+	}
+	err = renameNoReplaceBeneath(sourceRoot, source, targetRoot, target)
+	if os.IsExist(err) {
+		return ErrEntryExists
+	}
+	return err
+}
+
+func (fs *FileSystem) isSystemPath(relPath string) bool {
+	relPath = fs.cleanRelativePath(relPath)
+	return relPath == "/"+SystemFolder || strings.HasPrefix(relPath, "/"+SystemFolder+"/")
+}
+
+// systemFolder returns the path of a folder in the system folder of the library, creating it if it does not exist. It is
+// inside the real root folder, so files in it can be moved into the library with rename.
+func (fs *FileSystem) systemFolder(library model.Library, name string) (string, error) {
+	root, err := fs.libraryRoot(library)
+	if err != nil {
+		return "", err
+	}
+	folder := filepath.Join(root, SystemFolder, name)
+	return folder, mkdirAllBeneath(root, folder)
 }
 
 func (fs *FileSystem) GetEntriesForLibrary(library model.Library, parentPath string) ([]FileInfo, error) {
 	parentPath = fs.cleanRelativePath(parentPath)
-	target := fs.resolve(library, parentPath)
+	target, err := fs.resolve(library, parentPath, true)
+	if err != nil {
+		return nil, err
+	}
 
 	files, err := ioutil.ReadDir(target)
 	if err != nil {
 		return nil, err
 	}
 
-	output := make([]FileInfo, len(files))
+	output := make([]FileInfo, 0, len(files))
 
-	for i, file := range files {
-		category, _ := GetFileCategory(file.Name(), "", file.IsDir())
-		output[i] = FileInfo{
-			Name:     file.Name(),
-			Category: category,
-			Parent:   parentPath,
-			Modified: file.ModTime(),
-			Size:     file.Size(),
+	for _, file := range files {
+		if parentPath == "/" && file.Name() == SystemFolder {
+			continue
+		}
+		name := file.Name()
+		location := filepath.Join(target, name)
+		if file.Mode()&os.ModeSymlink != 0 && library.SymlinkPolicy != model.SymlinkReject {
+			// Links are listed as the entry they point to. Hidden, broken and escaping links are left out.
+			linkTarget, err := fs.resolve(library, filepath.Join(parentPath, name), true)
+			if err != nil {
+				continue
+			}
+			if file, err = os.Stat(linkTarget); err != nil {
+				continue
+			}
+			location = linkTarget
 		}
+		output = append(output, fs.toInfo(location, name, file, parentPath, false))
 	}
 
 	sort.Slice(output, func(i, j int) bool {
@@ -116,26 +309,36 @@ func getNumberPrefix(val string) (int, bool) {
 
 func (fs *FileSystem) GetEntryMetadata(library model.Library, path string) (FileInfo, error) {
 	path = fs.cleanRelativePath(path)
-	if path == "/" {
+	if path == "/" || fs.isSystemPath(path) {
 		// We're at the library root, so this is not a valid entry.
 		return FileInfo{}, os.ErrNotExist
 	}
 
 	parentPath := filepath.Dir(path)
-	target := fs.resolve(library, path)
+	target, err := fs.resolve(library, path, true)
+	if err != nil {
+		return FileInfo{}, err
+	}
 
 	file, err := os.Stat(target)
 	if err != nil {
 		return FileInfo{}, err
 	}
 
-	return fs.toInfo(file, parentPath, ""), nil
+	return fs.toInfo(target, filepath.Base(path), file, parentPath, true), nil
 }
 
 func (fs *FileSystem) CreateFolderInLibrary(library model.Library, name string, parentPath string) (FileInfo, error) {
 	parentPath = fs.cleanRelativePath(parentPath)
-	target := fs.resolve(library, parentPath, name)
-	err := os.MkdirAll(target, 0770)
+	path := filepath.Join(parentPath, name)
+	if fs.isSystemPath(path) {
+		return FileInfo{}, ErrReservedPath
+	}
+	target, err := fs.resolve(library, path, true)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	err = fs.mkdirAll(library, target)
 	if err != nil {
 		return FileInfo{}, err
 	}
@@ -143,60 +346,112 @@ func (fs *FileSystem) CreateFolderInLibrary(library model.Library, name string,
 	if err != nil {
 		return FileInfo{}, err
 	}
-	return fs.toInfo(created, parentPath, ""), nil
+	fs.changed(library, path)
+	return fs.toInfo(target, filepath.Base(path), created, filepath.Dir(path), false), nil
 }
 
+// CreateFileInLibrary writes an uploaded file to a new entry in the library. It fails with ErrEntryExists if there
+// already is an entry with the name, even if it was created while the file was written.
 func (fs *FileSystem) CreateFileInLibrary(library model.Library, name string, parentPath string, data *multipart.FileHeader) (FileInfo, error) {
 	parentPath = fs.cleanRelativePath(parentPath)
 	if name == "" {
 		name = data.Filename
 	}
-	target := fs.resolve(library, parentPath, name)
+	path := filepath.Join(parentPath, name)
+	if fs.isSystemPath(path) {
+		return FileInfo{}, ErrReservedPath
+	}
 
 	soureFile, err := data.Open()
 	if err != nil {
 		return FileInfo{}, err
 	}
 	defer soureFile.Close()
-
-	targetFile, err := os.Create(target)
+	staged, err := fs.StageFile(library, soureFile, data.Size)
 	if err != nil {
 		return FileInfo{}, err
 	}
-	defer targetFile.Close()
-	written, err := io.Copy(targetFile, soureFile)
+	defer os.Remove(staged)
+	return fs.commitFile(library, staged, path, false)
+}
+
+// StageFile writes data to a new file in the system folder of the library, so it can be moved into place with
+// CommitFileInLibrary once it is complete. Staged files that are never committed are removed by the integrity check.
+func (fs *FileSystem) StageFile(library model.Library, data io.Reader, size int64) (string, error) {
+	folder, err := fs.systemFolder(library, "transfers")
 	if err != nil {
-		return FileInfo{}, err
+		return "", err
 	}
-	if written != data.Size {
-		return FileInfo{}, errors.New("size mismatch")
+	slug, err := randomSlug()
+	if err != nil {
+		return "", err
 	}
-	file, err := os.Stat(target)
+	staged := filepath.Join(folder, slug)
+	file, err := os.OpenFile(staged, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0660)
 	if err != nil {
-		return FileInfo{}, err
+		return "", err
+	}
+	written, err := io.Copy(file, data)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil && written != size {
+		err = errors.New("size mismatch")
 	}
-	return fs.toInfo(file, parentPath, data.Header.Get("Content-Type")), nil
+	if err != nil {
+		_ = os.Remove(staged)
+		return "", err
+	}
+	return staged, nil
 }
 
 func (fs *FileSystem) DeleteEntryInLibrary(library model.Library, path string) error {
 	path = fs.cleanRelativePath(path)
-	target := fs.resolve(library, path)
-	err := os.RemoveAll(target)
-	if err != nil && !os.IsNotExist(err) {
+	if fs.isSystemPath(path) {
+		return ErrReservedPath
+	}
+	if path == "/" {
+		return ErrReservedPath
+	}
+	target, err := fs.resolve(library, path, false)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
 		return err
 	}
-	return nil
-}
-
-func (fs *FileSystem) MoveEntryInLibrary(library model.Library, source string, target string) error {
-	source = fs.resolve(library, fs.cleanRelativePath(source))
-	target = fs.resolve(library, fs.cleanRelativePath(target))
-	return os.Rename(source, target)
+	// The entry is moved out of the library first, so removing it can not follow a link that was swapped in.
+	folder, err := fs.systemFolder(library, "transfers")
+	if err != nil {
+		return err
+	}
+	slug, err := randomSlug()
+	if err != nil {
+		return err
+	}
+	removed := filepath.Join(folder, slug)
+	err = fs.rename(library, target, library, removed)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	fs.changed(library, path)
+	return os.RemoveAll(removed)
 }
 
-func (fs *FileSystem) toInfo(file os.FileInfo, parent string, mimeType string) FileInfo {
-	name := file.Name()
-	category, mimeType := GetFileCategory(name, mimeType, file.IsDir())
+// toInfo describes the entry at location on disk. The type of files is detected from their content if sniff is set, and
+// taken from the extension otherwise, so listing a folder does not read every file in it. Listings get the detected
+// type from the index instead, see Index.AddMetadata.
+func (fs *FileSystem) toInfo(location string, name string, file os.FileInfo, parent string, sniff bool) FileInfo {
+	var category model.Category
+	var mimeType string
+	if sniff {
+		category, mimeType = fs.DetectFileCategory(location, name, file, "")
+	} else {
+		category, mimeType = GetFileCategory(name, "", file.IsDir())
+	}
 	size := file.Size()
 	if file.IsDir() {
 		size = 0
@@ -212,8 +467,71 @@ func (fs *FileSystem) toInfo(file os.FileInfo, parent string, mimeType string) F
 	}
 }
 
-func (fs *FileSystem) OpenFile(library model.Library, path string) (io.ReadCloser, error) {
+func (fs *FileSystem) OpenFile(library model.Library, path string) (*os.File, error) {
 	path = fs.cleanRelativePath(path)
-	target := fs.resolve(library, path)
-	return os.Open(target)
+	if fs.isSystemPath(path) {
+		return nil, os.ErrNotExist
+	}
+	root, err := fs.libraryRoot(library)
+	if err != nil {
+		return nil, err
+	}
+	target, err := fs.resolve(library, path, true)
+	if err != nil {
+		return nil, err
+	}
+	// The resolved path should not contain any links, so opening fails if one was swapped in after resolving.
+	return openBeneath(root, target)
+}
+
+// CreateStagingFile creates an empty file in the system folder of the library. Since it lives on the same filesystem
+// as the library, it can later be moved into place atomically using CommitFileInLibrary.
+func (fs *FileSystem) CreateStagingFile(library model.Library, name string) (string, error) {
+	folder, err := fs.systemFolder(library, "uploads")
+	if err != nil {
+		return "", err
+	}
+	staged := filepath.Join(folder, name)
+	file, err := os.OpenFile(staged, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0660)
+	if err != nil {
+		return "", err
+	}
+	return staged, file.Close()
+}
+
+func (fs *FileSystem) StagingFile(library model.Library, name string) string {
+	root, err := fs.libraryRoot(library)
+	if err != nil {
+		root = library.RootFolder
+	}
+	return filepath.Join(root, SystemFolder, "uploads", name)
+}
+
+// CommitFileInLibrary moves a staged file to its final path in the library, replacing any file that is already there.
+func (fs *FileSystem) CommitFileInLibrary(library model.Library, staged string, path string) (FileInfo, error) {
+	return fs.commitFile(library, staged, path, true)
+}
+
+func (fs *FileSystem) commitFile(library model.Library, staged string, path string, replace bool) (FileInfo, error) {
+	path = fs.cleanRelativePath(path)
+	if path == "/" || fs.isSystemPath(path) {
+		return FileInfo{}, ErrReservedPath
+	}
+	target, err := fs.resolve(library, path, false)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	rename := fs.rename
+	if !replace {
+		rename = fs.renameNoReplace
+	}
+	if err := rename(library, staged, library, target); err != nil {
+		return FileInfo{}, err
+	}
+	file, err := os.Stat(target)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	fs.changed(library, path)
+	return fs.toInfo(target, filepath.Base(path), file, filepath.Dir(path), true), nil
 }
@@ -1,10 +1,13 @@
 package service
 
 import (
+	"context"
 	"io"
 	"keydrive/internal/model"
 	"os"
 	"path/filepath"
+	"runtime"
+	"strings"
 	"testing"
 )
 
@@ -24,3 +27,192 @@ func TestFileSystem_OpenFile(t *testing.T) {
 		t.Errorf("Invalid bytes came back")
 	}
 }
+
+func TestFileSystem_SystemFolder(t *testing.T) {
+	tmpDir := t.TempDir()
+	_ = os.WriteFile(filepath.Join(tmpDir, "visible.txt"), []byte("Hello"), 0777)
+	lib := model.Library{
+		RootFolder: tmpDir,
+	}
+	fs := FileSystem{}
+
+	staged, err := fs.CreateStagingFile(lib, "staged")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	t.Run("it hides the system folder from listings", func(t *testing.T) {
+		entries, err := fs.GetEntriesForLibrary(lib, "/")
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if len(entries) != 1 || entries[0].Name != "visible.txt" {
+			t.Errorf("Expected only visible.txt but got: %v", entries)
+		}
+	})
+
+	t.Run("it does not allow access to the system folder", func(t *testing.T) {
+		if _, err := fs.OpenFile(lib, "/.keydrive/uploads/staged"); !os.IsNotExist(err) {
+			t.Errorf("Expected the staged file to be inaccessible, but got: %v", err)
+		}
+		if err := fs.DeleteEntryInLibrary(lib, ".keydrive"); err != ErrReservedPath {
+			t.Errorf("Expected ErrReservedPath but got: %v", err)
+		}
+	})
+
+	t.Run("it commits a staged file", func(t *testing.T) {
+		_ = os.WriteFile(staged, []byte("Staged"), 0777)
+		info, err := fs.CommitFileInLibrary(lib, staged, "/committed.txt")
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if info.Name != "committed.txt" || info.Parent != "/" || info.Size != 6 {
+			t.Errorf("Unexpected file info: %v", info)
+		}
+		if _, err := os.Stat(staged); !os.IsNotExist(err) {
+			t.Errorf("Staged file still exists")
+		}
+	})
+
+	t.Run("it does not replace entries when creating them", func(t *testing.T) {
+		staged, err := fs.StageFile(lib, strings.NewReader("New"), 3)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if _, err := fs.commitFile(lib, staged, "/visible.txt", false); err != ErrEntryExists {
+			t.Errorf("Expected ErrEntryExists but got: %v", err)
+		}
+		if data, _ := os.ReadFile(filepath.Join(tmpDir, "visible.txt")); string(data) != "Hello" {
+			t.Errorf("Expected the existing file to stay but got: %s", data)
+		}
+
+		root, _ := filepath.EvalSymlinks(tmpDir)
+		_ = os.Mkdir(filepath.Join(root, "empty"), 0777)
+		_ = os.Mkdir(filepath.Join(root, "folder"), 0777)
+		if err := fs.renameNoReplace(lib, filepath.Join(root, "folder"), lib, filepath.Join(root, "empty")); err != ErrEntryExists {
+			t.Errorf("Expected ErrEntryExists for a folder but got: %v", err)
+		}
+	})
+}
+
+func TestFileSystem_Symlinks(t *testing.T) {
+	tmpDir := t.TempDir()
+	outside := t.TempDir()
+	_ = os.WriteFile(filepath.Join(outside, "secret.txt"), []byte("Secret"), 0777)
+	_ = os.Mkdir(filepath.Join(tmpDir, "inside"), 0777)
+	_ = os.WriteFile(filepath.Join(tmpDir, "inside", "file.txt"), []byte("Inside"), 0777)
+	_ = os.Symlink(outside, filepath.Join(tmpDir, "escape"))
+	_ = os.Symlink(filepath.Join(outside, "secret.txt"), filepath.Join(tmpDir, "secret.txt"))
+	_ = os.Symlink("inside/file.txt", filepath.Join(tmpDir, "relative.txt"))
+	_ = os.Symlink(filepath.Join(tmpDir, "inside"), filepath.Join(tmpDir, "absolute"))
+	lib := model.Library{
+		RootFolder:    tmpDir,
+		SymlinkPolicy: model.SymlinkFollow,
+	}
+	fs := FileSystem{}
+
+	t.Run("it does not follow links out of the library", func(t *testing.T) {
+		if _, err := fs.OpenFile(lib, "/escape/secret.txt"); err != ErrOutsideLibrary {
+			t.Errorf("Expected ErrOutsideLibrary but got: %v", err)
+		}
+		if _, err := fs.OpenFile(lib, "/secret.txt"); err != ErrOutsideLibrary {
+			t.Errorf("Expected ErrOutsideLibrary but got: %v", err)
+		}
+		if _, err := fs.GetEntriesForLibrary(lib, "/escape"); err != ErrOutsideLibrary {
+			t.Errorf("Expected ErrOutsideLibrary but got: %v", err)
+		}
+	})
+
+	t.Run("it does not list links out of the library", func(t *testing.T) {
+		entries, err := fs.GetEntriesForLibrary(lib, "/")
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		for _, entry := range entries {
+			if entry.Name == "escape" || entry.Name == "secret.txt" {
+				t.Errorf("Expected %s to be hidden", entry.Name)
+			}
+		}
+		if len(entries) != 3 {
+			t.Errorf("Expected 3 entries but got: %v", entries)
+		}
+	})
+
+	t.Run("it does not write through links out of the library", func(t *testing.T) {
+		if _, err := fs.CreateFolderInLibrary(lib, "new", "/escape"); err != ErrOutsideLibrary {
+			t.Errorf("Expected ErrOutsideLibrary but got: %v", err)
+		}
+		if _, err := fs.MoveEntry(context.Background(), lib, "/inside/file.txt", lib, "/escape/file.txt", ConflictFail, nil); err != ErrOutsideLibrary {
+			t.Errorf("Expected ErrOutsideLibrary but got: %v", err)
+		}
+		staged, _ := fs.CreateStagingFile(lib, "staged")
+		if _, err := fs.CommitFileInLibrary(lib, staged, "/escape/staged.txt"); err != ErrOutsideLibrary {
+			t.Errorf("Expected ErrOutsideLibrary but got: %v", err)
+		}
+		if _, err := os.Stat(filepath.Join(outside, "new")); !os.IsNotExist(err) {
+			t.Errorf("Expected nothing to be created outside the library")
+		}
+	})
+
+	t.Run("it does not write through links that are swapped in after resolving", func(t *testing.T) {
+		if runtime.GOOS != "linux" {
+			t.Skip("only the kernel can check links while writing")
+		}
+		root, _ := filepath.EvalSymlinks(tmpDir)
+		if err := mkdirAllBeneath(root, filepath.Join(root, "escape", "new")); err == nil {
+			t.Errorf("Expected an error when creating a folder through a link")
+		}
+		staged, _ := fs.CreateStagingFile(lib, "swapped")
+		if err := renameBeneath(root, staged, root, filepath.Join(root, "escape", "staged.txt")); err != ErrOutsideLibrary {
+			t.Errorf("Expected ErrOutsideLibrary but got: %v", err)
+		}
+		if entries, _ := os.ReadDir(outside); len(entries) != 1 {
+			t.Errorf("Expected nothing to be created outside the library but found: %v", entries)
+		}
+	})
+
+	t.Run("it follows links inside the library", func(t *testing.T) {
+		for _, name := range []string{"/relative.txt", "/absolute/file.txt"} {
+			stream, err := fs.OpenFile(lib, name)
+			if err != nil {
+				t.Fatalf("Failed to open %s: %s", name, err)
+			}
+			data, _ := io.ReadAll(stream)
+			_ = stream.Close()
+			if string(data) != "Inside" {
+				t.Errorf("Expected [Inside] but got: %s", data)
+			}
+		}
+		entry, err := fs.GetEntryMetadata(lib, "/relative.txt")
+		if err != nil || entry.Name != "relative.txt" || entry.Size != 6 {
+			t.Errorf("Unexpected metadata %v: %v", entry, err)
+		}
+	})
+
+	t.Run("it only deletes the link", func(t *testing.T) {
+		if err := fs.DeleteEntryInLibrary(lib, "/escape"); err != nil {
+			t.Fatal(err.Error())
+		}
+		if _, err := os.Stat(filepath.Join(outside, "secret.txt")); err != nil {
+			t.Errorf("Expected the link target to still exist: %s", err)
+		}
+	})
+
+	t.Run("it hides links", func(t *testing.T) {
+		hidden := model.Library{RootFolder: tmpDir, SymlinkPolicy: model.SymlinkHide}
+		if _, err := fs.OpenFile(hidden, "/relative.txt"); !os.IsNotExist(err) {
+			t.Errorf("Expected the link to not exist, but got: %v", err)
+		}
+		entries, _ := fs.GetEntriesForLibrary(hidden, "/")
+		if len(entries) != 1 || entries[0].Name != "inside" {
+			t.Errorf("Expected only the inside folder but got: %v", entries)
+		}
+	})
+
+	t.Run("it rejects links", func(t *testing.T) {
+		rejecting := model.Library{RootFolder: tmpDir, SymlinkPolicy: model.SymlinkReject}
+		if _, err := fs.OpenFile(rejecting, "/relative.txt"); err != ErrSymlinkRejected {
+			t.Errorf("Expected ErrSymlinkRejected but got: %v", err)
+		}
+	})
+}
@@ -0,0 +1,541 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"io"
+	"keydrive/internal/model"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// maxIndexedContent is the number of bytes of text that is indexed for every document. Postgres does not accept
+// search vectors larger than 1MB.
+const maxIndexedContent = 256 * 1024
+
+const indexBatchSize = 500
+
+// maxPendingChanges bounds the queue of changes that were made through the FileSystem. Once it is full, further changes
+// are dropped and their libraries are scanned completely instead.
+const maxPendingChanges = 10_000
+
+type SearchQuery struct {
+	Query          string
+	Category       model.Category
+	MinSize        int64
+	MaxSize        int64
+	ModifiedAfter  time.Time
+	ModifiedBefore time.Time
+}
+
+// Index keeps a copy of the entries of all libraries in the database, so they can be searched. The index is brought up
+// to date by scanning a library.
+type Index struct {
+	DB         *gorm.DB
+	FileSystem *FileSystem
+	Libraries  *Library
+	Events     *Events
+	Changes    *Changes
+	// IndexContent extracts the text of documents, so it can be found using full-text search.
+	IndexContent bool
+	lock         sync.Mutex
+	pending      []indexChange
+	queued       map[indexChangeKey]bool
+	rescan       map[int]model.Library
+	wake         chan struct{}
+	// applying is held while queued changes are applied, so they are applied in order by one goroutine at a time.
+	applying sync.Mutex
+}
+
+// indexChange is a change that was made through the FileSystem and still has to be applied to the index. For moves,
+// oldPath is the path the entry was moved from.
+type indexChange struct {
+	library model.Library
+	oldPath string
+	path    string
+}
+
+type indexChangeKey struct {
+	libraryID int
+	oldPath   string
+	path      string
+}
+
+func (c indexChange) key() indexChangeKey {
+	return indexChangeKey{libraryID: c.library.ID, oldPath: c.oldPath, path: c.path}
+}
+
+// Search finds entries in all libraries the user can access. Names are matched on a substring, and the text of
+// documents is matched using full-text search.
+func (i *Index) Search(user model.User, query SearchQuery, tx *gorm.DB) *gorm.DB {
+	libraries := i.Libraries.GetLibrariesForUser(user, tx.Session(&gorm.Session{NewDB: true})).Select("libraries.id")
+	result := tx.Model(&model.IndexedEntry{}).Where("library_id IN (?)", libraries)
+	if query.Query != "" {
+		pattern := "%" + escapeLike(query.Query) + "%"
+		result = result.Where("name ILIKE ? OR search_vector @@ plainto_tsquery('simple', ?)", pattern, query.Query)
+	}
+	if query.Category != "" {
+		result = result.Where("category = ?", query.Category)
+	}
+	if query.MinSize > 0 {
+		result = result.Where("size >= ?", query.MinSize)
+	}
+	if query.MaxSize > 0 {
+		result = result.Where("size <= ?", query.MaxSize)
+	}
+	if !query.ModifiedAfter.IsZero() {
+		result = result.Where("modified >= ?", query.ModifiedAfter)
+	}
+	if !query.ModifiedBefore.IsZero() {
+		result = result.Where("modified < ?", query.ModifiedBefore)
+	}
+	return result
+}
+
+func escapeLike(value string) string {
+	return strings.NewReplacer("\\", "\\\\", "%", "\\%", "_", "\\_").Replace(value)
+}
+
+// ScanAllLibraries brings the index of every library up to date. Scanning stops when the context is cancelled.
+func (i *Index) ScanAllLibraries(ctx context.Context) (int, error) {
+	var libraries []model.Library
+	if result := i.DB.WithContext(ctx).Model(&model.Library{}).Find(&libraries); result.Error != nil {
+		return 0, result.Error
+	}
+	total := 0
+	for _, library := range libraries {
+		changed, err := i.ScanLibrary(ctx, library)
+		total += changed
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
+
+// ScanLibrary walks through a library and updates the index with every entry that was added, changed or removed since
+// the last scan. It returns the number of entries that changed.
+func (i *Index) ScanLibrary(ctx context.Context, library model.Library) (int, error) {
+	return i.ScanPath(ctx, library, "/")
+}
+
+// ScanPath updates the index for an entry in a library and everything inside it, and publishes an event for every
+// change that is found. Nothing is published when a library is indexed for the first time. It returns the number of
+// entries that changed. Scanning stops when the context is cancelled; the entries found until then stay in the index.
+func (i *Index) ScanPath(ctx context.Context, library model.Library, relPath string) (int, error) {
+	relPath = filepath.ToSlash(i.FileSystem.cleanRelativePath(relPath))
+	if i.FileSystem.isSystemPath(relPath) {
+		return 0, nil
+	}
+
+	var existing []model.IndexedEntry
+	query := i.DB.WithContext(ctx).Model(&model.IndexedEntry{}).
+		Select("id", "path", "size", "modified", "metadata_version").
+		Where("library_id = ?", library.ID)
+	if relPath != "/" {
+		query = query.Where("path = ? OR path LIKE ?", relPath, escapeLike(relPath)+"/%")
+	}
+	if result := query.Find(&existing); result.Error != nil {
+		return 0, result.Error
+	}
+	known := make(map[string]model.IndexedEntry, len(existing))
+	for _, entry := range existing {
+		known[entry.Path] = entry
+	}
+	publish := !(relPath == "/" && len(existing) == 0)
+
+	changed := 0
+	batch := make([]model.IndexedEntry, 0, indexBatchSize)
+	seen := make(map[string]bool, len(existing))
+	// Entries that are only scanned again for newer metadata did not change, so nothing is published for them.
+	rescanned := make(map[string]bool)
+	flush := func() error {
+		if err := i.saveEntries(batch); err != nil {
+			return err
+		}
+		for _, entry := range batch {
+			eventType := EventCreated
+			if _, ok := known[entry.Path]; ok {
+				eventType = EventUpdated
+			}
+			if publish && !rescanned[entry.Path] {
+				i.publish(Event{Type: eventType, LibraryID: library.ID, Path: entry.Path, Entry: entryInfo(entry)})
+			}
+		}
+		batch = batch[:0]
+		return nil
+	}
+
+	start, err := i.FileSystem.resolve(library, relPath, true)
+	if err == nil {
+		err = filepath.Walk(start, func(file string, info os.FileInfo, err error) error {
+			if err != nil {
+				if os.IsNotExist(err) || os.IsPermission(err) {
+					return nil
+				}
+				return err
+			}
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			relative, err := filepath.Rel(start, file)
+			if err != nil {
+				return err
+			}
+			entryPath := path.Join(relPath, filepath.ToSlash(relative))
+			if entryPath == "/" {
+				return nil
+			}
+			if i.FileSystem.isSystemPath(entryPath) {
+				return filepath.SkipDir
+			}
+			if info.Mode()&os.ModeSymlink != 0 {
+				// Links are indexed as the entry they point to, but not walked into, so they can not cause loops.
+				target, err := i.FileSystem.resolve(library, entryPath, true)
+				if err != nil {
+					return nil
+				}
+				if info, err = os.Stat(target); err != nil {
+					return nil
+				}
+			}
+
+			seen[entryPath] = true
+			modified := info.ModTime().Truncate(time.Microsecond)
+			if old, ok := known[entryPath]; ok && old.Size == info.Size() && old.Modified.Equal(modified) {
+				if old.MetadataVersion == metadataVersion {
+					return nil
+				}
+				rescanned[entryPath] = true
+			}
+
+			category, mimeType := i.FileSystem.DetectFileCategory(file, path.Base(entryPath), info, "")
+			entry := model.IndexedEntry{
+				LibraryID:       library.ID,
+				Path:            entryPath,
+				Parent:          path.Dir(entryPath),
+				Name:            path.Base(entryPath),
+				Category:        category,
+				MimeType:        mimeType,
+				Size:            info.Size(),
+				Modified:        modified,
+				MetadataVersion: metadataVersion,
+			}
+			if !info.IsDir() {
+				entry.Metadata = ExtractMetadata(library.Type, file, entryPath, category, mimeType)
+				if i.IndexContent {
+					entry.Content = extractText(file, mimeType)
+				}
+			}
+			batch = append(batch, entry)
+			if !rescanned[entryPath] {
+				changed++
+			}
+			if len(batch) == indexBatchSize {
+				return flush()
+			}
+			return nil
+		})
+	}
+	if err != nil && !os.IsNotExist(err) && err != ErrOutsideLibrary && err != ErrSymlinkRejected {
+		return changed, err
+	}
+	if err := flush(); err != nil {
+		return changed, err
+	}
+
+	var removed []int
+	for entryPath, entry := range known {
+		if seen[entryPath] {
+			continue
+		}
+		removed = append(removed, entry.ID)
+		// Only the top of a removed tree is published.
+		if _, parentKnown := known[path.Dir(entryPath)]; publish && (!parentKnown || seen[path.Dir(entryPath)]) {
+			i.publish(Event{Type: EventDeleted, LibraryID: library.ID, Path: entryPath})
+		}
+	}
+	for start := 0; start < len(removed); start += indexBatchSize {
+		end := start + indexBatchSize
+		if end > len(removed) {
+			end = len(removed)
+		}
+		if result := i.DB.Delete(&model.IndexedEntry{}, removed[start:end]); result.Error != nil {
+			return changed, result.Error
+		}
+	}
+	return changed + len(removed), nil
+}
+
+// MoveEntry updates the index after an entry was moved, and publishes a single event for the move. It returns false if
+// the entry was not in the index, in which case the new path should be scanned instead.
+func (i *Index) MoveEntry(library model.Library, oldPath string, newPath string) (bool, error) {
+	oldPath = filepath.ToSlash(i.FileSystem.cleanRelativePath(oldPath))
+	newPath = filepath.ToSlash(i.FileSystem.cleanRelativePath(newPath))
+	if oldPath == "/" || newPath == "/" || oldPath == newPath {
+		return false, nil
+	}
+
+	var entry model.IndexedEntry
+	err := i.DB.Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&model.IndexedEntry{}).
+			Where("library_id = ? AND path = ?", library.ID, oldPath).
+			Take(&entry)
+		if result.Error != nil {
+			return result.Error
+		}
+		result = tx.Where("library_id = ? AND (path = ? OR path LIKE ?)", library.ID, newPath, escapeLike(newPath)+"/%").
+			Delete(&model.IndexedEntry{})
+		if result.Error != nil {
+			return result.Error
+		}
+		result = tx.Model(&model.IndexedEntry{}).
+			Where("library_id = ? AND path LIKE ?", library.ID, escapeLike(oldPath)+"/%").
+			Updates(map[string]interface{}{
+				"path":   gorm.Expr("? || substr(path, ?)", newPath, utf8.RuneCountInString(oldPath)+1),
+				"parent": gorm.Expr("? || substr(parent, ?)", newPath, utf8.RuneCountInString(oldPath)+1),
+			})
+		if result.Error != nil {
+			return result.Error
+		}
+
+		entry.Path = newPath
+		entry.Parent = path.Dir(newPath)
+		entry.Name = path.Base(newPath)
+		entry.Category, entry.MimeType = GetFileCategory(entry.Name, "", entry.Category == model.CategoryFolder)
+		if target, err := i.FileSystem.resolve(library, newPath, true); err == nil {
+			if info, err := os.Stat(target); err == nil {
+				entry.Category, entry.MimeType = i.FileSystem.DetectFileCategory(target, entry.Name, info, "")
+				if !info.IsDir() {
+					// Movies and shows are described by their name, so their metadata changes with it.
+					entry.Metadata = ExtractMetadata(library.Type, target, newPath, entry.Category, entry.MimeType)
+				}
+			}
+		}
+		return tx.Model(&model.IndexedEntry{ID: entry.ID}).
+			Select("path", "parent", "name", "category", "mime_type", "metadata").
+			Updates(&entry).Error
+	})
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	i.publish(Event{Type: EventMoved, LibraryID: library.ID, Path: newPath, OldPath: oldPath, Entry: entryInfo(entry)})
+	return true, nil
+}
+
+// EntryChanged queues an update of the index after an entry was changed through the FileSystem, so the request that
+// changed it does not wait for the scan.
+func (i *Index) EntryChanged(library model.Library, path string) {
+	i.enqueue(indexChange{library: library, path: path})
+}
+
+// EntryMoved queues an update of the index after an entry was moved through the FileSystem.
+func (i *Index) EntryMoved(library model.Library, oldPath string, newPath string) {
+	i.enqueue(indexChange{library: library, oldPath: oldPath, path: newPath})
+}
+
+// Start applies the changes that were made through the FileSystem to the index in the background, one at a time and
+// in the order they were made, until the context is cancelled.
+func (i *Index) Start(ctx context.Context) {
+	i.lock.Lock()
+	i.wake = make(chan struct{}, 1)
+	// Changes that were made before starting are applied right away.
+	i.wake <- struct{}{}
+	i.lock.Unlock()
+
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-i.wake:
+			}
+			i.Flush(ctx)
+		}
+	}()
+}
+
+// Flush applies all queued changes in the calling goroutine, for callers that read the index right after writing
+// through the FileSystem.
+func (i *Index) Flush(ctx context.Context) {
+	i.applying.Lock()
+	defer i.applying.Unlock()
+	for ctx.Err() == nil {
+		change, ok := i.dequeue()
+		if !ok {
+			return
+		}
+		i.apply(ctx, change)
+	}
+}
+
+// enqueue adds a change to the queue, unless the same change is already waiting to be applied.
+func (i *Index) enqueue(change indexChange) {
+	i.lock.Lock()
+	if i.queued == nil {
+		i.queued = map[indexChangeKey]bool{}
+		i.rescan = map[int]model.Library{}
+	}
+	if len(i.pending) >= maxPendingChanges {
+		i.rescan[change.library.ID] = change.library
+	} else if !i.queued[change.key()] {
+		i.queued[change.key()] = true
+		i.pending = append(i.pending, change)
+	}
+	wake := i.wake
+	i.lock.Unlock()
+	if wake != nil {
+		select {
+		case wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (i *Index) dequeue() (indexChange, bool) {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	if len(i.pending) == 0 {
+		for id, library := range i.rescan {
+			delete(i.rescan, id)
+			return indexChange{library: library, path: "/"}, true
+		}
+		return indexChange{}, false
+	}
+	change := i.pending[0]
+	i.pending = i.pending[1:]
+	delete(i.queued, change.key())
+	return change, true
+}
+
+func (i *Index) apply(ctx context.Context, change indexChange) {
+	library := change.library
+	if change.oldPath != "" {
+		if _, err := i.MoveEntry(library, change.oldPath, change.path); err != nil {
+			log.Error("failed to move %s to %s in the index of library %d: %s", change.oldPath, change.path, library.ID, err)
+		}
+	}
+	if _, err := i.ScanPath(ctx, library, change.path); err != nil && ctx.Err() == nil {
+		log.Error("failed to update index for %s in library %d: %s", change.path, library.ID, err)
+	}
+}
+
+// publish adds a change to the journal of the library and sends it to subscribers. The journal comes first, so
+// subscribers that fetch the changes after an event always find it.
+func (i *Index) publish(event Event) {
+	event.Time = time.Now()
+	if i.Changes != nil {
+		if err := i.Changes.Record(event); err != nil {
+			log.Error("failed to record change to %s in library %d: %s", event.Path, event.LibraryID, err)
+		}
+	}
+	if i.Events != nil {
+		i.Events.Publish(event)
+	}
+}
+
+func entryInfo(entry model.IndexedEntry) *FileInfo {
+	return &FileInfo{
+		Name:     entry.Name,
+		Modified: entry.Modified,
+		Parent:   entry.Parent,
+		Category: entry.Category,
+		MimeType: entry.MimeType,
+		Size:     entry.Size,
+		Metadata: entry.Metadata,
+	}
+}
+
+// AddMetadata adds the metadata and the detected type from the index to entries of a library. The type is only taken
+// if the file did not change since it was indexed. The entries are looked up in batches, so large folders stay below
+// the limit of parameters of a query.
+func (i *Index) AddMetadata(library model.Library, entries []FileInfo) error {
+	paths := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		if entry.Category != model.CategoryFolder {
+			paths = append(paths, path.Join(entry.Parent, entry.Name))
+		}
+	}
+	if len(paths) == 0 {
+		return nil
+	}
+	indexedEntries := make(map[string]model.IndexedEntry, len(paths))
+	for start := 0; start < len(paths); start += indexBatchSize {
+		end := start + indexBatchSize
+		if end > len(paths) {
+			end = len(paths)
+		}
+		var indexed []model.IndexedEntry
+		result := i.DB.Model(&model.IndexedEntry{}).
+			Select("path", "metadata", "category", "mime_type", "size", "modified").
+			Where("library_id = ? AND path IN ?", library.ID, paths[start:end]).
+			Find(&indexed)
+		if result.Error != nil {
+			return result.Error
+		}
+		for _, entry := range indexed {
+			indexedEntries[entry.Path] = entry
+		}
+	}
+	for index, entry := range entries {
+		indexed, ok := indexedEntries[path.Join(entry.Parent, entry.Name)]
+		if !ok {
+			continue
+		}
+		entries[index].Metadata = indexed.Metadata
+		if indexed.Size == entry.Size && indexed.Modified.Equal(entry.Modified.Truncate(time.Microsecond)) {
+			entries[index].Category = indexed.Category
+			entries[index].MimeType = indexed.MimeType
+		}
+	}
+	return nil
+}
+
+func (i *Index) saveEntries(entries []model.IndexedEntry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	return i.DB.Omit("Library").Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "library_id"}, {Name: "path"}},
+		DoUpdates: clause.AssignmentColumns([]string{"parent", "name", "category", "mime_type", "size", "modified", "metadata", "metadata_version", "content"}),
+	}).Create(&entries).Error
+}
+
+// extractText returns the text in a document, or nothing if the document is not plain text.
+func extractText(file string, mimeType string) string {
+	if !isTextMimeType(mimeType) {
+		return ""
+	}
+	reader, err := os.Open(file)
+	if err != nil {
+		return ""
+	}
+	defer reader.Close()
+	data, err := io.ReadAll(io.LimitReader(reader, maxIndexedContent))
+	if err != nil {
+		return ""
+	}
+	// Postgres does not allow null bytes or invalid utf-8 in text.
+	return strings.ToValidUTF8(strings.ReplaceAll(string(data), "\x00", ""), "")
+}
+
+func isTextMimeType(mimeType string) bool {
+	if strings.HasPrefix(mimeType, "text/") {
+		return true
+	}
+	switch mimeType {
+	case "application/json", "application/xml", "application/javascript", "application/x-sh", "application/x-latex":
+		return true
+	}
+	return false
+}
@@ -0,0 +1,40 @@
+package service
+
+import (
+	"fmt"
+	"keydrive/internal/model"
+	"testing"
+)
+
+func TestIndex_Queue(t *testing.T) {
+	lib := model.Library{ID: 1, RootFolder: t.TempDir()}
+
+	t.Run("it queues the same change once", func(t *testing.T) {
+		index := &Index{}
+		index.EntryChanged(lib, "/a.txt")
+		index.EntryChanged(lib, "/a.txt")
+		index.EntryMoved(lib, "/a.txt", "/b.txt")
+		if len(index.pending) != 2 {
+			t.Errorf("Expected 2 pending changes but got: %v", index.pending)
+		}
+	})
+
+	t.Run("it rescans the library when the queue is full", func(t *testing.T) {
+		index := &Index{}
+		for i := 0; i < maxPendingChanges+10; i++ {
+			index.EntryChanged(lib, fmt.Sprintf("/file %d.txt", i))
+		}
+		if len(index.pending) != maxPendingChanges {
+			t.Errorf("Expected %d pending changes but got: %d", maxPendingChanges, len(index.pending))
+		}
+		var last indexChange
+		count := 0
+		for change, ok := index.dequeue(); ok; change, ok = index.dequeue() {
+			last = change
+			count++
+		}
+		if count != maxPendingChanges+1 || last.path != "/" || last.library.ID != lib.ID {
+			t.Errorf("Expected a rescan of the library after %d changes but got %d changes ending in: %v", maxPendingChanges, count, last)
+		}
+	})
+}
@@ -0,0 +1,115 @@
+package service
+
+import (
+	"context"
+	"gorm.io/gorm"
+	"keydrive/internal/model"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// staleTransferAge is the age after which a staging folder of a copy is considered left over from an interrupted
+// transfer.
+const staleTransferAge = 24 * time.Hour
+
+// IntegrityReport counts the problems that an integrity check found and repaired.
+type IntegrityReport struct {
+	// UnreachableLibraries are libraries whose root folder can not be read. They are skipped, so their records are
+	// not removed while a disk is unmounted.
+	UnreachableLibraries int
+	MissingTrashItems    int
+	MissingVersions      int
+	StaleTransfers       int
+}
+
+// Integrity finds records that no longer match the system folders of the libraries, like trash items whose files were
+// removed by hand, and cleans up what interrupted operations left behind.
+type Integrity struct {
+	DB         *gorm.DB
+	FileSystem *FileSystem
+	Trash      *Trash
+	Versions   *Versions
+}
+
+// Check checks all libraries and repairs what it can.
+func (i *Integrity) Check(ctx context.Context) (IntegrityReport, error) {
+	var report IntegrityReport
+	var libraries []model.Library
+	if err := i.DB.Find(&libraries).Error; err != nil {
+		return report, err
+	}
+	for _, library := range libraries {
+		if err := ctx.Err(); err != nil {
+			return report, err
+		}
+		if _, err := os.ReadDir(library.RootFolder); err != nil {
+			log.Warn("library %d is not reachable: %s", library.ID, err)
+			report.UnreachableLibraries++
+			continue
+		}
+		if err := i.checkLibrary(ctx, library, &report); err != nil {
+			return report, err
+		}
+	}
+	return report, nil
+}
+
+func (i *Integrity) checkLibrary(ctx context.Context, library model.Library, report *IntegrityReport) error {
+	var items []model.TrashItem
+	if err := i.Trash.GetTrashForLibrary(library, i.DB).Find(&items).Error; err != nil {
+		return err
+	}
+	for _, item := range items {
+		file, err := i.Trash.trashFile(library, item)
+		if err != nil {
+			return err
+		}
+		if _, err := os.Lstat(file); os.IsNotExist(err) {
+			if err := i.DB.Delete(&model.TrashItem{}, item.ID).Error; err != nil {
+				return err
+			}
+			report.MissingTrashItems++
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	var versions []model.FileVersion
+	if err := i.DB.Where("library_id = ?", library.ID).Find(&versions).Error; err != nil {
+		return err
+	}
+	for _, version := range versions {
+		file, err := i.Versions.versionFile(library, version)
+		if err != nil {
+			return err
+		}
+		if _, err := os.Lstat(file); os.IsNotExist(err) {
+			if err := i.DB.Delete(&model.FileVersion{}, version.ID).Error; err != nil {
+				return err
+			}
+			report.MissingVersions++
+		}
+	}
+
+	folder, err := i.FileSystem.systemFolder(library, "transfers")
+	if err != nil {
+		return err
+	}
+	staged, err := os.ReadDir(folder)
+	if err != nil {
+		return err
+	}
+	for _, entry := range staged {
+		info, err := entry.Info()
+		if err != nil || time.Since(info.ModTime()) < staleTransferAge {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(folder, entry.Name())); err != nil {
+			return err
+		}
+		report.StaleTransfers++
+	}
+	return nil
+}
@@ -0,0 +1,463 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"keydrive/internal/model"
+	"sync"
+	"time"
+)
+
+var ErrJobFinished = errors.New("this job has already finished")
+var ErrJobActive = errors.New("a job of this type is already queued or running")
+
+// jobProgressInterval is how often the progress of a running job is saved.
+const jobProgressInterval = time.Second
+
+// jobHeartbeat is how often a running job is touched in the database, so other instances can tell that it is still
+// running, and it notices when it was cancelled.
+const jobHeartbeat = 10 * time.Second
+
+// jobStaleAfter is the time after which a running job that was not touched is considered interrupted, because the
+// instance that ran it is gone. It is queued again.
+const jobStaleAfter = 3 * jobHeartbeat
+
+// jobPollInterval is how often idle workers look for jobs that were queued by other instances.
+const jobPollInterval = 5 * time.Second
+
+// JobFunc carries out a job. It should stop when the context is cancelled. Jobs that were interrupted by a restart run
+// again, so a JobFunc should be able to pick up where it left off, for example using the saved result.
+type JobFunc func(ctx context.Context, job *RunningJob) (result interface{}, err error)
+
+// RunningJob is a job that is being carried out by a worker.
+type RunningJob struct {
+	model.Job
+
+	jobs      *Jobs
+	cancel    context.CancelFunc
+	lock      sync.Mutex
+	lastSaved time.Time
+}
+
+// DecodeParams reads the parameters the job was queued with.
+func (r *RunningJob) DecodeParams(params interface{}) error {
+	return json.Unmarshal(r.Params, params)
+}
+
+// DecodeResult reads the result that was saved before, and reports false if there is none.
+func (r *RunningJob) DecodeResult(result interface{}) (bool, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if len(r.Result) == 0 {
+		return false, nil
+	}
+	return true, json.Unmarshal(r.Result, result)
+}
+
+// Progress updates how much of the job is done. It is saved at most once per jobProgressInterval.
+func (r *RunningJob) Progress(done int64, total int64) {
+	r.lock.Lock()
+	r.Done = done
+	r.Total = total
+	r.lock.Unlock()
+	r.save(false)
+}
+
+// SaveResult saves a partial result together with the progress, so the job can continue from there if it is
+// interrupted.
+func (r *RunningJob) SaveResult(done int64, total int64, result interface{}) error {
+	data, err := json.Marshal(result)
+	if err != nil {
+		return err
+	}
+	r.lock.Lock()
+	r.Done = done
+	r.Total = total
+	r.Result = data
+	r.lock.Unlock()
+	r.save(false)
+	return nil
+}
+
+// save writes the progress to the database and checks if the job was cancelled in the meantime.
+func (r *RunningJob) save(force bool) {
+	r.lock.Lock()
+	if !force && time.Since(r.lastSaved) < jobProgressInterval {
+		r.lock.Unlock()
+		return
+	}
+	r.lastSaved = time.Now()
+	updates := map[string]interface{}{"done": r.Done, "total": r.Total, "result": r.Result, "updated_at": time.Now()}
+	r.lock.Unlock()
+
+	var cancelRequested bool
+	err := r.jobs.DB.Transaction(func(tx *gorm.DB) error {
+		if result := tx.Model(&model.Job{}).Where("id = ?", r.ID).Updates(updates); result.Error != nil {
+			return result.Error
+		}
+		return tx.Model(&model.Job{}).Where("id = ?", r.ID).Pluck("cancel_requested", &cancelRequested).Error
+	})
+	if err != nil {
+		log.Error("failed to save progress of job %d: %s", r.ID, err)
+		return
+	}
+	if cancelRequested {
+		r.cancel()
+	}
+}
+
+// Jobs runs background jobs with a pool of workers. Workers on all instances take jobs from the same table, and every
+// job is only run by one of them.
+type Jobs struct {
+	DB      *gorm.DB
+	Workers int
+
+	lock     sync.Mutex
+	handlers map[string]JobFunc
+	running  map[int]*RunningJob
+	wake     chan struct{}
+	stop     chan struct{}
+	stopping bool
+	workers  sync.WaitGroup
+}
+
+// Register sets the function that carries out jobs of a type. Workers only take jobs of registered types.
+func (j *Jobs) Register(jobType string, handler JobFunc) {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	if j.handlers == nil {
+		j.handlers = map[string]JobFunc{}
+	}
+	j.handlers[jobType] = handler
+}
+
+// Enqueue adds a job to the queue. The owner and the library are optional.
+func (j *Jobs) Enqueue(jobType string, owner *model.User, library *model.Library, params interface{}) (model.Job, error) {
+	return j.enqueue(j.DB, jobType, owner, library, params)
+}
+
+// EnqueueUnique adds a job to the queue, unless a job of the same type for the same library is already queued or
+// running. In that case it fails with ErrJobActive.
+func (j *Jobs) EnqueueUnique(jobType string, owner *model.User, library *model.Library, params interface{}) (model.Job, error) {
+	var job model.Job
+	err := j.DB.Transaction(func(tx *gorm.DB) error {
+		// The lock makes sure that two instances do not both find no active job and queue one each.
+		if result := tx.Exec("SELECT pg_advisory_xact_lock(hashtext(?))", jobType); result.Error != nil {
+			return result.Error
+		}
+		query := tx.Model(&model.Job{}).Where("type = ? AND status IN ?", jobType, []model.JobStatus{model.JobQueued, model.JobRunning})
+		if library != nil {
+			query = query.Where("library_id = ?", library.ID)
+		} else {
+			query = query.Where("library_id IS NULL")
+		}
+		var active int64
+		if result := query.Count(&active); result.Error != nil {
+			return result.Error
+		}
+		if active > 0 {
+			return ErrJobActive
+		}
+		var err error
+		job, err = j.enqueue(tx, jobType, owner, library, params)
+		return err
+	})
+	return job, err
+}
+
+func (j *Jobs) enqueue(tx *gorm.DB, jobType string, owner *model.User, library *model.Library, params interface{}) (model.Job, error) {
+	data, err := json.Marshal(params)
+	if err != nil {
+		return model.Job{}, err
+	}
+	job := model.Job{
+		Type:   jobType,
+		Status: model.JobQueued,
+		Params: data,
+	}
+	if owner != nil {
+		job.OwnerID = &owner.ID
+	}
+	if library != nil {
+		job.LibraryID = &library.ID
+	}
+	if result := tx.Omit("Owner", "Library").Create(&job); result.Error != nil {
+		return model.Job{}, result.Error
+	}
+	j.notify()
+	return job, nil
+}
+
+// notify wakes up an idle worker, if there is one.
+func (j *Jobs) notify() {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	select {
+	case j.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Get returns a job with its current progress.
+func (j *Jobs) Get(id int) (model.Job, error) {
+	var job model.Job
+	err := j.DB.Take(&job, id).Error
+	return job, err
+}
+
+// Cancel stops a job. Queued jobs are cancelled right away, and running jobs as soon as they notice it.
+func (j *Jobs) Cancel(id int) (model.Job, error) {
+	now := time.Now()
+	result := j.DB.Model(&model.Job{}).
+		Where("id = ? AND status = ?", id, model.JobQueued).
+		Updates(map[string]interface{}{"status": model.JobCancelled, "cancel_requested": true, "finished_at": now})
+	if result.Error != nil {
+		return model.Job{}, result.Error
+	}
+	if result.RowsAffected == 0 {
+		result = j.DB.Model(&model.Job{}).
+			Where("id = ? AND status = ?", id, model.JobRunning).
+			Update("cancel_requested", true)
+		if result.Error != nil {
+			return model.Job{}, result.Error
+		}
+		if result.RowsAffected == 0 {
+			job, err := j.Get(id)
+			if err == nil {
+				err = ErrJobFinished
+			}
+			return job, err
+		}
+		j.lock.Lock()
+		if running, ok := j.running[id]; ok {
+			running.cancel()
+		}
+		j.lock.Unlock()
+	}
+	return j.Get(id)
+}
+
+// Start recovers jobs that were interrupted and starts the workers. Jobs of instances that stop without a chance to
+// queue their jobs again are recovered once they are stale.
+func (j *Jobs) Start() {
+	j.lock.Lock()
+	workers := j.Workers
+	if workers < 1 {
+		workers = 1
+	}
+	j.running = map[int]*RunningJob{}
+	j.wake = make(chan struct{}, workers)
+	j.stop = make(chan struct{})
+	j.lock.Unlock()
+
+	if _, err := j.RecoverStale(); err != nil {
+		log.Error("failed to recover interrupted jobs: %s", err)
+	}
+	j.workers.Add(workers + 1)
+	for i := 0; i < workers; i++ {
+		go j.work()
+	}
+	go func() {
+		defer j.workers.Done()
+		ticker := time.NewTicker(jobHeartbeat)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-j.stop:
+				return
+			case <-ticker.C:
+				if _, err := j.RecoverStale(); err != nil {
+					log.Error("failed to recover interrupted jobs: %s", err)
+				}
+			}
+		}
+	}()
+}
+
+// Stop interrupts all running jobs and waits for the workers to finish. The jobs are queued again, so they continue
+// after the next start.
+func (j *Jobs) Stop() {
+	j.lock.Lock()
+	if j.stop == nil || j.stopping {
+		j.lock.Unlock()
+		return
+	}
+	j.stopping = true
+	close(j.stop)
+	for _, running := range j.running {
+		running.cancel()
+	}
+	j.lock.Unlock()
+	j.workers.Wait()
+}
+
+// PurgeFinished deletes jobs that finished longer than maxAge ago and returns how many there were.
+func (j *Jobs) PurgeFinished(maxAge time.Duration) (int64, error) {
+	result := j.DB.Where("finished_at < ?", time.Now().Add(-maxAge)).Delete(&model.Job{})
+	return result.RowsAffected, result.Error
+}
+
+// RecoverStale queues running jobs again if they were not touched for a while, because the instance that ran them was
+// stopped or crashed. It returns the number of recovered jobs.
+func (j *Jobs) RecoverStale() (int64, error) {
+	result := j.DB.Model(&model.Job{}).
+		Where("status = ? AND updated_at < ?", model.JobRunning, time.Now().Add(-jobStaleAfter)).
+		Updates(map[string]interface{}{"status": model.JobQueued, "started_at": nil, "updated_at": time.Now()})
+	if result.RowsAffected > 0 {
+		log.Info("queued %d interrupted jobs again", result.RowsAffected)
+		j.notify()
+	}
+	return result.RowsAffected, result.Error
+}
+
+func (j *Jobs) work() {
+	defer j.workers.Done()
+	poll := time.NewTicker(jobPollInterval)
+	defer poll.Stop()
+	for {
+		select {
+		case <-j.stop:
+			return
+		default:
+		}
+		job, err := j.claim()
+		if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+			log.Error("failed to take a job from the queue: %s", err)
+		}
+		if err == nil {
+			j.run(job)
+			continue
+		}
+		select {
+		case <-j.stop:
+			return
+		case <-j.wake:
+		case <-poll.C:
+		}
+	}
+}
+
+// claim takes the oldest queued job of a known type. Rows that are locked by other instances are skipped, so every job
+// is claimed only once.
+func (j *Jobs) claim() (model.Job, error) {
+	j.lock.Lock()
+	types := make([]string, 0, len(j.handlers))
+	for jobType := range j.handlers {
+		types = append(types, jobType)
+	}
+	j.lock.Unlock()
+	if len(types) == 0 {
+		return model.Job{}, gorm.ErrRecordNotFound
+	}
+
+	var job model.Job
+	err := j.DB.Transaction(func(tx *gorm.DB) error {
+		result := tx.Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"}).
+			Where("status = ? AND type IN ?", model.JobQueued, types).
+			Order("id").
+			Take(&job)
+		if result.Error != nil {
+			return result.Error
+		}
+		now := time.Now()
+		job.Status = model.JobRunning
+		job.StartedAt = &now
+		job.UpdatedAt = now
+		return tx.Model(&model.Job{ID: job.ID}).Select("status", "started_at", "updated_at").Updates(&job).Error
+	})
+	if err != nil {
+		return job, err
+	}
+	return job, j.DB.Preload("Owner").Preload("Library").Take(&job, job.ID).Error
+}
+
+func (j *Jobs) run(job model.Job) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	running := &RunningJob{Job: job, jobs: j, cancel: cancel, lastSaved: time.Now()}
+	j.lock.Lock()
+	handler := j.handlers[job.Type]
+	j.running[job.ID] = running
+	j.lock.Unlock()
+	defer func() {
+		j.lock.Lock()
+		delete(j.running, job.ID)
+		j.lock.Unlock()
+	}()
+	if job.CancelRequested {
+		cancel()
+	}
+
+	heartbeatDone := make(chan struct{})
+	go func() {
+		heartbeat := time.NewTicker(jobHeartbeat)
+		defer heartbeat.Stop()
+		for {
+			select {
+			case <-heartbeatDone:
+				return
+			case <-heartbeat.C:
+				running.save(true)
+			}
+		}
+	}()
+
+	result, err := j.runHandler(ctx, handler, running)
+	close(heartbeatDone)
+	// A job that ignored the cancellation and finished anyway did its work, so it is not counted as cancelled.
+	j.finish(running, result, err, err != nil && ctx.Err() != nil)
+}
+
+// runHandler calls the handler of a job, turning panics into errors so a broken job does not take the worker down.
+func (j *Jobs) runHandler(ctx context.Context, handler JobFunc, job *RunningJob) (result interface{}, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("job panicked: %v", r)
+		}
+	}()
+	return handler(ctx, job)
+}
+
+// finish saves the outcome of a job. Jobs that were interrupted because the instance is stopping are queued again.
+func (j *Jobs) finish(job *RunningJob, result interface{}, err error, interrupted bool) {
+	j.lock.Lock()
+	stopping := j.stopping
+	j.lock.Unlock()
+
+	now := time.Now()
+	job.lock.Lock()
+	updates := map[string]interface{}{"done": job.Done, "total": job.Total, "result": job.Result, "updated_at": now}
+	job.lock.Unlock()
+	switch {
+	case interrupted && stopping:
+		updates["status"] = model.JobQueued
+		updates["started_at"] = nil
+	case interrupted:
+		updates["status"] = model.JobCancelled
+		updates["finished_at"] = now
+	case err != nil:
+		log.Error("job %d of type %s failed: %s", job.ID, job.Type, err)
+		updates["status"] = model.JobFailed
+		updates["error"] = err.Error()
+		updates["finished_at"] = now
+	default:
+		updates["status"] = model.JobSucceeded
+		updates["finished_at"] = now
+		if result != nil {
+			data, err := json.Marshal(result)
+			if err != nil {
+				updates["status"] = model.JobFailed
+				updates["error"] = err.Error()
+			} else {
+				updates["result"] = model.JobData(data)
+			}
+		}
+	}
+	if result := j.DB.Model(&model.Job{}).Where("id = ?", job.ID).Updates(updates); result.Error != nil {
+		log.Error("failed to save the outcome of job %d: %s", job.ID, result.Error)
+	}
+}
@@ -0,0 +1,105 @@
+package service
+
+import (
+	"errors"
+	"keydrive/internal/model"
+	"net/http"
+	"os"
+	"path"
+)
+
+// metadataVersion is increased whenever the metadata scanners change, so all entries are scanned again.
+const metadataVersion = 3
+
+var ErrNoCover = errors.New("this file has no cover")
+
+// Cover is an image that is embedded in a file.
+type Cover struct {
+	Data     []byte
+	MimeType string
+}
+
+// ExtractMetadata reads the metadata of a file. The type of the library decides what is read: tags for music, the
+// package metadata for books and the file name for movies and shows. Photos are read in every library. It returns nil
+// if nothing was found.
+func ExtractMetadata(libraryType model.LibraryType, file string, entryPath string, category model.Category, mimeType string) *model.Metadata {
+	var metadata model.Metadata
+	var err error
+	switch {
+	case category == model.CategoryImage:
+		metadata, err = readPhotoMetadata(file)
+	case libraryType == model.TypeMusic && category == model.CategoryAudio:
+		metadata, _, err = readAudioTags(file, false)
+	case libraryType == model.TypeBooks && mimeType == "application/epub+zip":
+		metadata, _, err = readEpubMetadata(file, false)
+	case libraryType == model.TypeShows && category == model.CategoryVideo:
+		metadata = parseEpisodeName(entryPath)
+	case libraryType == model.TypeMovies && category == model.CategoryVideo:
+		metadata = parseMovieName(path.Base(entryPath))
+	}
+	if err != nil {
+		log.Debug("failed to read metadata of %s: %s", file, err)
+		return nil
+	}
+	if isEmptyMetadata(metadata) {
+		return nil
+	}
+	return &metadata
+}
+
+func isEmptyMetadata(metadata model.Metadata) bool {
+	return metadata.Title == "" && metadata.Artist == "" && metadata.Album == "" && metadata.AlbumArtist == "" &&
+		metadata.Genre == "" && metadata.Track == 0 && metadata.Disc == 0 && metadata.Year == 0 &&
+		len(metadata.Authors) == 0 && metadata.Publisher == "" && metadata.Language == "" &&
+		metadata.Description == "" && metadata.Identifier == "" && metadata.Series == "" && metadata.Show == "" && metadata.Season == 0 &&
+		metadata.Episode == 0 && metadata.CameraMake == "" && metadata.CameraModel == "" && metadata.TakenAt == nil &&
+		metadata.Latitude == nil && metadata.Longitude == nil && metadata.Width == 0 && metadata.Height == 0 &&
+		!metadata.HasCover
+}
+
+// ReadCover returns the cover image embedded in a book or an audio file.
+func (fs *FileSystem) ReadCover(library model.Library, entryPath string) (Cover, error) {
+	entryPath = fs.cleanRelativePath(entryPath)
+	if entryPath == "/" || fs.isSystemPath(entryPath) {
+		return Cover{}, os.ErrNotExist
+	}
+	file, err := fs.resolve(library, entryPath, true)
+	if err != nil {
+		return Cover{}, err
+	}
+	info, err := os.Stat(file)
+	if err != nil {
+		return Cover{}, err
+	}
+	category, mimeType := fs.DetectFileCategory(file, path.Base(entryPath), info, "")
+
+	var cover *Cover
+	switch {
+	case category == model.CategoryAudio:
+		_, cover, err = readAudioTags(file, true)
+	case mimeType == "application/epub+zip":
+		_, cover, err = readEpubMetadata(file, true)
+	}
+	if err != nil {
+		return Cover{}, err
+	}
+	if cover == nil || len(cover.Data) == 0 {
+		return Cover{}, ErrNoCover
+	}
+	// The type is taken from the file, so it is checked before it is sent to a browser.
+	cover.MimeType = http.DetectContentType(cover.Data)
+	if !IsSafeImageType(cover.MimeType) {
+		return Cover{}, ErrNoCover
+	}
+	return *cover, nil
+}
+
+// IsSafeImageType tells if images of a type can be shown in a browser safely. Only formats that can not contain
+// scripts are safe, so SVG images are not.
+func IsSafeImageType(mimeType string) bool {
+	switch mimeType {
+	case "image/jpeg", "image/png", "image/gif", "image/webp", "image/bmp":
+		return true
+	}
+	return false
+}
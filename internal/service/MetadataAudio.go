@@ -0,0 +1,488 @@
+package service
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"keydrive/internal/model"
+	"os"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+)
+
+// maxTagSize is the largest tag that is read. Tags are mostly small, unless they contain pictures.
+const maxTagSize = 16 * 1024 * 1024
+
+var errInvalidTag = errors.New("invalid tag")
+
+// readAudioTags reads the ID3 tags of MP3 files and the Vorbis comments of FLAC, Ogg Vorbis and Opus files. The
+// embedded cover is only read if it was asked for.
+func readAudioTags(file string, withCover bool) (model.Metadata, *Cover, error) {
+	input, err := os.Open(file)
+	if err != nil {
+		return model.Metadata{}, nil, err
+	}
+	defer input.Close()
+
+	magic := make([]byte, 4)
+	if _, err := io.ReadFull(input, magic); err != nil {
+		return model.Metadata{}, nil, nil
+	}
+	switch {
+	case bytes.HasPrefix(magic, []byte("ID3")):
+		return readID3v2(input, withCover)
+	case bytes.Equal(magic, []byte("fLaC")):
+		return readFlacTags(input, withCover)
+	case bytes.Equal(magic, []byte("OggS")):
+		return readOggTags(input, withCover)
+	}
+	metadata, err := readID3v1(input)
+	return metadata, nil, err
+}
+
+// readID3v2 reads an ID3v2.2, v2.3 or v2.4 tag from the start of a file.
+func readID3v2(input io.ReadSeeker, withCover bool) (model.Metadata, *Cover, error) {
+	var metadata model.Metadata
+	header := make([]byte, 10)
+	if _, err := input.Seek(0, io.SeekStart); err != nil {
+		return metadata, nil, err
+	}
+	if _, err := io.ReadFull(input, header); err != nil {
+		return metadata, nil, err
+	}
+	version := header[3]
+	flags := header[5]
+	size := syncsafe(header[6:10])
+	if version < 2 || version > 4 || size > maxTagSize {
+		return metadata, nil, errInvalidTag
+	}
+	tag := make([]byte, size)
+	if _, err := io.ReadFull(input, tag); err != nil {
+		return metadata, nil, err
+	}
+	if flags&0x80 != 0 && version < 4 {
+		// Unsynchronisation inserts a zero after every 0xff byte, so it can not be mistaken for an mpeg frame.
+		tag = bytes.ReplaceAll(tag, []byte{0xff, 0x00}, []byte{0xff})
+	}
+	if flags&0x40 != 0 && version > 2 {
+		// The extended header is skipped.
+		if len(tag) < 4 {
+			return metadata, nil, errInvalidTag
+		}
+		extended := int(binary.BigEndian.Uint32(tag))
+		if version == 3 {
+			extended += 4
+		} else {
+			extended = syncsafe(tag[:4])
+		}
+		if extended > len(tag) {
+			return metadata, nil, errInvalidTag
+		}
+		tag = tag[extended:]
+	}
+
+	idSize, headerSize := 4, 10
+	if version == 2 {
+		idSize, headerSize = 3, 6
+	}
+	var cover *Cover
+	for len(tag) >= headerSize && tag[0] != 0 {
+		id := string(tag[:idSize])
+		var frameSize int
+		switch version {
+		case 2:
+			frameSize = int(tag[3])<<16 | int(tag[4])<<8 | int(tag[5])
+		case 3:
+			frameSize = int(binary.BigEndian.Uint32(tag[4:8]))
+		default:
+			frameSize = syncsafe(tag[4:8])
+		}
+		if frameSize < 0 || headerSize+frameSize > len(tag) {
+			break
+		}
+		frame := tag[headerSize : headerSize+frameSize]
+		tag = tag[headerSize+frameSize:]
+
+		switch id {
+		case "TIT2", "TT2":
+			metadata.Title = decodeID3Text(frame)
+		case "TPE1", "TP1":
+			metadata.Artist = decodeID3Text(frame)
+		case "TALB", "TAL":
+			metadata.Album = decodeID3Text(frame)
+		case "TPE2", "TP2":
+			metadata.AlbumArtist = decodeID3Text(frame)
+		case "TCON", "TCO":
+			metadata.Genre = cleanGenre(decodeID3Text(frame))
+		case "TRCK", "TRK":
+			metadata.Track = leadingNumber(decodeID3Text(frame))
+		case "TPOS", "TPA":
+			metadata.Disc = leadingNumber(decodeID3Text(frame))
+		case "TYER", "TYE", "TDRC":
+			metadata.Year = leadingNumber(decodeID3Text(frame))
+		case "APIC", "PIC":
+			metadata.HasCover = true
+			if withCover && cover == nil {
+				cover = decodeID3Picture(frame, version == 2)
+			}
+		}
+	}
+	return metadata, cover, nil
+}
+
+// readID3v1 reads the fixed size ID3v1 tag at the end of a file.
+func readID3v1(input io.ReadSeeker) (model.Metadata, error) {
+	var metadata model.Metadata
+	if _, err := input.Seek(-128, io.SeekEnd); err != nil {
+		return metadata, nil
+	}
+	tag := make([]byte, 128)
+	if _, err := io.ReadFull(input, tag); err != nil || !bytes.HasPrefix(tag, []byte("TAG")) {
+		return metadata, nil
+	}
+	field := func(data []byte) string {
+		if end := bytes.IndexByte(data, 0); end >= 0 {
+			data = data[:end]
+		}
+		return strings.TrimSpace(decodeLatin1(data))
+	}
+	metadata.Title = field(tag[3:33])
+	metadata.Artist = field(tag[33:63])
+	metadata.Album = field(tag[63:93])
+	metadata.Year = leadingNumber(field(tag[93:97]))
+	if tag[125] == 0 && tag[126] != 0 {
+		// ID3v1.1 keeps the track number at the end of the comment.
+		metadata.Track = int(tag[126])
+	}
+	return metadata, nil
+}
+
+// readFlacTags reads the metadata blocks at the start of a FLAC file.
+func readFlacTags(input io.Reader, withCover bool) (model.Metadata, *Cover, error) {
+	var metadata model.Metadata
+	var cover *Cover
+	header := make([]byte, 4)
+	for {
+		if _, err := io.ReadFull(input, header); err != nil {
+			return metadata, cover, err
+		}
+		last := header[0]&0x80 != 0
+		blockType := header[0] & 0x7f
+		size := int(header[1])<<16 | int(header[2])<<8 | int(header[3])
+		switch blockType {
+		case 4:
+			block := make([]byte, size)
+			if _, err := io.ReadFull(input, block); err != nil {
+				return metadata, cover, err
+			}
+			picture := readVorbisComments(block, &metadata, withCover && cover == nil)
+			if picture != nil {
+				cover = picture
+			}
+		case 6:
+			metadata.HasCover = true
+			if !withCover || cover != nil {
+				if _, err := io.CopyN(io.Discard, input, int64(size)); err != nil {
+					return metadata, cover, err
+				}
+				break
+			}
+			block := make([]byte, size)
+			if _, err := io.ReadFull(input, block); err != nil {
+				return metadata, cover, err
+			}
+			cover = decodeFlacPicture(block)
+		default:
+			if _, err := io.CopyN(io.Discard, input, int64(size)); err != nil {
+				return metadata, cover, err
+			}
+		}
+		if last {
+			return metadata, cover, nil
+		}
+	}
+}
+
+// readOggTags reads the comment header of an Ogg Vorbis or Opus file, which is the second packet in the stream.
+func readOggTags(input io.ReadSeeker, withCover bool) (model.Metadata, *Cover, error) {
+	var metadata model.Metadata
+	if _, err := input.Seek(0, io.SeekStart); err != nil {
+		return metadata, nil, err
+	}
+	var packet []byte
+	packets := 0
+	header := make([]byte, 27)
+	for packets < 2 {
+		if _, err := io.ReadFull(input, header); err != nil {
+			return metadata, nil, err
+		}
+		if !bytes.HasPrefix(header, []byte("OggS")) {
+			return metadata, nil, errInvalidTag
+		}
+		segments := make([]byte, header[26])
+		if _, err := io.ReadFull(input, segments); err != nil {
+			return metadata, nil, err
+		}
+		for _, segment := range segments {
+			data := make([]byte, segment)
+			if _, err := io.ReadFull(input, data); err != nil {
+				return metadata, nil, err
+			}
+			if packets == 1 {
+				packet = append(packet, data...)
+				if len(packet) > maxTagSize {
+					return metadata, nil, errInvalidTag
+				}
+			}
+			if segment < 255 {
+				packets++
+				if packets == 2 {
+					break
+				}
+			}
+		}
+	}
+
+	switch {
+	case bytes.HasPrefix(packet, []byte("\x03vorbis")):
+		packet = packet[7:]
+	case bytes.HasPrefix(packet, []byte("OpusTags")):
+		packet = packet[8:]
+	default:
+		return metadata, nil, errInvalidTag
+	}
+	cover := readVorbisComments(packet, &metadata, withCover)
+	return metadata, cover, nil
+}
+
+// readVorbisComments reads a list of NAME=value comments, as used by FLAC, Vorbis and Opus.
+func readVorbisComments(block []byte, metadata *model.Metadata, withCover bool) *Cover {
+	next := func() ([]byte, bool) {
+		if len(block) < 4 {
+			return nil, false
+		}
+		length := binary.LittleEndian.Uint32(block)
+		if uint64(length) > uint64(len(block)-4) {
+			return nil, false
+		}
+		value := block[4 : 4+length]
+		block = block[4+length:]
+		return value, true
+	}
+	// The first value is the name of the encoder.
+	if _, ok := next(); !ok || len(block) < 4 {
+		return nil
+	}
+	count := binary.LittleEndian.Uint32(block)
+	block = block[4:]
+
+	var cover *Cover
+	for i := uint32(0); i < count; i++ {
+		comment, ok := next()
+		if !ok {
+			break
+		}
+		name, value, found := strings.Cut(string(comment), "=")
+		if !found {
+			continue
+		}
+		value = strings.TrimSpace(value)
+		switch strings.ToUpper(name) {
+		case "TITLE":
+			metadata.Title = value
+		case "ARTIST":
+			metadata.Artist = value
+		case "ALBUM":
+			metadata.Album = value
+		case "ALBUMARTIST", "ALBUM ARTIST":
+			metadata.AlbumArtist = value
+		case "GENRE":
+			metadata.Genre = value
+		case "TRACKNUMBER":
+			metadata.Track = leadingNumber(value)
+		case "DISCNUMBER":
+			metadata.Disc = leadingNumber(value)
+		case "DATE", "YEAR":
+			metadata.Year = leadingNumber(value)
+		case "METADATA_BLOCK_PICTURE":
+			metadata.HasCover = true
+			if withCover && cover == nil {
+				if data, err := base64.StdEncoding.DecodeString(value); err == nil {
+					cover = decodeFlacPicture(data)
+				}
+			}
+		}
+	}
+	return cover
+}
+
+// decodeFlacPicture reads the picture block of a FLAC file.
+func decodeFlacPicture(block []byte) *Cover {
+	next := func() ([]byte, bool) {
+		if len(block) < 4 {
+			return nil, false
+		}
+		length := binary.BigEndian.Uint32(block)
+		if uint64(length) > uint64(len(block)-4) {
+			return nil, false
+		}
+		value := block[4 : 4+length]
+		block = block[4+length:]
+		return value, true
+	}
+	if len(block) < 4 {
+		return nil
+	}
+	// Skip the picture type.
+	block = block[4:]
+	mimeType, ok := next()
+	if !ok {
+		return nil
+	}
+	if _, ok := next(); !ok {
+		return nil
+	}
+	// Skip the width, height, color depth and number of colors.
+	if len(block) < 16 {
+		return nil
+	}
+	block = block[16:]
+	data, ok := next()
+	if !ok {
+		return nil
+	}
+	return &Cover{Data: data, MimeType: string(mimeType)}
+}
+
+// decodeID3Picture reads an APIC frame, or a PIC frame in ID3v2.2.
+func decodeID3Picture(frame []byte, v22 bool) *Cover {
+	if len(frame) < 2 {
+		return nil
+	}
+	encoding := frame[0]
+	frame = frame[1:]
+	var mimeType string
+	if v22 {
+		if len(frame) < 3 {
+			return nil
+		}
+		mimeType = "image/" + strings.ToLower(string(frame[:3]))
+		if mimeType == "image/jpg" {
+			mimeType = "image/jpeg"
+		}
+		frame = frame[3:]
+	} else {
+		end := bytes.IndexByte(frame, 0)
+		if end < 0 {
+			return nil
+		}
+		mimeType = string(frame[:end])
+		frame = frame[end+1:]
+	}
+	if len(frame) < 1 {
+		return nil
+	}
+	// Skip the picture type and the description.
+	frame = frame[1:]
+	_, frame = splitID3Text(encoding, frame)
+	if !strings.Contains(mimeType, "/") {
+		mimeType = "image/" + strings.ToLower(mimeType)
+	}
+	return &Cover{Data: frame, MimeType: mimeType}
+}
+
+// decodeID3Text reads the first value of a text frame.
+func decodeID3Text(frame []byte) string {
+	if len(frame) < 1 {
+		return ""
+	}
+	value, _ := splitID3Text(frame[0], frame[1:])
+	return strings.TrimSpace(value)
+}
+
+// splitID3Text reads a null terminated string in the given encoding, and returns it with the data that follows.
+func splitID3Text(encoding byte, data []byte) (string, []byte) {
+	switch encoding {
+	case 1, 2:
+		end := 0
+		for end+1 < len(data) && (data[end] != 0 || data[end+1] != 0) {
+			end += 2
+		}
+		rest := data[min(end+2, len(data)):]
+		return decodeUTF16(data[:min(end, len(data))], encoding == 2), rest
+	default:
+		end := bytes.IndexByte(data, 0)
+		if end < 0 {
+			end = len(data)
+		}
+		rest := data[min(end+1, len(data)):]
+		if encoding == 3 {
+			return strings.ToValidUTF8(string(data[:end]), ""), rest
+		}
+		return decodeLatin1(data[:end]), rest
+	}
+}
+
+func decodeUTF16(data []byte, bigEndian bool) string {
+	if len(data) >= 2 {
+		switch {
+		case data[0] == 0xff && data[1] == 0xfe:
+			bigEndian, data = false, data[2:]
+		case data[0] == 0xfe && data[1] == 0xff:
+			bigEndian, data = true, data[2:]
+		}
+	}
+	units := make([]uint16, 0, len(data)/2)
+	for i := 0; i+1 < len(data); i += 2 {
+		if bigEndian {
+			units = append(units, binary.BigEndian.Uint16(data[i:]))
+		} else {
+			units = append(units, binary.LittleEndian.Uint16(data[i:]))
+		}
+	}
+	return string(utf16.Decode(units))
+}
+
+func decodeLatin1(data []byte) string {
+	runes := make([]rune, len(data))
+	for i, b := range data {
+		runes[i] = rune(b)
+	}
+	return string(runes)
+}
+
+func syncsafe(data []byte) int {
+	return int(data[0]&0x7f)<<21 | int(data[1]&0x7f)<<14 | int(data[2]&0x7f)<<7 | int(data[3]&0x7f)
+}
+
+// cleanGenre removes the numeric genre references of ID3v1, like "(17)Rock".
+func cleanGenre(genre string) string {
+	for strings.HasPrefix(genre, "(") {
+		end := strings.IndexByte(genre, ')')
+		if end < 0 {
+			break
+		}
+		genre = genre[end+1:]
+	}
+	return strings.TrimSpace(genre)
+}
+
+// leadingNumber parses the number at the start of a value like "3/12" or "2019-05-01".
+func leadingNumber(value string) int {
+	end := 0
+	for end < len(value) && value[end] >= '0' && value[end] <= '9' {
+		end++
+	}
+	number, _ := strconv.Atoi(value[:end])
+	return number
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
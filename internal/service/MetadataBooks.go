@@ -0,0 +1,163 @@
+package service
+
+import (
+	"archive/zip"
+	"encoding/xml"
+	"errors"
+	"html"
+	"io"
+	"keydrive/internal/model"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// maxCoverSize is the largest cover image that is read from a book.
+const maxCoverSize = 16 * 1024 * 1024
+
+var errInvalidEpub = errors.New("invalid epub")
+
+var htmlTagPattern = regexp.MustCompile(`<[^>]*>`)
+
+type epubContainer struct {
+	RootFiles []struct {
+		FullPath  string `xml:"full-path,attr"`
+		MediaType string `xml:"media-type,attr"`
+	} `xml:"rootfiles>rootfile"`
+}
+
+// epubPackage is the OPF file that describes a book.
+type epubPackage struct {
+	Metadata struct {
+		Titles       []string `xml:"title"`
+		Creators     []string `xml:"creator"`
+		Languages    []string `xml:"language"`
+		Publishers   []string `xml:"publisher"`
+		Descriptions []string `xml:"description"`
+		Identifiers  []string `xml:"identifier"`
+		Dates        []string `xml:"date"`
+		Meta         []struct {
+			Name     string `xml:"name,attr"`
+			Content  string `xml:"content,attr"`
+			ID       string `xml:"id,attr"`
+			Property string `xml:"property,attr"`
+			Refines  string `xml:"refines,attr"`
+			Value    string `xml:",chardata"`
+		} `xml:"meta"`
+	} `xml:"metadata"`
+	Items []struct {
+		ID         string `xml:"id,attr"`
+		Href       string `xml:"href,attr"`
+		MediaType  string `xml:"media-type,attr"`
+		Properties string `xml:"properties,attr"`
+	} `xml:"manifest>item"`
+}
+
+// readEpubMetadata reads the package metadata of an EPUB book. The cover image is only read if it was asked for.
+func readEpubMetadata(file string, withCover bool) (model.Metadata, *Cover, error) {
+	var metadata model.Metadata
+	archive, err := zip.OpenReader(file)
+	if err != nil {
+		return metadata, nil, err
+	}
+	defer archive.Close()
+
+	var container epubContainer
+	if err := readZipXml(&archive.Reader, "META-INF/container.xml", &container); err != nil {
+		return metadata, nil, err
+	}
+	if len(container.RootFiles) == 0 {
+		return metadata, nil, errInvalidEpub
+	}
+	packagePath := container.RootFiles[0].FullPath
+	var opf epubPackage
+	if err := readZipXml(&archive.Reader, packagePath, &opf); err != nil {
+		return metadata, nil, err
+	}
+
+	first := func(values []string) string {
+		for _, value := range values {
+			if value = strings.TrimSpace(value); value != "" {
+				return value
+			}
+		}
+		return ""
+	}
+	metadata.Title = first(opf.Metadata.Titles)
+	for _, creator := range opf.Metadata.Creators {
+		if creator = strings.TrimSpace(creator); creator != "" {
+			metadata.Authors = append(metadata.Authors, creator)
+		}
+	}
+	metadata.Language = first(opf.Metadata.Languages)
+	metadata.Publisher = first(opf.Metadata.Publishers)
+	metadata.Identifier = first(opf.Metadata.Identifiers)
+	metadata.Year = leadingNumber(first(opf.Metadata.Dates))
+	// Descriptions are often html.
+	metadata.Description = strings.TrimSpace(html.UnescapeString(htmlTagPattern.ReplaceAllString(first(opf.Metadata.Descriptions), "")))
+
+	// Calibre stores the series in meta elements, EPUB 3 uses a collection with a position that refines it.
+	seriesId := ""
+	for _, meta := range opf.Metadata.Meta {
+		switch {
+		case meta.Name == "calibre:series":
+			metadata.Series = strings.TrimSpace(meta.Content)
+		case meta.Name == "calibre:series_index":
+			metadata.SeriesIndex, _ = strconv.ParseFloat(strings.TrimSpace(meta.Content), 64)
+		case meta.Property == "belongs-to-collection" && metadata.Series == "":
+			metadata.Series = strings.TrimSpace(meta.Value)
+			seriesId = meta.ID
+		}
+	}
+	for _, meta := range opf.Metadata.Meta {
+		if seriesId != "" && meta.Refines == "#"+seriesId && meta.Property == "group-position" {
+			metadata.SeriesIndex, _ = strconv.ParseFloat(strings.TrimSpace(meta.Value), 64)
+		}
+	}
+
+	// EPUB 3 marks the cover in the manifest, EPUB 2 refers to it from a meta element.
+	coverHref, coverType := "", ""
+	coverId := ""
+	for _, meta := range opf.Metadata.Meta {
+		if meta.Name == "cover" {
+			coverId = meta.Content
+		}
+	}
+	for _, item := range opf.Items {
+		if strings.Contains(" "+item.Properties+" ", " cover-image ") || (coverId != "" && item.ID == coverId) {
+			coverHref, coverType = item.Href, item.MediaType
+			break
+		}
+	}
+	if coverHref == "" {
+		return metadata, nil, nil
+	}
+	coverPath := path.Join(path.Dir(packagePath), coverHref)
+	metadata.HasCover = true
+	if !withCover {
+		return metadata, nil, nil
+	}
+	data, err := readZipFile(&archive.Reader, coverPath, maxCoverSize)
+	if err != nil {
+		return metadata, nil, err
+	}
+	return metadata, &Cover{Data: data, MimeType: coverType}, nil
+}
+
+func readZipXml(archive *zip.Reader, name string, value interface{}) error {
+	data, err := readZipFile(archive, name, maxTagSize)
+	if err != nil {
+		return err
+	}
+	return xml.Unmarshal(data, value)
+}
+
+func readZipFile(archive *zip.Reader, name string, limit int64) ([]byte, error) {
+	file, err := archive.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return io.ReadAll(io.LimitReader(file, limit))
+}
@@ -0,0 +1,59 @@
+package service
+
+import (
+	"github.com/rwcarlsen/goexif/exif"
+	"image"
+	"io"
+	"keydrive/internal/model"
+	"os"
+	"strings"
+)
+
+// readPhotoMetadata reads the size of an image, and the camera, time and location from its EXIF data.
+func readPhotoMetadata(file string) (model.Metadata, error) {
+	var metadata model.Metadata
+	input, err := os.Open(file)
+	if err != nil {
+		return metadata, err
+	}
+	defer input.Close()
+
+	if config, _, err := image.DecodeConfig(input); err == nil {
+		metadata.Width, metadata.Height = config.Width, config.Height
+	}
+	if _, err := input.Seek(0, io.SeekStart); err != nil {
+		return metadata, err
+	}
+	data, err := exif.Decode(input)
+	if err != nil {
+		// Most formats other than JPEG have no EXIF data.
+		return metadata, nil
+	}
+
+	tagValue := func(name exif.FieldName) string {
+		tag, err := data.Get(name)
+		if err != nil {
+			return ""
+		}
+		value, err := tag.StringVal()
+		if err != nil {
+			return ""
+		}
+		return strings.TrimSpace(strings.TrimRight(value, "\x00"))
+	}
+	metadata.CameraMake = tagValue(exif.Make)
+	metadata.CameraModel = tagValue(exif.Model)
+	if taken, err := data.DateTime(); err == nil && !taken.IsZero() {
+		metadata.TakenAt = &taken
+	}
+	if latitude, longitude, err := data.LatLong(); err == nil {
+		metadata.Latitude, metadata.Longitude = &latitude, &longitude
+	}
+	if tag, err := data.Get(exif.Orientation); err == nil {
+		if orientation, err := tag.Int(0); err == nil && orientation >= 5 && orientation <= 8 {
+			// The image is shown rotated by 90 degrees.
+			metadata.Width, metadata.Height = metadata.Height, metadata.Width
+		}
+	}
+	return metadata, nil
+}
@@ -0,0 +1,71 @@
+package service
+
+import (
+	"keydrive/internal/model"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var (
+	// episodePatterns match names like "Show.Name.S01E02.Title" and "Show Name - 1x02 - Title".
+	episodePatterns = []*regexp.Regexp{
+		regexp.MustCompile(`(?i)^(.*?)[\s._-]*\bs(\d{1,2})[\s._-]*e(\d{1,3})\b(.*)$`),
+		regexp.MustCompile(`(?i)^(.*?)[\s._-]*\b(\d{1,2})x(\d{2,3})\b(.*)$`),
+	}
+	// moviePattern matches names like "Movie Name (2010)" and "Movie.Name.2010.1080p".
+	moviePattern  = regexp.MustCompile(`^(.*?)[\s._]*[(\[]?\b((?:19|20)\d{2})\b[)\]]?(.*)$`)
+	seasonPattern = regexp.MustCompile(`(?i)^(season|series|staffel|saison)[\s._-]*\d+$|^s\d{1,2}$`)
+	// releaseTagPattern matches the first of the tags that release names add after the title.
+	releaseTagPattern = regexp.MustCompile(`(?i)[\s._-]\b(480p|576p|720p|1080[pi]|2160p|4k|uhd|hdr|bluray|blu-ray|bdrip|brrip|web-?dl|webrip|hdtv|dvdrip|x264|x265|h\.?264|h\.?265|hevc|xvid|proper|repack)\b.*$`)
+)
+
+// parseEpisodeName reads the show, season and episode from the path of an episode. If the file name does not contain
+// the name of the show, it is taken from the folder, skipping season folders.
+func parseEpisodeName(entryPath string) model.Metadata {
+	var metadata model.Metadata
+	name := strings.TrimSuffix(path.Base(entryPath), path.Ext(entryPath))
+	for _, pattern := range episodePatterns {
+		match := pattern.FindStringSubmatch(name)
+		if match == nil {
+			continue
+		}
+		metadata.Show = cleanVideoName(match[1])
+		metadata.Season, _ = strconv.Atoi(match[2])
+		metadata.Episode, _ = strconv.Atoi(match[3])
+		metadata.Title = cleanVideoName(releaseTagPattern.ReplaceAllString(match[4], ""))
+		break
+	}
+	if metadata.Episode == 0 {
+		return model.Metadata{}
+	}
+	if metadata.Show == "" {
+		for folder := path.Dir(entryPath); folder != "/" && folder != "."; folder = path.Dir(folder) {
+			if base := path.Base(folder); !seasonPattern.MatchString(base) {
+				metadata.Show = cleanVideoName(base)
+				break
+			}
+		}
+	}
+	return metadata
+}
+
+// parseMovieName reads the title and year of a movie from its file name.
+func parseMovieName(name string) model.Metadata {
+	var metadata model.Metadata
+	name = strings.TrimSuffix(name, path.Ext(name))
+	if match := moviePattern.FindStringSubmatch(name); match != nil && strings.TrimSpace(match[1]) != "" {
+		metadata.Title = cleanVideoName(match[1])
+		metadata.Year, _ = strconv.Atoi(match[2])
+		return metadata
+	}
+	metadata.Title = cleanVideoName(releaseTagPattern.ReplaceAllString(name, ""))
+	return metadata
+}
+
+// cleanVideoName turns the dots and underscores that release names use instead of spaces back into spaces.
+func cleanVideoName(name string) string {
+	name = strings.NewReplacer(".", " ", "_", " ").Replace(name)
+	return strings.Trim(strings.Join(strings.Fields(name), " "), " -")
+}
@@ -0,0 +1,198 @@
+package service
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/binary"
+	"keydrive/internal/model"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func id3Frame(id string, value string) []byte {
+	frame := []byte(id)
+	frame = binary.BigEndian.AppendUint32(frame, uint32(len(value)+1))
+	frame = append(frame, 0, 0, 3)
+	return append(frame, value...)
+}
+
+func writeTestMp3(t *testing.T, file string) {
+	var frames []byte
+	frames = append(frames, id3Frame("TIT2", "Song Title")...)
+	frames = append(frames, id3Frame("TPE1", "The Artist")...)
+	frames = append(frames, id3Frame("TALB", "The Album")...)
+	frames = append(frames, id3Frame("TRCK", "3/12")...)
+	frames = append(frames, id3Frame("TCON", "(17)Rock")...)
+	frames = append(frames, id3Frame("TYER", "1999")...)
+	size := len(frames)
+	header := []byte{'I', 'D', '3', 3, 0, 0, byte(size >> 21 & 0x7f), byte(size >> 14 & 0x7f), byte(size >> 7 & 0x7f), byte(size & 0x7f)}
+	data := append(header, frames...)
+	data = append(data, 0xff, 0xfb, 0x90, 0x00)
+	if err := os.WriteFile(file, data, 0777); err != nil {
+		t.Fatal(err.Error())
+	}
+}
+
+func writeTestFlac(t *testing.T, file string) {
+	var comments []byte
+	appendString := func(value string) {
+		comments = binary.LittleEndian.AppendUint32(comments, uint32(len(value)))
+		comments = append(comments, value...)
+	}
+	appendString("test encoder")
+	comments = binary.LittleEndian.AppendUint32(comments, 3)
+	appendString("TITLE=Flac Title")
+	appendString("ALBUMARTIST=Various")
+	appendString("DISCNUMBER=2")
+
+	data := []byte("fLaC")
+	data = append(data, 0x84, byte(len(comments)>>16), byte(len(comments)>>8), byte(len(comments)))
+	data = append(data, comments...)
+	if err := os.WriteFile(file, data, 0777); err != nil {
+		t.Fatal(err.Error())
+	}
+}
+
+func writeTestEpub(t *testing.T, file string) {
+	buffer := &bytes.Buffer{}
+	archive := zip.NewWriter(buffer)
+	add := func(name string, content []byte) {
+		writer, _ := archive.Create(name)
+		_, _ = writer.Write(content)
+	}
+	add("mimetype", []byte("application/epub+zip"))
+	add("META-INF/container.xml", []byte(`<?xml version="1.0"?>
+<container version="1.0" xmlns="urn:oasis:names:tc:opendocument:xmlns:container">
+  <rootfiles><rootfile full-path="OEBPS/content.opf" media-type="application/oebps-package+xml"/></rootfiles>
+</container>`))
+	add("OEBPS/content.opf", []byte(`<?xml version="1.0"?>
+<package xmlns="http://www.idpf.org/2007/opf" version="3.0">
+  <metadata xmlns:dc="http://purl.org/dc/elements/1.1/">
+    <dc:title>The Book</dc:title>
+    <dc:creator>First Author</dc:creator>
+    <dc:creator>Second Author</dc:creator>
+    <dc:language>en</dc:language>
+    <dc:date>2015-03-01</dc:date>
+    <dc:description>&lt;p&gt;A &lt;b&gt;good&lt;/b&gt; book.&lt;/p&gt;</dc:description>
+    <meta property="belongs-to-collection" id="series">The Series</meta>
+    <meta refines="#series" property="group-position">2</meta>
+  </metadata>
+  <manifest>
+    <item id="cover" href="images/cover.png" media-type="image/png" properties="cover-image"/>
+  </manifest>
+</package>`))
+	add("OEBPS/images/cover.png", pngHeader)
+	_ = archive.Close()
+	if err := os.WriteFile(file, buffer.Bytes(), 0777); err != nil {
+		t.Fatal(err.Error())
+	}
+}
+
+func TestExtractMetadata(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	t.Run("it reads id3 tags", func(t *testing.T) {
+		file := filepath.Join(tmpDir, "song.mp3")
+		writeTestMp3(t, file)
+		metadata := ExtractMetadata(model.TypeMusic, file, "/song.mp3", model.CategoryAudio, "audio/mpeg")
+		if metadata == nil {
+			t.Fatal("Expected metadata")
+		}
+		if metadata.Title != "Song Title" || metadata.Artist != "The Artist" || metadata.Album != "The Album" {
+			t.Errorf("Unexpected metadata: %+v", metadata)
+		}
+		if metadata.Track != 3 || metadata.Year != 1999 || metadata.Genre != "Rock" {
+			t.Errorf("Unexpected metadata: %+v", metadata)
+		}
+	})
+
+	t.Run("it reads flac comments", func(t *testing.T) {
+		file := filepath.Join(tmpDir, "song.flac")
+		writeTestFlac(t, file)
+		metadata := ExtractMetadata(model.TypeMusic, file, "/song.flac", model.CategoryAudio, "audio/flac")
+		if metadata == nil || metadata.Title != "Flac Title" || metadata.AlbumArtist != "Various" || metadata.Disc != 2 {
+			t.Errorf("Unexpected metadata: %+v", metadata)
+		}
+	})
+
+	t.Run("it reads tags only in music libraries", func(t *testing.T) {
+		file := filepath.Join(tmpDir, "song.mp3")
+		if metadata := ExtractMetadata(model.TypeGeneric, file, "/song.mp3", model.CategoryAudio, "audio/mpeg"); metadata != nil {
+			t.Errorf("Expected no metadata but got: %+v", metadata)
+		}
+	})
+
+	t.Run("it reads epub metadata", func(t *testing.T) {
+		file := filepath.Join(tmpDir, "book.epub")
+		writeTestEpub(t, file)
+		metadata := ExtractMetadata(model.TypeBooks, file, "/book.epub", model.CategoryDocument, "application/epub+zip")
+		if metadata == nil {
+			t.Fatal("Expected metadata")
+		}
+		if metadata.Title != "The Book" || len(metadata.Authors) != 2 || metadata.Language != "en" || metadata.Year != 2015 {
+			t.Errorf("Unexpected metadata: %+v", metadata)
+		}
+		if metadata.Description != "A good book." || !metadata.HasCover {
+			t.Errorf("Unexpected metadata: %+v", metadata)
+		}
+		if metadata.Series != "The Series" || metadata.SeriesIndex != 2 {
+			t.Errorf("Unexpected series: %+v", metadata)
+		}
+	})
+
+	t.Run("it reads the epub cover", func(t *testing.T) {
+		lib := model.Library{RootFolder: tmpDir, Type: model.TypeBooks}
+		fs := FileSystem{}
+		cover, err := fs.ReadCover(lib, "/book.epub")
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if cover.MimeType != "image/png" || !bytes.Equal(cover.Data, pngHeader) {
+			t.Errorf("Unexpected cover: %s", cover.MimeType)
+		}
+	})
+}
+
+func TestParseEpisodeName(t *testing.T) {
+	tests := []struct {
+		path    string
+		show    string
+		season  int
+		episode int
+		title   string
+	}{
+		{"/The.Show.S01E02.Pilot.720p.WEB-DL.mkv", "The Show", 1, 2, "Pilot"},
+		{"/Other Show - 2x10 - The End.avi", "Other Show", 2, 10, "The End"},
+		{"/Folder Show/Season 3/s03e04.mkv", "Folder Show", 3, 4, ""},
+		{"/Not an episode.mkv", "", 0, 0, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.path, func(t *testing.T) {
+			metadata := parseEpisodeName(test.path)
+			if metadata.Show != test.show || metadata.Season != test.season || metadata.Episode != test.episode || metadata.Title != test.title {
+				t.Errorf("Unexpected metadata: %+v", metadata)
+			}
+		})
+	}
+}
+
+func TestParseMovieName(t *testing.T) {
+	tests := []struct {
+		name  string
+		title string
+		year  int
+	}{
+		{"The Movie (2010).mkv", "The Movie", 2010},
+		{"Another.Movie.1999.1080p.BluRay.x264.mkv", "Another Movie", 1999},
+		{"No Year.1080p.mp4", "No Year", 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			metadata := parseMovieName(test.name)
+			if metadata.Title != test.title || metadata.Year != test.year {
+				t.Errorf("Unexpected metadata: %+v", metadata)
+			}
+		})
+	}
+}
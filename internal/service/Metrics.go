@@ -0,0 +1,274 @@
+package service
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Types of metric families, as they appear in the text exposition format of Prometheus.
+const (
+	MetricCounter   = "counter"
+	MetricGauge     = "gauge"
+	MetricHistogram = "histogram"
+)
+
+// DefaultLatencyBuckets are the upper bounds in seconds of the buckets of latency histograms.
+var DefaultLatencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// MetricSample is a value of a metric family with one combination of label values. It is returned by the functions
+// that collect metrics when they are scraped.
+type MetricSample struct {
+	LabelValues []string
+	Value       float64
+}
+
+// MetricCollectFunc reads the current values of a metric family, for values that are kept elsewhere, like the number
+// of queued jobs.
+type MetricCollectFunc func(ctx context.Context) ([]MetricSample, error)
+
+// Metrics keeps metrics and writes them in the text exposition format of Prometheus. Families are registered once at
+// startup and are safe to update from multiple goroutines.
+type Metrics struct {
+	mutex    sync.Mutex
+	families map[string]*metricFamily
+}
+
+type metricFamily struct {
+	name    string
+	help    string
+	kind    string
+	labels  []string
+	buckets []float64
+	series  map[string]*metricSeries
+	collect MetricCollectFunc
+}
+
+type metricSeries struct {
+	labelValues []string
+	value       float64
+	// counts and sum are only used by histograms. counts has one more entry than the buckets, for +Inf.
+	counts []uint64
+	sum    float64
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{families: make(map[string]*metricFamily)}
+}
+
+func (m *Metrics) register(family *metricFamily) *metricFamily {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if _, exists := m.families[family.name]; exists {
+		panic(fmt.Sprintf("metric %s is registered twice", family.name))
+	}
+	family.series = make(map[string]*metricSeries)
+	m.families[family.name] = family
+	return family
+}
+
+// Counter registers a counter with the given labels.
+func (m *Metrics) Counter(name string, help string, labels ...string) *Counter {
+	return &Counter{metrics: m, family: m.register(&metricFamily{name: name, help: help, kind: MetricCounter, labels: labels})}
+}
+
+// Gauge registers a gauge with the given labels.
+func (m *Metrics) Gauge(name string, help string, labels ...string) *Gauge {
+	return &Gauge{metrics: m, family: m.register(&metricFamily{name: name, help: help, kind: MetricGauge, labels: labels})}
+}
+
+// Histogram registers a histogram with the given bucket bounds, in increasing order, and labels.
+func (m *Metrics) Histogram(name string, help string, buckets []float64, labels ...string) *Histogram {
+	return &Histogram{metrics: m, family: m.register(&metricFamily{name: name, help: help, kind: MetricHistogram, labels: labels, buckets: buckets})}
+}
+
+// Collect registers a counter or gauge whose values are read by a function every time the metrics are written.
+func (m *Metrics) Collect(name string, help string, kind string, labels []string, collect MetricCollectFunc) {
+	m.register(&metricFamily{name: name, help: help, kind: kind, labels: labels, collect: collect})
+}
+
+// seriesFor returns the series of a family for the label values, creating it if needed. The mutex must be held.
+func (f *metricFamily) seriesFor(labelValues []string) *metricSeries {
+	if len(labelValues) != len(f.labels) {
+		panic(fmt.Sprintf("metric %s has %d labels, got %d values", f.name, len(f.labels), len(labelValues)))
+	}
+	key := strings.Join(labelValues, "\x00")
+	series, ok := f.series[key]
+	if !ok {
+		series = &metricSeries{labelValues: append([]string(nil), labelValues...)}
+		if f.kind == MetricHistogram {
+			series.counts = make([]uint64, len(f.buckets)+1)
+		}
+		f.series[key] = series
+	}
+	return series
+}
+
+// Counter is a value that only goes up, like the number of requests.
+type Counter struct {
+	metrics *Metrics
+	family  *metricFamily
+}
+
+func (c *Counter) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+func (c *Counter) Add(value float64, labelValues ...string) {
+	if value < 0 {
+		panic(fmt.Sprintf("counter %s can not decrease", c.family.name))
+	}
+	c.metrics.mutex.Lock()
+	defer c.metrics.mutex.Unlock()
+	c.family.seriesFor(labelValues).value += value
+}
+
+// Gauge is a value that goes up and down, like the number of active downloads.
+type Gauge struct {
+	metrics *Metrics
+	family  *metricFamily
+}
+
+func (g *Gauge) Set(value float64, labelValues ...string) {
+	g.metrics.mutex.Lock()
+	defer g.metrics.mutex.Unlock()
+	g.family.seriesFor(labelValues).value = value
+}
+
+func (g *Gauge) Add(value float64, labelValues ...string) {
+	g.metrics.mutex.Lock()
+	defer g.metrics.mutex.Unlock()
+	g.family.seriesFor(labelValues).value += value
+}
+
+func (g *Gauge) Inc(labelValues ...string) {
+	g.Add(1, labelValues...)
+}
+
+func (g *Gauge) Dec(labelValues ...string) {
+	g.Add(-1, labelValues...)
+}
+
+// Histogram counts observations, like request durations, in buckets.
+type Histogram struct {
+	metrics *Metrics
+	family  *metricFamily
+}
+
+func (h *Histogram) Observe(value float64, labelValues ...string) {
+	h.metrics.mutex.Lock()
+	defer h.metrics.mutex.Unlock()
+	series := h.family.seriesFor(labelValues)
+	bucket := sort.SearchFloat64s(h.family.buckets, value)
+	series.counts[bucket]++
+	series.sum += value
+}
+
+// WriteText writes all metrics in the text exposition format of Prometheus, sorted by name. Families whose collect
+// function fails are left out, so one failing source does not hide the other metrics.
+func (m *Metrics) WriteText(ctx context.Context, w io.Writer) error {
+	m.mutex.Lock()
+	families := make([]*metricFamily, 0, len(m.families))
+	for _, family := range m.families {
+		families = append(families, family)
+	}
+	m.mutex.Unlock()
+	sort.Slice(families, func(i, j int) bool {
+		return families[i].name < families[j].name
+	})
+
+	out := bufio.NewWriter(w)
+	for _, family := range families {
+		var samples []metricSeries
+		if family.collect != nil {
+			collected, err := family.collect(ctx)
+			if err != nil {
+				log.Warn("failed to collect metric %s: %s", family.name, err)
+				continue
+			}
+			for _, sample := range collected {
+				samples = append(samples, metricSeries{labelValues: sample.LabelValues, value: sample.Value})
+			}
+		} else {
+			m.mutex.Lock()
+			for _, series := range family.series {
+				copied := *series
+				copied.counts = append([]uint64(nil), series.counts...)
+				samples = append(samples, copied)
+			}
+			m.mutex.Unlock()
+		}
+		sort.Slice(samples, func(i, j int) bool {
+			return strings.Join(samples[i].labelValues, "\x00") < strings.Join(samples[j].labelValues, "\x00")
+		})
+
+		fmt.Fprintf(out, "# HELP %s %s\n", family.name, escapeMetricHelp(family.help))
+		fmt.Fprintf(out, "# TYPE %s %s\n", family.name, family.kind)
+		for _, sample := range samples {
+			labels := formatMetricLabels(family.labels, sample.labelValues)
+			if family.kind != MetricHistogram {
+				fmt.Fprintf(out, "%s%s %s\n", family.name, labels, formatMetricValue(sample.value))
+				continue
+			}
+			var cumulative uint64
+			for i, bound := range family.buckets {
+				cumulative += sample.counts[i]
+				le := formatBucketLabels(family.labels, sample.labelValues, formatMetricValue(bound))
+				fmt.Fprintf(out, "%s_bucket%s %d\n", family.name, le, cumulative)
+			}
+			cumulative += sample.counts[len(family.buckets)]
+			le := formatBucketLabels(family.labels, sample.labelValues, "+Inf")
+			fmt.Fprintf(out, "%s_bucket%s %d\n", family.name, le, cumulative)
+			fmt.Fprintf(out, "%s_sum%s %s\n", family.name, labels, formatMetricValue(sample.sum))
+			fmt.Fprintf(out, "%s_count%s %d\n", family.name, labels, cumulative)
+		}
+	}
+	return out.Flush()
+}
+
+func formatMetricLabels(names []string, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		pairs[i] = name + `="` + escapeMetricLabel(values[i]) + `"`
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// formatBucketLabels adds the upper bound of a histogram bucket to the labels of a series.
+func formatBucketLabels(names []string, values []string, bound string) string {
+	names = append(append([]string(nil), names...), "le")
+	values = append(append([]string(nil), values...), bound)
+	return formatMetricLabels(names, values)
+}
+
+func formatMetricValue(value float64) string {
+	switch {
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	case math.IsNaN(value):
+		return "NaN"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+var metricLabelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+var metricHelpEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+
+func escapeMetricLabel(value string) string {
+	return metricLabelEscaper.Replace(value)
+}
+
+func escapeMetricHelp(value string) string {
+	return metricHelpEscaper.Replace(value)
+}
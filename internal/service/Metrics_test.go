@@ -0,0 +1,75 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestMetrics(t *testing.T) {
+	metrics := NewMetrics()
+	requests := metrics.Counter("test_requests_total", "Requests\nper route", "route")
+	active := metrics.Gauge("test_active", "Active things")
+	duration := metrics.Histogram("test_duration_seconds", "Durations", []float64{0.1, 1}, "route")
+	metrics.Collect("test_collected", "Collected values", MetricGauge, []string{"name"}, func(ctx context.Context) ([]MetricSample, error) {
+		return []MetricSample{{LabelValues: []string{`say "hi"`}, Value: 3}}, nil
+	})
+	metrics.Collect("test_failing", "Fails", MetricGauge, nil, func(ctx context.Context) ([]MetricSample, error) {
+		return nil, errors.New("no database")
+	})
+
+	requests.Inc("/b")
+	requests.Add(2, "/a")
+	active.Inc()
+	active.Inc()
+	active.Dec()
+	duration.Observe(0.05, "/a")
+	duration.Observe(0.1, "/a")
+	duration.Observe(5, "/a")
+
+	var out strings.Builder
+	if err := metrics.WriteText(context.Background(), &out); err != nil {
+		t.Fatal(err)
+	}
+	expected := `# HELP test_active Active things
+# TYPE test_active gauge
+test_active 1
+# HELP test_collected Collected values
+# TYPE test_collected gauge
+test_collected{name="say \"hi\""} 3
+# HELP test_duration_seconds Durations
+# TYPE test_duration_seconds histogram
+test_duration_seconds_bucket{route="/a",le="0.1"} 2
+test_duration_seconds_bucket{route="/a",le="1"} 2
+test_duration_seconds_bucket{route="/a",le="+Inf"} 3
+test_duration_seconds_sum{route="/a"} 5.15
+test_duration_seconds_count{route="/a"} 3
+# HELP test_requests_total Requests\nper route
+# TYPE test_requests_total counter
+test_requests_total{route="/a"} 2
+test_requests_total{route="/b"} 1
+`
+	if out.String() != expected {
+		t.Errorf("Unexpected metrics:\n%s", out.String())
+	}
+}
+
+func TestMetricsRejectInvalidUse(t *testing.T) {
+	metrics := NewMetrics()
+	counter := metrics.Counter("test_total", "Test", "route")
+	for name, use := range map[string]func(){
+		"register twice":      func() { metrics.Gauge("test_total", "Test") },
+		"wrong label count":   func() { counter.Inc() },
+		"decrease of counter": func() { counter.Add(-1, "/") },
+	} {
+		t.Run(name, func(t *testing.T) {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("Expected a panic")
+				}
+			}()
+			use()
+		})
+	}
+}
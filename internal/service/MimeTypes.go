@@ -0,0 +1,172 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/gabriel-vasile/mimetype"
+	"keydrive/internal/model"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxCachedMimeTypes is the number of detection results that is kept in memory.
+const maxCachedMimeTypes = 10000
+
+// genericMimeTypes are detected for many different formats, so a more specific type from the extension is preferred.
+var genericMimeTypes = map[string]bool{
+	"application/octet-stream":     true,
+	"application/zip":              true,
+	"application/xml":              true,
+	"application/x-rar-compressed": true,
+	"text/plain":                   true,
+	"text/xml":                     true,
+}
+
+// MimeTypesConfig adds to the built-in mime types and categories.
+type MimeTypesConfig struct {
+	// Extensions maps file extensions, including the dot, to mime types.
+	Extensions map[string]string `json:"extensions"`
+	// Categories maps mime types, or the part before the slash, to categories.
+	Categories map[string]model.Category `json:"categories"`
+}
+
+// LoadMimeTypes reads a JSON file with extra mime types and categories, and adds them to ExtToMime and MimeToCategory.
+// The maps are replaced by extended copies, so a map that is being read is never changed, and nothing changes if the
+// file is invalid. It is meant to be called once at startup.
+func LoadMimeTypes(file string) error {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	var config MimeTypesConfig
+	if err := json.Unmarshal(data, &config); err != nil {
+		return fmt.Errorf("invalid mime types file %s: %w", file, err)
+	}
+	for mimeType, category := range config.Categories {
+		switch category {
+		case model.CategoryArchive, model.CategoryAudio, model.CategoryBinary, model.CategoryDocument,
+			model.CategoryImage, model.CategoryVideo, model.CategorySourceCode:
+		default:
+			return fmt.Errorf("invalid category %q for %s in %s", category, mimeType, file)
+		}
+	}
+	extensions := make(map[string]string, len(ExtToMime)+len(config.Extensions))
+	for extension, mimeType := range ExtToMime {
+		extensions[extension] = mimeType
+	}
+	for extension, mimeType := range config.Extensions {
+		if !strings.HasPrefix(extension, ".") {
+			extension = "." + extension
+		}
+		extensions[strings.ToLower(extension)] = mimeType
+	}
+	categories := make(map[string]model.Category, len(MimeToCategory)+len(config.Categories))
+	for mimeType, category := range MimeToCategory {
+		categories[mimeType] = category
+	}
+	for mimeType, category := range config.Categories {
+		categories[mimeType] = category
+	}
+	ExtToMime, MimeToCategory = extensions, categories
+	return nil
+}
+
+// activeMimeTypes are formats that can run scripts when a browser shows them.
+var activeMimeTypes = map[string]bool{
+	"text/html":              true,
+	"application/xhtml+xml":  true,
+	"image/svg+xml":          true,
+	"text/xml":               true,
+	"application/xml":        true,
+	"text/javascript":        true,
+	"application/javascript": true,
+	"application/ecmascript": true,
+}
+
+// IsActiveMimeType checks if a browser could run scripts in a file of a mime type, so it must not be shown inline.
+func IsActiveMimeType(mimeType string) bool {
+	mimeType, _, _ = strings.Cut(mimeType, ";")
+	return activeMimeTypes[strings.ToLower(strings.TrimSpace(mimeType))]
+}
+
+type detectedMimeType struct {
+	size     int64
+	modified time.Time
+	mimeType string
+}
+
+// mimeTypeCache remembers the mime types of files, until their size or modification time changes.
+type mimeTypeCache struct {
+	lock    sync.Mutex
+	entries map[string]detectedMimeType
+}
+
+func (c *mimeTypeCache) get(file string, info os.FileInfo) (string, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	cached, ok := c.entries[file]
+	if !ok || cached.size != info.Size() || !cached.modified.Equal(info.ModTime()) {
+		return "", false
+	}
+	return cached.mimeType, true
+}
+
+func (c *mimeTypeCache) put(file string, info os.FileInfo, mimeType string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.entries == nil {
+		c.entries = make(map[string]detectedMimeType)
+	}
+	if len(c.entries) >= maxCachedMimeTypes {
+		// Maps are iterated in random order, so this drops a random entry.
+		for key := range c.entries {
+			delete(c.entries, key)
+			break
+		}
+	}
+	c.entries[file] = detectedMimeType{size: info.Size(), modified: info.ModTime(), mimeType: mimeType}
+}
+
+// DetectFileCategory finds the category and mime type of a file on disk. The first bytes of the file are checked for
+// known formats, and the extension is used when the content does not tell. The mime type claimed by a client is only
+// used if neither gives an answer. Types that browsers run scripts in are only taken from the extension, so a file can
+// not become one just by its content.
+func (fs *FileSystem) DetectFileCategory(file string, name string, info os.FileInfo, claimed string) (model.Category, string) {
+	if info.IsDir() {
+		return GetFileCategory(name, "", true)
+	}
+
+	sniffed := ""
+	// Empty files have no content to check, and reading other special files could block.
+	if info.Mode().IsRegular() && info.Size() > 0 {
+		var ok bool
+		if sniffed, ok = fs.mimeTypes.get(file, info); !ok {
+			if detected, err := mimetype.DetectFile(file); err == nil {
+				sniffed, _, _ = strings.Cut(detected.String(), ";")
+			}
+			fs.mimeTypes.put(file, info, sniffed)
+		}
+	}
+	if sniffed == "application/octet-stream" {
+		sniffed = ""
+	}
+
+	byExtension := ExtToMime[strings.ToLower(filepath.Ext(name))]
+	if IsActiveMimeType(sniffed) && !IsActiveMimeType(byExtension) {
+		sniffed = ""
+	}
+	if IsActiveMimeType(claimed) && !IsActiveMimeType(byExtension) {
+		claimed = ""
+	}
+	switch {
+	case sniffed != "" && !(genericMimeTypes[sniffed] && byExtension != ""):
+		return GetFileCategory(name, sniffed, false)
+	case byExtension != "":
+		return GetFileCategory(name, byExtension, false)
+	default:
+		return GetFileCategory(name, claimed, false)
+	}
+}
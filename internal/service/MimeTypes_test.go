@@ -0,0 +1,93 @@
+package service
+
+import (
+	"keydrive/internal/model"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+var pngHeader = []byte{0x89, 'P', 'N', 'G', '\r', '\n', 0x1a, '\n', 0, 0, 0, 13, 'I', 'H', 'D', 'R'}
+
+func TestFileSystem_DetectFileCategory(t *testing.T) {
+	tmpDir := t.TempDir()
+	_ = os.WriteFile(filepath.Join(tmpDir, "no_extension"), pngHeader, 0777)
+	_ = os.WriteFile(filepath.Join(tmpDir, "mislabeled.txt"), []byte("%PDF-1.4\n%\xe2\xe3\xcf\xd3\n"), 0777)
+	_ = os.WriteFile(filepath.Join(tmpDir, "readme.md"), []byte("# Hello\n"), 0777)
+	_ = os.WriteFile(filepath.Join(tmpDir, "notes"), []byte("Just some text\n"), 0777)
+	_ = os.WriteFile(filepath.Join(tmpDir, "empty"), []byte{}, 0777)
+	_ = os.WriteFile(filepath.Join(tmpDir, "page.txt"), []byte("<html><script>alert(1)</script></html>\n"), 0777)
+	_ = os.WriteFile(filepath.Join(tmpDir, "page"), []byte("<html><script>alert(1)</script></html>\n"), 0777)
+	_ = os.WriteFile(filepath.Join(tmpDir, "page.html"), []byte("<html><script>alert(1)</script></html>\n"), 0777)
+	fs := FileSystem{}
+
+	tests := []struct {
+		name             string
+		claimed          string
+		expectedCategory model.Category
+		expectedMimeType string
+	}{
+		{"no_extension", "", model.CategoryImage, "image/png"},
+		{"mislabeled.txt", "text/plain", model.CategoryDocument, "application/pdf"},
+		{"readme.md", "", model.CategoryDocument, "text/markdown"},
+		{"notes", "", model.CategoryDocument, "text/plain"},
+		{"empty", "application/x-custom", model.CategoryBinary, "application/x-custom"},
+		{"page.txt", "", model.CategoryDocument, "text/plain"},
+		{"page", "text/html", model.CategoryBinary, ""},
+		{"page.html", "", model.CategoryDocument, "text/html"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			file := filepath.Join(tmpDir, test.name)
+			info, err := os.Stat(file)
+			if err != nil {
+				t.Fatal(err.Error())
+			}
+			category, mimeType := fs.DetectFileCategory(file, test.name, info, test.claimed)
+			if category != test.expectedCategory {
+				t.Errorf("Expected category [%s] but got [%s]", test.expectedCategory, category)
+			}
+			if mimeType != test.expectedMimeType {
+				t.Errorf("Expected mime type [%s] but got [%s]", test.expectedMimeType, mimeType)
+			}
+		})
+	}
+
+	t.Run("it detects the new type after a file changes", func(t *testing.T) {
+		file := filepath.Join(tmpDir, "changing")
+		_ = os.WriteFile(file, []byte("Text for now\n"), 0777)
+		info, _ := os.Stat(file)
+		if _, mimeType := fs.DetectFileCategory(file, "changing", info, ""); mimeType != "text/plain" {
+			t.Errorf("Expected text/plain but got: %s", mimeType)
+		}
+		_ = os.WriteFile(file, pngHeader, 0777)
+		info, _ = os.Stat(file)
+		if _, mimeType := fs.DetectFileCategory(file, "changing", info, ""); mimeType != "image/png" {
+			t.Errorf("Expected image/png but got: %s", mimeType)
+		}
+	})
+}
+
+func TestLoadMimeTypes(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "mime-types.json")
+	_ = os.WriteFile(file, []byte(`{
+		"extensions": {".kdtest": "application/x-keydrive-test"},
+		"categories": {"application/x-keydrive-test": "Source Code"}
+	}`), 0777)
+	previous := ExtToMime
+	if err := LoadMimeTypes(file); err != nil {
+		t.Fatal(err.Error())
+	}
+	if _, ok := previous[".kdtest"]; ok {
+		t.Errorf("Expected the previous map to stay unchanged")
+	}
+	category, mimeType := GetFileCategory("file.KDTEST", "", false)
+	if category != model.CategorySourceCode || mimeType != "application/x-keydrive-test" {
+		t.Errorf("Expected the configured type but got [%s] [%s]", category, mimeType)
+	}
+
+	_ = os.WriteFile(file, []byte(`{"categories": {"application/x-other": "Nonsense"}}`), 0777)
+	if err := LoadMimeTypes(file); err == nil {
+		t.Errorf("Expected an error for an unknown category")
+	}
+}
@@ -0,0 +1,102 @@
+package service
+
+import (
+	"gorm.io/gorm"
+	"keydrive/internal/model"
+	"time"
+)
+
+// albumArtistColumn selects the artist an album is listed under: the album artist, or the artist if there is none.
+const albumArtistColumn = "COALESCE(NULLIF(metadata->>'albumArtist', ''), NULLIF(metadata->>'artist', ''), '')"
+
+// MusicArtist is an artist in the tags of the music of a user.
+type MusicArtist struct {
+	Name   string
+	Albums int
+}
+
+// MusicAlbum is an album in the tags of the music of a user.
+type MusicAlbum struct {
+	Artist string
+	Name   string
+	Songs  int
+	Year   int
+	Genre  string
+	// CoverID is the id of a song in the album that has a cover, or 0 if there is none.
+	CoverID  int
+	Modified time.Time
+}
+
+// GetMusicEntries returns the indexed entries in the music libraries a user can access.
+func (i *Index) GetMusicEntries(user model.User, tx *gorm.DB) *gorm.DB {
+	libraries := i.Libraries.GetLibrariesForUser(user, tx.Session(&gorm.Session{NewDB: true})).
+		Where("type = ?", model.TypeMusic).
+		Select("libraries.id")
+	return tx.Model(&model.IndexedEntry{}).Where("library_id IN (?)", libraries)
+}
+
+// GetSongs returns the audio files in the music libraries a user can access.
+func (i *Index) GetSongs(user model.User, tx *gorm.DB) *gorm.DB {
+	return i.GetMusicEntries(user, tx).Where("category = ?", model.CategoryAudio)
+}
+
+// GetMusicArtists returns the artists of albums as MusicArtist rows, ordered by name.
+func (i *Index) GetMusicArtists(user model.User, tx *gorm.DB) *gorm.DB {
+	return i.GetSongs(user, tx).
+		Where(albumArtistColumn + " <> ''").
+		Select(albumArtistColumn + " AS name, COUNT(DISTINCT COALESCE(metadata->>'album', '')) AS albums").
+		Group(albumArtistColumn).
+		Order(albumArtistColumn)
+}
+
+// GetMusicAlbums returns the albums as MusicAlbum rows, ordered by artist and name.
+func (i *Index) GetMusicAlbums(user model.User, tx *gorm.DB) *gorm.DB {
+	return i.GetSongs(user, tx).
+		Where(albumArtistColumn + " <> '' AND COALESCE(metadata->>'album', '') <> ''").
+		Select(albumArtistColumn + " AS artist, metadata->>'album' AS name, COUNT(*) AS songs, " +
+			"COALESCE(MAX(CAST(metadata->>'year' AS int)), 0) AS year, COALESCE(MIN(metadata->>'genre'), '') AS genre, " +
+			"COALESCE(MIN(id) FILTER (WHERE metadata->>'hasCover' = 'true'), 0) AS cover_id, MAX(modified) AS modified").
+		Group(albumArtistColumn + ", metadata->>'album'").
+		Order(albumArtistColumn + ", metadata->>'album'")
+}
+
+// GetArtistAlbums returns the albums of an artist as MusicAlbum rows.
+func (i *Index) GetArtistAlbums(user model.User, artist string, tx *gorm.DB) *gorm.DB {
+	return i.GetMusicAlbums(user, tx).Where(albumArtistColumn+" = ?", artist)
+}
+
+// GetAlbumSongs returns the songs of an album, in the order of the album.
+func (i *Index) GetAlbumSongs(user model.User, artist string, album string, tx *gorm.DB) *gorm.DB {
+	return i.GetSongs(user, tx).
+		Where(albumArtistColumn+" = ? AND metadata->>'album' = ?", artist, album).
+		Order("COALESCE(CAST(metadata->>'disc' AS int), 0), COALESCE(CAST(metadata->>'track' AS int), 0), path")
+}
+
+// SearchMusicArtists finds artists of albums by their name.
+func (i *Index) SearchMusicArtists(user model.User, text string, tx *gorm.DB) *gorm.DB {
+	return searchMusic(i.GetMusicArtists(user, tx), text, albumArtistColumn)
+}
+
+// SearchMusicAlbums finds albums by their name or artist.
+func (i *Index) SearchMusicAlbums(user model.User, text string, tx *gorm.DB) *gorm.DB {
+	return searchMusic(i.GetMusicAlbums(user, tx), text, "metadata->>'album'", albumArtistColumn)
+}
+
+// SearchSongs finds songs by their title, artist, album or file name.
+func (i *Index) SearchSongs(user model.User, text string, tx *gorm.DB) *gorm.DB {
+	return searchMusic(i.GetSongs(user, tx).Order("name, id"), text, "name", "metadata->>'title'", "metadata->>'artist'", "metadata->>'album'")
+}
+
+// searchMusic adds a search for a text in any of the columns to a query. An empty text matches everything, which
+// clients use to list the whole collection.
+func searchMusic(query *gorm.DB, text string, columns ...string) *gorm.DB {
+	if text == "" {
+		return query
+	}
+	pattern := "%" + escapeLike(text) + "%"
+	condition := query.Session(&gorm.Session{NewDB: true})
+	for _, column := range columns {
+		condition = condition.Or(column+" ILIKE ?", pattern)
+	}
+	return query.Where(condition)
+}
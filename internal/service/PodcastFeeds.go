@@ -0,0 +1,66 @@
+package service
+
+import (
+	"gorm.io/gorm"
+	"keydrive/internal/model"
+	"path"
+)
+
+type PodcastFeeds struct {
+	DB *gorm.DB
+}
+
+func (p *PodcastFeeds) GetFeedsForLibrary(library model.Library, tx *gorm.DB) *gorm.DB {
+	return tx.Model(&model.PodcastFeed{}).Where("library_id = ?", library.ID)
+}
+
+// CreateFeed assigns a random token to the feed and saves it.
+func (p *PodcastFeeds) CreateFeed(tx *gorm.DB, feed *model.PodcastFeed) error {
+	token, err := randomFeedToken()
+	if err != nil {
+		return err
+	}
+	feed.Token = token
+	feed.LibraryID = feed.Library.ID
+	return tx.Omit("Library").Create(feed).Error
+}
+
+// ResetToken gives the feed a new token, so the old url stops working.
+func (p *PodcastFeeds) ResetToken(tx *gorm.DB, feed *model.PodcastFeed) error {
+	token, err := randomFeedToken()
+	if err != nil {
+		return err
+	}
+	feed.Token = token
+	return tx.Model(feed).Update("token", token).Error
+}
+
+// OpenFeed looks up a feed by its token.
+func (p *PodcastFeeds) OpenFeed(token string) (model.PodcastFeed, error) {
+	var feed model.PodcastFeed
+	result := p.DB.Model(&model.PodcastFeed{}).Preload("Library").Where("token = ?", token).Take(&feed)
+	return feed, result.Error
+}
+
+// ResolveEpisodePath turns the path of an episode, relative to the folder of the feed, into a path in the library.
+// Only files directly in the folder are episodes, so it returns false for anything else.
+func (p *PodcastFeeds) ResolveEpisodePath(feed model.PodcastFeed, relPath string) (string, bool) {
+	relPath = path.Clean("/" + relPath)
+	if relPath == "/" || path.Dir(relPath) != "/" {
+		return "", false
+	}
+	return path.Join(feed.Path, relPath), true
+}
+
+// randomFeedToken returns a token that is longer than the slug of a share link, because a feed never expires.
+func randomFeedToken() (string, error) {
+	first, err := randomSlug()
+	if err != nil {
+		return "", err
+	}
+	second, err := randomSlug()
+	if err != nil {
+		return "", err
+	}
+	return first + second, nil
+}
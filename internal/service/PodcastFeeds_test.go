@@ -0,0 +1,30 @@
+package service
+
+import (
+	"keydrive/internal/model"
+	"testing"
+)
+
+func TestResolveEpisodePath(t *testing.T) {
+	feeds := PodcastFeeds{}
+	feed := model.PodcastFeed{Path: "/Talks"}
+	tests := []struct {
+		relPath  string
+		expected string
+		ok       bool
+	}{
+		{"episode.mp3", "/Talks/episode.mp3", true},
+		{"/episode.mp3", "/Talks/episode.mp3", true},
+		{"../secret.txt", "/Talks/secret.txt", true},
+		{"Sub/episode.mp3", "", false},
+		{"", "", false},
+	}
+	for _, test := range tests {
+		t.Run(test.relPath, func(t *testing.T) {
+			entryPath, ok := feeds.ResolveEpisodePath(feed, test.relPath)
+			if ok != test.ok || entryPath != test.expected {
+				t.Errorf("Expected %s, %v but got: %s, %v", test.expected, test.ok, entryPath, ok)
+			}
+		})
+	}
+}
@@ -0,0 +1,190 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"gorm.io/gorm"
+	"keydrive/internal/model"
+	"path/filepath"
+)
+
+var ErrQuotaExceeded = errors.New("quota exceeded")
+
+// Scopes of quotas.
+const (
+	QuotaScopeLibrary = "library"
+	QuotaScopeUser    = "user"
+)
+
+// QuotaError tells which quota a write would exceed. It matches ErrQuotaExceeded.
+type QuotaError struct {
+	Scope     string `json:"scope" enums:"library,user"`
+	Quota     int64  `json:"quota"`
+	Used      int64  `json:"used"`
+	Requested int64  `json:"requested"`
+}
+
+func (e QuotaError) Error() string {
+	return fmt.Sprintf("the %s quota of %d bytes would be exceeded, %d bytes are used and %d more were requested", e.Scope, e.Quota, e.Used, e.Requested)
+}
+
+func (e QuotaError) Is(target error) bool {
+	return target == ErrQuotaExceeded
+}
+
+// QuotaUsage is the space that counts towards a quota. Reserved is the announced size of uploads that are still in
+// progress. A quota of 0 means there is no limit.
+type QuotaUsage struct {
+	Quota    int64 `json:"quota"`
+	Used     int64 `json:"used"`
+	Reserved int64 `json:"reserved"`
+}
+
+// Available returns the space left under the quota, or -1 if there is no limit.
+func (u QuotaUsage) Available() int64 {
+	if u.Quota <= 0 {
+		return -1
+	}
+	if free := u.Quota - u.Used - u.Reserved; free > 0 {
+		return free
+	}
+	return 0
+}
+
+// Quotas keeps the space used by libraries and users within their quotas. Usage is taken from the search index, so it
+// is cheap to compute but only as current as the index. Changes made through the FileSystem are applied to the index
+// before it is read. The files in a library, its trash and the previous versions of
+// its files count towards the quota of the library. Users are charged for the files they uploaded or copied, which is
+// recorded in the index.
+type Quotas struct {
+	DB         *gorm.DB
+	FileSystem *FileSystem
+	Index      *Index
+}
+
+// flushIndex applies the changes that are still queued for the index, so usage includes what was just written.
+func (q *Quotas) flushIndex() {
+	if q.Index != nil {
+		q.Index.Flush(context.Background())
+	}
+}
+
+// GetLibraryUsage returns the space used by a library.
+func (q *Quotas) GetLibraryUsage(library model.Library) (QuotaUsage, error) {
+	q.flushIndex()
+	usage := QuotaUsage{Quota: library.Quota}
+	var sizes struct{ Files, Trash, Versions, Uploads int64 }
+	result := q.DB.Raw(`SELECT
+		(SELECT coalesce(sum(size), 0) FROM indexed_entries WHERE library_id = @library AND category <> @folder) AS files,
+		(SELECT coalesce(sum(size), 0) FROM trash_items WHERE library_id = @library) AS trash,
+		(SELECT coalesce(sum(size), 0) FROM file_versions WHERE library_id = @library) AS versions,
+		(SELECT coalesce(sum(length), 0) FROM uploads WHERE library_id = @library) AS uploads`,
+		map[string]interface{}{"library": library.ID, "folder": model.CategoryFolder}).
+		Scan(&sizes)
+	usage.Used = sizes.Files + sizes.Trash + sizes.Versions
+	usage.Reserved = sizes.Uploads
+	return usage, result.Error
+}
+
+// GetUserUsage returns the space used by the files of a user in all libraries.
+func (q *Quotas) GetUserUsage(user model.User) (QuotaUsage, error) {
+	q.flushIndex()
+	usage := QuotaUsage{Quota: user.Quota}
+	var sizes struct{ Files, Uploads int64 }
+	result := q.DB.Raw(`SELECT
+		(SELECT coalesce(sum(size), 0) FROM indexed_entries WHERE owner_id = @user AND category <> @folder) AS files,
+		(SELECT coalesce(sum(length), 0) FROM uploads WHERE user_id = @user) AS uploads`,
+		map[string]interface{}{"user": user.ID, "folder": model.CategoryFolder}).
+		Scan(&sizes)
+	usage.Used = sizes.Files
+	usage.Reserved = sizes.Uploads
+	return usage, result.Error
+}
+
+// Check returns a QuotaError if writing size bytes to a library would exceed the quota of the library or of the user.
+func (q *Quotas) Check(library model.Library, user model.User, size int64) error {
+	if library.Quota > 0 {
+		usage, err := q.GetLibraryUsage(library)
+		if err != nil {
+			return err
+		}
+		if err := checkUsage(QuotaScopeLibrary, usage, size); err != nil {
+			return err
+		}
+	}
+	if user.Quota > 0 {
+		usage, err := q.GetUserUsage(user)
+		if err != nil {
+			return err
+		}
+		if err := checkUsage(QuotaScopeUser, usage, size); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Available returns the space that can still be written to a library by a user, which is the smaller of what is left
+// under both quotas, or -1 if neither has a limit.
+func (q *Quotas) Available(library model.Library, user model.User) (int64, error) {
+	available := int64(-1)
+	if library.Quota > 0 {
+		usage, err := q.GetLibraryUsage(library)
+		if err != nil {
+			return 0, err
+		}
+		available = usage.Available()
+	}
+	if user.Quota > 0 {
+		usage, err := q.GetUserUsage(user)
+		if err != nil {
+			return 0, err
+		}
+		if free := usage.Available(); available < 0 || free < available {
+			available = free
+		}
+	}
+	return available, nil
+}
+
+func checkUsage(scope string, usage QuotaUsage, size int64) error {
+	if available := usage.Available(); available >= 0 && size > available {
+		return QuotaError{Scope: scope, Quota: usage.Quota, Used: usage.Used + usage.Reserved, Requested: size}
+	}
+	return nil
+}
+
+// CheckTransfer checks if an entry and everything inside it can be copied from one library to another. Moves within a
+// library do not take more space and are not checked.
+func (q *Quotas) CheckTransfer(source model.Library, sourcePath string, target model.Library, user model.User, move bool) error {
+	if move && source.ID == target.ID {
+		return nil
+	}
+	if target.Quota <= 0 && user.Quota <= 0 {
+		return nil
+	}
+	q.flushIndex()
+	var size int64
+	sourcePath = filepath.ToSlash(q.FileSystem.cleanRelativePath(sourcePath))
+	result := q.DB.Model(&model.IndexedEntry{}).
+		Select("coalesce(sum(size), 0)").
+		Where("library_id = ? AND category <> ?", source.ID, model.CategoryFolder).
+		Where("path = ? OR path LIKE ?", sourcePath, escapeLike(sourcePath)+"/%").
+		Scan(&size)
+	if result.Error != nil {
+		return result.Error
+	}
+	return q.Check(target, user, size)
+}
+
+// Claim charges a user for an entry and everything inside it. It is called after the entry was written, and waits until
+// the write is in the index.
+func (q *Quotas) Claim(library model.Library, entryPath string, userID int) error {
+	q.flushIndex()
+	entryPath = filepath.ToSlash(q.FileSystem.cleanRelativePath(entryPath))
+	return q.DB.Model(&model.IndexedEntry{}).
+		Where("library_id = ?", library.ID).
+		Where("path = ? OR path LIKE ?", entryPath, escapeLike(entryPath)+"/%").
+		Update("owner_id", userID).Error
+}
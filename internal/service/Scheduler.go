@@ -0,0 +1,487 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"keydrive/internal/model"
+	"sync"
+	"time"
+)
+
+var ErrUnknownTask = errors.New("there is no scheduled task with this name")
+
+// schedulerPollInterval is how often the scheduler looks for due tasks if none is due earlier. Tasks that were changed
+// or triggered on other instances are noticed within this time.
+const schedulerPollInterval = 30 * time.Second
+
+// ScheduledTaskFunc carries out a scheduled task. It should stop when the context is cancelled.
+type ScheduledTaskFunc func(ctx context.Context) error
+
+type scheduledTask struct {
+	name            string
+	description     string
+	defaultSchedule string
+	enabledDefault  bool
+	run             ScheduledTaskFunc
+}
+
+// ScheduleStatus describes a scheduled task, when it runs and how its last run went.
+type ScheduleStatus struct {
+	Name            string `json:"name"`
+	Description     string `json:"description"`
+	Schedule        string `json:"schedule"`
+	DefaultSchedule string `json:"defaultSchedule"`
+	Enabled         bool   `json:"enabled"`
+	// Running is only known for tasks that run on this instance.
+	Running bool `json:"running"`
+	// NextRunAt is empty for disabled tasks.
+	NextRunAt *time.Time `json:"nextRunAt,omitempty"`
+	LastRunAt *time.Time `json:"lastRunAt,omitempty"`
+	// LastDuration is the duration of the last run in milliseconds.
+	LastDuration int64  `json:"lastDuration"`
+	LastError    string `json:"lastError,omitempty"`
+}
+
+// Scheduler runs maintenance tasks on a schedule. All instances sharing the database run the scheduler, but a Postgres
+// advisory lock makes sure that a task only runs on one of them at a time, and the next run is shared in the database.
+type Scheduler struct {
+	DB *gorm.DB
+
+	lock    sync.Mutex
+	tasks   []*scheduledTask
+	running map[string]bool
+	// backoff keeps tasks that are locked by another instance from being tried again before the time it holds.
+	backoff map[string]time.Time
+	wake    chan struct{}
+	stop    chan struct{}
+	cancel  context.CancelFunc
+	ctx     context.Context
+	done    sync.WaitGroup
+}
+
+// Register adds a task with its default schedule. Admins can change the schedule and enable or disable the task, which
+// is kept in the database.
+func (s *Scheduler) Register(name string, description string, defaultSchedule string, enabled bool, run ScheduledTaskFunc) {
+	if _, err := ParseCronSchedule(defaultSchedule); err != nil {
+		panic(fmt.Sprintf("invalid default schedule of task %s: %s", name, err))
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.tasks = append(s.tasks, &scheduledTask{
+		name:            name,
+		description:     description,
+		defaultSchedule: defaultSchedule,
+		enabledDefault:  enabled,
+		run:             run,
+	})
+}
+
+func (s *Scheduler) task(name string) (*scheduledTask, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, task := range s.tasks {
+		if task.name == name {
+			return task, nil
+		}
+	}
+	return nil, ErrUnknownTask
+}
+
+// effective returns the schedule and whether a task is enabled, taking the changes of admins into account.
+func (t *scheduledTask) effective(row model.ScheduledTask) (string, bool) {
+	schedule := t.defaultSchedule
+	if row.Schedule != "" {
+		schedule = row.Schedule
+	}
+	enabled := t.enabledDefault
+	if row.Enabled != nil {
+		enabled = *row.Enabled
+	}
+	return schedule, enabled
+}
+
+func (s *Scheduler) status(task *scheduledTask, row model.ScheduledTask) ScheduleStatus {
+	schedule, enabled := task.effective(row)
+	s.lock.Lock()
+	running := s.running[task.name]
+	s.lock.Unlock()
+	status := ScheduleStatus{
+		Name:            task.name,
+		Description:     task.description,
+		Schedule:        schedule,
+		DefaultSchedule: task.defaultSchedule,
+		Enabled:         enabled,
+		Running:         running,
+		LastRunAt:       row.LastRunAt,
+		LastDuration:    row.LastDuration.Milliseconds(),
+		LastError:       row.LastError,
+	}
+	if enabled {
+		status.NextRunAt = row.NextRunAt
+	}
+	return status
+}
+
+// List returns the status of all tasks, in the order they were registered.
+func (s *Scheduler) List() ([]ScheduleStatus, error) {
+	rows, err := s.rows()
+	if err != nil {
+		return nil, err
+	}
+	s.lock.Lock()
+	tasks := append([]*scheduledTask(nil), s.tasks...)
+	s.lock.Unlock()
+	result := make([]ScheduleStatus, len(tasks))
+	for i, task := range tasks {
+		result[i] = s.status(task, rows[task.name])
+	}
+	return result, nil
+}
+
+// Get returns the status of a task.
+func (s *Scheduler) Get(name string) (ScheduleStatus, error) {
+	task, err := s.task(name)
+	if err != nil {
+		return ScheduleStatus{}, err
+	}
+	var row model.ScheduledTask
+	if err := s.DB.Where("name = ?", name).Limit(1).Find(&row).Error; err != nil {
+		return ScheduleStatus{}, err
+	}
+	return s.status(task, row), nil
+}
+
+// Update changes the schedule of a task and whether it is enabled. Settings that are nil are kept, and an empty
+// schedule restores the default one. The next run is planned from now on.
+func (s *Scheduler) Update(name string, schedule *string, enabled *bool) (ScheduleStatus, error) {
+	task, err := s.task(name)
+	if err != nil {
+		return ScheduleStatus{}, err
+	}
+	if schedule != nil && *schedule != "" {
+		if _, err := ParseCronSchedule(*schedule); err != nil {
+			return ScheduleStatus{}, err
+		}
+	}
+	err = s.DB.Transaction(func(tx *gorm.DB) error {
+		row, err := s.lockRow(tx, name)
+		if err != nil {
+			return err
+		}
+		if schedule != nil {
+			row.Schedule = *schedule
+			if row.Schedule == task.defaultSchedule {
+				row.Schedule = ""
+			}
+		}
+		if enabled != nil {
+			row.Enabled = enabled
+			if *enabled == task.enabledDefault {
+				row.Enabled = nil
+			}
+		}
+		row.NextRunAt = nil
+		if effectiveSchedule, enabled := task.effective(row); enabled {
+			parsed, err := ParseCronSchedule(effectiveSchedule)
+			if err != nil {
+				return err
+			}
+			next := parsed.Next(time.Now())
+			row.NextRunAt = &next
+		}
+		return tx.Save(&row).Error
+	})
+	if err != nil {
+		return ScheduleStatus{}, err
+	}
+	s.lock.Lock()
+	delete(s.backoff, name)
+	s.lock.Unlock()
+	s.notify()
+	return s.Get(name)
+}
+
+// Trigger makes a task run as soon as possible, on whichever instance gets to it first. Disabled tasks run too.
+func (s *Scheduler) Trigger(name string) (ScheduleStatus, error) {
+	if _, err := s.task(name); err != nil {
+		return ScheduleStatus{}, err
+	}
+	err := s.DB.Transaction(func(tx *gorm.DB) error {
+		row, err := s.lockRow(tx, name)
+		if err != nil {
+			return err
+		}
+		now := time.Now()
+		row.NextRunAt = &now
+		return tx.Save(&row).Error
+	})
+	if err != nil {
+		return ScheduleStatus{}, err
+	}
+	s.notify()
+	return s.Get(name)
+}
+
+// lockRow creates the row of a task if it does not exist yet and locks it for the transaction.
+func (s *Scheduler) lockRow(tx *gorm.DB, name string) (model.ScheduledTask, error) {
+	row := model.ScheduledTask{Name: name}
+	if err := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&row).Error; err != nil {
+		return row, err
+	}
+	return row, tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("name = ?", name).Take(&row).Error
+}
+
+func (s *Scheduler) rows() (map[string]model.ScheduledTask, error) {
+	var rows []model.ScheduledTask
+	if err := s.DB.Find(&rows).Error; err != nil {
+		return nil, err
+	}
+	result := make(map[string]model.ScheduledTask, len(rows))
+	for _, row := range rows {
+		result[row.Name] = row
+	}
+	return result, nil
+}
+
+func (s *Scheduler) notify() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.wake == nil {
+		return
+	}
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Start runs due tasks in the background until Stop is called.
+func (s *Scheduler) Start() {
+	s.lock.Lock()
+	s.running = map[string]bool{}
+	s.backoff = map[string]time.Time{}
+	s.wake = make(chan struct{}, 1)
+	s.stop = make(chan struct{})
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	stop := s.stop
+	s.lock.Unlock()
+
+	s.done.Add(1)
+	go func() {
+		defer s.done.Done()
+		timer := time.NewTimer(0)
+		defer timer.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-s.wake:
+				if !timer.Stop() {
+					<-timer.C
+				}
+			case <-timer.C:
+			}
+			wait := s.runDue()
+			timer.Reset(wait)
+		}
+	}()
+}
+
+// Stop cancels running tasks and waits for them to return.
+func (s *Scheduler) Stop() {
+	s.lock.Lock()
+	if s.stop == nil {
+		s.lock.Unlock()
+		return
+	}
+	close(s.stop)
+	s.stop = nil
+	s.cancel()
+	s.lock.Unlock()
+	s.done.Wait()
+}
+
+// runDue starts all tasks that are due and returns the time until the next one is.
+func (s *Scheduler) runDue() time.Duration {
+	wait := schedulerPollInterval
+	rows, err := s.rows()
+	if err != nil {
+		log.Error("failed to load scheduled tasks: %s", err)
+		return wait
+	}
+	s.lock.Lock()
+	tasks := append([]*scheduledTask(nil), s.tasks...)
+	s.lock.Unlock()
+
+	now := time.Now()
+	for _, task := range tasks {
+		row := rows[task.name]
+		schedule, enabled := task.effective(row)
+		if row.NextRunAt == nil {
+			if !enabled {
+				continue
+			}
+			next, err := s.planFirstRun(task, schedule, now)
+			if err != nil {
+				log.Error("failed to plan task %s: %s", task.name, err)
+				continue
+			}
+			row.NextRunAt = &next
+		}
+		if row.NextRunAt.After(now) {
+			if until := row.NextRunAt.Sub(now); until < wait {
+				wait = until
+			}
+			continue
+		}
+		// Tasks that were disabled but triggered by hand are due too, so only the time is checked here.
+		s.lock.Lock()
+		if s.running[task.name] {
+			s.lock.Unlock()
+			continue
+		}
+		if retry := s.backoff[task.name]; retry.After(now) {
+			s.lock.Unlock()
+			if until := retry.Sub(now); until < wait {
+				wait = until
+			}
+			continue
+		}
+		s.running[task.name] = true
+		s.done.Add(1)
+		s.lock.Unlock()
+		go func(task *scheduledTask) {
+			defer s.done.Done()
+			defer func() {
+				s.lock.Lock()
+				delete(s.running, task.name)
+				s.lock.Unlock()
+				// The next run was planned when the task finished.
+				s.notify()
+			}()
+			s.runExclusively(task)
+		}(task)
+	}
+	return wait
+}
+
+// planFirstRun saves the first run of a task that never had one planned. If another instance planned it in the
+// meantime, that time is kept.
+func (s *Scheduler) planFirstRun(task *scheduledTask, schedule string, now time.Time) (time.Time, error) {
+	parsed, err := ParseCronSchedule(schedule)
+	if err != nil {
+		return time.Time{}, err
+	}
+	var row model.ScheduledTask
+	err = s.DB.Transaction(func(tx *gorm.DB) error {
+		var err error
+		if row, err = s.lockRow(tx, task.name); err != nil {
+			return err
+		}
+		if row.NextRunAt != nil {
+			return nil
+		}
+		next := parsed.Next(now)
+		row.NextRunAt = &next
+		return tx.Model(&row).Update("next_run_at", next).Error
+	})
+	if err != nil {
+		return time.Time{}, err
+	}
+	return *row.NextRunAt, nil
+}
+
+// runExclusively runs a task while holding its advisory lock. Advisory locks belong to a database session, so one
+// connection is kept for the whole run. If another instance holds the lock, the task is skipped here until the next
+// poll, instead of being tried again right away while it is still due.
+func (s *Scheduler) runExclusively(task *scheduledTask) {
+	sqlDB, err := s.DB.DB()
+	if err != nil {
+		log.Error("failed to run task %s: %s", task.name, err)
+		s.backOff(task)
+		return
+	}
+	conn, err := sqlDB.Conn(s.ctx)
+	if err != nil {
+		log.Error("failed to run task %s: %s", task.name, err)
+		s.backOff(task)
+		return
+	}
+	defer conn.Close()
+	key := "scheduled-task:" + task.name
+	var locked bool
+	if err := conn.QueryRowContext(s.ctx, "SELECT pg_try_advisory_lock(hashtext($1))", key).Scan(&locked); err != nil {
+		log.Error("failed to lock task %s: %s", task.name, err)
+		s.backOff(task)
+		return
+	}
+	if !locked {
+		s.backOff(task)
+		return
+	}
+	defer func() {
+		if _, err := conn.ExecContext(context.Background(), "SELECT pg_advisory_unlock(hashtext($1))", key); err != nil {
+			log.Error("failed to unlock task %s: %s", task.name, err)
+		}
+	}()
+
+	// Another instance may have run the task between loading the due tasks and taking the lock.
+	var row model.ScheduledTask
+	if err := s.DB.Where("name = ?", task.name).Take(&row).Error; err != nil {
+		log.Error("failed to run task %s: %s", task.name, err)
+		return
+	}
+	if row.NextRunAt == nil || row.NextRunAt.After(time.Now()) {
+		return
+	}
+
+	started := time.Now()
+	err = s.runTask(task)
+	duration := time.Since(started)
+	lastError := ""
+	if err != nil {
+		log.Error("task %s failed: %s", task.name, err)
+		lastError = err.Error()
+	}
+
+	// The schedule may have been changed while the task was running, so it is loaded again.
+	if err := s.DB.Where("name = ?", task.name).Take(&row).Error; err != nil {
+		log.Error("failed to save the run of task %s: %s", task.name, err)
+		return
+	}
+	updates := map[string]interface{}{
+		"last_run_at":   started,
+		"last_duration": duration,
+		"last_error":    lastError,
+		"next_run_at":   nil,
+		"updated_at":    time.Now(),
+	}
+	if schedule, enabled := task.effective(row); enabled {
+		if parsed, err := ParseCronSchedule(schedule); err == nil {
+			updates["next_run_at"] = parsed.Next(time.Now())
+		}
+	}
+	if err := s.DB.Model(&model.ScheduledTask{}).Where("name = ?", task.name).Updates(updates).Error; err != nil {
+		log.Error("failed to save the run of task %s: %s", task.name, err)
+	}
+}
+
+// backOff skips a task until the next poll.
+func (s *Scheduler) backOff(task *scheduledTask) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.backoff[task.name] = time.Now().Add(schedulerPollInterval)
+}
+
+// runTask calls the function of a task, turning panics into errors so the scheduler keeps running.
+func (s *Scheduler) runTask(task *scheduledTask) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("task panicked: %v", r)
+		}
+	}()
+	return task.run(s.ctx)
+}
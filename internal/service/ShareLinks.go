@@ -0,0 +1,116 @@
+package service
+
+import (
+	"crypto/rand"
+	"errors"
+	"gorm.io/gorm"
+	"keydrive/internal/model"
+	"math/big"
+	"path"
+	"time"
+)
+
+const (
+	ShareLinkActionView     = "view"
+	ShareLinkActionDownload = "download"
+	ShareLinkActionUpload   = "upload"
+	ShareLinkActionDenied   = "denied"
+)
+
+var ErrShareLinkExpired = errors.New("share link expired")
+var ErrShareLinkExhausted = errors.New("share link download limit reached")
+var ErrShareLinkPassword = errors.New("share link password required")
+
+const slugAlphabet = "abcdefghijkmnopqrstuvwxyzABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+const slugLength = 12
+
+type ShareLinks struct {
+	DB              *gorm.DB
+	PasswordEncoder *BcryptEncoder
+}
+
+func (s *ShareLinks) GetShareLinksForUser(user model.User, tx *gorm.DB) *gorm.DB {
+	query := tx.Model(&model.ShareLink{})
+	if user.IsAdmin {
+		return query
+	}
+	return query.Where("owner_id = ?", user.ID)
+}
+
+// CreateShareLink assigns a random slug to the link and saves it. An empty password creates a link that anyone can open.
+func (s *ShareLinks) CreateShareLink(tx *gorm.DB, link *model.ShareLink, password string) error {
+	slug, err := randomSlug()
+	if err != nil {
+		return err
+	}
+	link.Slug = slug
+	link.LibraryID = link.Library.ID
+	link.OwnerID = link.Owner.ID
+	if password != "" {
+		link.HashedPassword = s.PasswordEncoder.Encode(password)
+		link.HasPassword = true
+	}
+	return tx.Omit("Library", "Owner").Create(link).Error
+}
+
+// OpenShareLink looks up a link by its slug and checks that it can still be used with the given password.
+func (s *ShareLinks) OpenShareLink(slug string, password string) (model.ShareLink, error) {
+	var link model.ShareLink
+	result := s.DB.Model(&model.ShareLink{}).Preload("Library").Preload("Owner").Where("slug = ?", slug).Take(&link)
+	if result.Error != nil {
+		return link, result.Error
+	}
+	if link.ExpiresAt != nil && time.Now().After(*link.ExpiresAt) {
+		return link, ErrShareLinkExpired
+	}
+	if link.HasPassword && !s.PasswordEncoder.Compare(password, link.HashedPassword) {
+		return link, ErrShareLinkPassword
+	}
+	return link, nil
+}
+
+// CountDownload registers a download through the link, failing if that would exceed the download limit. The check and
+// update are a single statement, so concurrent downloads can not exceed the limit.
+func (s *ShareLinks) CountDownload(link *model.ShareLink) error {
+	result := s.DB.Model(&model.ShareLink{}).
+		Where("id = ? AND (max_downloads = 0 OR downloads < max_downloads)", link.ID).
+		UpdateColumn("downloads", gorm.Expr("downloads + 1"))
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrShareLinkExhausted
+	}
+	link.Downloads++
+	return nil
+}
+
+func (s *ShareLinks) LogAccess(link model.ShareLink, action string, entryPath string, remoteAddr string, userAgent string) error {
+	return s.DB.Omit("ShareLink").Create(&model.ShareLinkAccess{
+		ShareLinkID: link.ID,
+		Action:      action,
+		Path:        entryPath,
+		RemoteAddr:  remoteAddr,
+		UserAgent:   userAgent,
+		Time:        time.Now(),
+	}).Error
+}
+
+// ResolveSharedPath turns a path relative to the shared entry into a path in the library. The result can never be
+// outside the shared entry.
+func (s *ShareLinks) ResolveSharedPath(link model.ShareLink, relPath string) string {
+	return path.Join("/", link.Path, path.Clean("/"+relPath))
+}
+
+func randomSlug() (string, error) {
+	slug := make([]byte, slugLength)
+	max := big.NewInt(int64(len(slugAlphabet)))
+	for i := range slug {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+		slug[i] = slugAlphabet[n.Int64()]
+	}
+	return string(slug), nil
+}
@@ -0,0 +1,302 @@
+package service
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/rwcarlsen/goexif/exif"
+	"golang.org/x/image/draw"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"keydrive/internal/model"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	_ "golang.org/x/image/webp"
+	_ "image/gif"
+)
+
+// ThumbnailSizes are the sizes thumbnails are generated in. Requested sizes are rounded up to one of these, so the
+// cache does not fill up with slightly different sizes of the same image.
+var ThumbnailSizes = []int{128, 256, 512, 1024}
+
+// maxThumbnailPixels is the largest image that is decoded to generate a thumbnail. Larger images would take too much
+// memory, up to 4 bytes per pixel while they are decoded.
+const maxThumbnailPixels = 40_000_000
+
+// thumbnailDecoders limits how many images are decoded at the same time, so many requests for thumbnails of large
+// images do not exhaust the memory.
+var thumbnailDecoders = make(chan struct{}, runtime.NumCPU())
+
+var ErrNoThumbnail = errors.New("no thumbnail can be generated for this file")
+
+// Thumbnails generates small versions of images and keeps them in the system folder of their library. A cached
+// thumbnail is used as long as the size and modification time of the image do not change.
+type Thumbnails struct {
+	FileSystem *FileSystem
+}
+
+// Thumbnail is a generated thumbnail on disk.
+type Thumbnail struct {
+	File     string
+	MimeType string
+}
+
+// ThumbnailSize rounds a requested size up to the nearest standard size.
+func ThumbnailSize(requested int) int {
+	for _, size := range ThumbnailSizes {
+		if requested <= size {
+			return size
+		}
+	}
+	return ThumbnailSizes[len(ThumbnailSizes)-1]
+}
+
+// GetThumbnail returns the thumbnail of an image, generating it if it is not in the cache yet.
+func (t *Thumbnails) GetThumbnail(library model.Library, entryPath string, size int) (Thumbnail, error) {
+	size = ThumbnailSize(size)
+	entry, err := t.FileSystem.GetEntryMetadata(library, entryPath)
+	if err != nil {
+		return Thumbnail{}, err
+	}
+	if entry.Category != model.CategoryImage {
+		return Thumbnail{}, ErrNoThumbnail
+	}
+	source, err := t.FileSystem.resolve(library, entryPath, true)
+	if err != nil {
+		return Thumbnail{}, err
+	}
+	info, err := os.Stat(source)
+	if err != nil {
+		return Thumbnail{}, err
+	}
+
+	folder, err := t.cacheFolder(library, entryPath)
+	if err != nil {
+		return Thumbnail{}, err
+	}
+	thumbnail := Thumbnail{MimeType: "image/jpeg"}
+	extension := ".jpg"
+	if entry.MimeType == "image/png" || entry.MimeType == "image/gif" || entry.MimeType == "image/webp" {
+		// These can have transparent pixels, which JPEG does not support.
+		thumbnail.MimeType = "image/png"
+		extension = ".png"
+	}
+	prefix := fmt.Sprintf("%d-", size)
+	thumbnail.File = filepath.Join(folder, fmt.Sprintf("%s%d-%d%s", prefix, info.Size(), info.ModTime().UnixNano(), extension))
+	if _, err := os.Stat(thumbnail.File); err == nil {
+		return thumbnail, nil
+	}
+
+	// Thumbnails of an older version of the image are no longer needed.
+	if cached, err := os.ReadDir(folder); err == nil {
+		for _, file := range cached {
+			if strings.HasPrefix(file.Name(), prefix) {
+				_ = os.Remove(filepath.Join(folder, file.Name()))
+			}
+		}
+	}
+	if err := generateThumbnail(source, thumbnail.File, size); err != nil {
+		return Thumbnail{}, err
+	}
+	return thumbnail, nil
+}
+
+// GenerateAll generates thumbnails in every size for all images in a library that do not have them yet. It reports
+// the number of images that were processed after each one, and returns it at the end. It stops when the context is
+// cancelled.
+func (t *Thumbnails) GenerateAll(ctx context.Context, library model.Library, sizes []int, progress func(count int)) (int, error) {
+	root, err := t.FileSystem.libraryRoot(library)
+	if err != nil {
+		return 0, err
+	}
+	count := 0
+	err = filepath.Walk(root, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) || os.IsPermission(err) {
+				return nil
+			}
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		relative, err := filepath.Rel(root, file)
+		if err != nil {
+			return err
+		}
+		entryPath := "/" + filepath.ToSlash(relative)
+		if t.FileSystem.isSystemPath(entryPath) {
+			return filepath.SkipDir
+		}
+		if info.IsDir() || !info.Mode().IsRegular() {
+			return nil
+		}
+		if category, _ := t.FileSystem.DetectFileCategory(file, info.Name(), info, ""); category != model.CategoryImage {
+			return nil
+		}
+		for _, size := range sizes {
+			if _, err := t.GetThumbnail(library, entryPath, size); err != nil && !errors.Is(err, ErrNoThumbnail) {
+				log.Warn("failed to generate thumbnail for %s in library %d: %s", entryPath, library.ID, err)
+				break
+			}
+		}
+		count++
+		progress(count)
+		return nil
+	})
+	return count, err
+}
+
+// cacheFolder returns the folder that holds the thumbnails of an entry.
+func (t *Thumbnails) cacheFolder(library model.Library, entryPath string) (string, error) {
+	folder, err := t.FileSystem.systemFolder(library, "thumbnails")
+	if err != nil {
+		return "", err
+	}
+	hash := sha256.Sum256([]byte(filepath.ToSlash(t.FileSystem.cleanRelativePath(entryPath))))
+	name := hex.EncodeToString(hash[:])
+	folder = filepath.Join(folder, name[:2], name)
+	return folder, os.MkdirAll(folder, 0770)
+}
+
+func generateThumbnail(source string, target string, size int) error {
+	file, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	config, format, err := image.DecodeConfig(file)
+	if err != nil || config.Width*config.Height > maxThumbnailPixels {
+		return ErrNoThumbnail
+	}
+	thumbnail, err := decodeThumbnail(file, format, size)
+	if err != nil {
+		return err
+	}
+
+	staging, err := os.CreateTemp(filepath.Dir(target), ".thumbnail-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(staging.Name())
+	if strings.HasSuffix(target, ".png") {
+		err = png.Encode(staging, thumbnail)
+	} else {
+		err = jpeg.Encode(staging, thumbnail, &jpeg.Options{Quality: 85})
+	}
+	if closeErr := staging.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	// The thumbnail is renamed into place, so concurrent requests never see a partial file.
+	return os.Rename(staging.Name(), target)
+}
+
+// decodeThumbnail decodes an image and scales it down. Only a few images are decoded at the same time, and the original
+// is no longer needed once it is scaled down.
+func decodeThumbnail(file *os.File, format string, size int) (image.Image, error) {
+	thumbnailDecoders <- struct{}{}
+	defer func() { <-thumbnailDecoders }()
+	if _, err := file.Seek(0, 0); err != nil {
+		return nil, err
+	}
+	original, _, err := image.Decode(file)
+	if err != nil {
+		return nil, ErrNoThumbnail
+	}
+	orientation := 1
+	if format == "jpeg" {
+		if _, err := file.Seek(0, 0); err == nil {
+			orientation = exifOrientation(file)
+		}
+	}
+	return orient(resize(original, size), orientation), nil
+}
+
+// resize scales an image down so it fits in a square of the given size. Images are never scaled up.
+func resize(original image.Image, size int) image.Image {
+	bounds := original.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	if width <= size && height <= size {
+		return original
+	}
+	if width >= height {
+		width, height = size, height*size/width
+	} else {
+		width, height = width*size/height, size
+	}
+	// Very long or tall images are kept at least a pixel wide.
+	if width == 0 {
+		width = 1
+	}
+	if height == 0 {
+		height = 1
+	}
+	resized := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.CatmullRom.Scale(resized, resized.Bounds(), original, bounds, draw.Src, nil)
+	return resized
+}
+
+// exifOrientation reads the orientation tag of a JPEG image, which tells how the camera was held.
+func exifOrientation(file *os.File) int {
+	data, err := exif.Decode(file)
+	if err != nil {
+		return 1
+	}
+	tag, err := data.Get(exif.Orientation)
+	if err != nil {
+		return 1
+	}
+	orientation, err := tag.Int(0)
+	if err != nil || orientation < 1 || orientation > 8 {
+		return 1
+	}
+	return orientation
+}
+
+// orient rotates and flips an image, so it is shown upright for the given EXIF orientation.
+func orient(img image.Image, orientation int) image.Image {
+	if orientation == 1 {
+		return img
+	}
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	// Orientations 5 to 8 are rotated by 90 degrees, so width and height swap.
+	transposed := orientation >= 5
+	target := image.NewRGBA(image.Rect(0, 0, width, height))
+	if transposed {
+		target = image.NewRGBA(image.Rect(0, 0, height, width))
+	}
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			var tx, ty int
+			switch orientation {
+			case 2:
+				tx, ty = width-1-x, y
+			case 3:
+				tx, ty = width-1-x, height-1-y
+			case 4:
+				tx, ty = x, height-1-y
+			case 5:
+				tx, ty = y, x
+			case 6:
+				tx, ty = height-1-y, x
+			case 7:
+				tx, ty = height-1-y, width-1-x
+			case 8:
+				tx, ty = y, width-1-x
+			}
+			target.Set(tx, ty, img.At(bounds.Min.X+x, bounds.Min.Y+y))
+		}
+	}
+	return target
+}
@@ -0,0 +1,133 @@
+package service
+
+import (
+	"image"
+	"image/color"
+	"image/png"
+	"keydrive/internal/model"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeTestImage(t *testing.T, file string, width, height int) {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			img.Set(x, y, color.RGBA{R: uint8(x), G: uint8(y), B: 100, A: 255})
+		}
+	}
+	output, err := os.Create(file)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer output.Close()
+	if err := png.Encode(output, img); err != nil {
+		t.Fatal(err.Error())
+	}
+}
+
+func readImageSize(t *testing.T, file string) (int, int) {
+	input, err := os.Open(file)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer input.Close()
+	config, _, err := image.DecodeConfig(input)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	return config.Width, config.Height
+}
+
+func TestThumbnails(t *testing.T) {
+	tmpDir := t.TempDir()
+	writeTestImage(t, filepath.Join(tmpDir, "wide.png"), 400, 200)
+	writeTestImage(t, filepath.Join(tmpDir, "small.png"), 50, 40)
+	_ = os.WriteFile(filepath.Join(tmpDir, "text.txt"), []byte("Hello"), 0777)
+	lib := model.Library{
+		RootFolder: tmpDir,
+	}
+	thumbnails := Thumbnails{FileSystem: &FileSystem{}}
+
+	t.Run("it scales images down to a standard size", func(t *testing.T) {
+		thumbnail, err := thumbnails.GetThumbnail(lib, "/wide.png", 100)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if width, height := readImageSize(t, thumbnail.File); width != 128 || height != 64 {
+			t.Errorf("Expected a 128x64 thumbnail but got %dx%d", width, height)
+		}
+		if thumbnail.MimeType != "image/png" {
+			t.Errorf("Expected a png thumbnail but got: %s", thumbnail.MimeType)
+		}
+	})
+
+	t.Run("it does not scale images up", func(t *testing.T) {
+		thumbnail, err := thumbnails.GetThumbnail(lib, "/small.png", 256)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if width, height := readImageSize(t, thumbnail.File); width != 50 || height != 40 {
+			t.Errorf("Expected a 50x40 thumbnail but got %dx%d", width, height)
+		}
+	})
+
+	t.Run("it regenerates thumbnails when the image changes", func(t *testing.T) {
+		first, _ := thumbnails.GetThumbnail(lib, "/wide.png", 128)
+		cached, _ := thumbnails.GetThumbnail(lib, "/wide.png", 128)
+		if first.File != cached.File {
+			t.Errorf("Expected the cached thumbnail to be used")
+		}
+
+		writeTestImage(t, filepath.Join(tmpDir, "wide.png"), 200, 400)
+		later := time.Now().Add(time.Minute)
+		_ = os.Chtimes(filepath.Join(tmpDir, "wide.png"), later, later)
+		updated, err := thumbnails.GetThumbnail(lib, "/wide.png", 128)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if width, height := readImageSize(t, updated.File); width != 64 || height != 128 {
+			t.Errorf("Expected a 64x128 thumbnail but got %dx%d", width, height)
+		}
+		if _, err := os.Stat(first.File); !os.IsNotExist(err) {
+			t.Errorf("Expected the old thumbnail to be removed")
+		}
+	})
+
+	t.Run("it generates thumbnails of gifs", func(t *testing.T) {
+		// A single transparent pixel, written as bytes so the test does not register the gif decoder itself.
+		pixel := "GIF89a\x01\x00\x01\x00\x80\x00\x00\xff\xff\xff\x00\x00\x00!\xf9\x04\x01\x00\x00\x00\x00" +
+			",\x00\x00\x00\x00\x01\x00\x01\x00\x00\x02\x02D\x01\x00;"
+		_ = os.WriteFile(filepath.Join(tmpDir, "pixel.gif"), []byte(pixel), 0777)
+
+		thumbnail, err := thumbnails.GetThumbnail(lib, "/pixel.gif", 128)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if width, height := readImageSize(t, thumbnail.File); width != 1 || height != 1 || thumbnail.MimeType != "image/png" {
+			t.Errorf("Expected a 1x1 png thumbnail but got %dx%d %s", width, height, thumbnail.MimeType)
+		}
+	})
+
+	t.Run("it does not generate thumbnails for other files", func(t *testing.T) {
+		if _, err := thumbnails.GetThumbnail(lib, "/text.txt", 128); err != ErrNoThumbnail {
+			t.Errorf("Expected ErrNoThumbnail but got: %v", err)
+		}
+	})
+}
+
+func TestOrient(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 3, 2))
+	img.Set(0, 0, color.RGBA{R: 255, A: 255})
+
+	rotated := orient(img, 6)
+	if bounds := rotated.Bounds(); bounds.Dx() != 2 || bounds.Dy() != 3 {
+		t.Fatalf("Expected a 2x3 image but got %dx%d", bounds.Dx(), bounds.Dy())
+	}
+	// Orientation 6 is rotated 90 degrees clockwise, so the top left corner moves to the top right.
+	if r, _, _, _ := rotated.At(1, 0).RGBA(); r == 0 {
+		t.Errorf("Expected the marked pixel in the top right corner")
+	}
+}
@@ -0,0 +1,379 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"io"
+	"keydrive/internal/model"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+var ErrTransferIntoItself = errors.New("an entry can not be copied or moved into itself")
+
+// ConflictPolicy decides what happens when the target of a copy or move already exists.
+type ConflictPolicy string
+
+const (
+	// ConflictFail refuses to touch the existing entry and fails with ErrEntryExists.
+	ConflictFail ConflictPolicy = "fail"
+	// ConflictOverwrite replaces the existing entry.
+	ConflictOverwrite ConflictPolicy = "overwrite"
+	// ConflictRename keeps the existing entry and picks a free name like "name (1).ext" for the new one.
+	ConflictRename ConflictPolicy = "rename"
+	// ConflictSkip keeps the existing entry and leaves the source alone.
+	ConflictSkip ConflictPolicy = "skip"
+)
+
+// transferProgressInterval is how often progress is reported while a transfer is running.
+const transferProgressInterval = time.Second
+
+// maxRenameAttempts limits the names that are tried for ConflictRename.
+const maxRenameAttempts = 1000
+
+type TransferProgress struct {
+	Files      int   `json:"files"`
+	TotalFiles int   `json:"totalFiles"`
+	Bytes      int64 `json:"bytes"`
+	TotalBytes int64 `json:"totalBytes"`
+}
+
+// TransferResult describes a finished copy or move. Path is where the entry ended up, which differs from the requested
+// target when it was renamed because of a conflict. Replaced is set if an existing entry was overwritten; it is kept in
+// the system folder of the target library until it is handed to the trash with Trash.KeepReplaced.
+type TransferResult struct {
+	Path     string `json:"path"`
+	Skipped  bool   `json:"skipped"`
+	Replaced bool   `json:"replaced,omitempty"`
+	TransferProgress
+
+	replacedFile string
+}
+
+// ProgressFunc is told about the progress of a transfer. It is called at most once per transferProgressInterval while
+// files are copied, and once more when the transfer is done.
+type ProgressFunc func(progress TransferProgress)
+
+// transfer is a copy or move of a single entry that has been checked and resolved.
+type transfer struct {
+	source     model.Library
+	target     model.Library
+	sourcePath string
+	targetPath string
+	sourceFile string
+	targetFile string
+	// replace is set if an existing entry at the target has to be set aside. replacedFile is where it was put.
+	replace      bool
+	replacedFile string
+	skip         bool
+
+	ctx          context.Context
+	progress     TransferProgress
+	report       ProgressFunc
+	lastReported time.Time
+}
+
+// prepareTransfer resolves the source and the target of a transfer, and applies the conflict policy if the target
+// already exists. Links at the source are followed if followSource is set, and moved as they are otherwise.
+func (fs *FileSystem) prepareTransfer(source model.Library, sourcePath string, target model.Library, targetPath string, conflict ConflictPolicy, followSource bool) (*transfer, error) {
+	sourcePath = filepath.ToSlash(fs.cleanRelativePath(sourcePath))
+	targetPath = filepath.ToSlash(fs.cleanRelativePath(targetPath))
+	if sourcePath == "/" || targetPath == "/" || fs.isSystemPath(sourcePath) || fs.isSystemPath(targetPath) {
+		return nil, ErrReservedPath
+	}
+	sourceFile, err := fs.resolve(source, sourcePath, followSource)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := os.Lstat(sourceFile); err != nil {
+		return nil, err
+	}
+	targetFile, err := fs.resolve(target, targetPath, false)
+	if err != nil {
+		return nil, err
+	}
+	if isInside(sourceFile, targetFile) {
+		return nil, ErrTransferIntoItself
+	}
+
+	t := &transfer{
+		source:     source,
+		target:     target,
+		sourcePath: sourcePath,
+		targetPath: targetPath,
+		sourceFile: sourceFile,
+		targetFile: targetFile,
+	}
+	if _, err := os.Lstat(targetFile); os.IsNotExist(err) {
+		return t, nil
+	} else if err != nil {
+		return nil, err
+	}
+	switch conflict {
+	case ConflictOverwrite:
+		t.replace = true
+	case ConflictSkip:
+		t.skip = true
+	case ConflictRename:
+		if err := fs.renameTarget(t); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, ErrEntryExists
+	}
+	return t, nil
+}
+
+// renameTarget changes the target of a transfer to the first free name with a number in it.
+func (fs *FileSystem) renameTarget(t *transfer) error {
+	parent, name := path.Split(t.targetPath)
+	extension := path.Ext(name)
+	if extension == name {
+		// Hidden files like .profile have no extension.
+		extension = ""
+	}
+	base := strings.TrimSuffix(name, extension)
+	for i := 1; i <= maxRenameAttempts; i++ {
+		candidate := path.Join(parent, base+" ("+strconv.Itoa(i)+")"+extension)
+		file, err := fs.resolve(t.target, candidate, false)
+		if err != nil {
+			return err
+		}
+		if _, err := os.Lstat(file); os.IsNotExist(err) {
+			t.targetPath = candidate
+			t.targetFile = file
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+	return ErrEntryExists
+}
+
+func (t *transfer) result() TransferResult {
+	return TransferResult{
+		Path:             t.targetPath,
+		Skipped:          t.skip,
+		Replaced:         t.replacedFile != "",
+		TransferProgress: t.progress,
+		replacedFile:     t.replacedFile,
+	}
+}
+
+// placeTransfer renames a file or folder to the target of a transfer. An existing entry at the target is set aside in
+// the system folder of the target library first, and put back if the rename fails, so it is only gone once the new
+// entry is in place.
+func (fs *FileSystem) placeTransfer(t *transfer, from model.Library, file string) error {
+	var aside string
+	if t.replace {
+		folder, err := fs.systemFolder(t.target, "transfers")
+		if err != nil {
+			return err
+		}
+		slug, err := randomSlug()
+		if err != nil {
+			return err
+		}
+		aside = filepath.Join(folder, slug)
+		if err := fs.rename(t.target, t.targetFile, t.target, aside); err != nil {
+			return err
+		}
+	}
+	if err := fs.rename(from, file, t.target, t.targetFile); err != nil {
+		if aside != "" {
+			if restoreErr := fs.rename(t.target, aside, t.target, t.targetFile); restoreErr != nil {
+				log.Error("failed to put back %s after a failed transfer: %s", t.targetFile, restoreErr)
+			}
+		}
+		return err
+	}
+	t.replacedFile = aside
+	return nil
+}
+
+// DiscardReplaced deletes the entry that was overwritten by a transfer, for callers that do not keep it in the trash.
+func (fs *FileSystem) DiscardReplaced(result TransferResult) error {
+	if result.replacedFile == "" {
+		return nil
+	}
+	return os.RemoveAll(result.replacedFile)
+}
+
+// CopyEntry copies a file or a folder with everything in it, possibly into another library. The copy is made in the
+// system folder of the target library first, so an incomplete copy never shows up in the library. Links and devices
+// inside copied folders are left out. Copying stops when the context is cancelled.
+func (fs *FileSystem) CopyEntry(ctx context.Context, source model.Library, sourcePath string, target model.Library, targetPath string, conflict ConflictPolicy, report ProgressFunc) (TransferResult, error) {
+	t, err := fs.prepareTransfer(source, sourcePath, target, targetPath, conflict, true)
+	if err != nil {
+		return TransferResult{}, err
+	}
+	t.ctx = ctx
+	t.report = report
+	if t.skip {
+		return t.result(), nil
+	}
+	if err := fs.copyTransfer(t); err != nil {
+		return TransferResult{}, err
+	}
+	fs.changed(target, t.targetPath)
+	return t.result(), nil
+}
+
+// MoveEntry moves a file or a folder, possibly into another library. Entries are renamed if possible, and copied and
+// deleted if the source and the target are on different filesystems. Copying stops when the context is cancelled, and
+// the source is left as it was.
+func (fs *FileSystem) MoveEntry(ctx context.Context, source model.Library, sourcePath string, target model.Library, targetPath string, conflict ConflictPolicy, report ProgressFunc) (TransferResult, error) {
+	t, err := fs.prepareTransfer(source, sourcePath, target, targetPath, conflict, false)
+	if err != nil {
+		return TransferResult{}, err
+	}
+	t.ctx = ctx
+	t.report = report
+	if t.skip {
+		return t.result(), nil
+	}
+
+	err = fs.placeTransfer(t, source, t.sourceFile)
+	if errors.Is(err, syscall.EXDEV) {
+		// Links can not be moved to another filesystem, so what they point to is copied instead.
+		original := t.sourceFile
+		if t.sourceFile, err = fs.resolve(source, t.sourcePath, true); err != nil {
+			return TransferResult{}, err
+		}
+		if err = fs.copyTransfer(t); err == nil {
+			err = os.RemoveAll(original)
+		}
+	} else if err == nil {
+		t.reportProgress(true)
+	}
+	if err != nil {
+		return TransferResult{}, err
+	}
+
+	if source.ID == target.ID {
+		fs.moved(source, t.sourcePath, t.targetPath)
+	} else {
+		fs.changed(source, t.sourcePath)
+		fs.changed(target, t.targetPath)
+	}
+	return t.result(), nil
+}
+
+// copyTransfer copies the source of a transfer into a staging folder and then moves it to the target.
+func (fs *FileSystem) copyTransfer(t *transfer) error {
+	if err := fs.countTransfer(t); err != nil {
+		return err
+	}
+	folder, err := fs.systemFolder(t.target, "transfers")
+	if err != nil {
+		return err
+	}
+	slug, err := randomSlug()
+	if err != nil {
+		return err
+	}
+	staged := filepath.Join(folder, slug)
+	defer os.RemoveAll(staged)
+
+	err = filepath.Walk(t.sourceFile, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := t.ctx.Err(); err != nil {
+			return err
+		}
+		relative, err := filepath.Rel(t.sourceFile, file)
+		if err != nil {
+			return err
+		}
+		destination := filepath.Join(staged, relative)
+		if info.IsDir() {
+			return os.Mkdir(destination, 0770)
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		if err := t.copyFile(file, destination, info); err != nil {
+			return err
+		}
+		t.progress.Files++
+		t.reportProgress(false)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := fs.placeTransfer(t, t.target, staged); err != nil {
+		return err
+	}
+	t.reportProgress(true)
+	return nil
+}
+
+// countTransfer adds up the files and bytes that have to be copied, so progress can be reported against them.
+func (fs *FileSystem) countTransfer(t *transfer) error {
+	return filepath.Walk(t.sourceFile, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() {
+			t.progress.TotalFiles++
+			t.progress.TotalBytes += info.Size()
+		}
+		return nil
+	})
+}
+
+func (t *transfer) copyFile(source string, destination string, info os.FileInfo) error {
+	in, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(destination, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0660)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, &progressReader{reader: in, transfer: t}); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	return os.Chtimes(destination, info.ModTime(), info.ModTime())
+}
+
+func (t *transfer) reportProgress(done bool) {
+	if t.report == nil {
+		return
+	}
+	if !done && time.Since(t.lastReported) < transferProgressInterval {
+		return
+	}
+	t.lastReported = time.Now()
+	t.report(t.progress)
+}
+
+// progressReader counts the bytes of a transfer while they are copied, so large files report progress too. It stops
+// when the transfer is cancelled.
+type progressReader struct {
+	reader   io.Reader
+	transfer *transfer
+}
+
+func (p *progressReader) Read(data []byte) (int, error) {
+	if err := p.transfer.ctx.Err(); err != nil {
+		return 0, err
+	}
+	n, err := p.reader.Read(data)
+	p.transfer.progress.Bytes += int64(n)
+	p.transfer.reportProgress(false)
+	return n, err
+}
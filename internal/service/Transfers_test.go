@@ -0,0 +1,93 @@
+package service
+
+import (
+	"context"
+	"keydrive/internal/model"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestTransfers(t *testing.T) {
+	fs := &FileSystem{}
+	source := model.Library{ID: 1, RootFolder: t.TempDir()}
+	target := model.Library{ID: 2, RootFolder: t.TempDir()}
+	_ = os.MkdirAll(filepath.Join(source.RootFolder, "folder", "nested"), 0777)
+	_ = os.WriteFile(filepath.Join(source.RootFolder, "folder", "nested", "file.txt"), []byte("Nested\n"), 0777)
+	_ = os.WriteFile(filepath.Join(source.RootFolder, "report.pdf"), []byte("New\n"), 0777)
+	_ = os.WriteFile(filepath.Join(target.RootFolder, "report.pdf"), []byte("Old\n"), 0777)
+
+	t.Run("it copies folders and reports progress", func(t *testing.T) {
+		var last TransferProgress
+		result, err := fs.CopyEntry(context.Background(), source, "/folder", target, "/folder", ConflictFail, func(progress TransferProgress) {
+			last = progress
+		})
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		expected := TransferProgress{Files: 1, TotalFiles: 1, Bytes: 7, TotalBytes: 7}
+		if result.Path != "/folder" || last != expected || result.TransferProgress != expected {
+			t.Errorf("Unexpected result %+v and progress %+v", result, last)
+		}
+		if data, err := os.ReadFile(filepath.Join(target.RootFolder, "folder", "nested", "file.txt")); err != nil || string(data) != "Nested\n" {
+			t.Errorf("Expected the file to be copied: %v", err)
+		}
+		if entries, _ := os.ReadDir(filepath.Join(target.RootFolder, SystemFolder, "transfers")); len(entries) != 0 {
+			t.Errorf("Expected the staging folder to be cleaned up: %v", entries)
+		}
+	})
+
+	t.Run("it applies conflict policies", func(t *testing.T) {
+		if _, err := fs.CopyEntry(context.Background(), source, "/report.pdf", target, "/report.pdf", ConflictFail, nil); err != ErrEntryExists {
+			t.Errorf("Expected ErrEntryExists but got: %v", err)
+		}
+		if result, err := fs.CopyEntry(context.Background(), source, "/report.pdf", target, "/report.pdf", ConflictSkip, nil); err != nil || !result.Skipped {
+			t.Errorf("Expected the copy to be skipped: %+v, %v", result, err)
+		}
+		if result, err := fs.CopyEntry(context.Background(), source, "/report.pdf", target, "/report.pdf", ConflictRename, nil); err != nil || result.Path != "/report (1).pdf" {
+			t.Errorf("Expected the copy to be renamed: %+v, %v", result, err)
+		}
+		result, err := fs.CopyEntry(context.Background(), source, "/report.pdf", target, "/report.pdf", ConflictOverwrite, nil)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if data, _ := os.ReadFile(filepath.Join(target.RootFolder, "report.pdf")); string(data) != "New\n" {
+			t.Errorf("Expected the file to be overwritten: %s", data)
+		}
+		if data, _ := os.ReadFile(result.replacedFile); !result.Replaced || string(data) != "Old\n" {
+			t.Errorf("Expected the old file to be set aside: %+v", result)
+		}
+		if err := fs.DiscardReplaced(result); err != nil {
+			t.Fatal(err.Error())
+		}
+		if entries, _ := os.ReadDir(filepath.Join(target.RootFolder, SystemFolder, "transfers")); len(entries) != 0 {
+			t.Errorf("Expected the old file to be discarded: %v", entries)
+		}
+	})
+
+	t.Run("it moves folders over existing folders", func(t *testing.T) {
+		result, err := fs.MoveEntry(context.Background(), source, "/folder", target, "/folder", ConflictOverwrite, nil)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if _, err := os.Stat(filepath.Join(result.replacedFile, "nested", "file.txt")); !result.Replaced || err != nil {
+			t.Errorf("Expected the old folder to be set aside: %+v, %v", result, err)
+		}
+		_ = fs.DiscardReplaced(result)
+		if _, err := os.Stat(filepath.Join(source.RootFolder, "folder")); !os.IsNotExist(err) {
+			t.Errorf("Expected the source to be gone: %v", err)
+		}
+		if _, err := os.Stat(filepath.Join(target.RootFolder, "folder", "nested", "file.txt")); err != nil {
+			t.Errorf("Expected the folder to be moved: %s", err)
+		}
+	})
+
+	t.Run("it does not move entries into themselves", func(t *testing.T) {
+		if _, err := fs.MoveEntry(context.Background(), target, "/folder", target, "/folder/nested/folder", ConflictFail, nil); err != ErrTransferIntoItself {
+			t.Errorf("Expected ErrTransferIntoItself but got: %v", err)
+		}
+		if _, err := fs.CopyEntry(context.Background(), target, "/folder", target, "/folder", ConflictOverwrite, nil); err != ErrTransferIntoItself {
+			t.Errorf("Expected ErrTransferIntoItself but got: %v", err)
+		}
+	})
+}
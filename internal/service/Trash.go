@@ -0,0 +1,165 @@
+package service
+
+import (
+	"errors"
+	"gorm.io/gorm"
+	"keydrive/internal/model"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+var ErrEntryExists = errors.New("an entry with this name already exists")
+
+// Trash keeps deleted entries in the system folder of their library, so they can be restored until the retention
+// period has passed.
+type Trash struct {
+	DB         *gorm.DB
+	FileSystem *FileSystem
+	Retention  time.Duration
+}
+
+func (t *Trash) GetTrashForLibrary(library model.Library, tx *gorm.DB) *gorm.DB {
+	return tx.Model(&model.TrashItem{}).Where("library_id = ?", library.ID)
+}
+
+// trashFile returns the location on disk where the entry of a trash item is kept.
+func (t *Trash) trashFile(library model.Library, item model.TrashItem) (string, error) {
+	folder, err := t.FileSystem.systemFolder(library, "trash")
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(folder, strconv.Itoa(item.ID)), nil
+}
+
+// MoveToTrash moves an entry out of the library and into the trash.
+func (t *Trash) MoveToTrash(library model.Library, user model.User, entryPath string) (model.TrashItem, error) {
+	entryPath = t.FileSystem.cleanRelativePath(entryPath)
+	if entryPath == "/" || t.FileSystem.isSystemPath(entryPath) {
+		return model.TrashItem{}, ErrReservedPath
+	}
+	entry, err := t.FileSystem.GetEntryMetadata(library, entryPath)
+	if err != nil {
+		return model.TrashItem{}, err
+	}
+	source, err := t.FileSystem.resolve(library, entryPath, false)
+	if err != nil {
+		return model.TrashItem{}, err
+	}
+	item, err := t.keep(library, user, entry, source)
+	if err == nil {
+		t.FileSystem.changed(library, item.Path)
+	}
+	return item, err
+}
+
+// KeepReplaced moves the entry that was overwritten by a copy or move into the trash, so it can be restored like a
+// deleted entry. It does nothing if the transfer did not replace anything.
+func (t *Trash) KeepReplaced(library model.Library, user model.User, result TransferResult) (model.TrashItem, error) {
+	if result.replacedFile == "" {
+		return model.TrashItem{}, nil
+	}
+	info, err := os.Lstat(result.replacedFile)
+	if err != nil {
+		return model.TrashItem{}, err
+	}
+	entryPath := t.FileSystem.cleanRelativePath(result.Path)
+	entry := t.FileSystem.toInfo(result.replacedFile, path.Base(entryPath), info, path.Dir(entryPath), false)
+	return t.keep(library, user, entry, result.replacedFile)
+}
+
+// keep records a trash item for an entry and moves the entry from source into the trash.
+func (t *Trash) keep(library model.Library, user model.User, entry FileInfo, source string) (model.TrashItem, error) {
+	item := model.TrashItem{
+		LibraryID:   library.ID,
+		Library:     library,
+		Path:        path.Join(entry.Parent, entry.Name),
+		Category:    entry.Category,
+		Size:        entry.Size,
+		DeletedByID: &user.ID,
+		DeletedAt:   time.Now(),
+	}
+	err := t.DB.Transaction(func(tx *gorm.DB) error {
+		if result := tx.Omit("Library", "DeletedBy").Create(&item); result.Error != nil {
+			return result.Error
+		}
+		target, err := t.trashFile(library, item)
+		if err != nil {
+			return err
+		}
+		return t.FileSystem.rename(library, source, library, target)
+	})
+	return item, err
+}
+
+// Restore moves an entry from the trash back to its original path. Missing parent folders are created again, but an
+// entry that has been created at the same path in the meantime is never overwritten.
+func (t *Trash) Restore(item model.TrashItem) (FileInfo, error) {
+	source, err := t.trashFile(item.Library, item)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	target, err := t.FileSystem.resolve(item.Library, item.Path, false)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	if err := t.FileSystem.mkdirAll(item.Library, filepath.Dir(target)); err != nil {
+		return FileInfo{}, err
+	}
+	if err := t.FileSystem.renameNoReplace(item.Library, source, item.Library, target); err != nil {
+		return FileInfo{}, err
+	}
+	t.FileSystem.changed(item.Library, item.Path)
+	if err := t.DB.Delete(&model.TrashItem{}, item.ID).Error; err != nil {
+		return FileInfo{}, err
+	}
+	return t.FileSystem.GetEntryMetadata(item.Library, item.Path)
+}
+
+// Purge permanently deletes an item in the trash.
+func (t *Trash) Purge(item model.TrashItem) error {
+	file, err := t.trashFile(item.Library, item)
+	if err != nil {
+		return err
+	}
+	if err := os.RemoveAll(file); err != nil {
+		return err
+	}
+	return t.DB.Delete(&model.TrashItem{}, item.ID).Error
+}
+
+// PurgeAll permanently deletes all items in the trash of a library and returns how many there were.
+func (t *Trash) PurgeAll(library model.Library) (int, error) {
+	var items []model.TrashItem
+	if result := t.GetTrashForLibrary(library, t.DB).Find(&items); result.Error != nil {
+		return 0, result.Error
+	}
+	for i, item := range items {
+		item.Library = library
+		if err := t.Purge(item); err != nil {
+			return i, err
+		}
+	}
+	return len(items), nil
+}
+
+// PurgeExpired permanently deletes all items that have been in the trash for longer than the retention period and
+// returns how many there were.
+func (t *Trash) PurgeExpired() (int, error) {
+	var expired []model.TrashItem
+	result := t.DB.Model(&model.TrashItem{}).
+		Preload("Library").
+		Where("deleted_at < ?", time.Now().Add(-t.Retention)).
+		Find(&expired)
+	if result.Error != nil {
+		return 0, result.Error
+	}
+	for i, item := range expired {
+		if err := t.Purge(item); err != nil {
+			return i, err
+		}
+	}
+	return len(expired), nil
+}
@@ -0,0 +1,209 @@
+package service
+
+import (
+	"errors"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"io"
+	"keydrive/internal/model"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+var ErrUploadExpired = errors.New("upload expired")
+var ErrOffsetMismatch = errors.New("upload offset does not match")
+var ErrNoParentFolder = errors.New("the parent folder does not exist")
+
+// Uploads keeps track of resumable uploads. The data of an upload is staged in the system folder of its library, and
+// moved to the target path once all bytes have been received.
+type Uploads struct {
+	DB         *gorm.DB
+	FileSystem *FileSystem
+	Versions   *Versions
+	// Quotas is checked with the length of new uploads, and charges the user once an upload is complete.
+	Quotas     *Quotas
+	Expiration time.Duration
+	locks      sync.Map
+}
+
+func (u *Uploads) CreateUpload(library model.Library, user model.User, path string, length int64, metadata string) (model.Upload, error) {
+	upload := model.Upload{
+		ID:        uuid.NewString(),
+		LibraryID: library.ID,
+		Library:   library,
+		UserID:    user.ID,
+		Path:      u.FileSystem.cleanRelativePath(path),
+		Length:    length,
+		Metadata:  metadata,
+		ExpiresAt: time.Now().Add(u.Expiration),
+	}
+	if upload.Path == "/" || u.FileSystem.isSystemPath(upload.Path) {
+		return upload, ErrReservedPath
+	}
+	if err := u.checkParent(library, upload.Path); err != nil {
+		return upload, err
+	}
+	if u.Quotas != nil {
+		if err := u.Quotas.Check(library, user, length); err != nil {
+			return upload, err
+		}
+	}
+
+	if _, err := u.FileSystem.CreateStagingFile(library, upload.ID); err != nil {
+		return upload, err
+	}
+	if result := u.DB.Omit("Library", "User").Create(&upload); result.Error != nil {
+		_ = os.Remove(u.FileSystem.StagingFile(library, upload.ID))
+		return upload, result.Error
+	}
+	return upload, nil
+}
+
+// checkParent makes sure the folder the upload is placed in exists, so clients do not send all the data of an upload
+// that can never be committed.
+func (u *Uploads) checkParent(library model.Library, path string) error {
+	parent, err := u.FileSystem.resolve(library, filepath.Dir(path), true)
+	if err != nil {
+		return err
+	}
+	info, err := os.Stat(parent)
+	if os.IsNotExist(err) || (err == nil && !info.IsDir()) {
+		return ErrNoParentFolder
+	}
+	return err
+}
+
+// GetUpload looks up an upload that was started by the user and returns it, together with the number of bytes that
+// were received so far.
+func (u *Uploads) GetUpload(library model.Library, user model.User, id string) (model.Upload, int64, error) {
+	var upload model.Upload
+	if _, err := uuid.Parse(id); err != nil {
+		return upload, 0, gorm.ErrRecordNotFound
+	}
+	result := u.DB.Model(&model.Upload{}).
+		Where(&model.Upload{ID: id, LibraryID: library.ID, UserID: user.ID}).
+		Take(&upload)
+	if result.Error != nil {
+		return upload, 0, result.Error
+	}
+	upload.Library = library
+	if time.Now().After(upload.ExpiresAt) {
+		return upload, 0, ErrUploadExpired
+	}
+	info, err := os.Stat(u.FileSystem.StagingFile(library, upload.ID))
+	if err != nil {
+		return upload, 0, err
+	}
+	return upload, info.Size(), nil
+}
+
+// WriteUpload appends data to an upload, starting at the given offset. The bytes that were written are kept, even if
+// reading the data fails halfway through. Once the upload is complete, it is committed to its target path and the
+// resulting entry is returned.
+func (u *Uploads) WriteUpload(upload model.Upload, offset int64, data io.Reader) (int64, *FileInfo, error) {
+	lock, _ := u.locks.LoadOrStore(upload.ID, &sync.Mutex{})
+	lock.(*sync.Mutex).Lock()
+	offset, created, err := u.write(upload, offset, data)
+	lock.(*sync.Mutex).Unlock()
+	if created != nil {
+		// The lock is only forgotten once it is released and the upload is gone, so no request can find the upload
+		// and take a new lock while another one still writes to it.
+		u.locks.Delete(upload.ID)
+	}
+	return offset, created, err
+}
+
+func (u *Uploads) write(upload model.Upload, offset int64, data io.Reader) (int64, *FileInfo, error) {
+	staged := u.FileSystem.StagingFile(upload.Library, upload.ID)
+	file, err := os.OpenFile(staged, os.O_WRONLY|os.O_APPEND, 0660)
+	if err != nil {
+		return 0, nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return 0, nil, err
+	}
+	if info.Size() != offset {
+		_ = file.Close()
+		return info.Size(), nil, ErrOffsetMismatch
+	}
+
+	written, copyErr := io.Copy(file, io.LimitReader(data, upload.Length-offset))
+	offset += written
+	if err := file.Close(); err != nil {
+		return offset, nil, err
+	}
+	if copyErr != nil {
+		return offset, nil, copyErr
+	}
+	if offset < upload.Length {
+		return offset, nil, nil
+	}
+
+	created, err := u.commit(upload)
+	if err != nil {
+		return offset, nil, err
+	}
+	return offset, &created, nil
+}
+
+// CompleteEmptyUpload commits an upload without any data. Uploads with data are committed by WriteUpload.
+func (u *Uploads) CompleteEmptyUpload(upload model.Upload) (FileInfo, error) {
+	if upload.Length != 0 {
+		return FileInfo{}, ErrOffsetMismatch
+	}
+	return u.commit(upload)
+}
+
+func (u *Uploads) commit(upload model.Upload) (FileInfo, error) {
+	if u.Versions != nil {
+		if err := u.Versions.KeepVersion(upload.Library, upload.Path); err != nil {
+			return FileInfo{}, err
+		}
+	}
+	staged := u.FileSystem.StagingFile(upload.Library, upload.ID)
+	created, err := u.FileSystem.CommitFileInLibrary(upload.Library, staged, upload.Path)
+	if err != nil {
+		return created, err
+	}
+	if u.Quotas != nil {
+		if err := u.Quotas.Claim(upload.Library, upload.Path, upload.UserID); err != nil {
+			return created, err
+		}
+	}
+	return created, u.DB.Delete(&model.Upload{ID: upload.ID}).Error
+}
+
+// TerminateUpload stops an upload and throws away all data that was received.
+func (u *Uploads) TerminateUpload(upload model.Upload) error {
+	err := os.Remove(u.FileSystem.StagingFile(upload.Library, upload.ID))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := u.DB.Delete(&model.Upload{ID: upload.ID}).Error; err != nil {
+		return err
+	}
+	u.locks.Delete(upload.ID)
+	return nil
+}
+
+// PurgeExpiredUploads terminates all uploads that have expired and returns how many there were.
+func (u *Uploads) PurgeExpiredUploads() (int, error) {
+	var expired []model.Upload
+	result := u.DB.Model(&model.Upload{}).
+		Preload("Library").
+		Where("expires_at < ?", time.Now()).
+		Find(&expired)
+	if result.Error != nil {
+		return 0, result.Error
+	}
+	for i, upload := range expired {
+		if err := u.TerminateUpload(upload); err != nil {
+			return i, err
+		}
+	}
+	return len(expired), nil
+}
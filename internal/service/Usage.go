@@ -0,0 +1,71 @@
+package service
+
+import (
+	"gorm.io/gorm"
+	"keydrive/internal/model"
+	"os"
+	"path/filepath"
+)
+
+type UsageStats struct {
+	Count int64 `json:"count"`
+	Size  int64 `json:"size"`
+}
+
+type LibraryUsage struct {
+	Files    UsageStats `json:"files"`
+	Trash    UsageStats `json:"trash"`
+	Versions UsageStats `json:"versions"`
+}
+
+// Usage reports how much disk space is used by a library. Files in the trash and old versions are counted separately
+// from the files in the library.
+type Usage struct {
+	DB         *gorm.DB
+	FileSystem *FileSystem
+}
+
+func (u *Usage) GetUsageForLibrary(library model.Library) (LibraryUsage, error) {
+	var usage LibraryUsage
+	root, err := u.FileSystem.libraryRoot(library)
+	if err != nil {
+		return usage, err
+	}
+	if usage.Files, err = diskUsage(root, filepath.Join(root, SystemFolder)); err != nil {
+		return usage, err
+	}
+
+	trash, err := diskUsage(filepath.Join(root, SystemFolder, "trash"), "")
+	if err != nil && !os.IsNotExist(err) {
+		return usage, err
+	}
+	usage.Trash.Size = trash.Size
+	if result := u.DB.Model(&model.TrashItem{}).Where("library_id = ?", library.ID).Count(&usage.Trash.Count); result.Error != nil {
+		return usage, result.Error
+	}
+
+	result := u.DB.Model(&model.FileVersion{}).
+		Select("count(*) AS count, coalesce(sum(size), 0) AS size").
+		Where("library_id = ?", library.ID).
+		Scan(&usage.Versions)
+	return usage, result.Error
+}
+
+// diskUsage counts the regular files in a folder and their total size, leaving out the skipped folder.
+func diskUsage(root string, skip string) (UsageStats, error) {
+	var stats UsageStats
+	err := filepath.Walk(root, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() && file == skip {
+			return filepath.SkipDir
+		}
+		if info.Mode().IsRegular() {
+			stats.Count++
+			stats.Size += info.Size()
+		}
+		return nil
+	})
+	return stats, err
+}
@@ -0,0 +1,208 @@
+package service
+
+import (
+	"gorm.io/gorm"
+	"io"
+	"keydrive/internal/model"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// Versions keeps the previous content of overwritten files in the system folder of their library. Only the newest
+// MaxCount versions of a file are kept, and versions older than MaxAge are purged.
+type Versions struct {
+	DB         *gorm.DB
+	FileSystem *FileSystem
+	MaxCount   int
+	MaxAge     time.Duration
+}
+
+func (v *Versions) GetVersionsForEntry(library model.Library, path string, tx *gorm.DB) *gorm.DB {
+	return tx.Model(&model.FileVersion{}).
+		Where("library_id = ? AND path = ?", library.ID, v.FileSystem.cleanRelativePath(path))
+}
+
+func (v *Versions) GetVersion(library model.Library, id int, tx *gorm.DB) (model.FileVersion, error) {
+	var version model.FileVersion
+	result := tx.Model(&model.FileVersion{}).Where("library_id = ?", library.ID).Take(&version, id)
+	version.Library = library
+	return version, result.Error
+}
+
+// versionFile returns the location on disk where the content of a version is kept.
+func (v *Versions) versionFile(library model.Library, version model.FileVersion) (string, error) {
+	folder, err := v.FileSystem.systemFolder(library, "versions")
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(folder, strconv.Itoa(version.ID)), nil
+}
+
+// KeepVersion adds the current content of a file to the version storage before it is replaced. The file itself stays
+// untouched, so it should be replaced atomically with CommitFileInLibrary afterwards. Nothing happens if the file does
+// not exist yet.
+func (v *Versions) KeepVersion(library model.Library, path string) error {
+	path = v.FileSystem.cleanRelativePath(path)
+	if path == "/" || v.FileSystem.isSystemPath(path) {
+		return nil
+	}
+	current, err := v.FileSystem.resolve(library, path, true)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	info, err := os.Stat(current)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return nil
+	}
+
+	version := model.FileVersion{
+		LibraryID: library.ID,
+		Library:   library,
+		Path:      filepath.ToSlash(path),
+		Size:      info.Size(),
+		Modified:  info.ModTime(),
+	}
+	err = v.DB.Transaction(func(tx *gorm.DB) error {
+		if result := tx.Omit("Library").Create(&version); result.Error != nil {
+			return result.Error
+		}
+		target, err := v.versionFile(library, version)
+		if err != nil {
+			return err
+		}
+		return linkOrCopy(current, target)
+	})
+	if err != nil {
+		return err
+	}
+	return v.pruneVersions(library, version.Path)
+}
+
+// linkOrCopy makes the content of a file available at target. A hard link shares the content without copying it, and
+// keeps it when the file is replaced by a rename. Filesystems without hard links get a copy.
+func linkOrCopy(source string, target string) error {
+	if err := os.Link(source, target); err == nil {
+		return nil
+	}
+	in, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(target, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0660)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		_ = os.Remove(target)
+		return err
+	}
+	return out.Close()
+}
+
+// pruneVersions purges all but the newest versions of a file.
+func (v *Versions) pruneVersions(library model.Library, path string) error {
+	if v.MaxCount <= 0 {
+		return nil
+	}
+	var old []model.FileVersion
+	result := v.GetVersionsForEntry(library, path, v.DB).
+		Order("created_at desc, id desc").
+		Offset(v.MaxCount).
+		Find(&old)
+	if result.Error != nil {
+		return result.Error
+	}
+	for _, version := range old {
+		version.Library = library
+		if err := v.Purge(version); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// OpenVersion opens the content of a version for reading.
+func (v *Versions) OpenVersion(version model.FileVersion) (*os.File, error) {
+	file, err := v.versionFile(version.Library, version)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(file)
+}
+
+// Restore makes a version the current content of its file again. The content it replaces is kept as a new version, so
+// restoring can be undone. The version is only removed once it has been restored.
+func (v *Versions) Restore(version model.FileVersion) (FileInfo, error) {
+	source, err := v.versionFile(version.Library, version)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	// Link the version out of the way first, so it is not lost if it is pruned when the current content is kept.
+	folder, err := v.FileSystem.systemFolder(version.Library, "transfers")
+	if err != nil {
+		return FileInfo{}, err
+	}
+	slug, err := randomSlug()
+	if err != nil {
+		return FileInfo{}, err
+	}
+	staged := filepath.Join(folder, slug)
+	defer os.Remove(staged)
+	if err := linkOrCopy(source, staged); err != nil {
+		return FileInfo{}, err
+	}
+	if err := v.KeepVersion(version.Library, version.Path); err != nil {
+		return FileInfo{}, err
+	}
+	restored, err := v.FileSystem.CommitFileInLibrary(version.Library, staged, version.Path)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	return restored, v.Purge(version)
+}
+
+// Purge permanently deletes a version.
+func (v *Versions) Purge(version model.FileVersion) error {
+	file, err := v.versionFile(version.Library, version)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return v.DB.Delete(&model.FileVersion{}, version.ID).Error
+}
+
+// PurgeExpired permanently deletes all versions older than MaxAge and returns how many there were.
+func (v *Versions) PurgeExpired() (int, error) {
+	if v.MaxAge <= 0 {
+		return 0, nil
+	}
+	var expired []model.FileVersion
+	result := v.DB.Model(&model.FileVersion{}).
+		Preload("Library").
+		Where("created_at < ?", time.Now().Add(-v.MaxAge)).
+		Find(&expired)
+	if result.Error != nil {
+		return 0, result.Error
+	}
+	for i, version := range expired {
+		if err := v.Purge(version); err != nil {
+			return i, err
+		}
+	}
+	return len(expired), nil
+}
@@ -0,0 +1,346 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"github.com/fsnotify/fsnotify"
+	"gorm.io/gorm"
+	"keydrive/internal/model"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Watcher follows changes that are made to libraries outside KeyDrive, and updates the index as they happen. When the
+// system does not allow enough watches for a library, that library has to be rescanned periodically instead.
+type Watcher struct {
+	DB    *gorm.DB
+	Index *Index
+	// Delay is the time during which changes are collected before they are processed, so a file that is being written
+	// is only scanned once.
+	Delay     time.Duration
+	lock      sync.Mutex
+	libraries map[int]*libraryWatcher
+	closed    bool
+}
+
+type libraryWatcher struct {
+	library model.Library
+	root    string
+	index   *Index
+	delay   time.Duration
+	watcher *fsnotify.Watcher
+	watched map[string]bool
+	// limited is set when the watch limit was reached, so not every folder is watched.
+	limited bool
+	lock    sync.Mutex
+	stop    chan struct{}
+	done    chan struct{}
+	// ctx is cancelled when the library is no longer watched, so running scans stop.
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// Sync starts watching all libraries that are not watched yet, and stops watching libraries that were removed.
+func (w *Watcher) Sync() error {
+	var libraries []model.Library
+	if result := w.DB.Model(&model.Library{}).Find(&libraries); result.Error != nil {
+		return result.Error
+	}
+	current := map[int]bool{}
+	for _, library := range libraries {
+		current[library.ID] = true
+		if err := w.Watch(library); err != nil {
+			log.Error("failed to watch library %d: %s", library.ID, err)
+		}
+	}
+
+	w.lock.Lock()
+	var removed []int
+	for id := range w.libraries {
+		if !current[id] {
+			removed = append(removed, id)
+		}
+	}
+	w.lock.Unlock()
+	for _, id := range removed {
+		w.Unwatch(id)
+	}
+	return nil
+}
+
+// Watch starts watching a library. A library that is already watched is restarted if its settings changed.
+func (w *Watcher) Watch(library model.Library) error {
+	w.lock.Lock()
+	existing, ok := w.libraries[library.ID]
+	w.lock.Unlock()
+	if ok {
+		if existing.library == library {
+			return nil
+		}
+		w.Unwatch(library.ID)
+	}
+
+	root, err := w.Index.FileSystem.libraryRoot(library)
+	if err != nil {
+		return err
+	}
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	lw := &libraryWatcher{
+		library: library,
+		root:    root,
+		index:   w.Index,
+		delay:   w.Delay,
+		watcher: watcher,
+		watched: map[string]bool{},
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	lw.ctx, lw.cancel = context.WithCancel(context.Background())
+	if lw.delay <= 0 {
+		lw.delay = time.Second
+	}
+	lw.watchTree(root)
+	go lw.run()
+
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.closed {
+		lw.cancel()
+		close(lw.stop)
+		return nil
+	}
+	if w.libraries == nil {
+		w.libraries = map[int]*libraryWatcher{}
+	}
+	w.libraries[library.ID] = lw
+	return nil
+}
+
+// Unwatch stops watching a library.
+func (w *Watcher) Unwatch(libraryID int) {
+	w.lock.Lock()
+	lw, ok := w.libraries[libraryID]
+	delete(w.libraries, libraryID)
+	w.lock.Unlock()
+	if ok {
+		lw.cancel()
+		close(lw.stop)
+		<-lw.done
+	}
+}
+
+// Close stops watching all libraries.
+func (w *Watcher) Close() {
+	w.lock.Lock()
+	w.closed = true
+	ids := make([]int, 0, len(w.libraries))
+	for id := range w.libraries {
+		ids = append(ids, id)
+	}
+	w.lock.Unlock()
+	for _, id := range ids {
+		w.Unwatch(id)
+	}
+}
+
+// RescanLimited scans the libraries that could not be watched completely, and returns the number of changed entries.
+func (w *Watcher) RescanLimited(ctx context.Context) (int, error) {
+	w.lock.Lock()
+	var limited []model.Library
+	for _, lw := range w.libraries {
+		lw.lock.Lock()
+		if lw.limited {
+			limited = append(limited, lw.library)
+		}
+		lw.lock.Unlock()
+	}
+	w.lock.Unlock()
+
+	total := 0
+	for _, library := range limited {
+		changed, err := w.Index.ScanLibrary(ctx, library)
+		total += changed
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
+
+// watchTree adds a watch for a folder and every folder inside it.
+func (lw *libraryWatcher) watchTree(folder string) {
+	_ = filepath.Walk(folder, func(file string, info os.FileInfo, err error) error {
+		if err != nil || !info.IsDir() {
+			return nil
+		}
+		if lw.isSystemPath(file) {
+			return filepath.SkipDir
+		}
+		lw.lock.Lock()
+		defer lw.lock.Unlock()
+		if lw.watched[file] {
+			return nil
+		}
+		if err := lw.watcher.Add(file); err != nil {
+			if errors.Is(err, syscall.ENOSPC) || errors.Is(err, syscall.EMFILE) {
+				if !lw.limited {
+					log.Warn("watch limit reached for library %d, changes will be found by periodic rescans instead", lw.library.ID)
+				}
+				lw.limited = true
+				return filepath.SkipAll
+			}
+			return nil
+		}
+		lw.watched[file] = true
+		return nil
+	})
+}
+
+// unwatchTree removes the watches for a folder that was moved or deleted, and every folder inside it.
+func (lw *libraryWatcher) unwatchTree(folder string) {
+	lw.lock.Lock()
+	defer lw.lock.Unlock()
+	for file := range lw.watched {
+		if file == folder || strings.HasPrefix(file, folder+string(filepath.Separator)) {
+			_ = lw.watcher.Remove(file)
+			delete(lw.watched, file)
+		}
+	}
+}
+
+func (lw *libraryWatcher) isSystemPath(file string) bool {
+	return lw.index.FileSystem.isSystemPath(lw.relative(file))
+}
+
+func (lw *libraryWatcher) relative(file string) string {
+	relative, err := filepath.Rel(lw.root, file)
+	if err != nil {
+		return "/"
+	}
+	return path.Clean("/" + filepath.ToSlash(relative))
+}
+
+func (lw *libraryWatcher) run() {
+	defer close(lw.done)
+	defer lw.watcher.Close()
+
+	pending := map[string]fsnotify.Op{}
+	timer := time.NewTimer(lw.delay)
+	timer.Stop()
+	for {
+		select {
+		case <-lw.stop:
+			timer.Stop()
+			return
+		case event, ok := <-lw.watcher.Events:
+			if !ok {
+				return
+			}
+			if lw.isSystemPath(event.Name) {
+				continue
+			}
+			if event.Op&(fsnotify.Rename|fsnotify.Remove) != 0 {
+				lw.unwatchTree(event.Name)
+			}
+			if event.Op&fsnotify.Create != 0 {
+				if info, err := os.Lstat(event.Name); err == nil && info.IsDir() {
+					lw.watchTree(event.Name)
+				}
+			}
+			if len(pending) == 0 {
+				timer.Reset(lw.delay)
+			}
+			pending[lw.relative(event.Name)] |= event.Op
+		case err, ok := <-lw.watcher.Errors:
+			if !ok {
+				return
+			}
+			if errors.Is(err, fsnotify.ErrEventOverflow) {
+				// Events were lost, so only a full scan can tell what changed.
+				if len(pending) == 0 {
+					timer.Reset(lw.delay)
+				}
+				pending["/"] |= fsnotify.Write
+				continue
+			}
+			log.Error("error while watching library %d: %s", lw.library.ID, err)
+		case <-timer.C:
+			lw.process(pending)
+			pending = map[string]fsnotify.Op{}
+		}
+	}
+}
+
+// process updates the index for all paths that changed. A path that disappeared and a path that appeared with the same
+// size and modification time are treated as a single move.
+func (lw *libraryWatcher) process(pending map[string]fsnotify.Op) {
+	if _, ok := pending["/"]; ok {
+		lw.scan("/")
+		return
+	}
+
+	var removed, created []string
+	for entryPath, op := range pending {
+		_, err := os.Lstat(filepath.Join(lw.root, filepath.FromSlash(entryPath)))
+		if op&(fsnotify.Rename|fsnotify.Remove) != 0 && os.IsNotExist(err) {
+			removed = append(removed, entryPath)
+		} else if op&fsnotify.Create != 0 && err == nil {
+			created = append(created, entryPath)
+		}
+	}
+	for _, oldPath := range removed {
+		var old model.IndexedEntry
+		result := lw.index.DB.Model(&model.IndexedEntry{}).
+			Where("library_id = ? AND path = ?", lw.library.ID, oldPath).
+			Take(&old)
+		if result.Error != nil {
+			continue
+		}
+		for i, newPath := range created {
+			info, err := os.Stat(filepath.Join(lw.root, filepath.FromSlash(newPath)))
+			if err != nil || info.IsDir() != (old.Category == model.CategoryFolder) {
+				continue
+			}
+			if info.Size() != old.Size || !info.ModTime().Truncate(time.Microsecond).Equal(old.Modified) {
+				continue
+			}
+			if moved, err := lw.index.MoveEntry(lw.library, oldPath, newPath); err != nil {
+				log.Error("failed to move %s to %s in library %d: %s", oldPath, newPath, lw.library.ID, err)
+			} else if moved {
+				delete(pending, oldPath)
+				created = append(created[:i], created[i+1:]...)
+			}
+			break
+		}
+	}
+
+	// Scanning a folder also scans everything inside it, so nested paths can be skipped.
+	paths := make([]string, 0, len(pending))
+	for entryPath := range pending {
+		paths = append(paths, entryPath)
+	}
+	sort.Strings(paths)
+	scanned := ""
+	for _, entryPath := range paths {
+		if scanned != "" && strings.HasPrefix(entryPath, scanned+"/") {
+			continue
+		}
+		lw.scan(entryPath)
+		scanned = entryPath
+	}
+}
+
+func (lw *libraryWatcher) scan(entryPath string) {
+	if _, err := lw.index.ScanPath(lw.ctx, lw.library, entryPath); err != nil && lw.ctx.Err() == nil {
+		log.Error("failed to scan %s in library %d: %s", entryPath, lw.library.ID, err)
+	}
+}
@@ -1,5 +1,31 @@
 package service
 
+import (
+	"fmt"
+	"golang.org/x/sys/unix"
+)
+
 func listDisks() []string {
 	return []string{"/"}
 }
+
+func diskSpace(folder string) (DiskSpace, error) {
+	var stat unix.Statfs_t
+	if err := unix.Statfs(folder, &stat); err != nil {
+		return DiskSpace{}, err
+	}
+	var info unix.Stat_t
+	if err := unix.Stat(folder, &info); err != nil {
+		return DiskSpace{}, err
+	}
+	return DiskSpace{
+		Device: fmt.Sprint(info.Dev),
+		Total:  stat.Blocks * stat.Bsize,
+		Free:   uint64(stat.Bavail) * stat.Bsize,
+	}, nil
+}
+
+// checkWritable asks the kernel if the folder can be written to, which also fails on read-only mounts.
+func checkWritable(folder string) error {
+	return unix.Access(folder, unix.W_OK)
+}
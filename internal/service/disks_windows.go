@@ -1,6 +1,10 @@
 package service
 
 import (
+	"golang.org/x/sys/windows"
+	"os"
+	"path/filepath"
+	"strings"
 	"syscall"
 )
 
@@ -32,3 +36,31 @@ func bitsToDrives(bitMap uint32) (drives []string) {
 
 	return
 }
+
+func diskSpace(folder string) (DiskSpace, error) {
+	path, err := windows.UTF16PtrFromString(folder)
+	if err != nil {
+		return DiskSpace{}, err
+	}
+	var free, total, totalFree uint64
+	if err := windows.GetDiskFreeSpaceEx(path, &free, &total, &totalFree); err != nil {
+		return DiskSpace{}, err
+	}
+	absolute, err := filepath.Abs(folder)
+	if err != nil {
+		return DiskSpace{}, err
+	}
+	return DiskSpace{Device: strings.ToUpper(filepath.VolumeName(absolute)), Total: total, Free: free}, nil
+}
+
+// checkWritable checks the read-only attribute of the folder. Permissions are not checked.
+func checkWritable(folder string) error {
+	info, err := os.Stat(folder)
+	if err != nil {
+		return err
+	}
+	if info.Mode().Perm()&0200 == 0 {
+		return os.ErrPermission
+	}
+	return nil
+}
@@ -0,0 +1,158 @@
+package service
+
+import (
+	"errors"
+	"golang.org/x/sys/unix"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// openBeneath opens target, which must be a path inside root without any symbolic links. The kernel checks this while
+// opening the file, so a link that is created after the path was resolved can not be used to escape the library.
+func openBeneath(root string, target string) (*os.File, error) {
+	relative, err := relativeBeneath(root, target)
+	if err != nil {
+		return nil, err
+	}
+
+	rootFd, err := unix.Open(root, unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: root, Err: err}
+	}
+	defer unix.Close(rootFd)
+
+	fd, err := unix.Openat2(rootFd, relative, &unix.OpenHow{
+		Flags:   unix.O_RDONLY | unix.O_CLOEXEC,
+		Resolve: unix.RESOLVE_BENEATH | unix.RESOLVE_NO_SYMLINKS | unix.RESOLVE_NO_MAGICLINKS,
+	})
+	switch {
+	case errors.Is(err, unix.ENOSYS):
+		// openat2 is only available since Linux 5.6.
+		return os.Open(target)
+	case errors.Is(err, unix.EXDEV), errors.Is(err, unix.ELOOP):
+		return nil, ErrOutsideLibrary
+	case err != nil:
+		return nil, &os.PathError{Op: "open", Path: target, Err: err}
+	}
+	return os.NewFile(uintptr(fd), target), nil
+}
+
+// openDirBeneath opens the folder dir inside root for use with the *at system calls, with the same checks as
+// openBeneath. The caller closes the returned descriptor.
+func openDirBeneath(root string, dir string) (int, error) {
+	relative, err := relativeBeneath(root, dir)
+	if err != nil {
+		return -1, err
+	}
+
+	rootFd, err := unix.Open(root, unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return -1, &os.PathError{Op: "open", Path: root, Err: err}
+	}
+	defer unix.Close(rootFd)
+
+	fd, err := unix.Openat2(rootFd, relative, &unix.OpenHow{
+		Flags:   unix.O_PATH | unix.O_DIRECTORY | unix.O_CLOEXEC,
+		Resolve: unix.RESOLVE_BENEATH | unix.RESOLVE_NO_SYMLINKS | unix.RESOLVE_NO_MAGICLINKS,
+	})
+	if errors.Is(err, unix.ENOSYS) {
+		fd, err = unix.Open(dir, unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	}
+	switch {
+	case errors.Is(err, unix.EXDEV), errors.Is(err, unix.ELOOP):
+		return -1, ErrOutsideLibrary
+	case err != nil:
+		return -1, &os.PathError{Op: "open", Path: dir, Err: err}
+	}
+	return fd, nil
+}
+
+// mkdirAllBeneath creates the folder target inside root together with any missing parents. Every folder is opened
+// without following links before the next one is created in it, so a link that is swapped in along the way makes it
+// fail instead of creating folders outside the library.
+func mkdirAllBeneath(root string, target string) error {
+	relative, err := relativeBeneath(root, target)
+	if err != nil {
+		return err
+	}
+	fd, err := unix.Open(root, unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return &os.PathError{Op: "mkdir", Path: root, Err: err}
+	}
+	for _, part := range strings.Split(relative, string(filepath.Separator)) {
+		if part == "." {
+			continue
+		}
+		if err := unix.Mkdirat(fd, part, 0770); err != nil && !errors.Is(err, unix.EEXIST) {
+			_ = unix.Close(fd)
+			return &os.PathError{Op: "mkdir", Path: target, Err: err}
+		}
+		next, err := unix.Openat(fd, part, unix.O_PATH|unix.O_DIRECTORY|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0)
+		_ = unix.Close(fd)
+		if err != nil {
+			return &os.PathError{Op: "mkdir", Path: target, Err: err}
+		}
+		fd = next
+	}
+	return unix.Close(fd)
+}
+
+// renameBeneath moves source inside sourceRoot to target inside targetRoot. The parent folders of both are opened with
+// openDirBeneath, so neither side can be redirected out of its library by a link that is swapped in after resolving.
+func renameBeneath(sourceRoot string, source string, targetRoot string, target string) error {
+	return renameatBeneath(sourceRoot, source, targetRoot, target, false)
+}
+
+// renameNoReplaceBeneath is like renameBeneath, but fails with an error that matches os.ErrExist if target exists.
+func renameNoReplaceBeneath(sourceRoot string, source string, targetRoot string, target string) error {
+	return renameatBeneath(sourceRoot, source, targetRoot, target, true)
+}
+
+func renameatBeneath(sourceRoot string, source string, targetRoot string, target string, noReplace bool) error {
+	sourceDir, err := openDirBeneath(sourceRoot, filepath.Dir(source))
+	if err != nil {
+		return err
+	}
+	defer unix.Close(sourceDir)
+	targetDir, err := openDirBeneath(targetRoot, filepath.Dir(target))
+	if err != nil {
+		return err
+	}
+	defer unix.Close(targetDir)
+
+	sourceName, targetName := filepath.Base(source), filepath.Base(target)
+	if !noReplace {
+		err = unix.Renameat(sourceDir, sourceName, targetDir, targetName)
+	} else if err = unix.Renameat2(sourceDir, sourceName, targetDir, targetName, unix.RENAME_NOREPLACE); errors.Is(err, unix.EINVAL) || errors.Is(err, unix.ENOSYS) {
+		err = renameNoReplaceFallback(sourceDir, sourceName, targetDir, targetName)
+	}
+	if err != nil {
+		return &os.LinkError{Op: "rename", Old: source, New: target, Err: err}
+	}
+	return nil
+}
+
+// renameNoReplaceFallback is used on filesystems that do not support RENAME_NOREPLACE. Files are linked to the target,
+// which fails if it exists, and then unlinked from the source. Folders can not be linked, so for them the target is
+// only checked before renaming.
+func renameNoReplaceFallback(sourceDir int, sourceName string, targetDir int, targetName string) error {
+	var stat unix.Stat_t
+	if err := unix.Fstatat(sourceDir, sourceName, &stat, unix.AT_SYMLINK_NOFOLLOW); err != nil {
+		return err
+	}
+	if stat.Mode&unix.S_IFMT != unix.S_IFDIR {
+		if err := unix.Linkat(sourceDir, sourceName, targetDir, targetName, 0); err != nil {
+			return err
+		}
+		return unix.Unlinkat(sourceDir, sourceName, 0)
+	}
+	err := unix.Fstatat(targetDir, targetName, &stat, unix.AT_SYMLINK_NOFOLLOW)
+	if err == nil {
+		return unix.EEXIST
+	}
+	if !errors.Is(err, unix.ENOENT) {
+		return err
+	}
+	return unix.Renameat(sourceDir, sourceName, targetDir, targetName)
+}
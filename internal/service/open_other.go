@@ -0,0 +1,58 @@
+//go:build !linux
+
+package service
+
+import "os"
+
+// openBeneath opens target, which has already been checked to be inside root. Without openat2 the check is only done
+// while resolving, so a link that is swapped in afterwards is not noticed.
+func openBeneath(root string, target string) (*os.File, error) {
+	return os.Open(target)
+}
+
+// mkdirAllBeneath creates the folder target inside root together with any missing parents.
+func mkdirAllBeneath(root string, target string) error {
+	if _, err := relativeBeneath(root, target); err != nil {
+		return err
+	}
+	return os.MkdirAll(target, 0770)
+}
+
+// renameBeneath moves source inside sourceRoot to target inside targetRoot.
+func renameBeneath(sourceRoot string, source string, targetRoot string, target string) error {
+	if _, err := relativeBeneath(sourceRoot, source); err != nil {
+		return err
+	}
+	if _, err := relativeBeneath(targetRoot, target); err != nil {
+		return err
+	}
+	return os.Rename(source, target)
+}
+
+// renameNoReplaceBeneath is like renameBeneath, but fails with an error that matches os.ErrExist if target exists. Files
+// are linked to the target, which fails if it exists, and then removed from the source. Folders can not be linked, so
+// for them the target is only checked before renaming.
+func renameNoReplaceBeneath(sourceRoot string, source string, targetRoot string, target string) error {
+	if _, err := relativeBeneath(sourceRoot, source); err != nil {
+		return err
+	}
+	if _, err := relativeBeneath(targetRoot, target); err != nil {
+		return err
+	}
+	info, err := os.Lstat(source)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		if err := os.Link(source, target); err != nil {
+			return err
+		}
+		return os.Remove(source)
+	}
+	if _, err := os.Lstat(target); err == nil {
+		return &os.LinkError{Op: "rename", Old: source, New: target, Err: os.ErrExist}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	return os.Rename(source, target)
+}
@@ -13,6 +13,7 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"time"
 )
 
 func stringOpt(name string, value string, description string) *string {
@@ -31,12 +32,50 @@ func intOpt(name string, value int, description string) *int {
 	return flag.Int(name, value, description)
 }
 
+func boolOpt(name string, value bool, description string) *bool {
+	if envValue, ok := os.LookupEnv(strings.ToUpper(strings.ReplaceAll(name, "-", "_"))); ok {
+		if boolVal, err := strconv.ParseBool(envValue); err == nil {
+			value = boolVal
+		}
+	}
+	return flag.Bool(name, value, description)
+}
+
+func durationOpt(name string, value time.Duration, description string) *time.Duration {
+	if envValue, ok := os.LookupEnv(strings.ToUpper(strings.ReplaceAll(name, "-", "_"))); ok {
+		if durationVal, err := time.ParseDuration(envValue); err == nil {
+			value = durationVal
+		}
+	}
+	return flag.Duration(name, value, description)
+}
+
 var listenAddr = stringOpt("listen", ":5555", "The address on which to listen for http requests.")
 var postgresHost = stringOpt("postgres-host", "localhost", "The psql host")
 var postgresUser = stringOpt("postgres-user", "postgres", "The psql username")
 var postgresPassword = stringOpt("postgres-password", "postgres", "The psql password")
 var postgresDb = stringOpt("postgres-db", "postgres", "The psql database name")
 var postgresPort = intOpt("postgres-port", 5432, "The psql host port")
+var uploadExpiration = durationOpt("upload-expiration", 24*time.Hour, "The time after which unfinished uploads are discarded")
+var downloadTokenTTL = durationOpt("download-token-ttl", time.Hour, "The time after which unused download tokens expire")
+var downloadTokenStore = stringOpt("download-token-store", "memory", "Where to keep download tokens: memory or database")
+var downloadTokenMultiUse = boolOpt("download-token-multi-use", false, "Allow every download token to be used until it expires")
+var trashRetention = durationOpt("trash-retention", 30*24*time.Hour, "The time after which deleted files are removed from the trash")
+var versionMaxCount = intOpt("version-max-count", 10, "The number of previous versions to keep for every file")
+var versionMaxAge = durationOpt("version-max-age", 30*24*time.Hour, "The time after which previous versions of files are removed")
+var indexInterval = durationOpt("index-interval", time.Hour, "The time between scans of all libraries for the search index")
+var indexContent = boolOpt("index-content", false, "Extract the text of documents so it can be searched")
+var watchFiles = boolOpt("watch-files", true, "Watch the library folders for changes made outside KeyDrive")
+var rescanInterval = durationOpt("rescan-interval", 5*time.Minute, "The time between scans of libraries that can not be watched completely")
+var changeRetention = durationOpt("change-retention", 30*24*time.Hour, "The time after which changes are removed from the change journal used by sync clients")
+var mimeTypesFile = stringOpt("mime-types", "", "A JSON file with extra file extensions, mime types and categories")
+var jobWorkers = intOpt("job-workers", 2, "The number of background jobs that run at the same time")
+var jobRetention = durationOpt("job-retention", 7*24*time.Hour, "The time after which finished background jobs are removed")
+var diskWarningPercent = intOpt("disk-warning-percent", 10, "The percentage of free space below which the health check warns about the filesystem of a library")
+var diskCriticalPercent = intOpt("disk-critical-percent", 5, "The percentage of free space below which the health check reports the filesystem of a library as critical")
+var metricsListen = stringOpt("metrics-listen", "", "A separate address on which to serve the metrics. Without it, the metrics are only served at /metrics on the main address if a metrics token is set")
+var metricsToken = stringOpt("metrics-token", "", "A bearer token that is required to read the metrics, and enables them on the main address")
+var publicUrl = stringOpt("public-url", "", "The URL at which KeyDrive is reached, used for links in podcast feeds. Taken from the request by default")
 var log = logger.NewConsole(logger.LevelDebug, "MAIN")
 
 // @title KeyDrive API
@@ -48,6 +87,8 @@ var log = logger.NewConsole(logger.LevelDebug, "MAIN")
 
 // @securitydefinitions.oauth2.password OAuth2
 // @tokenUrl /oauth2/token
+
+// @securitydefinitions.basic BasicAuth
 func main() {
 	flag.Parse()
 
@@ -61,7 +102,28 @@ func main() {
 		*postgresPort,
 	)
 
-	webApp, err := controller.NewApp(postgres.Open(postgresDsn))
+	webApp, err := controller.NewApp(postgres.Open(postgresDsn), controller.Config{
+		UploadExpiration:      *uploadExpiration,
+		DownloadTokenTTL:      *downloadTokenTTL,
+		DownloadTokenStore:    *downloadTokenStore,
+		DownloadTokenMultiUse: *downloadTokenMultiUse,
+		TrashRetention:        *trashRetention,
+		VersionMaxCount:       *versionMaxCount,
+		VersionMaxAge:         *versionMaxAge,
+		IndexInterval:         *indexInterval,
+		IndexContent:          *indexContent,
+		WatchFiles:            *watchFiles,
+		RescanInterval:        *rescanInterval,
+		ChangeRetention:       *changeRetention,
+		MimeTypesFile:         *mimeTypesFile,
+		PublicURL:             *publicUrl,
+		JobWorkers:            *jobWorkers,
+		JobRetention:          *jobRetention,
+		DiskWarningPercent:    *diskWarningPercent,
+		DiskCriticalPercent:   *diskCriticalPercent,
+		MetricsListen:         *metricsListen,
+		MetricsToken:          *metricsToken,
+	})
 	if err != nil {
 		os.Exit(1)
 	}